@@ -0,0 +1,141 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type cachedCommand struct {
+	ID          string    `json:"id"`
+	Payload     string    `json:"payload"`
+	ReasonCode  byte      `json:"reasonCode,omitempty"`
+	ProcessedAt time.Time `json:"processedAt"`
+}
+
+// commandCache keeps the result payloads and the reason codes of the processed commands by their IDs for ttl, at most maxEntries of them.
+// If path is not empty, the cache is persisted to the file so that it survives restarts.
+type commandCache struct {
+	logger         *zap.SugaredLogger
+	ttl            time.Duration
+	maxEntries     int
+	path           string
+	getCurrentTime func() time.Time
+	mutex          sync.Mutex
+	// commands are sorted by the processed time, the oldest first
+	commands []*cachedCommand
+}
+
+func newCommandCache(logger *zap.SugaredLogger, ttl time.Duration, maxEntries int, path string) *commandCache {
+	c := &commandCache{
+		logger:         logger,
+		ttl:            ttl,
+		maxEntries:     maxEntries,
+		path:           path,
+		getCurrentTime: time.Now,
+		commands:       []*cachedCommand{},
+	}
+	if path != "" {
+		c.load()
+	}
+	return c
+}
+
+// get returns the result of the command processed within ttl.
+func (c *commandCache) get(id string) (*cachedCommand, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.expire()
+	for _, command := range c.commands {
+		if command.ID == id {
+			return command, true
+		}
+	}
+	return nil, false
+}
+
+// put records the result payload and the reason code of the command, evicting the oldest ones over maxEntries.
+func (c *commandCache) put(id string, payload string, reasonCode byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.expire()
+	for i, command := range c.commands {
+		if command.ID == id {
+			c.commands = append(c.commands[:i], c.commands[i+1:]...)
+			break
+		}
+	}
+	c.commands = append(c.commands, &cachedCommand{ID: id, Payload: payload, ReasonCode: reasonCode, ProcessedAt: c.getCurrentTime()})
+	if len(c.commands) > c.maxEntries {
+		c.commands = c.commands[len(c.commands)-c.maxEntries:]
+	}
+	c.save()
+}
+
+func (c *commandCache) expire() {
+	now := c.getCurrentTime()
+	i := 0
+	for i < len(c.commands) && now.Sub(c.commands[i].ProcessedAt) >= c.ttl {
+		i++
+	}
+	c.commands = c.commands[i:]
+}
+
+// load restores the cache from the file, and starts with an empty cache if the file does not exist or is broken.
+func (c *commandCache) load() {
+	data, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		c.logger.Errorf("read command cache err -- %s: %s", c.path, err.Error())
+		return
+	}
+	commands := []*cachedCommand{}
+	if err := json.Unmarshal(data, &commands); err != nil {
+		c.logger.Errorf("invalid command cache, ignore it -- %s: %s", c.path, err.Error())
+		return
+	}
+	c.commands = commands
+	c.expire()
+	c.logger.Infof("load %d processed commands -- %s", len(c.commands), c.path)
+}
+
+// save writes the cache to a temporary file and renames it, so that the file is never left half-written.
+func (c *commandCache) save() {
+	if c.path == "" {
+		return
+	}
+	data, err := json.Marshal(c.commands)
+	if err != nil {
+		c.logger.Errorf("marshal command cache err: %s", err.Error())
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		c.logger.Errorf("write command cache err -- %s: %s", c.path, err.Error())
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		c.logger.Errorf("write command cache err -- %s: %s", c.path, err.Error())
+	}
+}
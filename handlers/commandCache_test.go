@@ -0,0 +1,126 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setUpCommandCache(t *testing.T, maxEntries int, path string) (*commandCache, *time.Time, func()) {
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = zap.NewAtomicLevelAt(zap.FatalLevel)
+	logger, _ := loggerConfig.Build()
+
+	now := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := newCommandCache(logger.Sugar(), time.Minute, maxEntries, "")
+	c.path = path
+	c.getCurrentTime = func() time.Time {
+		return now
+	}
+	if path != "" {
+		c.load()
+	}
+	return c, &now, func() {
+		logger.Sync()
+	}
+}
+
+func TestCommandCache(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("ttl", func(t *testing.T) {
+		c, now, tearDown := setUpCommandCache(t, 10, "")
+		defer tearDown()
+
+		_, ok := c.get("a")
+		assert.False(ok)
+
+		c.put("a", "a@apply|create deployment -- my-deployment", reasonSuccess)
+		*now = now.Add(59 * time.Second)
+		cached, ok := c.get("a")
+		assert.True(ok)
+		assert.Equal("a@apply|create deployment -- my-deployment", cached.Payload)
+
+		*now = now.Add(time.Second)
+		_, ok = c.get("a")
+		assert.False(ok)
+		assert.Empty(c.commands)
+	})
+	t.Run("max entries", func(t *testing.T) {
+		c, now, tearDown := setUpCommandCache(t, 2, "")
+		defer tearDown()
+
+		for _, id := range []string{"a", "b", "a", "c"} {
+			c.put(id, id+"@apply|done", reasonSuccess)
+			*now = now.Add(time.Second)
+		}
+		_, ok := c.get("b")
+		assert.False(ok)
+		_, ok = c.get("a")
+		assert.True(ok)
+		_, ok = c.get("c")
+		assert.True(ok)
+	})
+	t.Run("persistence", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "commandCache")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "commands.json")
+
+		c, _, tearDown := setUpCommandCache(t, 10, path)
+		defer tearDown()
+		c.put("a", "a@apply|create deployment -- my-deployment", reasonImplementationSpecificError)
+
+		restarted, now, tearDownRestarted := setUpCommandCache(t, 10, path)
+		defer tearDownRestarted()
+		cached, ok := restarted.get("a")
+		assert.True(ok)
+		assert.Equal("a@apply|create deployment -- my-deployment", cached.Payload)
+		assert.Equal(reasonImplementationSpecificError, cached.ReasonCode)
+
+		*now = now.Add(time.Minute)
+		restarted.put("b", "b@delete|delete deployment -- my-deployment", reasonSuccess)
+		files, err := ioutil.ReadDir(dir)
+		assert.Nil(err)
+		assert.Len(files, 1)
+
+		expired, expiredNow, tearDownExpired := setUpCommandCache(t, 10, path)
+		defer tearDownExpired()
+		*expiredNow = expiredNow.Add(90 * time.Second)
+		_, ok = expired.get("a")
+		assert.False(ok)
+		_, ok = expired.get("b")
+		assert.True(ok)
+		*expiredNow = expiredNow.Add(30 * time.Second)
+		_, ok = expired.get("b")
+		assert.False(ok)
+	})
+	t.Run("broken file", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "commandCache")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "commands.json")
+		if err := ioutil.WriteFile(path, []byte("broken"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		c, _, tearDown := setUpCommandCache(t, 10, path)
+		defer tearDown()
+		assert.Empty(c.commands)
+	})
+}
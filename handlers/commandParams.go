@@ -0,0 +1,50 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"strconv"
+	"strings"
+)
+
+type commandParams map[string]string
+
+// parseCommandBody splits "<body>|key1=value1|key2=value2" into the body and its parameters.
+// The body is url-escaped, so it never contains a raw '|'.
+func parseCommandBody(s string) (string, commandParams) {
+	segments := strings.Split(s, "|")
+	params := commandParams{}
+	for _, segment := range segments[1:] {
+		kv := strings.SplitN(segment, "=", 2)
+		if len(kv) == 2 {
+			params[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		} else {
+			params[strings.TrimSpace(kv[0])] = "true"
+		}
+	}
+	return segments[0], params
+}
+
+// getInt64 returns nil if the key is not specified.
+func (p commandParams) getInt64(key string) (*int64, error) {
+	s, ok := p[key]
+	if !ok {
+		return nil, nil
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
+
+func (p commandParams) getBool(key string) bool {
+	b, err := strconv.ParseBool(p[key])
+	if err != nil {
+		return false
+	}
+	return b
+}
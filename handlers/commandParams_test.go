@@ -0,0 +1,68 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCommandBody(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		s      string
+		body   string
+		params commandParams
+	}{
+		{s: "", body: "", params: commandParams{}},
+		{s: "body", body: "body", params: commandParams{}},
+		{s: "body|force=true", body: "body", params: commandParams{"force": "true"}},
+		{s: "body|force|a= b |c=d=e", body: "body", params: commandParams{"force": "true", "a": "b", "c": "d=e"}},
+		{s: "|force=true", body: "", params: commandParams{"force": "true"}},
+	}
+
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("s=%v", c.s), func(t *testing.T) {
+			body, params := parseCommandBody(c.s)
+			assert.Equal(c.body, body)
+			assert.Equal(c.params, params)
+		})
+	}
+}
+
+func TestCommandParamsGetBool(t *testing.T) {
+	assert := assert.New(t)
+
+	params := commandParams{"t": "true", "T": "True", "one": "1", "f": "false", "invalid": "invalid"}
+	assert.True(params.getBool("t"))
+	assert.True(params.getBool("T"))
+	assert.True(params.getBool("one"))
+	assert.False(params.getBool("f"))
+	assert.False(params.getBool("invalid"))
+	assert.False(params.getBool("notexist"))
+}
+
+func TestCommandParamsGetInt64(t *testing.T) {
+	assert := assert.New(t)
+
+	params := commandParams{"ten": "10", "negative": "-1", "invalid": "1m"}
+
+	i, err := params.getInt64("ten")
+	assert.Nil(err)
+	assert.Equal(int64(10), *i)
+	i, err = params.getInt64("negative")
+	assert.Nil(err)
+	assert.Equal(int64(-1), *i)
+	i, err = params.getInt64("notexist")
+	assert.Nil(err)
+	assert.Nil(i)
+	i, err = params.getInt64("invalid")
+	assert.NotNil(err)
+	assert.Nil(i)
+}
@@ -30,48 +30,57 @@ func newConfigmapHandler(clientset *kubernetes.Clientset, logger *zap.SugaredLog
 	}
 }
 
-func (h *configmapHandler) Apply(rawData runtime.Object) string {
+func (h *configmapHandler) Apply(rawData runtime.Object) *Result {
 	configmap := rawData.(*apiv1.ConfigMap)
-	configmapsClient := h.kubeClient.CoreV1().ConfigMaps(apiv1.NamespaceDefault)
+	namespace := configmap.ObjectMeta.Namespace
+	configmapsClient := h.kubeClient.CoreV1().ConfigMaps(namespace)
 	name := configmap.ObjectMeta.Name
 	current, getErr := configmapsClient.Get(name, metav1.GetOptions{})
 
 	if current != nil && getErr == nil {
+		resourceVersion := current.ObjectMeta.ResourceVersion
+		var updated *apiv1.ConfigMap
 		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
 			current.ObjectMeta.Labels = configmap.ObjectMeta.Labels
 			current.ObjectMeta.Annotations = configmap.ObjectMeta.Annotations
 			current.Data = configmap.Data
-			_, err := configmapsClient.Update(current)
+			var err error
+			updated, err = configmapsClient.Update(current)
 			return err
 		})
 		if err != nil {
 			msg := fmt.Sprintf("update configmap err -- %s", name)
 			h.logger.Errorf("%s: %s", msg, err.Error())
-			return msg
+			return newResult("ConfigMap", namespace, name, OutcomeError, msg).setError(err)
 		}
 		msg := fmt.Sprintf("update configmap -- %s", name)
 		h.logger.Infof(msg)
-		return msg
+		result := newResult("ConfigMap", namespace, name, OutcomeUpdated, msg)
+		if updated != nil {
+			result.setUpdatedResourceVersion(resourceVersion, updated.ObjectMeta.ResourceVersion)
+		}
+		return result
 	} else if errors.IsNotFound(getErr) {
-		result, err := configmapsClient.Create(configmap)
+		created, err := configmapsClient.Create(configmap)
 		if err != nil {
 			msg := fmt.Sprintf("create configmap err -- %s", name)
 			h.logger.Errorf("%s: %s", msg, err.Error())
-			return msg
+			return newResult("ConfigMap", namespace, name, OutcomeError, msg).setError(err)
 		}
-		msg := fmt.Sprintf("create configmap -- %s", result.GetObjectMeta().GetName())
+		msg := fmt.Sprintf("create configmap -- %s", created.GetObjectMeta().GetName())
 		h.logger.Infof(msg)
-		return msg
+		return newResult("ConfigMap", namespace, name, OutcomeCreated, msg).setResourceVersion(created.ObjectMeta.ResourceVersion)
 	} else {
 		msg := fmt.Sprintf("get configmap err -- %s", name)
 		h.logger.Errorf("%s: %s", msg, getErr.Error())
-		return msg
+		return newResult("ConfigMap", namespace, name, OutcomeError, msg).setError(getErr)
 	}
 }
 
-func (h *configmapHandler) Delete(rawData runtime.Object) string {
+func (h *configmapHandler) Delete(rawData runtime.Object) *Result {
 	configmap := rawData.(*apiv1.ConfigMap)
-	configmapsClient := h.kubeClient.CoreV1().ConfigMaps(apiv1.NamespaceDefault)
+	namespace := configmap.ObjectMeta.Namespace
+	configmapsClient := h.kubeClient.CoreV1().ConfigMaps(namespace)
 	name := configmap.ObjectMeta.Name
 	current, getErr := configmapsClient.Get(name, metav1.GetOptions{})
 
@@ -82,18 +91,18 @@ func (h *configmapHandler) Delete(rawData runtime.Object) string {
 		}); err != nil {
 			msg := fmt.Sprintf("delete configmap err -- %s", name)
 			h.logger.Errorf("%s: %s", msg, err.Error())
-			return msg
+			return newResult("ConfigMap", namespace, name, OutcomeError, msg).setError(err)
 		}
 		msg := fmt.Sprintf("delete configmap -- %s", name)
 		h.logger.Infof(msg)
-		return msg
+		return newResult("ConfigMap", namespace, name, OutcomeDeleted, msg).setResourceVersion(current.ObjectMeta.ResourceVersion)
 	} else if errors.IsNotFound(getErr) {
 		msg := fmt.Sprintf("configmap does not exist -- %s", name)
 		h.logger.Infof(msg)
-		return msg
+		return newResult("ConfigMap", namespace, name, OutcomeNotFound, msg)
 	} else {
 		msg := fmt.Sprintf("get configmap err -- %s", name)
 		h.logger.Errorf("%s: %s", msg, getErr.Error())
-		return msg
+		return newResult("ConfigMap", namespace, name, OutcomeError, msg).setError(getErr)
 	}
 }
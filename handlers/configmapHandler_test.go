@@ -68,7 +68,8 @@ func TestConfigMapCreate(t *testing.T) {
 		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 		result := handler.Apply(rawData)
-		assert.Equal(fmt.Sprintf("create configmap -- %s", name), result)
+		assert.Equal(OutcomeCreated, result.Outcome)
+		assert.Equal(fmt.Sprintf("create configmap -- %s", name), result.Message)
 	})
 	t.Run("failure", func(t *testing.T) {
 		client.EXPECT().Get(name, metav1.GetOptions{}).Return(nil, getErr)
@@ -77,7 +78,8 @@ func TestConfigMapCreate(t *testing.T) {
 		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 		result := handler.Apply(rawData)
-		assert.Equal(fmt.Sprintf("create configmap err -- %s", name), result)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(fmt.Sprintf("create configmap err -- %s", name), result.Message)
 	})
 }
 
@@ -96,7 +98,8 @@ func TestConfigMapUpdate(t *testing.T) {
 		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 		result := handler.Apply(rawData)
-		assert.Equal(fmt.Sprintf("update configmap -- %s", name), result)
+		assert.Equal(OutcomeUpdated, result.Outcome)
+		assert.Equal(fmt.Sprintf("update configmap -- %s", name), result.Message)
 	})
 	t.Run("failure", func(t *testing.T) {
 		client.EXPECT().Get(name, metav1.GetOptions{}).Return(prev, nil)
@@ -105,7 +108,8 @@ func TestConfigMapUpdate(t *testing.T) {
 		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 		result := handler.Apply(rawData)
-		assert.Equal(fmt.Sprintf("update configmap err -- %s", name), result)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(fmt.Sprintf("update configmap err -- %s", name), result.Message)
 	})
 }
 
@@ -120,7 +124,8 @@ func TestConfigMapApplyGetErr(t *testing.T) {
 	client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 	result := handler.Apply(rawData)
-	assert.Equal(fmt.Sprintf("get configmap err -- %s", name), result)
+	assert.Equal(OutcomeError, result.Outcome)
+	assert.Equal(fmt.Sprintf("get configmap err -- %s", name), result.Message)
 }
 
 func TestConfigMapDelete(t *testing.T) {
@@ -137,7 +142,8 @@ func TestConfigMapDelete(t *testing.T) {
 		client.EXPECT().Delete(name, &metav1.DeleteOptions{PropagationPolicy: &deletePolicy}).Return(nil)
 
 		result := handler.Delete(rawData)
-		assert.Equal(fmt.Sprintf("delete configmap -- %s", name), result)
+		assert.Equal(OutcomeDeleted, result.Outcome)
+		assert.Equal(fmt.Sprintf("delete configmap -- %s", name), result.Message)
 	})
 	t.Run("failure", func(t *testing.T) {
 		client.EXPECT().Get(name, metav1.GetOptions{}).Return(obj, nil)
@@ -146,7 +152,8 @@ func TestConfigMapDelete(t *testing.T) {
 		client.EXPECT().Delete(name, &metav1.DeleteOptions{PropagationPolicy: &deletePolicy}).Return(fmt.Errorf("failure"))
 
 		result := handler.Delete(rawData)
-		assert.Equal(fmt.Sprintf("delete configmap err -- %s", name), result)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(fmt.Sprintf("delete configmap err -- %s", name), result.Message)
 	})
 }
 
@@ -156,12 +163,13 @@ func TestConfigMapDeleteError(t *testing.T) {
 	defer tearDown()
 
 	errCases := []struct {
-		name string
-		err  error
-		msg  string
+		name    string
+		err     error
+		msg     string
+		outcome Outcome
 	}{
-		{name: "notfound", err: errors.NewNotFound(apiv1.Resource("configmap"), name), msg: "configmap does not exist"},
-		{name: "othererr", err: fmt.Errorf("failure"), msg: "get configmap err"},
+		{name: "notfound", err: errors.NewNotFound(apiv1.Resource("configmap"), name), msg: "configmap does not exist", outcome: OutcomeNotFound},
+		{name: "othererr", err: fmt.Errorf("failure"), msg: "get configmap err", outcome: OutcomeError},
 	}
 
 	for _, c := range errCases {
@@ -172,7 +180,8 @@ func TestConfigMapDeleteError(t *testing.T) {
 			client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 			result := handler.Delete(rawData)
-			assert.Equal(fmt.Sprintf("%s -- %s", c.msg, name), result)
+			assert.Equal(c.outcome, result.Outcome)
+			assert.Equal(fmt.Sprintf("%s -- %s", c.msg, name), result.Message)
 		})
 	}
 }
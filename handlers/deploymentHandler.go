@@ -11,7 +11,6 @@ import (
 	"go.uber.org/zap"
 
 	appsv1 "k8s.io/api/apps/v1"
-	apiv1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -31,48 +30,61 @@ func newDeploymentHandler(clientset *kubernetes.Clientset, logger *zap.SugaredLo
 	}
 }
 
-func (h *deploymentHandler) Apply(rawData runtime.Object) string {
+func (h *deploymentHandler) Apply(rawData runtime.Object) *Result {
 	deployment := rawData.(*appsv1.Deployment)
-	deploymentsClient := h.kubeClient.AppsV1().Deployments(apiv1.NamespaceDefault)
+	namespace := deployment.ObjectMeta.Namespace
+	deploymentsClient := h.kubeClient.AppsV1().Deployments(namespace)
 	name := deployment.ObjectMeta.Name
 	current, getErr := deploymentsClient.Get(name, metav1.GetOptions{})
 
 	if current != nil && getErr == nil {
+		resourceVersion := current.ObjectMeta.ResourceVersion
+		previous := current.DeepCopy()
+		var updated *appsv1.Deployment
 		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
 			current.ObjectMeta.Labels = deployment.ObjectMeta.Labels
 			current.ObjectMeta.Annotations = deployment.ObjectMeta.Annotations
 			current.Spec = deployment.Spec
-			_, err := deploymentsClient.Update(current)
+			var err error
+			updated, err = deploymentsClient.Update(current)
 			return err
 		})
 		if err != nil {
 			msg := fmt.Sprintf("update deployment err -- %s", name)
 			h.logger.Errorf("%s: %s", msg, err.Error())
-			return msg
+			return newResult("Deployment", namespace, name, OutcomeError, msg).setError(err)
 		}
 		msg := fmt.Sprintf("update deployment -- %s", name)
 		h.logger.Infof(msg)
-		return msg
+		result := newResult("Deployment", namespace, name, OutcomeUpdated, msg)
+		if updated != nil {
+			result.setUpdatedResourceVersion(resourceVersion, updated.ObjectMeta.ResourceVersion)
+		}
+		if result.Outcome == OutcomeUpdated {
+			result.previous = previous
+		}
+		return result
 	} else if errors.IsNotFound(getErr) {
-		result, err := deploymentsClient.Create(deployment)
+		created, err := deploymentsClient.Create(deployment)
 		if err != nil {
 			msg := fmt.Sprintf("create deployment err -- %s", name)
 			h.logger.Errorf("%s: %s", msg, err.Error())
-			return msg
+			return newResult("Deployment", namespace, name, OutcomeError, msg).setError(err)
 		}
-		msg := fmt.Sprintf("create deployment -- %s", result.GetObjectMeta().GetName())
+		msg := fmt.Sprintf("create deployment -- %s", created.GetObjectMeta().GetName())
 		h.logger.Infof(msg)
-		return msg
+		return newResult("Deployment", namespace, name, OutcomeCreated, msg).setResourceVersion(created.ObjectMeta.ResourceVersion)
 	} else {
 		msg := fmt.Sprintf("get deployment err -- %s", name)
 		h.logger.Errorf("%s: %s", msg, getErr.Error())
-		return msg
+		return newResult("Deployment", namespace, name, OutcomeError, msg).setError(getErr)
 	}
 }
 
-func (h *deploymentHandler) Delete(rawData runtime.Object) string {
+func (h *deploymentHandler) Delete(rawData runtime.Object) *Result {
 	deployment := rawData.(*appsv1.Deployment)
-	deploymentsClient := h.kubeClient.AppsV1().Deployments(apiv1.NamespaceDefault)
+	namespace := deployment.ObjectMeta.Namespace
+	deploymentsClient := h.kubeClient.AppsV1().Deployments(namespace)
 	name := deployment.ObjectMeta.Name
 	current, getErr := deploymentsClient.Get(name, metav1.GetOptions{})
 
@@ -83,18 +95,18 @@ func (h *deploymentHandler) Delete(rawData runtime.Object) string {
 		}); err != nil {
 			msg := fmt.Sprintf("delete deployment err -- %s", name)
 			h.logger.Errorf("%s: %s", msg, err.Error())
-			return msg
+			return newResult("Deployment", namespace, name, OutcomeError, msg).setError(err)
 		}
 		msg := fmt.Sprintf("delete deployment -- %s", name)
 		h.logger.Infof(msg)
-		return msg
+		return newResult("Deployment", namespace, name, OutcomeDeleted, msg).setResourceVersion(current.ObjectMeta.ResourceVersion)
 	} else if errors.IsNotFound(getErr) {
 		msg := fmt.Sprintf("deployment does not exist -- %s", name)
 		h.logger.Infof(msg)
-		return msg
+		return newResult("Deployment", namespace, name, OutcomeNotFound, msg)
 	} else {
 		msg := fmt.Sprintf("get deployment err -- %s", name)
 		h.logger.Errorf("%s: %s", msg, getErr.Error())
-		return msg
+		return newResult("Deployment", namespace, name, OutcomeError, msg).setError(getErr)
 	}
 }
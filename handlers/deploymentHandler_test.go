@@ -68,7 +68,8 @@ func TestDeploymentCreate(t *testing.T) {
 		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 		result := handler.Apply(rawData)
-		assert.Equal(fmt.Sprintf("create deployment -- %s", name), result)
+		assert.Equal(OutcomeCreated, result.Outcome)
+		assert.Equal(fmt.Sprintf("create deployment -- %s", name), result.Message)
 	})
 	t.Run("failure", func(t *testing.T) {
 		client.EXPECT().Get(name, metav1.GetOptions{}).Return(nil, getErr)
@@ -77,7 +78,8 @@ func TestDeploymentCreate(t *testing.T) {
 		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 		result := handler.Apply(rawData)
-		assert.Equal(fmt.Sprintf("create deployment err -- %s", name), result)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(fmt.Sprintf("create deployment err -- %s", name), result.Message)
 	})
 }
 
@@ -96,7 +98,9 @@ func TestDeploymentUpdate(t *testing.T) {
 		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 		result := handler.Apply(rawData)
-		assert.Equal(fmt.Sprintf("update deployment -- %s", name), result)
+		assert.Equal(OutcomeUpdated, result.Outcome)
+		assert.Equal(fmt.Sprintf("update deployment -- %s", name), result.Message)
+		assert.Equal(prev, result.previous)
 	})
 	t.Run("failure", func(t *testing.T) {
 		client.EXPECT().Get(name, metav1.GetOptions{}).Return(prev, nil)
@@ -105,7 +109,9 @@ func TestDeploymentUpdate(t *testing.T) {
 		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 		result := handler.Apply(rawData)
-		assert.Equal(fmt.Sprintf("update deployment err -- %s", name), result)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(fmt.Sprintf("update deployment err -- %s", name), result.Message)
+		assert.Nil(result.previous)
 	})
 }
 
@@ -120,7 +126,8 @@ func TestDeploymentApplyGetErr(t *testing.T) {
 	client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 	result := handler.Apply(rawData)
-	assert.Equal(fmt.Sprintf("get deployment err -- %s", name), result)
+	assert.Equal(OutcomeError, result.Outcome)
+	assert.Equal(fmt.Sprintf("get deployment err -- %s", name), result.Message)
 }
 
 func TestDeploymentDelete(t *testing.T) {
@@ -137,7 +144,8 @@ func TestDeploymentDelete(t *testing.T) {
 		client.EXPECT().Delete(name, &metav1.DeleteOptions{PropagationPolicy: &deletePolicy}).Return(nil)
 
 		result := handler.Delete(rawData)
-		assert.Equal(fmt.Sprintf("delete deployment -- %s", name), result)
+		assert.Equal(OutcomeDeleted, result.Outcome)
+		assert.Equal(fmt.Sprintf("delete deployment -- %s", name), result.Message)
 	})
 	t.Run("failure", func(t *testing.T) {
 		client.EXPECT().Get(name, metav1.GetOptions{}).Return(obj, nil)
@@ -146,7 +154,8 @@ func TestDeploymentDelete(t *testing.T) {
 		client.EXPECT().Delete(name, &metav1.DeleteOptions{PropagationPolicy: &deletePolicy}).Return(fmt.Errorf("failure"))
 
 		result := handler.Delete(rawData)
-		assert.Equal(fmt.Sprintf("delete deployment err -- %s", name), result)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(fmt.Sprintf("delete deployment err -- %s", name), result.Message)
 	})
 }
 
@@ -156,12 +165,13 @@ func TestDeploymentDeleteError(t *testing.T) {
 	defer tearDown()
 
 	errCases := []struct {
-		name string
-		err  error
-		msg  string
+		name    string
+		err     error
+		msg     string
+		outcome Outcome
 	}{
-		{name: "notfound", err: errors.NewNotFound(appsv1.Resource("deployment"), name), msg: "deployment does not exist"},
-		{name: "othererr", err: fmt.Errorf("failure"), msg: "get deployment err"},
+		{name: "notfound", err: errors.NewNotFound(appsv1.Resource("deployment"), name), msg: "deployment does not exist", outcome: OutcomeNotFound},
+		{name: "othererr", err: fmt.Errorf("failure"), msg: "get deployment err", outcome: OutcomeError},
 	}
 
 	for _, c := range errCases {
@@ -172,7 +182,8 @@ func TestDeploymentDeleteError(t *testing.T) {
 			client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 			result := handler.Delete(rawData)
-			assert.Equal(fmt.Sprintf("%s -- %s", c.msg, name), result)
+			assert.Equal(c.outcome, result.Outcome)
+			assert.Equal(fmt.Sprintf("%s -- %s", c.msg, name), result.Message)
 		})
 	}
 }
@@ -0,0 +1,140 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pmezard/go-difflib/difflib"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	redactedValue         = "<redacted>"
+	redactedChangedValue  = "<redacted, changed>"
+	lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+)
+
+// diffIgnoredFields lists the fields which are maintained by the api server, or updated by every apply, and only make noise in a diff.
+var diffIgnoredFields = [][]string{
+	{"metadata", "annotations", generationAnnotation},
+	{"status"},
+	{"metadata", "managedFields"},
+	{"metadata", "resourceVersion"},
+	{"metadata", "generation"},
+	{"metadata", "uid"},
+	{"metadata", "selfLink"},
+	{"metadata", "creationTimestamp"},
+}
+
+// diffObjects returns a unified diff between the live object and the merged one, which is empty when they are same.
+// live is nil when the object does not exist yet.
+func diffObjects(live *unstructured.Unstructured, merged *unstructured.Unstructured) (string, error) {
+	if isSecret(merged) {
+		live, merged = redactSecrets(live, merged)
+	}
+	from, err := toDiffYAML(live)
+	if err != nil {
+		return "", err
+	}
+	to, err := toDiffYAML(merged)
+	if err != nil {
+		return "", err
+	}
+	if from == to {
+		return "", nil
+	}
+	path := strings.ToLower(merged.GetKind()) + "/" + merged.GetName()
+	if merged.GetNamespace() != "" {
+		path = merged.GetNamespace() + "/" + path
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(from),
+		FromFile: fmt.Sprintf("live/%s", path),
+		B:        splitLines(to),
+		ToFile:   fmt.Sprintf("merged/%s", path),
+		Context:  3,
+	})
+}
+
+func toDiffYAML(obj *unstructured.Unstructured) (string, error) {
+	if obj == nil {
+		return "", nil
+	}
+	obj = obj.DeepCopy()
+	for _, fields := range diffIgnoredFields {
+		unstructured.RemoveNestedField(obj.Object, fields...)
+	}
+	if len(obj.GetAnnotations()) == 0 {
+		unstructured.RemoveNestedField(obj.Object, "metadata", "annotations")
+	}
+	data, err := yaml.Marshal(obj.Object)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func isSecret(obj *unstructured.Unstructured) bool {
+	return obj.GetKind() == "Secret" && obj.GroupVersionKind().Group == ""
+}
+
+// redactSecrets returns the copies of the secrets whose values are replaced, so that the diff published to the broker does not leak them.
+// A value of merged is marked as changed if it differs from the one of live, so the diff still tells which keys are updated.
+func redactSecrets(live *unstructured.Unstructured, merged *unstructured.Unstructured) (*unstructured.Unstructured, *unstructured.Unstructured) {
+	var liveValues map[string]interface{}
+	if live != nil {
+		live = live.DeepCopy()
+		liveValues = redactValues(live, func(string, interface{}) string {
+			return redactedValue
+		})
+	}
+	merged = merged.DeepCopy()
+	redactValues(merged, func(field string, value interface{}) string {
+		if liveValue, ok := liveValues[field]; live == nil || (ok && liveValue == value) {
+			return redactedValue
+		}
+		return redactedChangedValue
+	})
+	return live, merged
+}
+
+// redactValues replaces the values of data and stringData, and the last applied configuration which contains them,
+// with the value returned by redact, and returns the original values keyed by their field path.
+func redactValues(obj *unstructured.Unstructured, redact func(string, interface{}) string) map[string]interface{} {
+	original := map[string]interface{}{}
+	for _, field := range []string{"data", "stringData"} {
+		values, ok := obj.Object[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for key, value := range values {
+			path := field + "." + key
+			original[path] = value
+			values[key] = redact(path, value)
+		}
+	}
+	if annotations := obj.GetAnnotations(); annotations != nil {
+		if value, ok := annotations[lastAppliedAnnotation]; ok {
+			original[lastAppliedAnnotation] = value
+			annotations[lastAppliedAnnotation] = redact(lastAppliedAnnotation, value)
+			obj.SetAnnotations(annotations)
+		}
+	}
+	return original
+}
+
+// splitLines splits s into lines keeping their line breaks, without the empty last line which difflib.SplitLines adds.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
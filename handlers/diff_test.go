@@ -0,0 +1,118 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffObjects(t *testing.T) {
+	assert := assert.New(t)
+
+	live := getUnstructuredFromFixture(t, "../testdata/customresource.yaml")
+	live.SetNamespace("default")
+	live.SetResourceVersion("1")
+	live.Object["spec"] = map[string]interface{}{"interval": int64(5)}
+
+	t.Run("create", func(t *testing.T) {
+		diff, err := diffObjects(nil, live)
+		assert.Nil(err)
+		assert.Equal("--- live/default/sensor/my-sensor\n"+
+			"+++ merged/default/sensor/my-sensor\n"+
+			"@@ -0,0 +1,9 @@\n"+
+			"+apiVersion: example.com/v1alpha1\n"+
+			"+kind: Sensor\n"+
+			"+metadata:\n"+
+			"+  labels:\n"+
+			"+    app: MySensor\n"+
+			"+  name: my-sensor\n"+
+			"+  namespace: default\n"+
+			"+spec:\n"+
+			"+  interval: 5\n", diff)
+	})
+	t.Run("update", func(t *testing.T) {
+		merged := live.DeepCopy()
+		merged.SetResourceVersion("2")
+		merged.SetGeneration(2)
+		merged.Object["spec"] = map[string]interface{}{"interval": int64(10)}
+
+		diff, err := diffObjects(live, merged)
+		assert.Nil(err)
+		assert.Equal("--- live/default/sensor/my-sensor\n"+
+			"+++ merged/default/sensor/my-sensor\n"+
+			"@@ -6,4 +6,4 @@\n"+
+			"   name: my-sensor\n"+
+			"   namespace: default\n"+
+			" spec:\n"+
+			"-  interval: 5\n"+
+			"+  interval: 10\n", diff)
+	})
+	t.Run("unchanged", func(t *testing.T) {
+		merged := live.DeepCopy()
+		merged.SetResourceVersion("2")
+		merged.Object["status"] = map[string]interface{}{"ready": true}
+		live.SetAnnotations(map[string]string{generationAnnotation: "1"})
+		defer live.SetAnnotations(nil)
+
+		diff, err := diffObjects(live, merged)
+		assert.Nil(err)
+		assert.Equal("", diff)
+	})
+}
+
+func TestDiffSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	live := getUnstructuredFromFixture(t, "../testdata/secret.yaml")
+	live.SetNamespace("default")
+	live.SetAnnotations(map[string]string{lastAppliedAnnotation: `{"data":{"password":"MWYyZDFlMmU2N2Rm"}}`})
+
+	t.Run("create", func(t *testing.T) {
+		merged := live.DeepCopy()
+		merged.Object["stringData"] = map[string]interface{}{"token": "plain-token"}
+
+		diff, err := diffObjects(nil, merged)
+		assert.Nil(err)
+		assert.NotContains(diff, "MWYyZDFlMmU2N2Rm")
+		assert.NotContains(diff, "YWRtaW4=")
+		assert.NotContains(diff, "plain-token")
+		assert.Contains(diff, "+  password: <redacted>\n")
+		assert.Contains(diff, "+  token: <redacted>\n")
+		assert.Contains(diff, "kubectl.kubernetes.io/last-applied-configuration: <redacted>\n")
+	})
+	t.Run("update", func(t *testing.T) {
+		merged := live.DeepCopy()
+		merged.Object["data"].(map[string]interface{})["password"] = "bmV3LXBhc3N3b3Jk"
+		merged.SetAnnotations(map[string]string{lastAppliedAnnotation: `{"data":{"password":"bmV3LXBhc3N3b3Jk"}}`})
+
+		diff, err := diffObjects(live, merged)
+		assert.Nil(err)
+		assert.Equal("--- live/default/secret/my-secret\n"+
+			"+++ merged/default/secret/my-secret\n"+
+			"@@ -1,11 +1,11 @@\n"+
+			" apiVersion: v1\n"+
+			" data:\n"+
+			"-  password: <redacted>\n"+
+			"+  password: <redacted, changed>\n"+
+			"   username: <redacted>\n"+
+			" kind: Secret\n"+
+			" metadata:\n"+
+			"   annotations:\n"+
+			"-    kubectl.kubernetes.io/last-applied-configuration: <redacted>\n"+
+			"+    kubectl.kubernetes.io/last-applied-configuration: <redacted, changed>\n"+
+			"   labels:\n"+
+			"     app: MySecret\n"+
+			"   name: my-secret\n", diff)
+		assert.Equal("MWYyZDFlMmU2N2Rm", live.Object["data"].(map[string]interface{})["password"])
+	})
+	t.Run("unchanged", func(t *testing.T) {
+		diff, err := diffObjects(live, live.DeepCopy())
+		assert.Nil(err)
+		assert.Equal("", diff)
+	})
+}
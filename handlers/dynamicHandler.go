@@ -0,0 +1,414 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/util/retry"
+)
+
+type dynamicHandler struct {
+	dynamicClient dynamic.Interface
+	mapper        meta.RESTMapper
+	logger        *zap.SugaredLogger
+}
+
+func newDynamicHandler(dynamicClient dynamic.Interface, discoveryClient discovery.DiscoveryInterface, logger *zap.SugaredLogger) *dynamicHandler {
+	return &dynamicHandler{
+		dynamicClient: dynamicClient,
+		mapper:        restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient)),
+		logger:        logger,
+	}
+}
+
+func (h *dynamicHandler) Apply(rawData runtime.Object) *Result {
+	obj := rawData.(*unstructured.Unstructured)
+	kind := strings.ToLower(obj.GetKind())
+	name := obj.GetName()
+	resourceClient, err := h.getResourceClient(obj)
+	if err != nil {
+		msg := fmt.Sprintf("get %s mapping err -- %s", kind, name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult(obj.GetKind(), obj.GetNamespace(), name, OutcomeError, msg).setError(err)
+	}
+	namespace := obj.GetNamespace()
+	current, getErr := resourceClient.Get(name, metav1.GetOptions{})
+
+	if current != nil && getErr == nil {
+		resourceVersion := current.GetResourceVersion()
+		var updated *unstructured.Unstructured
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			mergeObject(current, obj)
+			var err error
+			updated, err = resourceClient.Update(current, metav1.UpdateOptions{})
+			return err
+		})
+		if err != nil {
+			msg := fmt.Sprintf("update %s err -- %s", kind, name)
+			h.logger.Errorf("%s: %s", msg, err.Error())
+			return newResult(obj.GetKind(), namespace, name, OutcomeError, msg).setError(err)
+		}
+		msg := fmt.Sprintf("update %s -- %s", kind, name)
+		h.logger.Infof(msg)
+		result := newResult(obj.GetKind(), namespace, name, OutcomeUpdated, msg)
+		if updated != nil {
+			result.setUpdatedResourceVersion(resourceVersion, updated.GetResourceVersion())
+		}
+		return result
+	} else if errors.IsNotFound(getErr) {
+		created, err := resourceClient.Create(obj, metav1.CreateOptions{})
+		if err != nil {
+			msg := fmt.Sprintf("create %s err -- %s", kind, name)
+			h.logger.Errorf("%s: %s", msg, err.Error())
+			return newResult(obj.GetKind(), namespace, name, OutcomeError, msg).setError(err)
+		}
+		msg := fmt.Sprintf("create %s -- %s", kind, created.GetName())
+		h.logger.Infof(msg)
+		return newResult(obj.GetKind(), namespace, name, OutcomeCreated, msg).setResourceVersion(created.GetResourceVersion())
+	} else {
+		msg := fmt.Sprintf("get %s err -- %s", kind, name)
+		h.logger.Errorf("%s: %s", msg, getErr.Error())
+		return newResult(obj.GetKind(), namespace, name, OutcomeError, msg).setError(getErr)
+	}
+}
+
+func (h *dynamicHandler) Delete(rawData runtime.Object) *Result {
+	obj := rawData.(*unstructured.Unstructured)
+	kind := strings.ToLower(obj.GetKind())
+	name := obj.GetName()
+	resourceClient, err := h.getResourceClient(obj)
+	if err != nil {
+		msg := fmt.Sprintf("get %s mapping err -- %s", kind, name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult(obj.GetKind(), obj.GetNamespace(), name, OutcomeError, msg).setError(err)
+	}
+	namespace := obj.GetNamespace()
+	current, getErr := resourceClient.Get(name, metav1.GetOptions{})
+
+	if current != nil && getErr == nil {
+		deletePolicy := metav1.DeletePropagationForeground
+		if err := resourceClient.Delete(name, &metav1.DeleteOptions{
+			PropagationPolicy: &deletePolicy,
+		}); err != nil {
+			msg := fmt.Sprintf("delete %s err -- %s", kind, name)
+			h.logger.Errorf("%s: %s", msg, err.Error())
+			return newResult(obj.GetKind(), namespace, name, OutcomeError, msg).setError(err)
+		}
+		msg := fmt.Sprintf("delete %s -- %s", kind, name)
+		h.logger.Infof(msg)
+		return newResult(obj.GetKind(), namespace, name, OutcomeDeleted, msg).setResourceVersion(current.GetResourceVersion())
+	} else if errors.IsNotFound(getErr) {
+		msg := fmt.Sprintf("%s does not exist -- %s", kind, name)
+		h.logger.Infof(msg)
+		return newResult(obj.GetKind(), namespace, name, OutcomeNotFound, msg)
+	} else {
+		msg := fmt.Sprintf("get %s err -- %s", kind, name)
+		h.logger.Errorf("%s: %s", msg, getErr.Error())
+		return newResult(obj.GetKind(), namespace, name, OutcomeError, msg).setError(getErr)
+	}
+}
+
+func (h *dynamicHandler) DryRun(rawData runtime.Object) *Result {
+	return h.dryRun(rawData, false)
+}
+
+func (h *dynamicHandler) Diff(rawData runtime.Object) *Result {
+	return h.dryRun(rawData, true)
+}
+
+func (h *dynamicHandler) dryRun(rawData runtime.Object, withDiff bool) *Result {
+	obj, err := toUnstructured(rawData)
+	if err != nil {
+		msg := "invalid format, skip this message"
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newErrorResult(msg)
+	}
+	kind := strings.ToLower(obj.GetKind())
+	name := obj.GetName()
+	resourceClient, err := h.getResourceClient(obj)
+	if err != nil {
+		msg := fmt.Sprintf("get %s mapping err -- %s", kind, name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult(obj.GetKind(), obj.GetNamespace(), name, OutcomeError, msg).setError(err)
+	}
+	namespace := obj.GetNamespace()
+	live, getErr := resourceClient.Get(name, metav1.GetOptions{})
+
+	var merged *unstructured.Unstructured
+	dryRun := []string{metav1.DryRunAll}
+	if live != nil && getErr == nil {
+		current := live.DeepCopy()
+		mergeObject(current, obj)
+		merged, err = resourceClient.Update(current, metav1.UpdateOptions{DryRun: dryRun})
+	} else if errors.IsNotFound(getErr) {
+		live = nil
+		merged, err = resourceClient.Create(obj, metav1.CreateOptions{DryRun: dryRun})
+	} else {
+		msg := fmt.Sprintf("get %s err -- %s", kind, name)
+		h.logger.Errorf("%s: %s", msg, getErr.Error())
+		return newResult(obj.GetKind(), namespace, name, OutcomeError, msg).setError(getErr)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("dry run %s err -- %s", kind, name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult(obj.GetKind(), namespace, name, OutcomeError, msg).setError(err)
+	}
+	return h.dryRunResult(obj, live, merged, withDiff)
+}
+
+// dryRunResult tells what the apply would do by comparing the live object with the result of the dry run.
+func (h *dynamicHandler) dryRunResult(obj *unstructured.Unstructured, live *unstructured.Unstructured, merged *unstructured.Unstructured, withDiff bool) *Result {
+	kind := strings.ToLower(obj.GetKind())
+	name := obj.GetName()
+	if merged == nil {
+		merged = obj
+	}
+	diff, err := diffObjects(live, merged)
+	if err != nil {
+		msg := fmt.Sprintf("diff %s err -- %s", kind, name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult(obj.GetKind(), obj.GetNamespace(), name, OutcomeError, msg)
+	}
+
+	var result *Result
+	if live == nil {
+		result = newResult(obj.GetKind(), obj.GetNamespace(), name, OutcomeCreated, fmt.Sprintf("create %s (dry run) -- %s", kind, name))
+	} else if diff == "" {
+		result = newResult(obj.GetKind(), obj.GetNamespace(), name, OutcomeUnchanged, fmt.Sprintf("%s is unchanged (dry run) -- %s", kind, name))
+		result.setResourceVersion(live.GetResourceVersion())
+	} else {
+		result = newResult(obj.GetKind(), obj.GetNamespace(), name, OutcomeUpdated, fmt.Sprintf("update %s (dry run) -- %s", kind, name))
+		result.setResourceVersion(live.GetResourceVersion())
+	}
+	if withDiff {
+		result.Diff = diff
+	}
+	h.logger.Infof(result.Message)
+	return result
+}
+
+/*
+Drift : compare the object with the live one, and report whether the live one is deleted or modified.
+Only the labels, annotations and fields specified in the object are compared, so the fields set by kubernetes are not regarded as drifts.
+*/
+func (h *dynamicHandler) Drift(rawData runtime.Object) *Result {
+	obj, err := toUnstructured(rawData)
+	if err != nil {
+		msg := "invalid format, skip this message"
+		h.logger.Infof("%s: %s", msg, err.Error())
+		return newErrorResult(msg)
+	}
+	obj = obj.DeepCopy()
+	kind := strings.ToLower(obj.GetKind())
+	name := obj.GetName()
+	resourceClient, err := h.getResourceClient(obj)
+	if err != nil {
+		msg := fmt.Sprintf("get %s mapping err -- %s", kind, name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult(obj.GetKind(), obj.GetNamespace(), name, OutcomeError, msg).setError(err)
+	}
+	namespace := obj.GetNamespace()
+	live, err := resourceClient.Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		msg := fmt.Sprintf("%s is deleted -- %s", kind, name)
+		h.logger.Infof(msg)
+		return newResult(obj.GetKind(), namespace, name, OutcomeDrifted, msg)
+	} else if err != nil {
+		msg := fmt.Sprintf("get %s err -- %s", kind, name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult(obj.GetKind(), namespace, name, OutcomeError, msg).setError(err)
+	}
+
+	if obj.GetKind() == "Secret" && obj.GroupVersionKind().Group == "" {
+		encodeStringData(obj)
+	}
+	desired := map[string]interface{}{}
+	for key, value := range obj.Object {
+		switch key {
+		case "apiVersion", "kind", "metadata", "status":
+			continue
+		}
+		desired[key] = value
+	}
+	desired["metadata"] = map[string]interface{}{
+		"labels":      toInterfaceMap(obj.GetLabels()),
+		"annotations": toInterfaceMap(obj.GetAnnotations()),
+	}
+	current := map[string]interface{}{}
+	for key, value := range live.Object {
+		current[key] = value
+	}
+	current["metadata"] = map[string]interface{}{
+		"labels":      toInterfaceMap(live.GetLabels()),
+		"annotations": toInterfaceMap(live.GetAnnotations()),
+	}
+
+	if path := findDrift(desired, current, ""); path != "" {
+		msg := fmt.Sprintf("%s is modified at %s -- %s", kind, path, name)
+		h.logger.Infof(msg)
+		return newResult(obj.GetKind(), namespace, name, OutcomeDrifted, msg).setResourceVersion(live.GetResourceVersion())
+	}
+	msg := fmt.Sprintf("%s is not modified -- %s", kind, name)
+	h.logger.Debugf(msg)
+	return newResult(obj.GetKind(), namespace, name, OutcomeUnchanged, msg).setResourceVersion(live.GetResourceVersion())
+}
+
+/*
+List : get the objects of gvk in namespaces, or in the cluster if the kind is cluster-scoped, which match the label selector.
+*/
+func (h *dynamicHandler) List(gvk schema.GroupVersionKind, namespaces []string, selector string) ([]runtime.Object, error) {
+	mapping, err := h.getRESTMapping(gvk)
+	if err != nil {
+		return nil, err
+	}
+	resourceClients := []dynamic.ResourceInterface{}
+	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		resourceClients = append(resourceClients, h.dynamicClient.Resource(mapping.Resource))
+	} else {
+		for _, namespace := range namespaces {
+			resourceClients = append(resourceClients, h.dynamicClient.Resource(mapping.Resource).Namespace(namespace))
+		}
+	}
+
+	objects := []runtime.Object{}
+	for _, resourceClient := range resourceClients {
+		list, err := resourceClient.List(metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			list.Items[i].SetGroupVersionKind(gvk)
+			objects = append(objects, &list.Items[i])
+		}
+	}
+	return objects, nil
+}
+
+func (h *dynamicHandler) getResourceClient(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+	mapping, err := h.getRESTMapping(obj.GroupVersionKind())
+	if err != nil {
+		return nil, err
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		obj.SetNamespace("")
+		return h.dynamicClient.Resource(mapping.Resource), nil
+	}
+	return h.dynamicClient.Resource(mapping.Resource).Namespace(obj.GetNamespace()), nil
+}
+
+func (h *dynamicHandler) getRESTMapping(gvk schema.GroupVersionKind) (*meta.RESTMapping, error) {
+	mapping, err := h.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		// the kind may be defined by a CRD created after the discovery cache was filled
+		if resettable, ok := h.mapper.(interface{ Reset() }); ok {
+			resettable.Reset()
+			return h.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		}
+	}
+	return mapping, err
+}
+
+// mergeObject overwrites the labels, annotations and the top-level fields except status of current by those of obj.
+func mergeObject(current *unstructured.Unstructured, obj *unstructured.Unstructured) {
+	current.SetLabels(obj.GetLabels())
+	current.SetAnnotations(obj.GetAnnotations())
+	for key, value := range obj.Object {
+		switch key {
+		case "apiVersion", "kind", "metadata", "status":
+			continue
+		}
+		current.Object[key] = value
+	}
+}
+
+// findDrift returns the path of the first field of desired whose value differs from that of live, or "" if live has all the fields of desired.
+// The fields which live has but desired does not are ignored.
+func findDrift(desired interface{}, live interface{}, path string) string {
+	switch d := desired.(type) {
+	case nil:
+		return ""
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			if len(d) == 0 && live == nil {
+				return ""
+			}
+			return path
+		}
+		keys := []string{}
+		for key := range d {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if p := findDrift(d[key], l[key], path+"."+key); p != "" {
+				return p
+			}
+		}
+		return ""
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			if len(d) == 0 && live == nil {
+				return ""
+			}
+			return path
+		}
+		for i := range d {
+			if p := findDrift(d[i], l[i], fmt.Sprintf("%s[%d]", path, i)); p != "" {
+				return p
+			}
+		}
+		return ""
+	default:
+		// numbers may be decoded as int64 or float64, so compare them as texts
+		if live == nil || fmt.Sprint(desired) != fmt.Sprint(live) {
+			return path
+		}
+		return ""
+	}
+}
+
+// encodeStringData merges the stringData of the secret into its data, as kubernetes does.
+func encodeStringData(obj *unstructured.Unstructured) {
+	stringData, found, err := unstructured.NestedStringMap(obj.Object, "stringData")
+	if !found || err != nil {
+		return
+	}
+	data, _, _ := unstructured.NestedMap(obj.Object, "data")
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	for key, value := range stringData {
+		data[key] = base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	obj.Object["data"] = data
+	delete(obj.Object, "stringData")
+}
+
+func toInterfaceMap(m map[string]string) map[string]interface{} {
+	result := map[string]interface{}{}
+	for key, value := range m {
+		result[key] = value
+	}
+	return result
+}
@@ -0,0 +1,457 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"go.uber.org/zap"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/mqtt-kube-operator/mock"
+)
+
+var sensorResource = schema.GroupVersionResource{Group: "example.com", Version: "v1alpha1", Resource: "sensors"}
+
+func setUpDynamicHandler(t *testing.T) (*dynamicHandler, *mock.MockRESTMapper, *mock.MockResourceInterface, *unstructured.Unstructured, string, func()) {
+	ctrl := gomock.NewController(t)
+
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = zap.NewAtomicLevelAt(zap.FatalLevel)
+	logger, _ := loggerConfig.Build()
+
+	mapper := mock.NewMockRESTMapper(ctrl)
+	dynamicClient := mock.NewMockDynamicInterface(ctrl)
+	namespaceable := mock.NewMockNamespaceableResourceInterface(ctrl)
+	resource := mock.NewMockResourceInterface(ctrl)
+	dynamicClient.EXPECT().Resource(sensorResource).Return(namespaceable).AnyTimes()
+	namespaceable.EXPECT().Namespace("default").Return(resource).AnyTimes()
+
+	handler := &dynamicHandler{
+		dynamicClient: dynamicClient,
+		mapper:        mapper,
+		logger:        logger.Sugar(),
+	}
+
+	obj := getUnstructuredFromFixture(t, "../testdata/customresource.yaml")
+	obj.SetNamespace("default")
+
+	name := "my-sensor"
+
+	return handler, mapper, resource, obj, name, func() {
+		logger.Sync()
+		ctrl.Finish()
+	}
+}
+
+func getUnstructuredFromFixture(t *testing.T, filepath string) *unstructured.Unstructured {
+	yamlbytes, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jstr, err := yaml.YAMLToJSON(yamlbytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(jstr); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func sensorMapping(scope meta.RESTScope) *meta.RESTMapping {
+	return &meta.RESTMapping{
+		Resource:         sensorResource,
+		GroupVersionKind: schema.GroupVersionKind{Group: "example.com", Version: "v1alpha1", Kind: "Sensor"},
+		Scope:            scope,
+	}
+}
+
+func TestDynamicCreate(t *testing.T) {
+	assert := assert.New(t)
+	handler, mapper, client, obj, name, tearDown := setUpDynamicHandler(t)
+	defer tearDown()
+
+	getErr := errors.NewNotFound(sensorResource.GroupResource(), name)
+	mapper.EXPECT().RESTMapping(schema.GroupKind{Group: "example.com", Kind: "Sensor"}, "v1alpha1").Return(sensorMapping(meta.RESTScopeNamespace), nil).AnyTimes()
+
+	t.Run("success", func(t *testing.T) {
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(nil, getErr)
+		client.EXPECT().Create(obj, metav1.CreateOptions{}).Return(obj, nil)
+		client.EXPECT().Update(gomock.Any(), gomock.Any()).Times(0)
+		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
+
+		result := handler.Apply(obj)
+		assert.Equal(OutcomeCreated, result.Outcome)
+		assert.Equal(fmt.Sprintf("create sensor -- %s", name), result.Message)
+	})
+	t.Run("failure", func(t *testing.T) {
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(nil, getErr)
+		client.EXPECT().Create(obj, metav1.CreateOptions{}).Return(nil, fmt.Errorf("failure"))
+		client.EXPECT().Update(gomock.Any(), gomock.Any()).Times(0)
+		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
+
+		result := handler.Apply(obj)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(fmt.Sprintf("create sensor err -- %s", name), result.Message)
+	})
+}
+
+func TestDynamicUpdate(t *testing.T) {
+	assert := assert.New(t)
+	handler, mapper, client, obj, name, tearDown := setUpDynamicHandler(t)
+	defer tearDown()
+
+	mapper.EXPECT().RESTMapping(gomock.Any(), gomock.Any()).Return(sensorMapping(meta.RESTScopeNamespace), nil).AnyTimes()
+
+	t.Run("success", func(t *testing.T) {
+		prev := obj.DeepCopy()
+		prev.SetLabels(map[string]string{"test": "test"})
+		prev.Object["spec"] = map[string]interface{}{"interval": int64(1)}
+		prev.Object["status"] = map[string]interface{}{"ready": true}
+		prev.SetResourceVersion("1")
+
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(prev, nil)
+		client.EXPECT().Create(gomock.Any(), gomock.Any()).Times(0)
+		client.EXPECT().Update(gomock.Any(), metav1.UpdateOptions{}).DoAndReturn(func(current *unstructured.Unstructured, options metav1.UpdateOptions) (*unstructured.Unstructured, error) {
+			assert.Equal(obj.GetLabels(), current.GetLabels())
+			assert.Equal(obj.Object["spec"], current.Object["spec"])
+			assert.Equal(map[string]interface{}{"ready": true}, current.Object["status"])
+			updated := current.DeepCopy()
+			updated.SetResourceVersion("2")
+			return updated, nil
+		})
+		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
+
+		result := handler.Apply(obj)
+		assert.Equal(OutcomeUpdated, result.Outcome)
+		assert.Equal(fmt.Sprintf("update sensor -- %s", name), result.Message)
+		assert.Equal("2", result.ResourceVersion)
+	})
+	t.Run("unchanged", func(t *testing.T) {
+		prev := obj.DeepCopy()
+		prev.SetResourceVersion("1")
+
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(prev, nil)
+		client.EXPECT().Update(gomock.Any(), metav1.UpdateOptions{}).DoAndReturn(func(current *unstructured.Unstructured, options metav1.UpdateOptions) (*unstructured.Unstructured, error) {
+			return current, nil
+		})
+
+		result := handler.Apply(obj)
+		assert.Equal(OutcomeUnchanged, result.Outcome)
+		assert.Equal("1", result.ResourceVersion)
+	})
+	t.Run("failure", func(t *testing.T) {
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(obj.DeepCopy(), nil)
+		client.EXPECT().Create(gomock.Any(), gomock.Any()).Times(0)
+		client.EXPECT().Update(gomock.Any(), metav1.UpdateOptions{}).Return(nil, fmt.Errorf("failure"))
+		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
+
+		result := handler.Apply(obj)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(fmt.Sprintf("update sensor err -- %s", name), result.Message)
+	})
+}
+
+func TestDynamicApplyGetErr(t *testing.T) {
+	assert := assert.New(t)
+	handler, mapper, client, obj, name, tearDown := setUpDynamicHandler(t)
+	defer tearDown()
+
+	mapper.EXPECT().RESTMapping(gomock.Any(), gomock.Any()).Return(sensorMapping(meta.RESTScopeNamespace), nil)
+	client.EXPECT().Get(name, metav1.GetOptions{}).Return(nil, fmt.Errorf("getErr"))
+	client.EXPECT().Create(gomock.Any(), gomock.Any()).Times(0)
+	client.EXPECT().Update(gomock.Any(), gomock.Any()).Times(0)
+	client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
+
+	result := handler.Apply(obj)
+	assert.Equal(OutcomeError, result.Outcome)
+	assert.Equal(fmt.Sprintf("get sensor err -- %s", name), result.Message)
+}
+
+func TestDynamicMappingErr(t *testing.T) {
+	assert := assert.New(t)
+	handler, mapper, client, obj, name, tearDown := setUpDynamicHandler(t)
+	defer tearDown()
+
+	mapper.EXPECT().RESTMapping(gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("mappingErr")).Times(2)
+	client.EXPECT().Get(gomock.Any(), gomock.Any()).Times(0)
+
+	assert.Equal(fmt.Sprintf("get sensor mapping err -- %s", name), handler.Apply(obj).Message)
+	assert.Equal(fmt.Sprintf("get sensor mapping err -- %s", name), handler.Delete(obj).Message)
+}
+
+func TestDynamicClusterScoped(t *testing.T) {
+	assert := assert.New(t)
+	handler, mapper, _, obj, name, tearDown := setUpDynamicHandler(t)
+	defer tearDown()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	dynamicClient := mock.NewMockDynamicInterface(ctrl)
+	namespaceable := mock.NewMockNamespaceableResourceInterface(ctrl)
+	handler.dynamicClient = dynamicClient
+	dynamicClient.EXPECT().Resource(sensorResource).Return(namespaceable)
+	namespaceable.EXPECT().Namespace(gomock.Any()).Times(0)
+
+	mapper.EXPECT().RESTMapping(gomock.Any(), gomock.Any()).Return(sensorMapping(meta.RESTScopeRoot), nil)
+	namespaceable.EXPECT().Get(name, metav1.GetOptions{}).Return(nil, errors.NewNotFound(sensorResource.GroupResource(), name))
+	namespaceable.EXPECT().Create(gomock.Any(), metav1.CreateOptions{}).DoAndReturn(func(obj *unstructured.Unstructured, options metav1.CreateOptions) (*unstructured.Unstructured, error) {
+		assert.Equal("", obj.GetNamespace())
+		return obj, nil
+	})
+
+	result := handler.Apply(obj)
+	assert.Equal(OutcomeCreated, result.Outcome)
+	assert.Equal(fmt.Sprintf("create sensor -- %s", name), result.Message)
+}
+
+func TestDynamicList(t *testing.T) {
+	assert := assert.New(t)
+	handler, mapper, client, obj, _, tearDown := setUpDynamicHandler(t)
+	defer tearDown()
+
+	gvk := schema.GroupVersionKind{Group: "example.com", Version: "v1alpha1", Kind: "Sensor"}
+	selector := "app.kubernetes.io/managed-by=mqtt-kube-operator"
+
+	t.Run("namespaced", func(t *testing.T) {
+		mapper.EXPECT().RESTMapping(gvk.GroupKind(), gvk.Version).Return(sensorMapping(meta.RESTScopeNamespace), nil)
+		client.EXPECT().List(metav1.ListOptions{LabelSelector: selector}).Return(&unstructured.UnstructuredList{Items: []unstructured.Unstructured{*obj}}, nil)
+
+		objects, err := handler.List(gvk, []string{"default"}, selector)
+		assert.Nil(err)
+		assert.Len(objects, 1)
+		assert.Equal("my-sensor", objects[0].(*unstructured.Unstructured).GetName())
+		assert.Equal(gvk, objects[0].GetObjectKind().GroupVersionKind())
+	})
+	t.Run("cluster-scoped", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		dynamicClient := mock.NewMockDynamicInterface(ctrl)
+		namespaceable := mock.NewMockNamespaceableResourceInterface(ctrl)
+		original := handler.dynamicClient
+		handler.dynamicClient = dynamicClient
+		defer func() { handler.dynamicClient = original }()
+		dynamicClient.EXPECT().Resource(sensorResource).Return(namespaceable)
+		namespaceable.EXPECT().Namespace(gomock.Any()).Times(0)
+
+		mapper.EXPECT().RESTMapping(gvk.GroupKind(), gvk.Version).Return(sensorMapping(meta.RESTScopeRoot), nil)
+		namespaceable.EXPECT().List(metav1.ListOptions{LabelSelector: selector}).Return(&unstructured.UnstructuredList{}, nil)
+
+		objects, err := handler.List(gvk, []string{"default", "tenant-a"}, selector)
+		assert.Nil(err)
+		assert.Empty(objects)
+	})
+	t.Run("list failure", func(t *testing.T) {
+		mapper.EXPECT().RESTMapping(gvk.GroupKind(), gvk.Version).Return(sensorMapping(meta.RESTScopeNamespace), nil)
+		client.EXPECT().List(gomock.Any()).Return(nil, fmt.Errorf("listErr"))
+
+		_, err := handler.List(gvk, []string{"default"}, selector)
+		assert.NotNil(err)
+	})
+}
+
+func TestDynamicDelete(t *testing.T) {
+	assert := assert.New(t)
+	handler, mapper, client, obj, name, tearDown := setUpDynamicHandler(t)
+	defer tearDown()
+
+	mapper.EXPECT().RESTMapping(gomock.Any(), gomock.Any()).Return(sensorMapping(meta.RESTScopeNamespace), nil).AnyTimes()
+
+	t.Run("success", func(t *testing.T) {
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(obj, nil)
+		client.EXPECT().Create(gomock.Any(), gomock.Any()).Times(0)
+		client.EXPECT().Update(gomock.Any(), gomock.Any()).Times(0)
+		client.EXPECT().Delete(name, gomock.Any()).Return(nil)
+
+		result := handler.Delete(obj)
+		assert.Equal(OutcomeDeleted, result.Outcome)
+		assert.Equal(fmt.Sprintf("delete sensor -- %s", name), result.Message)
+	})
+	t.Run("failure", func(t *testing.T) {
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(obj, nil)
+		client.EXPECT().Create(gomock.Any(), gomock.Any()).Times(0)
+		client.EXPECT().Update(gomock.Any(), gomock.Any()).Times(0)
+		client.EXPECT().Delete(name, gomock.Any()).Return(fmt.Errorf("failure"))
+
+		result := handler.Delete(obj)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(fmt.Sprintf("delete sensor err -- %s", name), result.Message)
+	})
+	t.Run("not exist", func(t *testing.T) {
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(nil, errors.NewNotFound(sensorResource.GroupResource(), name))
+		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
+
+		result := handler.Delete(obj)
+		assert.Equal(OutcomeNotFound, result.Outcome)
+		assert.Equal(fmt.Sprintf("sensor does not exist -- %s", name), result.Message)
+	})
+}
+
+func TestDynamicDryRun(t *testing.T) {
+	assert := assert.New(t)
+	handler, mapper, client, obj, name, tearDown := setUpDynamicHandler(t)
+	defer tearDown()
+
+	mapper.EXPECT().RESTMapping(gomock.Any(), gomock.Any()).Return(sensorMapping(meta.RESTScopeNamespace), nil).AnyTimes()
+	dryRun := []string{metav1.DryRunAll}
+
+	t.Run("create", func(t *testing.T) {
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(nil, errors.NewNotFound(sensorResource.GroupResource(), name))
+		client.EXPECT().Create(gomock.Any(), metav1.CreateOptions{DryRun: dryRun}).Return(obj, nil)
+		client.EXPECT().Update(gomock.Any(), gomock.Any()).Times(0)
+
+		result := handler.Diff(obj)
+		assert.Equal(OutcomeCreated, result.Outcome)
+		assert.Equal(fmt.Sprintf("create sensor (dry run) -- %s", name), result.Message)
+		assert.Contains(result.Diff, "+kind: Sensor\n")
+	})
+	t.Run("update", func(t *testing.T) {
+		live := obj.DeepCopy()
+		live.SetResourceVersion("1")
+		live.Object["spec"] = map[string]interface{}{"interval": int64(5)}
+
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(live, nil)
+		client.EXPECT().Create(gomock.Any(), gomock.Any()).Times(0)
+		client.EXPECT().Update(gomock.Any(), metav1.UpdateOptions{DryRun: dryRun}).DoAndReturn(func(current *unstructured.Unstructured, options metav1.UpdateOptions) (*unstructured.Unstructured, error) {
+			assert.Equal(obj.Object["spec"], current.Object["spec"])
+			return current, nil
+		})
+
+		result := handler.Diff(obj)
+		assert.Equal(OutcomeUpdated, result.Outcome)
+		assert.Equal(fmt.Sprintf("update sensor (dry run) -- %s", name), result.Message)
+		assert.Equal("1", result.ResourceVersion)
+		assert.Contains(result.Diff, "-  interval: 5\n+  interval: 10\n")
+		assert.Equal(int64(5), live.Object["spec"].(map[string]interface{})["interval"])
+	})
+	t.Run("unchanged", func(t *testing.T) {
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(obj.DeepCopy(), nil)
+		client.EXPECT().Update(gomock.Any(), metav1.UpdateOptions{DryRun: dryRun}).DoAndReturn(func(current *unstructured.Unstructured, options metav1.UpdateOptions) (*unstructured.Unstructured, error) {
+			return current, nil
+		})
+
+		result := handler.DryRun(obj)
+		assert.Equal(OutcomeUnchanged, result.Outcome)
+		assert.Equal(fmt.Sprintf("sensor is unchanged (dry run) -- %s", name), result.Message)
+		assert.Equal("", result.Diff)
+	})
+	t.Run("failure", func(t *testing.T) {
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(obj.DeepCopy(), nil)
+		client.EXPECT().Update(gomock.Any(), metav1.UpdateOptions{DryRun: dryRun}).Return(nil, errors.NewForbidden(sensorResource.GroupResource(), name, fmt.Errorf("forbidden")))
+
+		result := handler.DryRun(obj)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal("Forbidden", result.Reason)
+		assert.Equal(fmt.Sprintf("dry run sensor err -- %s", name), result.Message)
+	})
+}
+
+func TestDynamicDrift(t *testing.T) {
+	assert := assert.New(t)
+	handler, mapper, client, obj, name, tearDown := setUpDynamicHandler(t)
+	defer tearDown()
+
+	mapper.EXPECT().RESTMapping(gomock.Any(), gomock.Any()).Return(sensorMapping(meta.RESTScopeNamespace), nil).AnyTimes()
+
+	testCases := []struct {
+		name    string
+		live    func() *unstructured.Unstructured
+		err     error
+		outcome Outcome
+		reason  string
+		msg     string
+	}{
+		{name: "not modified", live: func() *unstructured.Unstructured {
+			live := obj.DeepCopy()
+			live.SetResourceVersion("2")
+			live.SetLabels(map[string]string{"app": "MySensor", "added": "by-others"})
+			live.Object["spec"].(map[string]interface{})["defaulted"] = true
+			live.Object["status"] = map[string]interface{}{"ready": true}
+			return live
+		}, outcome: OutcomeUnchanged, msg: "sensor is not modified -- my-sensor"},
+		{name: "spec modified", live: func() *unstructured.Unstructured {
+			live := obj.DeepCopy()
+			live.Object["spec"] = map[string]interface{}{"interval": float64(5)}
+			return live
+		}, outcome: OutcomeDrifted, msg: "sensor is modified at .spec.interval -- my-sensor"},
+		{name: "label removed", live: func() *unstructured.Unstructured {
+			live := obj.DeepCopy()
+			live.SetLabels(nil)
+			return live
+		}, outcome: OutcomeDrifted, msg: "sensor is modified at .metadata.labels.app -- my-sensor"},
+		{name: "deleted", err: errors.NewNotFound(sensorResource.GroupResource(), name), outcome: OutcomeDrifted, msg: "sensor is deleted -- my-sensor"},
+		{name: "failure", err: errors.NewForbidden(sensorResource.GroupResource(), name, fmt.Errorf("forbidden")), outcome: OutcomeError, reason: "Forbidden", msg: "get sensor err -- my-sensor"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.live != nil {
+				client.EXPECT().Get(name, metav1.GetOptions{}).Return(c.live(), nil)
+			} else {
+				client.EXPECT().Get(name, metav1.GetOptions{}).Return(nil, c.err)
+			}
+			client.EXPECT().Update(gomock.Any(), gomock.Any()).Times(0)
+
+			result := handler.Drift(obj)
+			assert.Equal(c.outcome, result.Outcome)
+			assert.Equal(c.reason, result.Reason)
+			assert.Equal(c.msg, result.Message)
+		})
+	}
+}
+
+func TestFindDrift(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		name    string
+		desired interface{}
+		live    interface{}
+		path    string
+	}{
+		{name: "same", desired: map[string]interface{}{"a": "x", "b": int64(1)}, live: map[string]interface{}{"a": "x", "b": int64(1)}, path: ""},
+		{name: "extra live field", desired: map[string]interface{}{"a": "x"}, live: map[string]interface{}{"a": "x", "b": "y"}, path: ""},
+		{name: "number type", desired: map[string]interface{}{"a": int64(1)}, live: map[string]interface{}{"a": float64(1)}, path: ""},
+		{name: "null", desired: map[string]interface{}{"a": nil}, live: map[string]interface{}{}, path: ""},
+		{name: "empty map", desired: map[string]interface{}{"a": map[string]interface{}{}}, live: map[string]interface{}{}, path: ""},
+		{name: "different value", desired: map[string]interface{}{"a": map[string]interface{}{"b": "x"}}, live: map[string]interface{}{"a": map[string]interface{}{"b": "y"}}, path: ".a.b"},
+		{name: "missing field", desired: map[string]interface{}{"a": "x", "b": "y"}, live: map[string]interface{}{"a": "x"}, path: ".b"},
+		{name: "different type", desired: map[string]interface{}{"a": map[string]interface{}{"b": "x"}}, live: map[string]interface{}{"a": "x"}, path: ".a"},
+		{name: "list item", desired: map[string]interface{}{"a": []interface{}{map[string]interface{}{"b": "x"}}}, live: map[string]interface{}{"a": []interface{}{map[string]interface{}{"b": "x", "c": "z"}}}, path: ""},
+		{name: "list item modified", desired: map[string]interface{}{"a": []interface{}{"x", "y"}}, live: map[string]interface{}{"a": []interface{}{"x", "z"}}, path: ".a[1]"},
+		{name: "list length", desired: map[string]interface{}{"a": []interface{}{"x"}}, live: map[string]interface{}{"a": []interface{}{"x", "y"}}, path: ".a"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(c.path, findDrift(c.desired, c.live, ""))
+		})
+	}
+}
+
+func TestEncodeStringData(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"kind":       "Secret",
+		"data":       map[string]interface{}{"username": "YWRtaW4="},
+		"stringData": map[string]interface{}{"password": "pass"},
+	}}
+	encodeStringData(obj)
+	assert.Equal(t, map[string]interface{}{"username": "YWRtaW4=", "password": "cGFzcw=="}, obj.Object["data"])
+	assert.NotContains(t, obj.Object, "stringData")
+}
@@ -0,0 +1,68 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/tech-sketch/mqtt-kube-operator/metrics"
+)
+
+// knownActions are the actions used as the label of the metrics as they are. The others are counted as "unknown",
+// so that the commands sent by the broker can not add labels without limit.
+var knownActions = map[string]bool{
+	"apply": true, "delete": true, "dryrun": true, "diff": true, "prune": true, "logs": true,
+	"scale": true, "restart": true, "pause": true, "resume": true, "rollback": true,
+}
+
+// handledKinds are the kinds of the typed handlers, which are used as the label of the metrics as they are
+// like the kinds allowed for the dynamic handler. The others are counted as "other" not to add labels without limit.
+var handledKinds = map[string]bool{
+	"Deployment": true, "Service": true, "ConfigMap": true, "Secret": true,
+}
+
+// kindLabel returns the label of the metrics for kind.
+func (h *MessageHandler) kindLabel(kind string) string {
+	if kind == "" || handledKinds[kind] {
+		return kind
+	}
+	for gvk := range h.allowedKinds {
+		if gvk.Kind == kind {
+			return kind
+		}
+	}
+	return "other"
+}
+
+// recordCommand counts the results of the command and observes the time to process it.
+func (h *MessageHandler) recordCommand(action string, startedAt time.Time, results []*Result) {
+	if !knownActions[action] {
+		action = "unknown"
+	}
+	for _, result := range results {
+		metrics.Commands.WithLabelValues(action, h.kindLabel(result.Kind), string(result.Outcome)).Inc()
+	}
+	metrics.CommandDuration.WithLabelValues(action).Observe(time.Since(startedAt).Seconds())
+}
+
+// timedOperations wraps the operations to observe the time to apply an object by its kind.
+func (h *MessageHandler) timedOperations(operations map[handlerType]func(runtime.Object) *Result) map[handlerType]func(runtime.Object) *Result {
+	timed := map[handlerType]func(runtime.Object) *Result{}
+	for t, operation := range operations {
+		operation := operation
+		timed[t] = func(rawData runtime.Object) *Result {
+			startedAt := time.Now()
+			result := operation(rawData)
+			if result != nil {
+				metrics.ApplyDuration.WithLabelValues(h.kindLabel(result.Kind)).Observe(time.Since(startedAt).Seconds())
+			}
+			return result
+		}
+	}
+	return timed
+}
@@ -0,0 +1,101 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/tech-sketch/mqtt-kube-operator/metrics"
+)
+
+func TestRecordCommand(t *testing.T) {
+	assert := assert.New(t)
+	messageHandler := &MessageHandler{}
+
+	actionCases := []struct {
+		action string
+		label  string
+	}{
+		{action: "apply", label: "apply"},
+		{action: "rollback", label: "rollback"},
+		{action: "no-such-action", label: "unknown"},
+	}
+
+	for _, c := range actionCases {
+		t.Run(c.action, func(t *testing.T) {
+			created := metrics.Commands.WithLabelValues(c.label, "Deployment", string(OutcomeCreated))
+			failed := metrics.Commands.WithLabelValues(c.label, "", string(OutcomeError))
+			createdBefore := testutil.ToFloat64(created)
+			failedBefore := testutil.ToFloat64(failed)
+
+			messageHandler.recordCommand(c.action, time.Now(), []*Result{
+				newResult("Deployment", "default", "a", OutcomeCreated, ""),
+				newResult("Deployment", "default", "b", OutcomeCreated, ""),
+				newErrorResult("invalid"),
+			})
+			assert.Equal(createdBefore+2, testutil.ToFloat64(created))
+			assert.Equal(failedBefore+1, testutil.ToFloat64(failed))
+		})
+	}
+}
+
+func TestKindLabel(t *testing.T) {
+	assert := assert.New(t)
+	messageHandler := &MessageHandler{
+		allowedKinds: map[schema.GroupVersionKind]bool{{Group: "example.com", Version: "v1", Kind: "Sensor"}: true},
+	}
+
+	kindCases := []struct {
+		kind  string
+		label string
+	}{
+		{kind: "Deployment", label: "Deployment"},
+		{kind: "Secret", label: "Secret"},
+		{kind: "Sensor", label: "Sensor"},
+		{kind: "", label: ""},
+		{kind: "NoSuchKind", label: "other"},
+	}
+
+	for _, c := range kindCases {
+		t.Run(c.kind, func(t *testing.T) {
+			assert.Equal(c.label, messageHandler.kindLabel(c.kind))
+		})
+	}
+
+	other := metrics.Commands.WithLabelValues("apply", "other", string(OutcomeError))
+	before := testutil.ToFloat64(other)
+	messageHandler.recordCommand("apply", time.Now(), []*Result{
+		newResult("NoSuchKind", "default", "a", OutcomeError, ""),
+		newResult("AnotherKind", "default", "b", OutcomeError, ""),
+	})
+	assert.Equal(before+2, testutil.ToFloat64(other))
+}
+
+func TestTimedOperations(t *testing.T) {
+	assert := assert.New(t)
+	messageHandler := &MessageHandler{}
+
+	expected := newResult("Service", "default", "svc", OutcomeUpdated, "")
+	called := 0
+	operations := messageHandler.timedOperations(map[handlerType]func(runtime.Object) *Result{
+		serviceType: func(runtime.Object) *Result {
+			called++
+			return expected
+		},
+	})
+
+	assert.Len(operations, 1)
+	assert.Equal(expected, operations[serviceType](nil))
+	assert.Equal(1, called)
+}
@@ -6,13 +6,90 @@ Package handlers : handle MQTT message and deploy object to kubernetes.
 package handlers
 
 import (
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
 /*
 HandlerInf : a interface to specify the method signatures that an object handler should be implemented.
 */
 type HandlerInf interface {
-	Apply(runtime.Object) string
-	Delete(runtime.Object) string
+	Apply(runtime.Object) *Result
+	Delete(runtime.Object) *Result
+}
+
+/*
+ServerSideHandlerInf : a interface to specify the method signatures that a server-side apply handler should be implemented.
+*/
+type ServerSideHandlerInf interface {
+	Apply(runtime.Object) *Result
+	ForceApply(runtime.Object) *Result
+	DryRunHandlerInf
+}
+
+/*
+DryRunHandlerInf : a interface to specify the method signatures that a dry run handler should be implemented.
+*/
+type DryRunHandlerInf interface {
+	DryRun(runtime.Object) *Result
+	Diff(runtime.Object) *Result
+}
+
+/*
+RolloutHandlerInf : a interface to specify the method signatures that a rollout handler of Deployments should be implemented.
+*/
+type RolloutHandlerInf interface {
+	Scale(string, string, int32) *Result
+	Restart(string, string) *Result
+	Pause(string, string) *Result
+	Resume(string, string) *Result
+	Rollback(string, string, int64) *Result
+	Wait(string, string, time.Duration, func(string)) *Result
+	Restore(*appsv1.Deployment) *Result
+}
+
+/*
+DriftHandlerInf : a interface to specify the method signatures that a handler to detect the drift of an object from its desired state should be implemented.
+*/
+type DriftHandlerInf interface {
+	Drift(runtime.Object) *Result
+}
+
+/*
+StateStoreInf : a interface to specify the method signatures that a store of the desired states of objects should be implemented.
+*/
+type StateStoreInf interface {
+	Save(runtime.Object) error
+	Remove(runtime.Object) error
+	Find(schema.GroupKind, string, string) (runtime.Object, error)
+	Load() ([]runtime.Object, error)
+}
+
+/*
+PruneHandlerInf : a interface to specify the method signatures that a handler to prune the managed objects should be implemented.
+*/
+type PruneHandlerInf interface {
+	List(schema.GroupVersionKind, []string, string) ([]runtime.Object, error)
+	Delete(runtime.Object) *Result
+}
+
+/*
+LogsHandlerInf : a interface to specify the method signatures that a logs handler should be implemented.
+*/
+type LogsHandlerInf interface {
+	Logs(string, string, *apiv1.PodLogOptions) ([]*PodLogs, *Result)
+}
+
+/*
+MessagePropertiesInf : a interface to specify the method signatures that a message received with the MQTT v5 properties should be implemented.
+*/
+type MessagePropertiesInf interface {
+	ResponseTopic() string
+	CorrelationData() []byte
+	ContentType() string
+	UserProperty(string) string
 }
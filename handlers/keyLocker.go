@@ -0,0 +1,57 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"sync"
+)
+
+// keyLocker locks the objects by their keys, so that the commands and the reconciler do not operate the same object at once
+// while the ones operating the other objects go on.
+type keyLocker struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	locked map[string]bool
+}
+
+func newKeyLocker() *keyLocker {
+	l := &keyLocker{
+		locked: map[string]bool{},
+	}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+// lock waits until none of keys is locked and locks all of them at once, and returns the function to unlock them.
+// Locking all of the keys at once never causes a deadlock with the other callers.
+func (l *keyLocker) lock(keys []string) func() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for l.isLocked(keys) {
+		l.cond.Wait()
+	}
+	for _, key := range keys {
+		l.locked[key] = true
+	}
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		for _, key := range keys {
+			delete(l.locked, key)
+		}
+		l.cond.Broadcast()
+	}
+}
+
+// isLocked returns true if any of keys is locked. It must be called with the mutex locked.
+func (l *keyLocker) isLocked(keys []string) bool {
+	for _, key := range keys {
+		if l.locked[key] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyLocker(t *testing.T) {
+	assert := assert.New(t)
+	l := newKeyLocker()
+
+	unlock := l.lock([]string{"k", "j"})
+	// the other keys are not blocked
+	l.lock([]string{"i"})()
+	l.lock(nil)()
+
+	locked := make(chan bool)
+	go func() {
+		unlockOther := l.lock([]string{"i", "j"})
+		locked <- true
+		unlockOther()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("the locked key is locked twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("the unlocked key is not locked")
+	}
+	l.lock([]string{"i", "j", "k"})()
+	assert.Empty(l.locked)
+}
@@ -0,0 +1,184 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+/*
+PodLogs : a struct to hold the logs of a container, or the result of the failure to get them.
+*/
+type PodLogs struct {
+	Namespace string
+	Pod       string
+	Container string
+	Data      []byte
+	Result    *Result
+}
+
+type logsHandler struct {
+	kubeClient kubernetes.Interface
+	logger     *zap.SugaredLogger
+	getLogs    func(namespace string, pod string, options *apiv1.PodLogOptions) ([]byte, error)
+}
+
+func newLogsHandler(clientset *kubernetes.Clientset, logger *zap.SugaredLogger) *logsHandler {
+	return &logsHandler{
+		kubeClient: clientset,
+		logger:     logger,
+		getLogs: func(namespace string, pod string, options *apiv1.PodLogOptions) ([]byte, error) {
+			return clientset.CoreV1().Pods(namespace).GetLogs(pod, options).DoRaw()
+		},
+	}
+}
+
+/*
+Logs : get the logs of the pods specified by target, which is "<pod>", "pod/<pod>", "deployment/<deployment>" or "selector/<label selector>".
+When the container is not specified in options, the logs of all containers of each pod are got.
+*/
+func (h *logsHandler) Logs(namespace string, target string, options *apiv1.PodLogOptions) ([]*PodLogs, *Result) {
+	pods, result := h.findPods(namespace, target)
+	if result != nil {
+		return nil, result
+	}
+	if len(pods) == 0 {
+		msg := fmt.Sprintf("no pod is found -- %s", target)
+		h.logger.Infof(msg)
+		return nil, newResult("Pod", namespace, "", OutcomeNotFound, msg)
+	}
+
+	podLogs := []*PodLogs{}
+	for _, pod := range pods {
+		containers := []string{options.Container}
+		if options.Container == "" {
+			containers = []string{}
+			for _, container := range pod.Spec.Containers {
+				containers = append(containers, container.Name)
+			}
+		}
+		for _, container := range containers {
+			containerOptions := options.DeepCopy()
+			containerOptions.Container = container
+			logs := &PodLogs{Namespace: namespace, Pod: pod.ObjectMeta.Name, Container: container}
+			data, err := h.getLogs(namespace, pod.ObjectMeta.Name, containerOptions)
+			if err != nil {
+				msg := fmt.Sprintf("get logs err -- %s/%s", pod.ObjectMeta.Name, container)
+				h.logger.Errorf("%s: %s", msg, err.Error())
+				logs.Result = newResult("Pod", namespace, pod.ObjectMeta.Name, OutcomeError, msg).setError(err)
+			} else {
+				logs.Data = data
+			}
+			podLogs = append(podLogs, logs)
+		}
+	}
+	return podLogs, nil
+}
+
+func (h *logsHandler) findPods(namespace string, target string) ([]apiv1.Pod, *Result) {
+	kind, name := "pod", target
+	if i := strings.Index(target, "/"); i >= 0 {
+		kind, name = strings.ToLower(target[:i]), target[i+1:]
+	}
+	if name == "" {
+		msg := fmt.Sprintf("invalid logs target -- %s", target)
+		h.logger.Infof(msg)
+		return nil, newErrorResult(msg)
+	}
+
+	var selector string
+	switch kind {
+	case "pod":
+		pod, err := h.kubeClient.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			msg := fmt.Sprintf("get pod err -- %s", name)
+			h.logger.Errorf("%s: %s", msg, err.Error())
+			return nil, newResult("Pod", namespace, name, OutcomeError, msg).setError(err)
+		}
+		return []apiv1.Pod{*pod}, nil
+	case "deployment":
+		deployment, err := h.kubeClient.AppsV1().Deployments(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			msg := fmt.Sprintf("get deployment err -- %s", name)
+			h.logger.Errorf("%s: %s", msg, err.Error())
+			return nil, newResult("Deployment", namespace, name, OutcomeError, msg).setError(err)
+		}
+		s, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+		if err != nil {
+			msg := fmt.Sprintf("invalid selector of deployment -- %s", name)
+			h.logger.Errorf("%s: %s", msg, err.Error())
+			return nil, newResult("Deployment", namespace, name, OutcomeError, msg)
+		}
+		selector = s.String()
+	case "selector":
+		selector = name
+	default:
+		msg := fmt.Sprintf("invalid logs target -- %s", target)
+		h.logger.Infof(msg)
+		return nil, newErrorResult(msg)
+	}
+
+	podList, err := h.kubeClient.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		msg := fmt.Sprintf("list pods err -- %s", selector)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return nil, newResult("Pod", namespace, "", OutcomeError, msg).setError(err)
+	}
+	pods := podList.Items
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].ObjectMeta.Name < pods[j].ObjectMeta.Name
+	})
+	return pods, nil
+}
+
+// chunkLogs splits the logs into the payloads like "<cmdID>@logs|<namespace>/<pod>/<container>|<seq>/<total>|<data>"
+// whose size does not exceed maxPayloadSize. The data is split at a line end if possible, and never in a UTF-8 character.
+func chunkLogs(cmdID string, logs *PodLogs, maxPayloadSize int) ([]string, error) {
+	prefix := fmt.Sprintf("%s@logs|%s/%s/%s|", cmdID, logs.Namespace, logs.Pod, logs.Container)
+	// every chunk has at least 1 byte, so the number of chunks never has more digits than the size of the data
+	digits := len(strconv.Itoa(len(logs.Data) + 1))
+	budget := maxPayloadSize - len(prefix) - (digits*2 + 2)
+	if budget < utf8.UTFMax {
+		return nil, fmt.Errorf("max payload size %d is too small", maxPayloadSize)
+	}
+
+	data := logs.Data
+	pieces := [][]byte{}
+	for len(data) > budget {
+		end := budget
+		if i := bytes.LastIndexByte(data[:end], '\n'); i >= 0 {
+			end = i + 1
+		} else {
+			for end > 0 && !utf8.RuneStart(data[end]) {
+				end--
+			}
+			if end == 0 {
+				// not UTF-8, so split it anywhere
+				end = budget
+			}
+		}
+		pieces = append(pieces, data[:end])
+		data = data[end:]
+	}
+	pieces = append(pieces, data)
+
+	payloads := []string{}
+	for i, piece := range pieces {
+		payloads = append(payloads, fmt.Sprintf("%s%d/%d|%s", prefix, i+1, len(pieces), piece))
+	}
+	return payloads, nil
+}
@@ -0,0 +1,277 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/mqtt-kube-operator/mock"
+)
+
+type getLogsCall struct {
+	namespace string
+	pod       string
+	options   *apiv1.PodLogOptions
+}
+
+func setUpLogsHandler(t *testing.T) (*logsHandler, *mock.MockPodInterface, *mock.MockDeploymentInterface, *[]getLogsCall, func()) {
+	ctrl := gomock.NewController(t)
+
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = zap.NewAtomicLevelAt(zap.FatalLevel)
+	logger, _ := loggerConfig.Build()
+
+	clientset := mock.NewMockInterface(ctrl)
+	mcorev1 := mock.NewMockCoreV1Interface(ctrl)
+	mappsv1 := mock.NewMockAppsV1Interface(ctrl)
+	pod := mock.NewMockPodInterface(ctrl)
+	deployment := mock.NewMockDeploymentInterface(ctrl)
+	clientset.EXPECT().CoreV1().Return(mcorev1).AnyTimes()
+	clientset.EXPECT().AppsV1().Return(mappsv1).AnyTimes()
+	mcorev1.EXPECT().Pods("default").Return(pod).AnyTimes()
+	mappsv1.EXPECT().Deployments("default").Return(deployment).AnyTimes()
+
+	calls := []getLogsCall{}
+	handler := &logsHandler{
+		kubeClient: clientset,
+		logger:     logger.Sugar(),
+		getLogs: func(namespace string, pod string, options *apiv1.PodLogOptions) ([]byte, error) {
+			calls = append(calls, getLogsCall{namespace, pod, options})
+			if options.Container == "broken" {
+				return nil, fmt.Errorf("failure")
+			}
+			return []byte(fmt.Sprintf("logs of %s/%s\n", pod, options.Container)), nil
+		},
+	}
+
+	return handler, pod, deployment, &calls, func() {
+		logger.Sync()
+		ctrl.Finish()
+	}
+}
+
+func newLogsTestPod(name string, containers ...string) apiv1.Pod {
+	pod := apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+	for _, container := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, apiv1.Container{Name: container})
+	}
+	return pod
+}
+
+func TestLogsPod(t *testing.T) {
+	assert := assert.New(t)
+	var tailLines int64 = 10
+
+	testCases := []struct {
+		target     string
+		container  string
+		containers []string
+		data       []string
+	}{
+		{target: "my-pod", containers: []string{"app", "sidecar"}, data: []string{"logs of my-pod/app\n", "logs of my-pod/sidecar\n"}},
+		{target: "pod/my-pod", containers: []string{"app", "sidecar"}, data: []string{"logs of my-pod/app\n", "logs of my-pod/sidecar\n"}},
+		{target: "Pod/my-pod", container: "sidecar", containers: []string{"sidecar"}, data: []string{"logs of my-pod/sidecar\n"}},
+	}
+
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("target=%s, container=%s", c.target, c.container), func(t *testing.T) {
+			handler, pod, _, calls, tearDown := setUpLogsHandler(t)
+			defer tearDown()
+
+			myPod := newLogsTestPod("my-pod", "app", "sidecar")
+			pod.EXPECT().Get("my-pod", metav1.GetOptions{}).Return(&myPod, nil)
+
+			podLogs, result := handler.Logs("default", c.target, &apiv1.PodLogOptions{Container: c.container, TailLines: &tailLines})
+			assert.Nil(result)
+			assert.Len(podLogs, len(c.containers))
+			for i, logs := range podLogs {
+				assert.Equal("default", logs.Namespace)
+				assert.Equal("my-pod", logs.Pod)
+				assert.Equal(c.containers[i], logs.Container)
+				assert.Equal(c.data[i], string(logs.Data))
+				assert.Nil(logs.Result)
+				assert.Equal(c.containers[i], (*calls)[i].options.Container)
+				assert.Equal(&tailLines, (*calls)[i].options.TailLines)
+			}
+		})
+	}
+}
+
+func TestLogsSelector(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("deployment", func(t *testing.T) {
+		handler, pod, deployment, _, tearDown := setUpLogsHandler(t)
+		defer tearDown()
+
+		deployment.EXPECT().Get("my-deployment", metav1.GetOptions{}).Return(&appsv1.Deployment{
+			Spec: appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nginx"}}},
+		}, nil)
+		pod.EXPECT().List(metav1.ListOptions{LabelSelector: "app=nginx"}).Return(&apiv1.PodList{
+			Items: []apiv1.Pod{newLogsTestPod("my-deployment-2", "nginx"), newLogsTestPod("my-deployment-1", "nginx")},
+		}, nil)
+
+		podLogs, result := handler.Logs("default", "deployment/my-deployment", &apiv1.PodLogOptions{})
+		assert.Nil(result)
+		assert.Len(podLogs, 2)
+		assert.Equal("my-deployment-1", podLogs[0].Pod)
+		assert.Equal("my-deployment-2", podLogs[1].Pod)
+	})
+
+	t.Run("selector", func(t *testing.T) {
+		handler, pod, _, _, tearDown := setUpLogsHandler(t)
+		defer tearDown()
+
+		pod.EXPECT().List(metav1.ListOptions{LabelSelector: "app=nginx,tier!=db"}).Return(&apiv1.PodList{
+			Items: []apiv1.Pod{newLogsTestPod("my-pod", "nginx", "broken")},
+		}, nil)
+
+		podLogs, result := handler.Logs("default", "selector/app=nginx,tier!=db", &apiv1.PodLogOptions{})
+		assert.Nil(result)
+		assert.Len(podLogs, 2)
+		assert.Equal("logs of my-pod/nginx\n", string(podLogs[0].Data))
+		assert.Nil(podLogs[0].Result)
+		assert.Nil(podLogs[1].Data)
+		assert.Equal(OutcomeError, podLogs[1].Result.Outcome)
+		assert.Equal("get logs err -- my-pod/broken", podLogs[1].Result.Message)
+	})
+
+	t.Run("no pod", func(t *testing.T) {
+		handler, pod, _, _, tearDown := setUpLogsHandler(t)
+		defer tearDown()
+
+		pod.EXPECT().List(metav1.ListOptions{LabelSelector: "app=nginx"}).Return(&apiv1.PodList{}, nil)
+
+		podLogs, result := handler.Logs("default", "selector/app=nginx", &apiv1.PodLogOptions{})
+		assert.Nil(podLogs)
+		assert.Equal(OutcomeNotFound, result.Outcome)
+		assert.Equal("no pod is found -- selector/app=nginx", result.Message)
+	})
+}
+
+func TestLogsError(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		target string
+		setUp  func(pod *mock.MockPodInterface, deployment *mock.MockDeploymentInterface)
+		reason metav1.StatusReason
+		msg    string
+	}{
+		{target: "pod/", msg: "invalid logs target -- pod/"},
+		{target: "replicaset/my-replicaset", msg: "invalid logs target -- replicaset/my-replicaset"},
+		{target: "my-pod", setUp: func(pod *mock.MockPodInterface, deployment *mock.MockDeploymentInterface) {
+			pod.EXPECT().Get("my-pod", metav1.GetOptions{}).Return(nil, errors.NewNotFound(apiv1.Resource("pod"), "my-pod"))
+		}, reason: metav1.StatusReasonNotFound, msg: "get pod err -- my-pod"},
+		{target: "deployment/my-deployment", setUp: func(pod *mock.MockPodInterface, deployment *mock.MockDeploymentInterface) {
+			deployment.EXPECT().Get("my-deployment", metav1.GetOptions{}).Return(nil, errors.NewForbidden(appsv1.Resource("deployment"), "my-deployment", fmt.Errorf("forbidden")))
+		}, reason: metav1.StatusReasonForbidden, msg: "get deployment err -- my-deployment"},
+		{target: "selector/app=nginx", setUp: func(pod *mock.MockPodInterface, deployment *mock.MockDeploymentInterface) {
+			pod.EXPECT().List(gomock.Any()).Return(nil, fmt.Errorf("failure"))
+		}, reason: metav1.StatusReasonUnknown, msg: "list pods err -- app=nginx"},
+	}
+
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("target=%s", c.target), func(t *testing.T) {
+			handler, pod, deployment, calls, tearDown := setUpLogsHandler(t)
+			defer tearDown()
+
+			if c.setUp != nil {
+				c.setUp(pod, deployment)
+			}
+
+			podLogs, result := handler.Logs("default", c.target, &apiv1.PodLogOptions{})
+			assert.Nil(podLogs)
+			assert.Equal(OutcomeError, result.Outcome)
+			assert.Equal(string(c.reason), result.Reason)
+			assert.Equal(c.msg, result.Message)
+			assert.Empty(*calls)
+		})
+	}
+}
+
+func TestChunkLogs(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		name           string
+		data           string
+		maxPayloadSize int
+		payloads       []string
+	}{
+		{
+			name:           "empty",
+			data:           "",
+			maxPayloadSize: 100,
+			payloads:       []string{"cmd1@logs|default/my-pod/app|1/1|"},
+		},
+		{
+			name:           "one chunk",
+			data:           "line1\nline2\n",
+			maxPayloadSize: 100,
+			payloads:       []string{"cmd1@logs|default/my-pod/app|1/1|line1\nline2\n"},
+		},
+		{
+			name:           "split at line end",
+			data:           "line1\nline2\nline3\n",
+			maxPayloadSize: 52,
+			payloads: []string{
+				"cmd1@logs|default/my-pod/app|1/2|line1\nline2\n",
+				"cmd1@logs|default/my-pod/app|2/2|line3\n",
+			},
+		},
+		{
+			name:           "split long line",
+			data:           "0123456789abcdef",
+			maxPayloadSize: 44,
+			payloads: []string{
+				"cmd1@logs|default/my-pod/app|1/2|012345678",
+				"cmd1@logs|default/my-pod/app|2/2|9abcdef",
+			},
+		},
+		{
+			name:           "split not in a character",
+			data:           "あいうえお",
+			maxPayloadSize: 44,
+			payloads: []string{
+				"cmd1@logs|default/my-pod/app|1/2|あいう",
+				"cmd1@logs|default/my-pod/app|2/2|えお",
+			},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			payloads, err := chunkLogs("cmd1", &PodLogs{Namespace: "default", Pod: "my-pod", Container: "app", Data: []byte(c.data)}, c.maxPayloadSize)
+			assert.Nil(err)
+			assert.Equal(c.payloads, payloads)
+			for _, payload := range payloads {
+				assert.True(len(payload) <= c.maxPayloadSize)
+			}
+			data := ""
+			for _, payload := range payloads {
+				data += strings.SplitN(payload, "|", 4)[3]
+			}
+			assert.Equal(c.data, data)
+		})
+	}
+
+	payloads, err := chunkLogs("cmd1", &PodLogs{Namespace: "default", Pod: "my-pod", Container: "app", Data: []byte("logs")}, 30)
+	assert.Nil(payloads)
+	assert.NotNil(err)
+}
@@ -0,0 +1,185 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// applyOrder lists the kinds which must exist before the kinds listed after them.
+var applyOrder = []string{
+	"Namespace",
+	"ResourceQuota",
+	"LimitRange",
+	"CustomResourceDefinition",
+	"ServiceAccount",
+	"Secret",
+	"ConfigMap",
+	"PersistentVolume",
+	"PersistentVolumeClaim",
+	"ClusterRole",
+	"ClusterRoleBinding",
+	"Role",
+	"RoleBinding",
+	"Service",
+	"DaemonSet",
+	"Deployment",
+	"ReplicaSet",
+	"StatefulSet",
+	"Job",
+	"CronJob",
+	"Ingress",
+}
+
+func decode(data string) (runtime.Object, *schema.GroupVersionKind, error) {
+	rawData, gvk, err := scheme.Codecs.UniversalDeserializer().Decode([]byte(data), nil, nil)
+	if runtime.IsNotRegisteredError(err) {
+		// kinds which are not registered in the scheme (e.g. custom resources) are decoded as unstructured
+		jsonData, err := yaml.ToJSON([]byte(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		return unstructured.UnstructuredJSONScheme.Decode(jsonData, nil, nil)
+	}
+	return rawData, gvk, err
+}
+
+// decodeManifests decodes a multi-document YAML stream (or a single JSON object) and expands v1/List into its items.
+func decodeManifests(data string) ([]runtime.Object, error) {
+	objects, _, err := decodeOriginalManifests(data)
+	return objects, err
+}
+
+// decodeOriginalManifests decodes the manifests like decodeManifests, and also returns the original of each object as unstructured,
+// which has only the fields written in the manifest.
+func decodeOriginalManifests(data string) ([]runtime.Object, map[runtime.Object]*unstructured.Unstructured, error) {
+	objects := []runtime.Object{}
+	originals := map[runtime.Object]*unstructured.Unstructured{}
+	reader := yaml.NewYAMLReader(bufio.NewReader(strings.NewReader(data)))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if isEmptyDocument(doc) {
+			continue
+		}
+		rawData, gvk, err := decode(string(doc))
+		if err != nil {
+			return nil, nil, err
+		}
+		rawData.GetObjectKind().SetGroupVersionKind(*gvk)
+
+		list, ok := rawData.(*apiv1.List)
+		if !ok {
+			if originals[rawData], err = decodeOriginal(doc); err != nil {
+				return nil, nil, err
+			}
+			objects = append(objects, rawData)
+			continue
+		}
+		for _, item := range list.Items {
+			itemData, gvk, err := decode(string(item.Raw))
+			if err != nil {
+				return nil, nil, err
+			}
+			itemData.GetObjectKind().SetGroupVersionKind(*gvk)
+			if originals[itemData], err = decodeOriginal(item.Raw); err != nil {
+				return nil, nil, err
+			}
+			objects = append(objects, itemData)
+		}
+	}
+	if len(objects) == 0 {
+		return nil, nil, fmt.Errorf("no object is found")
+	}
+	return objects, originals, nil
+}
+
+func decodeOriginal(doc []byte) (*unstructured.Unstructured, error) {
+	jsonData, err := yaml.ToJSON(doc)
+	if err != nil {
+		return nil, err
+	}
+	original := &unstructured.Unstructured{}
+	if err := original.UnmarshalJSON(jsonData); err != nil {
+		return nil, err
+	}
+	return original, nil
+}
+
+func isEmptyDocument(doc []byte) bool {
+	jsonData, err := yaml.ToJSON(doc)
+	if err != nil {
+		return false
+	}
+	jsonData = bytes.TrimSpace(jsonData)
+	return len(jsonData) == 0 || bytes.Equal(jsonData, []byte("null"))
+}
+
+// sortManifests sorts objects in dependency order, or in the reverse order when deleting them.
+func sortManifests(objects []runtime.Object, reverse bool) {
+	rank := func(rawData runtime.Object) int {
+		kind := rawData.GetObjectKind().GroupVersionKind().Kind
+		for i, k := range applyOrder {
+			if k == kind {
+				return i
+			}
+		}
+		return len(applyOrder)
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		if reverse {
+			return rank(objects[i]) > rank(objects[j])
+		}
+		return rank(objects[i]) < rank(objects[j])
+	})
+}
+
+// toTyped converts the unstructured object to the typed object of its kind if it is registered in the scheme.
+func toTyped(rawData runtime.Object) (runtime.Object, error) {
+	obj, ok := rawData.(*unstructured.Unstructured)
+	if !ok {
+		return rawData, nil
+	}
+	jsonData, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	typed, gvk, err := decode(string(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	typed.GetObjectKind().SetGroupVersionKind(*gvk)
+	return typed, nil
+}
+
+func toUnstructured(rawData runtime.Object) (*unstructured.Unstructured, error) {
+	if obj, ok := rawData.(*unstructured.Unstructured); ok {
+		return obj, nil
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(rawData)
+	if err != nil {
+		return nil, err
+	}
+	obj := &unstructured.Unstructured{Object: content}
+	obj.SetGroupVersionKind(rawData.GetObjectKind().GroupVersionKind())
+	return obj, nil
+}
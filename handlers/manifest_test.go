@@ -0,0 +1,125 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getKindsAndNames(t *testing.T, objects []runtime.Object) []string {
+	result := []string{}
+	for _, obj := range objects {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, fmt.Sprintf("%s/%s", obj.GetObjectKind().GroupVersionKind().Kind, accessor.GetName()))
+	}
+	return result
+}
+
+func TestDecodeManifests(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		fixture string
+		json    bool
+		objects []string
+	}{
+		{fixture: "../testdata/deployment.yaml", objects: []string{"Deployment/my-deployment"}},
+		{fixture: "../testdata/deployment.yaml", json: true, objects: []string{"Deployment/my-deployment"}},
+		{fixture: "../testdata/bundle.yaml", objects: []string{"Deployment/my-deployment", "Service/my-service", "ConfigMap/my-configmap"}},
+		{fixture: "../testdata/list.yaml", objects: []string{"Secret/my-secret", "Sensor/my-sensor", "Namespace/my-namespace"}},
+	}
+
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("fixture=%v, json=%v", c.fixture, c.json), func(t *testing.T) {
+			var data []byte
+			if c.json {
+				data, _ = getPayloadFromFixture(t, c.fixture)
+			} else {
+				var err error
+				data, err = ioutil.ReadFile(c.fixture)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			objects, err := decodeManifests(string(data))
+			assert.Nil(err)
+			assert.Equal(c.objects, getKindsAndNames(t, objects))
+		})
+	}
+
+	t.Run("custom resource is decoded as unstructured", func(t *testing.T) {
+		data, err := ioutil.ReadFile("../testdata/list.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects, err := decodeManifests(string(data))
+		assert.Nil(err)
+		_, ok := objects[1].(*unstructured.Unstructured)
+		assert.True(ok)
+	})
+}
+
+func TestDecodeManifestsError(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		data string
+	}{
+		{data: "{}"},
+		{data: "dummy"},
+		{data: "---\n---\n"},
+		{data: "# comment only"},
+		{data: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n---\ndummy"},
+	}
+
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("data=%v", c.data), func(t *testing.T) {
+			objects, err := decodeManifests(c.data)
+			assert.NotNil(err)
+			assert.Nil(objects)
+		})
+	}
+}
+
+func TestSortManifests(t *testing.T) {
+	assert := assert.New(t)
+
+	data, err := ioutil.ReadFile("../testdata/list.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := decodeManifests(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile("../testdata/bundle.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := decodeManifests(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := append(bundle, list...)
+
+	sortManifests(objects, false)
+	assert.Equal([]string{"Namespace/my-namespace", "Secret/my-secret", "ConfigMap/my-configmap", "Service/my-service", "Deployment/my-deployment", "Sensor/my-sensor"}, getKindsAndNames(t, objects))
+
+	sortManifests(objects, true)
+	assert.Equal([]string{"Sensor/my-sensor", "Deployment/my-deployment", "Service/my-service", "ConfigMap/my-configmap", "Secret/my-secret", "Namespace/my-namespace"}, getKindsAndNames(t, objects))
+}
@@ -7,8 +7,10 @@ package handlers
 
 import (
 	"fmt"
+	"math"
 	"net/url"
 	"regexp"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -17,9 +19,17 @@ import (
 
 	appsv1 "k8s.io/api/apps/v1"
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/kubernetes/scheme"
+
+	"github.com/tech-sketch/mqtt-kube-operator/metrics"
 )
 
 type handlerType int
@@ -30,8 +40,22 @@ const (
 	serviceType
 	configmapType
 	secretType
+	dynamicType
+)
+
+const (
+	defaultMaxLogPayloadSize = 64 * 1024
+	defaultLogTailLines      = 1000
+	defaultMaxLogBytes       = 1024 * 1024
+	defaultWaitTimeout       = 5 * time.Minute
 )
 
+// commandPattern matches a command like "<cmdID>@<action>|<body>".
+var commandPattern = regexp.MustCompile(`^([\w\-]+)@([\w\-]+)\|(.*)$`)
+
+// waitableActions are the commands which can wait for the rollouts of the deployments with the wait parameter.
+var waitableActions = map[string]bool{"apply": true, "scale": true, "restart": true, "resume": true, "rollback": true}
+
 func (h handlerType) String() string {
 	switch h {
 	case deploymentType:
@@ -42,6 +66,8 @@ func (h handlerType) String() string {
 		return "ConfigMap"
 	case secretType:
 		return "Secret"
+	case dynamicType:
+		return "Dynamic"
 	default:
 		return "Unknown"
 	}
@@ -51,14 +77,33 @@ func (h handlerType) String() string {
 MessageHandler : a struct handling object handlers to deploy an object generated from MQTT message.
 */
 type MessageHandler struct {
-	logger           *zap.SugaredLogger
-	deviceType       string
-	deviceID         string
-	deployment       HandlerInf
-	service          HandlerInf
-	configmap        HandlerInf
-	secret           HandlerInf
-	sleepMillisecond int
+	logger               *zap.SugaredLogger
+	deviceType           string
+	deviceID             string
+	deployment           HandlerInf
+	service              HandlerInf
+	configmap            HandlerInf
+	secret               HandlerInf
+	dynamic              HandlerInf
+	serverSide           ServerSideHandlerInf
+	dryRun               DryRunHandlerInf
+	logs                 LogsHandlerInf
+	rollout              RolloutHandlerInf
+	prune                PruneHandlerInf
+	allowedKinds         map[schema.GroupVersionKind]bool
+	namespaces           *namespacePolicy
+	resultFormat         ResultFormat
+	maxLogPayloadSize    int
+	logTailLines         int64
+	maxLogBytes          int64
+	waitTimeout          time.Duration
+	autoRollbackDeadline time.Duration
+	reconciler           *reconciler
+	commands             *commandCache
+	workers              *workerPool
+	sleepMillisecond     int
+	resultQoS            byte
+	locks                *keyLocker
 }
 
 /*
@@ -66,15 +111,196 @@ NewMessageHandler : a factory method to create MessageHandler.
 */
 func NewMessageHandler(clientset *kubernetes.Clientset, logger *zap.SugaredLogger, deviceType string, deviceID string) *MessageHandler {
 	return &MessageHandler{
-		logger:           logger,
-		deviceType:       deviceType,
-		deviceID:         deviceID,
-		deployment:       newDeploymentHandler(clientset, logger),
-		service:          newServiceHandler(clientset, logger),
-		configmap:        newConfigmapHandler(clientset, logger),
-		secret:           newSecretHandler(clientset, logger),
-		sleepMillisecond: 500,
+		logger:            logger,
+		deviceType:        deviceType,
+		deviceID:          deviceID,
+		deployment:        newDeploymentHandler(clientset, logger),
+		service:           newServiceHandler(clientset, logger),
+		configmap:         newConfigmapHandler(clientset, logger),
+		secret:            newSecretHandler(clientset, logger),
+		logs:              newLogsHandler(clientset, logger),
+		rollout:           newRolloutHandler(clientset, logger),
+		allowedKinds:      map[schema.GroupVersionKind]bool{},
+		namespaces:        newNamespacePolicy(apiv1.NamespaceDefault, nil),
+		resultFormat:      ResultFormatUltralight,
+		maxLogPayloadSize: defaultMaxLogPayloadSize,
+		logTailLines:      defaultLogTailLines,
+		maxLogBytes:       defaultMaxLogBytes,
+		waitTimeout:       defaultWaitTimeout,
+		sleepMillisecond:  500,
+		locks:             newKeyLocker(),
+	}
+}
+
+/*
+SetNamespaces : set the namespace used when a manifest does not specify it and the namespaces allowed to operate.
+*/
+func (h *MessageHandler) SetNamespaces(defaultNamespace string, allowedNamespaces []string) {
+	h.namespaces = newNamespacePolicy(defaultNamespace, allowedNamespaces)
+}
+
+/*
+SetResultFormat : set the format ("ultralight" or "json") of the command result published to the cmdexe topic.
+*/
+func (h *MessageHandler) SetResultFormat(format string) error {
+	switch ResultFormat(format) {
+	case ResultFormatUltralight, ResultFormatJSON:
+		h.resultFormat = ResultFormat(format)
+		return nil
+	default:
+		return fmt.Errorf("unknown result format '%s', expected %s or %s", format, ResultFormatUltralight, ResultFormatJSON)
+	}
+}
+
+/*
+SetMaxLogPayloadSize : set the maximum size in bytes of a payload published to the logs topic, over which the logs are split into chunks.
+*/
+func (h *MessageHandler) SetMaxLogPayloadSize(size int) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid max log payload size %d", size)
 	}
+	h.maxLogPayloadSize = size
+	return nil
+}
+
+/*
+SetLogLimits : set the number of the lines retrieved by the logs command when tailLines is not specified,
+and the maximum size in bytes of the logs retrieved from each container.
+*/
+func (h *MessageHandler) SetLogLimits(tailLines int, maxBytes int) error {
+	if tailLines <= 0 {
+		return fmt.Errorf("invalid log tail lines %d", tailLines)
+	}
+	if maxBytes <= 0 {
+		return fmt.Errorf("invalid max log bytes %d", maxBytes)
+	}
+	h.logTailLines = int64(tailLines)
+	h.maxLogBytes = int64(maxBytes)
+	return nil
+}
+
+/*
+SetWaitTimeout : set the default timeout in seconds to wait for the rollouts of the deployments when a command has the wait parameter.
+*/
+func (h *MessageHandler) SetWaitTimeout(seconds int) error {
+	if seconds <= 0 {
+		return fmt.Errorf("invalid wait timeout %d", seconds)
+	}
+	h.waitTimeout = time.Duration(seconds) * time.Second
+	return nil
+}
+
+/*
+EnableAutoRollback : roll a deployment updated by the apply command back to the spec before the update
+when its rollout is not completed within deadlineSeconds.
+*/
+func (h *MessageHandler) EnableAutoRollback(deadlineSeconds int) error {
+	if deadlineSeconds <= 0 {
+		return fmt.Errorf("invalid auto rollback deadline %d", deadlineSeconds)
+	}
+	h.autoRollbackDeadline = time.Duration(deadlineSeconds) * time.Second
+	return nil
+}
+
+/*
+SetPublishDelay : set the delay in milliseconds before publishing a command result.
+*/
+func (h *MessageHandler) SetPublishDelay(milliseconds int) error {
+	if milliseconds < 0 {
+		return fmt.Errorf("invalid publish delay %d", milliseconds)
+	}
+	h.sleepMillisecond = milliseconds
+	return nil
+}
+
+/*
+SetResultQoS : set the QoS (0, 1 or 2) of the messages published to the cmdexe, logs and drift topics.
+*/
+func (h *MessageHandler) SetResultQoS(qos int) error {
+	if qos < 0 || qos > 2 {
+		return fmt.Errorf("invalid result QoS %d", qos)
+	}
+	h.resultQoS = byte(qos)
+	return nil
+}
+
+/*
+EnableWorkerPool : process the commands concurrently by the workers, at most queueSize of which can wait to be processed.
+The commands operating the same object are processed in the received order.
+*/
+func (h *MessageHandler) EnableWorkerPool(workers int, queueSize int) error {
+	if workers <= 0 {
+		return fmt.Errorf("invalid number of workers %d", workers)
+	}
+	if queueSize <= 0 {
+		return fmt.Errorf("invalid command queue size %d", queueSize)
+	}
+	h.workers = newWorkerPool(workers, queueSize)
+	return nil
+}
+
+/*
+StopWorkers : stop accepting commands, and wait until the queued commands are processed.
+*/
+func (h *MessageHandler) StopWorkers() {
+	if h.workers == nil {
+		return
+	}
+	h.workers.stop()
+}
+
+/*
+EnableCommandDedup : keep the results of at most maxEntries commands processed within ttlSeconds by their IDs,
+and replay the result instead of processing a command again when the same command ID is received.
+The results are persisted to the file at path if it is not empty.
+*/
+func (h *MessageHandler) EnableCommandDedup(ttlSeconds int, maxEntries int, path string) error {
+	if ttlSeconds <= 0 {
+		return fmt.Errorf("invalid command dedup ttl %d", ttlSeconds)
+	}
+	if maxEntries <= 0 {
+		return fmt.Errorf("invalid command dedup max entries %d", maxEntries)
+	}
+	h.commands = newCommandCache(h.logger, time.Duration(ttlSeconds)*time.Second, maxEntries, path)
+	return nil
+}
+
+/*
+EnableDynamicHandler : enable the handler to operate the kinds listed in allowedKinds (e.g. "apps/v1/StatefulSet") using the dynamic client.
+*/
+func (h *MessageHandler) EnableDynamicHandler(dynamicClient dynamic.Interface, discoveryClient discovery.DiscoveryInterface, allowedKinds []string) error {
+	kinds := map[schema.GroupVersionKind]bool{}
+	for _, allowedKind := range allowedKinds {
+		gvk, err := parseGroupVersionKind(allowedKind)
+		if err != nil {
+			return err
+		}
+		kinds[gvk] = true
+	}
+	h.dynamic = newDynamicHandler(dynamicClient, discoveryClient, h.logger)
+	h.allowedKinds = kinds
+	return nil
+}
+
+/*
+EnableServerSideApply : apply every object using server-side apply owned by fieldManager instead of overwriting it.
+*/
+func (h *MessageHandler) EnableServerSideApply(dynamicClient dynamic.Interface, discoveryClient discovery.DiscoveryInterface, fieldManager string) {
+	h.serverSide = newServerSideHandler(dynamicClient, discoveryClient, fieldManager, h.logger)
+}
+
+/*
+EnableDryRun : enable the dryrun and diff commands which run the apply with server-side dry-run.
+*/
+func (h *MessageHandler) EnableDryRun(dynamicClient dynamic.Interface, discoveryClient discovery.DiscoveryInterface) {
+	h.dryRun = newDynamicHandler(dynamicClient, discoveryClient, h.logger)
+}
+
+/*
+EnablePrune : enable the prune command which deletes the managed objects not in the bundle applied last to a set.
+*/
+func (h *MessageHandler) EnablePrune(dynamicClient dynamic.Interface, discoveryClient discovery.DiscoveryInterface) {
+	h.prune = newDynamicHandler(dynamicClient, discoveryClient, h.logger)
 }
 
 /*
@@ -91,84 +317,494 @@ func (h *MessageHandler) GetCmdExeTopic() string {
 	return "/" + h.deviceType + "/" + h.deviceID + "/cmdexe"
 }
 
+/*
+GetLogsTopic : get the topic name to publish the logs got by the logs command
+*/
+func (h *MessageHandler) GetLogsTopic() string {
+	return "/" + h.deviceType + "/" + h.deviceID + "/logs"
+}
+
 /*
 Command : a method which return a function called when receiving a new MQTT message.
+When the worker pool is enabled, the function queues the command to the pool and returns without waiting for it to be processed.
+When the message is received by a MQTT v5 client, the results are published to its response topic with its correlation data if it has them.
 */
 func (h *MessageHandler) Command() mqtt.MessageHandler {
-	r := regexp.MustCompile(`^([\w\-]+)@([\w\-]+)\|(.*)$`)
-	publish := func(client mqtt.Client, payload string) {
-		time.Sleep(time.Duration(h.sleepMillisecond) * time.Millisecond)
-		if resultToken := client.Publish(h.GetCmdExeTopic(), 0, false, payload); resultToken.Wait() && resultToken.Error() != nil {
-			h.logger.Errorf("mqtt publish error, topic=%s, %s", h.GetCmdExeTopic(), resultToken.Error())
-			panic(resultToken.Error())
-		}
-		h.logger.Infof("send message: %s", payload)
-	}
-
 	return func(client mqtt.Client, msg mqtt.Message) {
-		payload := msg.Payload()
+		startedAt := time.Now()
+		reply, payload, err := h.newReply(msg)
+		if err != nil {
+			h.logger.Infof("invalid message: %s", err.Error())
+			h.publish(client, reply, newCommandResult("", "", startedAt, newErrorResult(err.Error())).Format(h.resultFormat), reasonPayloadFormatInvalid)
+			return
+		}
 		h.logger.Infof("received message: %s", payload)
 
-		g := r.FindSubmatch(payload)
+		g := commandPattern.FindSubmatch(payload)
 
 		if len(g) != 4 {
-			publish(client, "invalid payload")
+			h.publish(client, reply, newCommandResult("", "", startedAt, newErrorResult("invalid payload")).Format(h.resultFormat), reasonPayloadFormatInvalid)
 			return
 		}
+		cmdID := string(g[1][:])
+		action := string(g[2][:])
+		body, params := parseCommandBody(string(g[3][:]))
 
-		sendMessage := func(resultMsg string) {
-			result := fmt.Sprintf("%s@%s|%s", g[1], g[2], resultMsg)
-			publish(client, result)
+		if h.workers == nil {
+			h.execute(client, reply, cmdID, action, body, params, startedAt)
+			return
+		}
+		// the same command delivered twice is also processed in order, so that the second one replays the result of the first one
+		keys := append(h.commandKeys(action, body, params), "cmd/"+cmdID)
+		if !h.workers.submit(keys, func() {
+			h.execute(client, reply, cmdID, action, body, params, startedAt)
+		}) {
+			resultMsg := "command queue is full, retry later"
+			h.logger.Warnf("%s -- %s", resultMsg, cmdID)
+			result := newErrorResult(resultMsg)
+			result.Reason = string(metav1.StatusReasonTooManyRequests)
+			h.publish(client, reply, newCommandResult(cmdID, action, startedAt, result).Format(h.resultFormat), reasonQuotaExceeded)
+			return
 		}
+		h.logger.Debugf("queue command -- %s, %d commands waiting", cmdID, h.workers.queued())
+	}
+}
 
-		if len(g[3]) == 0 {
-			resultMsg := "empty command body"
-			h.logger.Infof(resultMsg)
-			sendMessage(resultMsg)
+func (h *MessageHandler) publish(client mqtt.Client, reply *reply, payload string, reasonCode byte) {
+	time.Sleep(time.Duration(h.sleepMillisecond) * time.Millisecond)
+	if resultToken := client.Publish(reply.topic, h.resultQoS, false, reply.message(payload, h.resultFormat, reasonCode)); resultToken.Wait() && resultToken.Error() != nil {
+		h.logger.Errorf("mqtt publish error, topic=%s, %s", reply.topic, resultToken.Error())
+		metrics.PublishFailed(h.metricTopicOf(reply))
+		return
+	}
+	h.logger.Infof("send message: %s", payload)
+}
+
+// execute processes the command and publishes its result.
+func (h *MessageHandler) execute(client mqtt.Client, reply *reply, cmdID string, action string, body string, params commandParams, startedAt time.Time) {
+	if h.commands != nil {
+		if cached, ok := h.commands.get(cmdID); ok {
+			h.logger.Infof("command is already processed, replay the result -- %s", cmdID)
+			h.publish(client, reply, cached.Payload, cached.ReasonCode)
 			return
 		}
-		data, err := url.QueryUnescape(string(g[3][:]))
-		if err != nil {
-			resultMsg := "command body is invalid format"
-			h.logger.Infof(resultMsg)
-			sendMessage(resultMsg)
+	}
+
+	var results []*Result
+	defer func() {
+		h.recordCommand(action, startedAt, results)
+	}()
+	sendResults := func(results ...*Result) {
+		h.publish(client, reply, newCommandResult(cmdID, action, startedAt, results...).Format(h.resultFormat), reasonCodeOf(results))
+	}
+
+	if len(body) == 0 {
+		resultMsg := "empty command body"
+		h.logger.Infof(resultMsg)
+		results = []*Result{newErrorResult(resultMsg)}
+		sendResults(results...)
+		return
+	}
+	data, err := url.QueryUnescape(body)
+	if err != nil {
+		resultMsg := "command body is invalid format"
+		h.logger.Infof(resultMsg)
+		results = []*Result{newErrorResult(resultMsg)}
+		sendResults(results...)
+		return
+	}
+
+	h.logger.Infof("data: %s", data)
+	var waitTimeout time.Duration
+	if waitableActions[action] && params.getBool("wait") {
+		timeout, err := params.getInt64("timeout")
+		if err != nil || (timeout != nil && *timeout <= 0) {
+			results = []*Result{newErrorResult("invalid parameter -- timeout")}
+			sendResults(results...)
 			return
 		}
+		waitTimeout = h.waitTimeout
+		if timeout != nil {
+			waitTimeout = time.Duration(*timeout) * time.Second
+		}
+	}
 
-		h.logger.Infof("data: %s", data)
-		var resultMsg string
-		switch string(g[2][:]) {
-		case "apply":
-			operations := map[handlerType]func(runtime.Object) string{
-				deploymentType: h.deployment.Apply,
-				serviceType:    h.service.Apply,
-				configmapType:  h.configmap.Apply,
-				secretType:     h.secret.Apply,
+	// the objects are locked only while operating them, and not while waiting for their rollouts
+	unlock := h.locks.lock(h.commandKeys(action, body, params))
+	switch action {
+	case "apply":
+		set := params["set"]
+		if set != "" && len(validation.IsValidLabelValue(set)) > 0 {
+			results = []*Result{newErrorResult("invalid parameter -- set")}
+			break
+		}
+		results = h.operate(h.ownedOperations(h.applyOperations(params.getBool("force")), set, newGeneration(startedAt)), data, false, h.saveState)
+	case "delete":
+		results = h.operate(h.deleteOperations(), data, true, h.removeState)
+	case "dryrun", "diff":
+		operations := h.dryRunOperations(action == "diff")
+		if operations == nil {
+			resultMsg := "dry run is not enabled"
+			h.logger.Infof(resultMsg)
+			results = []*Result{newErrorResult(resultMsg)}
+			break
+		}
+		// the generation is not stamped, otherwise the objects applied to a set would never be unchanged
+		results = h.operate(h.ownedOperations(operations, params["set"], ""), data, false, nil)
+	case "prune":
+		if h.prune == nil {
+			resultMsg := "prune is not enabled"
+			h.logger.Infof(resultMsg)
+			results = []*Result{newErrorResult(resultMsg)}
+			break
+		}
+		results = h.pruneSet(data)
+	case "logs":
+		results = h.sendLogs(client, cmdID, data, params)
+	case "scale", "restart", "pause", "resume", "rollback":
+		results = h.operateRollout(action, data, params)
+	default:
+		results = []*Result{newErrorResult("unknown command")}
+	}
+	unlock()
+	if waitTimeout > 0 || h.autoRollbackDeadline > 0 {
+		results = h.waitRollouts(results, waitTimeout, func(result *Result) {
+			if waitTimeout > 0 {
+				sendResults(result)
 			}
-			resultMsg = h.operate(operations, data)
-		case "delete":
-			operations := map[handlerType]func(runtime.Object) string{
-				deploymentType: h.deployment.Delete,
-				serviceType:    h.service.Delete,
-				configmapType:  h.configmap.Delete,
-				secretType:     h.secret.Delete,
+		})
+	}
+	resultPayload := newCommandResult(cmdID, action, startedAt, results...).Format(h.resultFormat)
+	reasonCode := reasonCodeOf(results)
+	h.publish(client, reply, resultPayload, reasonCode)
+	if h.commands != nil {
+		h.commands.put(cmdID, resultPayload, reasonCode)
+	}
+}
+
+// commandKeys returns the keys of the objects operated by the command, with which the commands operating the same object are processed in order.
+func (h *MessageHandler) commandKeys(action string, body string, params commandParams) []string {
+	keys := []string{}
+	data, err := url.QueryUnescape(body)
+	if err != nil || data == "" {
+		return keys
+	}
+	switch action {
+	case "apply", "delete", "dryrun", "diff":
+		if set := params["set"]; set != "" && action == "apply" {
+			keys = append(keys, "set/"+set)
+		}
+		objects, err := decodeManifests(data)
+		if err != nil {
+			return keys
+		}
+		for _, rawData := range objects {
+			if key, err := h.objectKey(rawData); err == nil {
+				keys = append(keys, key)
 			}
-			resultMsg = h.operate(operations, data)
+		}
+	case "prune":
+		keys = append(keys, "set/"+data)
+	case "scale", "restart", "pause", "resume", "rollback":
+		namespace, _ := h.namespaces.resolve(params["namespace"])
+		keys = append(keys, stateKeyOf(deploymentGroupKind, namespace, data))
+	}
+	return keys
+}
+
+// objectKey returns the key of the object operated by the command, which is also used by the reconciler to lock it.
+func (h *MessageHandler) objectKey(rawData runtime.Object) (string, error) {
+	accessor, err := meta.Accessor(rawData)
+	if err != nil {
+		return "", err
+	}
+	namespace, _ := h.namespaces.resolve(accessor.GetNamespace())
+	return stateKeyOf(rawData.GetObjectKind().GroupVersionKind().GroupKind(), namespace, accessor.GetName()), nil
+}
+
+// operateRollout operates the deployment whose name is given as the command body instead of a manifest.
+func (h *MessageHandler) operateRollout(action string, name string, params commandParams) []*Result {
+	namespace, ok := h.namespaces.resolve(params["namespace"])
+	if !ok {
+		msg := fmt.Sprintf("namespace is not allowed -- %s", namespace)
+		h.logger.Infof(msg)
+		result := newResult("Deployment", namespace, name, OutcomeError, msg)
+		result.Reason = string(metav1.StatusReasonForbidden)
+		return []*Result{result}
+	}
+	var result, adoptResult *Result
+	switch action {
+	case "scale":
+		replicas, err := params.getInt64("replicas")
+		if err != nil || replicas == nil || *replicas < 0 || *replicas > math.MaxInt32 {
+			return []*Result{newErrorResult("invalid parameter -- replicas")}
+		}
+		scaled := int32(*replicas)
+		result = h.rollout.Scale(namespace, name, scaled)
+		adoptResult = h.adoptState(result, func(deployment *unstructured.Unstructured) error {
+			return unstructured.SetNestedField(deployment.Object, int64(scaled), "spec", "replicas")
+		})
+	case "restart":
+		result = h.rollout.Restart(namespace, name)
+	case "pause":
+		result = h.rollout.Pause(namespace, name)
+	case "resume":
+		result = h.rollout.Resume(namespace, name)
+	default:
+		revision, err := params.getInt64("revision")
+		if err != nil || (revision != nil && *revision < 0) {
+			return []*Result{newErrorResult("invalid parameter -- revision")}
+		}
+		if revision == nil {
+			result = h.rollout.Rollback(namespace, name, 0)
+		} else {
+			result = h.rollout.Rollback(namespace, name, *revision)
+		}
+		if updated, ok := result.updated.(*appsv1.Deployment); ok {
+			adoptResult = h.adoptState(result, func(deployment *unstructured.Unstructured) error {
+				template := updated.Spec.Template.DeepCopy()
+				delete(template.ObjectMeta.Annotations, restartedAtAnnotation)
+				content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(template)
+				if err != nil {
+					return err
+				}
+				return unstructured.SetNestedMap(deployment.Object, content, "spec", "template")
+			})
+		}
+	}
+	if adoptResult != nil {
+		return []*Result{result, adoptResult}
+	}
+	return []*Result{result}
+}
+
+// waitRollouts waits for the rollouts of the deployments in the results within timeout, and returns the results followed by the result of each rollout.
+// The progress of the rollouts is reported by progress in the meantime.
+// When the auto rollback is enabled, the rollout of a deployment updated by the apply command is waited within the auto rollback deadline instead,
+// and the deployment is rolled back if the rollout is not completed.
+func (h *MessageHandler) waitRollouts(results []*Result, timeout time.Duration, progress func(*Result)) []*Result {
+	deadline := time.Now().Add(timeout)
+	waited := append([]*Result{}, results...)
+	for _, result := range results {
+		if result.Kind != "Deployment" {
+			continue
+		}
+		switch result.Outcome {
+		case OutcomeCreated, OutcomeUpdated, OutcomeUnchanged:
 		default:
-			resultMsg = "unknown command"
+			continue
+		}
+		previous, _ := result.previous.(*appsv1.Deployment)
+		rollback := h.autoRollbackDeadline > 0 && previous != nil
+		wait := time.Until(deadline)
+		if rollback {
+			wait = h.autoRollbackDeadline
+		} else if timeout <= 0 {
+			continue
+		}
+
+		namespace, name := result.Namespace, result.Name
+		rolloutResult := h.rollout.Wait(namespace, name, wait, func(msg string) {
+			progress(newResult("Deployment", namespace, name, OutcomeProgressing, msg))
+		})
+		waited = append(waited, rolloutResult)
+		if rollback && isFailedRollout(rolloutResult) {
+			unlock := h.locks.lock([]string{stateKeyOf(deploymentGroupKind, namespace, name)})
+			restored := h.rollout.Restore(previous)
+			waited = append(waited, restored)
+			if restored.Outcome == OutcomeUpdated {
+				if stateResult := h.saveDesiredDeployment(previous, restored); stateResult != nil {
+					waited = append(waited, stateResult)
+				}
+			}
+			unlock()
 		}
-		sendMessage(resultMsg)
 	}
+	return waited
+}
+
+// isFailedRollout returns true if the rollout exceeded its progress deadline or was not completed within the timeout.
+func isFailedRollout(result *Result) bool {
+	return result.Outcome == OutcomeError &&
+		(result.Reason == progressDeadlineExceededReason || result.Reason == string(metav1.StatusReasonTimeout))
 }
 
-func (h *MessageHandler) operate(operations map[handlerType]func(rawData runtime.Object) string, data string) string {
-	decode := scheme.Codecs.UniversalDeserializer().Decode
-	rawData, _, err := decode([]byte(data), nil, nil)
+// sendLogs publishes the logs of the target to the logs topic, and returns the result of each container.
+func (h *MessageHandler) sendLogs(client mqtt.Client, cmdID string, target string, params commandParams) []*Result {
+	namespace, ok := h.namespaces.resolve(params["namespace"])
+	if !ok {
+		msg := fmt.Sprintf("namespace is not allowed -- %s", namespace)
+		h.logger.Infof(msg)
+		result := newResult("Pod", namespace, "", OutcomeError, msg)
+		result.Reason = string(metav1.StatusReasonForbidden)
+		return []*Result{result}
+	}
+	tailLines, err := params.getInt64("tailLines")
+	if err != nil {
+		return []*Result{newErrorResult("invalid parameter -- tailLines")}
+	}
+	if tailLines == nil {
+		defaultTailLines := h.logTailLines
+		tailLines = &defaultTailLines
+	}
+	sinceSeconds, err := params.getInt64("sinceSeconds")
+	if err != nil {
+		return []*Result{newErrorResult("invalid parameter -- sinceSeconds")}
+	}
+	// the logs are capped so that a command does not publish the whole logs of a long-running pod
+	limitBytes := h.maxLogBytes
+	options := &apiv1.PodLogOptions{
+		Container:    params["container"],
+		TailLines:    tailLines,
+		SinceSeconds: sinceSeconds,
+		LimitBytes:   &limitBytes,
+	}
+
+	podLogs, result := h.logs.Logs(namespace, target, options)
+	if result != nil {
+		return []*Result{result}
+	}
+	results := []*Result{}
+	for _, logs := range podLogs {
+		if logs.Result != nil {
+			results = append(results, logs.Result)
+			continue
+		}
+		results = append(results, h.publishLogs(client, cmdID, logs))
+	}
+	return results
+}
+
+func (h *MessageHandler) publishLogs(client mqtt.Client, cmdID string, logs *PodLogs) *Result {
+	payloads, err := chunkLogs(cmdID, logs, h.maxLogPayloadSize)
+	if err != nil {
+		msg := fmt.Sprintf("chunk logs err -- %s/%s", logs.Pod, logs.Container)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult("Pod", logs.Namespace, logs.Pod, OutcomeError, msg)
+	}
+	for _, payload := range payloads {
+		if token := client.Publish(h.GetLogsTopic(), h.resultQoS, false, payload); token.Wait() && token.Error() != nil {
+			msg := fmt.Sprintf("publish logs err -- %s/%s", logs.Pod, logs.Container)
+			h.logger.Errorf("mqtt publish error, topic=%s, %s", h.GetLogsTopic(), token.Error())
+			metrics.PublishFailed(h.GetLogsTopic())
+			return newResult("Pod", logs.Namespace, logs.Pod, OutcomeError, msg)
+		}
+	}
+	msg := fmt.Sprintf("logs %s/%s -- %d bytes in %d chunks", logs.Pod, logs.Container, len(logs.Data), len(payloads))
+	h.logger.Infof(msg)
+	return newResult("Pod", logs.Namespace, logs.Pod, OutcomeRetrieved, msg)
+}
+
+func (h *MessageHandler) applyOperations(force bool) map[handlerType]func(runtime.Object) *Result {
+	if h.serverSide != nil {
+		apply := h.serverSide.Apply
+		if force {
+			apply = h.serverSide.ForceApply
+		}
+		operations := map[handlerType]func(runtime.Object) *Result{
+			deploymentType: apply,
+			serviceType:    apply,
+			configmapType:  apply,
+			secretType:     apply,
+		}
+		if h.dynamic != nil {
+			operations[dynamicType] = apply
+		}
+		return h.timedOperations(operations)
+	}
+
+	operations := map[handlerType]func(runtime.Object) *Result{
+		deploymentType: h.deployment.Apply,
+		serviceType:    h.service.Apply,
+		configmapType:  h.configmap.Apply,
+		secretType:     h.secret.Apply,
+	}
+	if h.dynamic != nil {
+		operations[dynamicType] = h.dynamic.Apply
+	}
+	return h.timedOperations(operations)
+}
+
+func (h *MessageHandler) deleteOperations() map[handlerType]func(runtime.Object) *Result {
+	operations := map[handlerType]func(runtime.Object) *Result{
+		deploymentType: h.deployment.Delete,
+		serviceType:    h.service.Delete,
+		configmapType:  h.configmap.Delete,
+		secretType:     h.secret.Delete,
+	}
+	if h.dynamic != nil {
+		operations[dynamicType] = h.dynamic.Delete
+	}
+	return operations
+}
+
+func (h *MessageHandler) dryRunOperations(withDiff bool) map[handlerType]func(runtime.Object) *Result {
+	// the dry run follows the way of the apply, so server-side apply is used if enabled
+	var dryRun DryRunHandlerInf
+	if h.serverSide != nil {
+		dryRun = h.serverSide
+	} else if h.dryRun != nil {
+		dryRun = h.dryRun
+	} else {
+		return nil
+	}
+	operation := dryRun.DryRun
+	if withDiff {
+		operation = dryRun.Diff
+	}
+
+	operations := map[handlerType]func(runtime.Object) *Result{
+		deploymentType: operation,
+		serviceType:    operation,
+		configmapType:  operation,
+		secretType:     operation,
+	}
+	if h.dynamic != nil {
+		operations[dynamicType] = operation
+	}
+	return operations
+}
+
+// operate operates the objects in the manifest, and records each object with its result by record if it is not nil.
+// The object is recorded as written in the manifest, with the namespace, labels and annotations resolved when operating it.
+// The result of record is appended to the results if it is not nil.
+func (h *MessageHandler) operate(operations map[handlerType]func(rawData runtime.Object) *Result, data string, reverse bool, record func(rawData runtime.Object, result *Result) *Result) []*Result {
+	objects, originals, err := decodeOriginalManifests(data)
 	if err != nil {
 		msg := "invalid format, skip this message"
 		h.logger.Infof("%s: %s", msg, err.Error())
-		return msg
+		return []*Result{newErrorResult(msg)}
+	}
+	sortManifests(objects, reverse)
+
+	results := []*Result{}
+	for _, rawData := range objects {
+		result := h.operateObject(operations, rawData)
+		results = append(results, result)
+		if record == nil {
+			continue
+		}
+		if recordResult := record(desiredState(originals[rawData], rawData), result); recordResult != nil {
+			results = append(results, recordResult)
+		}
 	}
+	return results
+}
+
+func (h *MessageHandler) operateObject(operations map[handlerType]func(rawData runtime.Object) *Result, rawData runtime.Object) *Result {
+	accessor, err := meta.Accessor(rawData)
+	if err != nil {
+		msg := "invalid format, skip this message"
+		h.logger.Infof("%s: %s", msg, err.Error())
+		return newErrorResult(msg)
+	}
+	gvk := rawData.GetObjectKind().GroupVersionKind()
+	kind := gvk.Kind
+	namespace, ok := h.namespaces.resolve(accessor.GetNamespace())
+	if !ok {
+		return h.namespaceNotAllowed(kind, namespace, accessor.GetName(), namespace)
+	}
+	accessor.SetNamespace(namespace)
 
 	switch rawData.(type) {
 	case *appsv1.Deployment:
@@ -180,8 +816,42 @@ func (h *MessageHandler) operate(operations map[handlerType]func(rawData runtime
 	case *apiv1.Secret:
 		return operations[secretType](rawData)
 	default:
-		msg := "unknown type, skip this message"
-		h.logger.Infof(msg)
-		return msg
+		operation, ok := operations[dynamicType]
+		if !ok || !h.allowedKinds[gvk] {
+			msg := "unknown type, skip this message"
+			h.logger.Infof(msg)
+			return newResult(kind, namespace, accessor.GetName(), OutcomeError, msg)
+		}
+		// a Namespace is cluster-scoped, so the namespace it names must be allowed instead
+		if gvk.Group == "" && kind == "Namespace" && !h.namespaces.allowed[accessor.GetName()] {
+			return h.namespaceNotAllowed(kind, "", accessor.GetName(), accessor.GetName())
+		}
+		obj, err := toUnstructured(rawData)
+		if err != nil {
+			msg := "invalid format, skip this message"
+			h.logger.Infof("%s: %s", msg, err.Error())
+			return newResult(kind, namespace, accessor.GetName(), OutcomeError, msg)
+		}
+		return operation(obj)
+	}
+}
+
+func (h *MessageHandler) namespaceNotAllowed(kind string, namespace string, name string, notAllowed string) *Result {
+	msg := fmt.Sprintf("namespace is not allowed -- %s", notAllowed)
+	h.logger.Infof(msg)
+	result := newResult(kind, namespace, name, OutcomeError, msg)
+	result.Reason = string(metav1.StatusReasonForbidden)
+	return result
+}
+
+func parseGroupVersionKind(s string) (schema.GroupVersionKind, error) {
+	i := strings.LastIndex(s, "/")
+	if i < 0 || i == len(s)-1 {
+		return schema.GroupVersionKind{}, fmt.Errorf("invalid kind '%s', expected apiVersion/Kind", s)
+	}
+	gv, err := schema.ParseGroupVersion(strings.TrimSpace(s[:i]))
+	if err != nil {
+		return schema.GroupVersionKind{}, fmt.Errorf("invalid kind '%s': %s", s, err.Error())
 	}
+	return gv.WithKind(strings.TrimSpace(s[i+1:])), nil
 }
@@ -11,13 +11,20 @@ import (
 	"io/ioutil"
 	"net/url"
 	"testing"
+	"time"
 
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/ghodss/yaml"
 	"go.uber.org/zap"
 
 	appsv1 "k8s.io/api/apps/v1"
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
 
 	"github.com/golang/mock/gomock"
@@ -26,17 +33,17 @@ import (
 	"github.com/tech-sketch/mqtt-kube-operator/mock"
 )
 
-func setUpMocks(t *testing.T, deviceType string, deviceID string) (*MessageHandler, *mock.MockHandlerInf, *mock.MockHandlerInf, *mock.MockHandlerInf, *mock.MockHandlerInf, *mock.MockClient, *mock.MockMessage, *mock.MockToken, func()) {
+func setUpMocks(t *testing.T, deviceType string, deviceID string) (*MessageHandler, *MockHandlerInf, *MockHandlerInf, *MockHandlerInf, *MockHandlerInf, *mock.MockClient, *mock.MockMessage, *mock.MockToken, func()) {
 	ctrl := gomock.NewController(t)
 
 	loggerConfig := zap.NewProductionConfig()
 	loggerConfig.Level = zap.NewAtomicLevelAt(zap.FatalLevel)
 	logger, _ := loggerConfig.Build()
 
-	deployment := mock.NewMockHandlerInf(ctrl)
-	service := mock.NewMockHandlerInf(ctrl)
-	configmap := mock.NewMockHandlerInf(ctrl)
-	secret := mock.NewMockHandlerInf(ctrl)
+	deployment := NewMockHandlerInf(ctrl)
+	service := NewMockHandlerInf(ctrl)
+	configmap := NewMockHandlerInf(ctrl)
+	secret := NewMockHandlerInf(ctrl)
 
 	handler := &MessageHandler{
 		logger:           logger.Sugar(),
@@ -46,7 +53,10 @@ func setUpMocks(t *testing.T, deviceType string, deviceID string) (*MessageHandl
 		service:          service,
 		configmap:        configmap,
 		secret:           secret,
+		namespaces:       newNamespacePolicy(apiv1.NamespaceDefault, []string{"tenant-a"}),
+		resultFormat:     ResultFormatUltralight,
 		sleepMillisecond: 0,
+		locks:            newKeyLocker(),
 	}
 
 	client := mock.NewMockClient(ctrl)
@@ -142,7 +152,7 @@ func TestDeployment(t *testing.T) {
 		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s", url.QueryEscape(string(payload)))))
 		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@apply|apply deployment success").Return(token)
 		token.EXPECT().Wait().Return(false)
-		deployment.EXPECT().Apply(NewRawDataMatcher(rawData)).Return("apply deployment success").Times(1)
+		deployment.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(&Result{Message: "apply deployment success"}).Times(1)
 		deployment.EXPECT().Delete(gomock.Any()).Times(0)
 		service.EXPECT().Apply(gomock.Any()).Times(0)
 		service.EXPECT().Delete(gomock.Any()).Times(0)
@@ -159,7 +169,7 @@ func TestDeployment(t *testing.T) {
 		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@delete|delete deployment success").Return(token)
 		token.EXPECT().Wait().Return(false)
 		deployment.EXPECT().Apply(gomock.Any()).Times(0)
-		deployment.EXPECT().Delete(NewRawDataMatcher(rawData)).Return("delete deployment success").Times(1)
+		deployment.EXPECT().Delete(NewRawDataMatcher(rawData)).Return(&Result{Message: "delete deployment success"}).Times(1)
 		service.EXPECT().Apply(gomock.Any()).Times(0)
 		service.EXPECT().Delete(gomock.Any()).Times(0)
 		configmap.EXPECT().Apply(gomock.Any()).Times(0)
@@ -183,7 +193,7 @@ func TestService(t *testing.T) {
 		token.EXPECT().Wait().Return(false)
 		deployment.EXPECT().Apply(gomock.Any()).Times(0)
 		deployment.EXPECT().Delete(gomock.Any()).Times(0)
-		service.EXPECT().Apply(NewRawDataMatcher(rawData)).Return("apply service success").Times(1)
+		service.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(&Result{Message: "apply service success"}).Times(1)
 		service.EXPECT().Delete(gomock.Any()).Times(0)
 		configmap.EXPECT().Apply(gomock.Any()).Times(0)
 		configmap.EXPECT().Delete(gomock.Any()).Times(0)
@@ -200,7 +210,7 @@ func TestService(t *testing.T) {
 		deployment.EXPECT().Apply(gomock.Any()).Times(0)
 		deployment.EXPECT().Delete(gomock.Any()).Times(0)
 		service.EXPECT().Apply(gomock.Any()).Times(0)
-		service.EXPECT().Delete(NewRawDataMatcher(rawData)).Return("delete service success").Times(1)
+		service.EXPECT().Delete(NewRawDataMatcher(rawData)).Return(&Result{Message: "delete service success"}).Times(1)
 		configmap.EXPECT().Apply(gomock.Any()).Times(0)
 		configmap.EXPECT().Delete(gomock.Any()).Times(0)
 		secret.EXPECT().Apply(gomock.Any()).Times(0)
@@ -224,7 +234,7 @@ func TestConfigmap(t *testing.T) {
 		deployment.EXPECT().Delete(gomock.Any()).Times(0)
 		service.EXPECT().Apply(gomock.Any()).Times(0)
 		service.EXPECT().Delete(gomock.Any()).Times(0)
-		configmap.EXPECT().Apply(NewRawDataMatcher(rawData)).Return("apply configmap success").Times(1)
+		configmap.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(&Result{Message: "apply configmap success"}).Times(1)
 		configmap.EXPECT().Delete(gomock.Any()).Times(0)
 		secret.EXPECT().Apply(gomock.Any()).Times(0)
 		secret.EXPECT().Delete(gomock.Any()).Times(0)
@@ -241,7 +251,7 @@ func TestConfigmap(t *testing.T) {
 		service.EXPECT().Apply(gomock.Any()).Times(0)
 		service.EXPECT().Delete(gomock.Any()).Times(0)
 		configmap.EXPECT().Apply(gomock.Any()).Times(0)
-		configmap.EXPECT().Delete(NewRawDataMatcher(rawData)).Return("delete configmap success").Times(1)
+		configmap.EXPECT().Delete(NewRawDataMatcher(rawData)).Return(&Result{Message: "delete configmap success"}).Times(1)
 		secret.EXPECT().Apply(gomock.Any()).Times(0)
 		secret.EXPECT().Delete(gomock.Any()).Times(0)
 
@@ -265,7 +275,7 @@ func TestSecret(t *testing.T) {
 		service.EXPECT().Delete(gomock.Any()).Times(0)
 		configmap.EXPECT().Apply(gomock.Any()).Times(0)
 		configmap.EXPECT().Delete(gomock.Any()).Times(0)
-		secret.EXPECT().Apply(NewRawDataMatcher(rawData)).Return("apply secret success").Times(1)
+		secret.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(&Result{Message: "apply secret success"}).Times(1)
 		secret.EXPECT().Delete(gomock.Any()).Times(0)
 
 		messageHandler.Command()(client, message)
@@ -282,7 +292,7 @@ func TestSecret(t *testing.T) {
 		configmap.EXPECT().Apply(gomock.Any()).Times(0)
 		configmap.EXPECT().Delete(gomock.Any()).Times(0)
 		secret.EXPECT().Apply(gomock.Any()).Times(0)
-		secret.EXPECT().Delete(NewRawDataMatcher(rawData)).Return("delete secret success").Times(1)
+		secret.EXPECT().Delete(NewRawDataMatcher(rawData)).Return(&Result{Message: "delete secret success"}).Times(1)
 
 		messageHandler.Command()(client, message)
 	})
@@ -320,6 +330,918 @@ func TestUnknownType(t *testing.T) {
 	}
 }
 
+func TestDynamic(t *testing.T) {
+	messageHandler, deployment, service, configmap, secret, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	dynamic := NewMockHandlerInf(ctrl)
+	messageHandler.dynamic = dynamic
+	messageHandler.allowedKinds = map[schema.GroupVersionKind]bool{
+		{Group: "apps", Version: "v1", Kind: "StatefulSet"}:         true,
+		{Group: "example.com", Version: "v1alpha1", Kind: "Sensor"}: true,
+	}
+
+	fixtureCases := []struct {
+		fixture string
+		kind    string
+		name    string
+	}{
+		{fixture: "../testdata/statefulset.yaml", kind: "StatefulSet", name: "my-statefulset"},
+		{fixture: "../testdata/customresource.yaml", kind: "Sensor", name: "my-sensor"},
+	}
+	methodCases := []struct {
+		method string
+	}{
+		{method: "apply"},
+		{method: "delete"},
+	}
+
+	for _, fixtureCase := range fixtureCases {
+		for _, methodCase := range methodCases {
+			t.Run(fmt.Sprintf("fixture=%v, method=%v", fixtureCase.fixture, methodCase.method), func(t *testing.T) {
+				payload := getPayloadWithNamespace(t, fixtureCase.fixture, "")
+				matcher := NewRawDataMatcher(&unstructured.Unstructured{Object: map[string]interface{}{
+					"kind":     fixtureCase.kind,
+					"metadata": map[string]interface{}{"name": fixtureCase.name, "namespace": "default"},
+				}})
+
+				message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@%s|%s", methodCase.method, url.QueryEscape(string(payload)))))
+				client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, fmt.Sprintf("a@%s|%s dynamic success", methodCase.method, methodCase.method)).Return(token)
+				token.EXPECT().Wait().Return(false)
+				if methodCase.method == "apply" {
+					dynamic.EXPECT().Apply(matcher).Return(&Result{Message: "apply dynamic success"}).Times(1)
+					dynamic.EXPECT().Delete(gomock.Any()).Times(0)
+				} else {
+					dynamic.EXPECT().Apply(gomock.Any()).Times(0)
+					dynamic.EXPECT().Delete(matcher).Return(&Result{Message: "delete dynamic success"}).Times(1)
+				}
+				deployment.EXPECT().Apply(gomock.Any()).Times(0)
+				deployment.EXPECT().Delete(gomock.Any()).Times(0)
+				service.EXPECT().Apply(gomock.Any()).Times(0)
+				service.EXPECT().Delete(gomock.Any()).Times(0)
+				configmap.EXPECT().Apply(gomock.Any()).Times(0)
+				configmap.EXPECT().Delete(gomock.Any()).Times(0)
+				secret.EXPECT().Apply(gomock.Any()).Times(0)
+				secret.EXPECT().Delete(gomock.Any()).Times(0)
+
+				messageHandler.Command()(client, message)
+			})
+		}
+	}
+
+	t.Run("not allowed kind", func(t *testing.T) {
+		payload, _ := getPayloadFromFixture(t, "../testdata/namespace.yaml")
+
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s", url.QueryEscape(string(payload)))))
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@apply|unknown type, skip this message").Return(token)
+		token.EXPECT().Wait().Return(false)
+		dynamic.EXPECT().Apply(gomock.Any()).Times(0)
+		dynamic.EXPECT().Delete(gomock.Any()).Times(0)
+
+		messageHandler.Command()(client, message)
+	})
+
+	messageHandler.allowedKinds[schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}] = true
+	namespaceCases := []struct {
+		name   string
+		result string
+	}{
+		{name: "tenant-a", result: "a@delete|delete dynamic success"},
+		{name: "kube-system", result: "a@delete|namespace is not allowed -- kube-system"},
+	}
+	for _, c := range namespaceCases {
+		t.Run(fmt.Sprintf("namespace=%v", c.name), func(t *testing.T) {
+			payload := fmt.Sprintf(`{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"%s"}}`, c.name)
+
+			message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@delete|%s", url.QueryEscape(payload))))
+			client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, c.result).Return(token)
+			token.EXPECT().Wait().Return(false)
+			if c.name == "tenant-a" {
+				dynamic.EXPECT().Delete(gomock.Any()).Return(&Result{Message: "delete dynamic success"}).Times(1)
+			} else {
+				dynamic.EXPECT().Delete(gomock.Any()).Times(0)
+			}
+
+			messageHandler.Command()(client, message)
+		})
+	}
+}
+
+func TestServerSide(t *testing.T) {
+	messageHandler, deployment, service, configmap, secret, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	serverSide := NewMockServerSideHandlerInf(ctrl)
+	messageHandler.serverSide = serverSide
+
+	fixtureCases := []struct {
+		fixture string
+	}{
+		{fixture: "../testdata/deployment.yaml"},
+		{fixture: "../testdata/service.yaml"},
+		{fixture: "../testdata/configmap.yaml"},
+		{fixture: "../testdata/secret.yaml"},
+	}
+	paramCases := []struct {
+		params string
+		force  bool
+	}{
+		{params: "", force: false},
+		{params: "|force=false", force: false},
+		{params: "|force=true", force: true},
+	}
+
+	for _, fixtureCase := range fixtureCases {
+		for _, paramCase := range paramCases {
+			t.Run(fmt.Sprintf("fixture=%v, params=%v", fixtureCase.fixture, paramCase.params), func(t *testing.T) {
+				payload, rawData := getPayloadFromFixture(t, fixtureCase.fixture)
+
+				message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s%s", url.QueryEscape(string(payload)), paramCase.params)))
+				client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@apply|apply success").Return(token)
+				token.EXPECT().Wait().Return(false)
+				if paramCase.force {
+					serverSide.EXPECT().Apply(gomock.Any()).Times(0)
+					serverSide.EXPECT().ForceApply(NewRawDataMatcher(rawData)).Return(&Result{Message: "apply success"}).Times(1)
+				} else {
+					serverSide.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(&Result{Message: "apply success"}).Times(1)
+					serverSide.EXPECT().ForceApply(gomock.Any()).Times(0)
+				}
+				deployment.EXPECT().Apply(gomock.Any()).Times(0)
+				service.EXPECT().Apply(gomock.Any()).Times(0)
+				configmap.EXPECT().Apply(gomock.Any()).Times(0)
+				secret.EXPECT().Apply(gomock.Any()).Times(0)
+
+				messageHandler.Command()(client, message)
+			})
+		}
+	}
+
+	t.Run("delete", func(t *testing.T) {
+		payload, rawData := getPayloadFromFixture(t, "../testdata/deployment.yaml")
+
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@delete|%s|force=true", url.QueryEscape(string(payload)))))
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@delete|delete deployment success").Return(token)
+		token.EXPECT().Wait().Return(false)
+		serverSide.EXPECT().Apply(gomock.Any()).Times(0)
+		serverSide.EXPECT().ForceApply(gomock.Any()).Times(0)
+		deployment.EXPECT().Delete(NewRawDataMatcher(rawData)).Return(&Result{Message: "delete deployment success"}).Times(1)
+
+		messageHandler.Command()(client, message)
+	})
+}
+
+func TestDryRun(t *testing.T) {
+	messageHandler, deployment, service, _, _, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	payload, rawData := getPayloadFromFixture(t, "../testdata/deployment.yaml")
+	diff := "--- live/default/deployment/my-deployment\n+++ merged/default/deployment/my-deployment\n@@ -1 +1 @@\n-  replicas: 1\n+  replicas: 3\n"
+
+	t.Run("not enabled", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@dryrun|%s", url.QueryEscape(string(payload)))))
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@dryrun|dry run is not enabled").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+	})
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	dryRun := NewMockDryRunHandlerInf(ctrl)
+	messageHandler.dryRun = dryRun
+
+	t.Run("dryrun", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@dryrun|%s", url.QueryEscape(string(payload)))))
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@dryrun|update deployment (dry run) -- my-deployment").Return(token)
+		token.EXPECT().Wait().Return(false)
+		dryRun.EXPECT().DryRun(NewRawDataMatcher(rawData)).Return(&Result{Message: "update deployment (dry run) -- my-deployment"})
+		dryRun.EXPECT().Diff(gomock.Any()).Times(0)
+		deployment.EXPECT().Apply(gomock.Any()).Times(0)
+		service.EXPECT().Apply(gomock.Any()).Times(0)
+
+		messageHandler.Command()(client, message)
+	})
+
+	t.Run("diff", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@diff|%s", url.QueryEscape(string(payload)))))
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@diff|update deployment (dry run) -- my-deployment\n"+diff).Return(token)
+		token.EXPECT().Wait().Return(false)
+		dryRun.EXPECT().DryRun(gomock.Any()).Times(0)
+		dryRun.EXPECT().Diff(NewRawDataMatcher(rawData)).Return(&Result{Message: "update deployment (dry run) -- my-deployment", Diff: diff})
+		deployment.EXPECT().Apply(gomock.Any()).Times(0)
+
+		messageHandler.Command()(client, message)
+	})
+
+	t.Run("set", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@dryrun|%s|set=my-set", url.QueryEscape(string(payload)))))
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@dryrun|deployment is unchanged (dry run) -- my-deployment").Return(token)
+		token.EXPECT().Wait().Return(false)
+		dryRun.EXPECT().DryRun(gomock.Any()).DoAndReturn(func(rawData runtime.Object) *Result {
+			accessor, err := meta.Accessor(rawData)
+			assert.Nil(t, err)
+			assert.Equal(t, "my-set", accessor.GetLabels()[setLabel])
+			assert.NotContains(t, accessor.GetAnnotations(), generationAnnotation)
+			return &Result{Message: "deployment is unchanged (dry run) -- my-deployment"}
+		})
+
+		messageHandler.Command()(client, message)
+	})
+
+	t.Run("server side", func(t *testing.T) {
+		serverSide := NewMockServerSideHandlerInf(ctrl)
+		messageHandler.serverSide = serverSide
+		defer func() { messageHandler.serverSide = nil }()
+
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@diff|%s", url.QueryEscape(string(payload)))))
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@diff|deployment is unchanged (dry run) -- my-deployment").Return(token)
+		token.EXPECT().Wait().Return(false)
+		serverSide.EXPECT().Diff(NewRawDataMatcher(rawData)).Return(&Result{Message: "deployment is unchanged (dry run) -- my-deployment"})
+		serverSide.EXPECT().Apply(gomock.Any()).Times(0)
+		dryRun.EXPECT().Diff(gomock.Any()).Times(0)
+
+		messageHandler.Command()(client, message)
+	})
+}
+
+func TestLogs(t *testing.T) {
+	assert := assert.New(t)
+	messageHandler, _, _, _, _, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	logs := NewMockLogsHandlerInf(ctrl)
+	messageHandler.logs = logs
+	messageHandler.maxLogPayloadSize = 52
+	messageHandler.logTailLines = defaultLogTailLines
+	messageHandler.maxLogBytes = defaultMaxLogBytes
+	var limitBytes int64 = 1024 * 1024
+	var defaultTailLines int64 = 1000
+
+	assert.Equal("/dType/dID/logs", messageHandler.GetLogsTopic())
+	assert.NotNil(messageHandler.SetMaxLogPayloadSize(0))
+	assert.NotNil(messageHandler.SetLogLimits(0, 1024))
+	assert.NotNil(messageHandler.SetLogLimits(100, 0))
+
+	t.Run("logs", func(t *testing.T) {
+		var tailLines int64 = 3
+		var sinceSeconds int64 = 60
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@logs|%s|container=app|tailLines=3|sinceSeconds=60|namespace=tenant-a", url.QueryEscape("deployment/my-deployment"))))
+		logs.EXPECT().Logs("tenant-a", "deployment/my-deployment", &apiv1.PodLogOptions{Container: "app", TailLines: &tailLines, SinceSeconds: &sinceSeconds, LimitBytes: &limitBytes}).Return([]*PodLogs{
+			{Namespace: "tenant-a", Pod: "my-pod-1", Container: "app", Data: []byte("line1\nline2\nline3\n")},
+			{Namespace: "tenant-a", Pod: "my-pod-2", Container: "app", Result: &Result{Outcome: OutcomeError, Message: "get logs err -- my-pod-2/app"}},
+		}, nil)
+		gomock.InOrder(
+			client.EXPECT().Publish("/dType/dID/logs", byte(0), false, "a@logs|tenant-a/my-pod-1/app|1/2|line1\nline2\n").Return(token),
+			client.EXPECT().Publish("/dType/dID/logs", byte(0), false, "a@logs|tenant-a/my-pod-1/app|2/2|line3\n").Return(token),
+			client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@logs|logs my-pod-1/app -- 18 bytes in 2 chunks; get logs err -- my-pod-2/app").Return(token),
+		)
+		token.EXPECT().Wait().Return(false).Times(3)
+
+		messageHandler.Command()(client, message)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte("a@logs|my-pod"))
+		logs.EXPECT().Logs("default", "my-pod", &apiv1.PodLogOptions{TailLines: &defaultTailLines, LimitBytes: &limitBytes}).Return(nil, &Result{Outcome: OutcomeError, Message: "get pod err -- my-pod"})
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@logs|get pod err -- my-pod").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		assert.Nil(messageHandler.SetLogLimits(100, 2048))
+		defer messageHandler.SetLogLimits(defaultLogTailLines, defaultMaxLogBytes)
+		var tailLines int64 = 100
+		var limitBytes int64 = 2048
+		message.EXPECT().Payload().Return([]byte("a@logs|my-pod"))
+		logs.EXPECT().Logs("default", "my-pod", &apiv1.PodLogOptions{TailLines: &tailLines, LimitBytes: &limitBytes}).Return(nil, &Result{Outcome: OutcomeError, Message: "get pod err -- my-pod"})
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@logs|get pod err -- my-pod").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+	})
+
+	errorCases := []struct {
+		payload string
+		result  string
+	}{
+		{payload: "a@logs|my-pod|namespace=kube-system", result: "a@logs|namespace is not allowed -- kube-system"},
+		{payload: "a@logs|my-pod|tailLines=all", result: "a@logs|invalid parameter -- tailLines"},
+		{payload: "a@logs|my-pod|sinceSeconds=1m", result: "a@logs|invalid parameter -- sinceSeconds"},
+	}
+	for _, c := range errorCases {
+		t.Run(c.payload, func(t *testing.T) {
+			message.EXPECT().Payload().Return([]byte(c.payload))
+			logs.EXPECT().Logs(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+			client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, c.result).Return(token)
+			token.EXPECT().Wait().Return(false)
+
+			messageHandler.Command()(client, message)
+		})
+	}
+}
+
+func TestRollout(t *testing.T) {
+	messageHandler, _, _, _, _, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rollout := NewMockRolloutHandlerInf(ctrl)
+	messageHandler.rollout = rollout
+
+	testCases := []struct {
+		payload string
+		setUp   func()
+		result  string
+	}{
+		{payload: "a@scale|my-deployment|replicas=3", setUp: func() {
+			rollout.EXPECT().Scale("default", "my-deployment", int32(3)).Return(&Result{Outcome: OutcomeUpdated, Message: "scale deployment to 3 -- my-deployment"})
+		}, result: "a@scale|scale deployment to 3 -- my-deployment"},
+		{payload: "a@scale|my-deployment|replicas=0|namespace=tenant-a", setUp: func() {
+			rollout.EXPECT().Scale("tenant-a", "my-deployment", int32(0)).Return(&Result{Outcome: OutcomeUpdated, Message: "scale deployment to 0 -- my-deployment"})
+		}, result: "a@scale|scale deployment to 0 -- my-deployment"},
+		{payload: "a@restart|my-deployment", setUp: func() {
+			rollout.EXPECT().Restart("default", "my-deployment").Return(&Result{Outcome: OutcomeUpdated, Message: "restart deployment -- my-deployment"})
+		}, result: "a@restart|restart deployment -- my-deployment"},
+		{payload: "a@pause|my-deployment", setUp: func() {
+			rollout.EXPECT().Pause("default", "my-deployment").Return(&Result{Outcome: OutcomeUpdated, Message: "pause deployment -- my-deployment"})
+		}, result: "a@pause|pause deployment -- my-deployment"},
+		{payload: "a@resume|my-deployment", setUp: func() {
+			rollout.EXPECT().Resume("default", "my-deployment").Return(&Result{Outcome: OutcomeUnchanged, Message: "deployment is already resumed -- my-deployment"})
+		}, result: "a@resume|deployment is already resumed -- my-deployment"},
+		{payload: "a@rollback|my-deployment", setUp: func() {
+			rollout.EXPECT().Rollback("default", "my-deployment", int64(0)).Return(&Result{Outcome: OutcomeUpdated, Message: "rollback deployment to revision 2 -- my-deployment"})
+		}, result: "a@rollback|rollback deployment to revision 2 -- my-deployment"},
+		{payload: "a@rollback|my-deployment|revision=1", setUp: func() {
+			rollout.EXPECT().Rollback("default", "my-deployment", int64(1)).Return(&Result{Outcome: OutcomeUpdated, Message: "rollback deployment to revision 1 -- my-deployment"})
+		}, result: "a@rollback|rollback deployment to revision 1 -- my-deployment"},
+		{payload: "a@scale|my-deployment", result: "a@scale|invalid parameter -- replicas"},
+		{payload: "a@scale|my-deployment|replicas=-1", result: "a@scale|invalid parameter -- replicas"},
+		{payload: "a@scale|my-deployment|replicas=2147483648", result: "a@scale|invalid parameter -- replicas"},
+		{payload: "a@rollback|my-deployment|revision=last", result: "a@rollback|invalid parameter -- revision"},
+		{payload: "a@restart|my-deployment|namespace=kube-system", result: "a@restart|namespace is not allowed -- kube-system"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.payload, func(t *testing.T) {
+			message.EXPECT().Payload().Return([]byte(c.payload))
+			if c.setUp != nil {
+				c.setUp()
+			}
+			client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, c.result).Return(token)
+			token.EXPECT().Wait().Return(false)
+
+			messageHandler.Command()(client, message)
+		})
+	}
+}
+
+func TestWait(t *testing.T) {
+	assert := assert.New(t)
+	messageHandler, deployment, _, _, _, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rollout := NewMockRolloutHandlerInf(ctrl)
+	messageHandler.rollout = rollout
+	messageHandler.waitTimeout = defaultWaitTimeout
+
+	assert.NotNil(messageHandler.SetWaitTimeout(0))
+
+	payload, rawData := getPayloadFromFixture(t, "../testdata/deployment.yaml")
+	updated := &Result{Kind: "Deployment", Namespace: "default", Name: "my-deployment", Outcome: OutcomeUpdated, Message: "update deployment -- my-deployment"}
+
+	t.Run("apply", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s|wait=true", url.QueryEscape(string(payload)))))
+		deployment.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(updated)
+		rollout.EXPECT().Wait("default", "my-deployment", gomock.Any(), gomock.Any()).DoAndReturn(func(namespace string, name string, timeout time.Duration, progress func(string)) *Result {
+			assert.True(timeout > defaultWaitTimeout-time.Second && timeout <= defaultWaitTimeout)
+			progress("1 out of 3 new replicas have been updated -- my-deployment")
+			progress("2 of 3 updated replicas are available -- my-deployment")
+			return &Result{Outcome: OutcomeReady, Message: "deployment successfully rolled out -- my-deployment"}
+		})
+		gomock.InOrder(
+			client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@apply|1 out of 3 new replicas have been updated -- my-deployment").Return(token),
+			client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@apply|2 of 3 updated replicas are available -- my-deployment").Return(token),
+			client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@apply|update deployment -- my-deployment; deployment successfully rolled out -- my-deployment").Return(token),
+		)
+		token.EXPECT().Wait().Return(false).Times(3)
+
+		messageHandler.Command()(client, message)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte("a@restart|my-deployment|wait|timeout=30"))
+		rollout.EXPECT().Restart("default", "my-deployment").Return(updated)
+		rollout.EXPECT().Wait("default", "my-deployment", gomock.Any(), gomock.Any()).DoAndReturn(func(namespace string, name string, timeout time.Duration, progress func(string)) *Result {
+			assert.True(timeout > 29*time.Second && timeout <= 30*time.Second)
+			return &Result{Outcome: OutcomeError, Reason: "ProgressDeadlineExceeded", Message: "deployment exceeded its progress deadline -- my-deployment"}
+		})
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@restart|update deployment -- my-deployment; deployment exceeded its progress deadline -- my-deployment").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte("a@rollback|my-deployment|wait=true"))
+		rollout.EXPECT().Rollback("default", "my-deployment", int64(0)).Return(&Result{Kind: "Deployment", Namespace: "default", Name: "my-deployment", Outcome: OutcomeNotFound, Message: "no previous revision of deployment -- my-deployment"})
+		rollout.EXPECT().Wait(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@rollback|no previous revision of deployment -- my-deployment").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+	})
+
+	t.Run("not waitable", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte("a@pause|my-deployment|wait=true"))
+		rollout.EXPECT().Pause("default", "my-deployment").Return(&Result{Kind: "Deployment", Namespace: "default", Name: "my-deployment", Outcome: OutcomeUpdated, Message: "pause deployment -- my-deployment"})
+		rollout.EXPECT().Wait(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@pause|pause deployment -- my-deployment").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+	})
+
+	for _, timeout := range []string{"0", "-1", "1m"} {
+		t.Run(fmt.Sprintf("timeout=%s", timeout), func(t *testing.T) {
+			message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@scale|my-deployment|replicas=3|wait=true|timeout=%s", timeout)))
+			rollout.EXPECT().Scale(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+			client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@scale|invalid parameter -- timeout").Return(token)
+			token.EXPECT().Wait().Return(false)
+
+			messageHandler.Command()(client, message)
+		})
+	}
+}
+
+func TestAutoRollback(t *testing.T) {
+	assert := assert.New(t)
+	messageHandler, deployment, _, _, _, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rollout := NewMockRolloutHandlerInf(ctrl)
+	messageHandler.rollout = rollout
+	messageHandler.waitTimeout = defaultWaitTimeout
+
+	assert.NotNil(messageHandler.EnableAutoRollback(0))
+	assert.Nil(messageHandler.EnableAutoRollback(60))
+
+	payload, rawData := getPayloadFromFixture(t, "../testdata/deployment.yaml")
+	previous := rawData.(*appsv1.Deployment).DeepCopy()
+	updated := func() *Result {
+		result := newResult("Deployment", "default", "my-deployment", OutcomeUpdated, "update deployment -- my-deployment")
+		result.previous = previous
+		return result
+	}
+	waitReturns := func(result *Result) func(string, string, time.Duration, func(string)) *Result {
+		return func(namespace string, name string, timeout time.Duration, progress func(string)) *Result {
+			// the deployment is not locked while waiting, so that the reconciler and the other commands can operate it
+			messageHandler.locks.lock([]string{"default_Deployment.apps_my-deployment"})()
+			progress("1 out of 3 new replicas have been updated -- my-deployment")
+			return result
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		params   string
+		applied  *Result
+		waited   *Result
+		restore  bool
+		payloads []string
+	}{
+		{
+			name:    "rolled out",
+			applied: updated(),
+			waited:  &Result{Outcome: OutcomeReady, Message: "deployment successfully rolled out -- my-deployment"},
+			payloads: []string{
+				"a@apply|update deployment -- my-deployment; deployment successfully rolled out -- my-deployment",
+			},
+		},
+		{
+			name:    "progress deadline exceeded",
+			applied: updated(),
+			waited:  &Result{Outcome: OutcomeError, Reason: "ProgressDeadlineExceeded", Message: "deployment exceeded its progress deadline -- my-deployment"},
+			restore: true,
+			payloads: []string{
+				"a@apply|update deployment -- my-deployment; deployment exceeded its progress deadline -- my-deployment; rollback deployment to the previously applied spec -- my-deployment",
+			},
+		},
+		{
+			name:    "timeout with wait",
+			params:  "|wait=true|timeout=10",
+			applied: updated(),
+			waited:  &Result{Outcome: OutcomeError, Reason: "Timeout", Message: "timed out waiting for the rollout of deployment -- my-deployment"},
+			restore: true,
+			payloads: []string{
+				"a@apply|1 out of 3 new replicas have been updated -- my-deployment",
+				"a@apply|update deployment -- my-deployment; timed out waiting for the rollout of deployment -- my-deployment; rollback deployment to the previously applied spec -- my-deployment",
+			},
+		},
+		{
+			name:    "watch failure",
+			applied: updated(),
+			waited:  &Result{Outcome: OutcomeError, Reason: "Forbidden", Message: "watch deployment err -- my-deployment"},
+			payloads: []string{
+				"a@apply|update deployment -- my-deployment; watch deployment err -- my-deployment",
+			},
+		},
+		{
+			name:     "created",
+			applied:  newResult("Deployment", "default", "my-deployment", OutcomeCreated, "create deployment -- my-deployment"),
+			payloads: []string{"a@apply|create deployment -- my-deployment"},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s%s", url.QueryEscape(string(payload)), c.params)))
+			deployment.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(c.applied)
+			if c.waited != nil {
+				rollout.EXPECT().Wait("default", "my-deployment", 60*time.Second, gomock.Any()).DoAndReturn(waitReturns(c.waited))
+			} else {
+				rollout.EXPECT().Wait(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+			}
+			if c.restore {
+				rollout.EXPECT().Restore(previous).Return(&Result{Outcome: OutcomeUpdated, Message: "rollback deployment to the previously applied spec -- my-deployment"})
+			} else {
+				rollout.EXPECT().Restore(gomock.Any()).Times(0)
+			}
+			calls := []*gomock.Call{}
+			for _, payload := range c.payloads {
+				calls = append(calls, client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, payload).Return(token))
+			}
+			gomock.InOrder(calls...)
+			token.EXPECT().Wait().Return(false).Times(len(c.payloads))
+
+			messageHandler.Command()(client, message)
+		})
+	}
+}
+
+func TestAutoRollbackServerSide(t *testing.T) {
+	assert := assert.New(t)
+	messageHandler, _, _, _, _, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rollout := NewMockRolloutHandlerInf(ctrl)
+	messageHandler.rollout = rollout
+	serverSide, resource, rawData, name, tearDownServerSide := setUpServerSideHandler(t)
+	defer tearDownServerSide()
+	messageHandler.serverSide = serverSide
+	assert.Nil(messageHandler.EnableAutoRollback(60))
+
+	current, err := toUnstructured(rawData.DeepCopyObject())
+	assert.Nil(err)
+	current.SetResourceVersion("1")
+	applied := current.DeepCopy()
+	applied.SetResourceVersion("2")
+	resource.EXPECT().Get(name, metav1.GetOptions{}).Return(current, nil)
+	resource.EXPECT().Patch(name, types.ApplyPatchType, gomock.Any(), gomock.Any()).Return(applied, nil)
+
+	payload, _ := getPayloadFromFixture(t, "../testdata/deployment.yaml")
+	message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s", url.QueryEscape(string(payload)))))
+	rollout.EXPECT().Wait("default", name, 60*time.Second, gomock.Any()).Return(&Result{Outcome: OutcomeError, Reason: "ProgressDeadlineExceeded", Message: "deployment exceeded its progress deadline -- my-deployment"})
+	rollout.EXPECT().Restore(gomock.Any()).DoAndReturn(func(previous *appsv1.Deployment) *Result {
+		assert.Equal(name, previous.ObjectMeta.Name)
+		assert.Equal("default", previous.ObjectMeta.Namespace)
+		assert.Equal("1", previous.ObjectMeta.ResourceVersion)
+		return &Result{Outcome: OutcomeUpdated, Message: "rollback deployment to the previously applied spec -- my-deployment"}
+	})
+	client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@apply|apply deployment -- my-deployment; deployment exceeded its progress deadline -- my-deployment; rollback deployment to the previously applied spec -- my-deployment").Return(token)
+	token.EXPECT().Wait().Return(false)
+
+	messageHandler.Command()(client, message)
+}
+
+func TestCommandDedup(t *testing.T) {
+	assert := assert.New(t)
+	messageHandler, deployment, _, _, _, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	assert.NotNil(messageHandler.EnableCommandDedup(0, 10, ""))
+	assert.NotNil(messageHandler.EnableCommandDedup(60, 0, ""))
+	assert.Nil(messageHandler.EnableCommandDedup(60, 10, ""))
+
+	payload, rawData := getPayloadFromFixture(t, "../testdata/deployment.yaml")
+	body := url.QueryEscape(string(payload))
+
+	t.Run("first", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s", body)))
+		deployment.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(&Result{Message: "create deployment -- my-deployment"})
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@apply|create deployment -- my-deployment").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+	})
+	t.Run("duplicated", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s", body)))
+		deployment.EXPECT().Apply(gomock.Any()).Times(0)
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@apply|create deployment -- my-deployment").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+	})
+	t.Run("another", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("b@apply|%s", body)))
+		deployment.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(&Result{Message: "update deployment -- my-deployment"})
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "b@apply|update deployment -- my-deployment").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+	})
+}
+
+func TestWorkerPool(t *testing.T) {
+	assert := assert.New(t)
+	messageHandler, deployment, _, _, _, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	assert.NotNil(messageHandler.EnableWorkerPool(0, 10))
+	assert.NotNil(messageHandler.EnableWorkerPool(4, 0))
+	assert.NotNil(messageHandler.SetPublishDelay(-1))
+	assert.Nil(messageHandler.SetPublishDelay(0))
+
+	payload, rawData := getPayloadFromFixture(t, "../testdata/deployment.yaml")
+	body := url.QueryEscape(string(payload))
+
+	t.Run("processed", func(t *testing.T) {
+		assert.Nil(messageHandler.EnableWorkerPool(4, 10))
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s", body)))
+		deployment.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(&Result{Message: "create deployment -- my-deployment"})
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@apply|create deployment -- my-deployment").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+		messageHandler.StopWorkers()
+	})
+	t.Run("queue is full", func(t *testing.T) {
+		// no worker takes the queued command
+		messageHandler.workers = newWorkerPool(0, 1)
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s", body)))
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("b@apply|%s", body)))
+		deployment.EXPECT().Apply(gomock.Any()).Times(0)
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "b@apply|command queue is full, retry later").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+		messageHandler.Command()(client, message)
+	})
+}
+
+func TestCommandKeys(t *testing.T) {
+	messageHandler, _, _, _, _, _, _, _, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	bundle, err := ioutil.ReadFile("../testdata/bundle.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		action string
+		body   string
+		params commandParams
+		keys   []string
+	}{
+		{action: "apply", body: url.QueryEscape(string(bundle)), params: commandParams{"set": "my-set"}, keys: []string{"set/my-set", "default_Deployment.apps_my-deployment", "default_Service_my-service", "default_ConfigMap_my-configmap"}},
+		{action: "delete", body: url.QueryEscape(string(bundle)), params: commandParams{"set": "my-set"}, keys: []string{"default_Deployment.apps_my-deployment", "default_Service_my-service", "default_ConfigMap_my-configmap"}},
+		{action: "apply", body: "invalid", params: commandParams{}, keys: []string{}},
+		{action: "prune", body: "my-set", params: commandParams{}, keys: []string{"set/my-set"}},
+		{action: "scale", body: "my-deployment", params: commandParams{"namespace": "tenant-a"}, keys: []string{"tenant-a_Deployment.apps_my-deployment"}},
+		{action: "logs", body: "my-pod", params: commandParams{}, keys: []string{}},
+		{action: "apply", body: "%zz", params: commandParams{}, keys: []string{}},
+	}
+
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("%s|%s", c.action, c.params), func(t *testing.T) {
+			assert.Equal(t, c.keys, messageHandler.commandKeys(c.action, c.body, c.params))
+		})
+	}
+}
+
+func TestResultFormat(t *testing.T) {
+	messageHandler, deployment, _, _, _, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	assert.NotNil(t, messageHandler.SetResultFormat("xml"))
+	assert.Nil(t, messageHandler.SetResultFormat("json"))
+
+	payload, rawData := getPayloadFromFixture(t, "../testdata/deployment.yaml")
+
+	t.Run("apply", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s", url.QueryEscape(string(payload)))))
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, gomock.Any()).DoAndReturn(func(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+			result := CommandResult{}
+			assert.Nil(t, json.Unmarshal([]byte(payload.(string)), &result))
+			assert.Equal(t, "a", result.CommandID)
+			assert.Equal(t, "apply", result.Action)
+			assert.Equal(t, []*Result{{Kind: "Deployment", Namespace: "default", Name: "my-deployment", Outcome: OutcomeCreated, ResourceVersion: "1", Message: "create deployment -- my-deployment"}}, result.Results)
+			assert.False(t, result.StartedAt.IsZero())
+			return token
+		})
+		token.EXPECT().Wait().Return(false)
+		deployment.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(newResult("Deployment", "default", "my-deployment", OutcomeCreated, "create deployment -- my-deployment").setResourceVersion("1"))
+
+		messageHandler.Command()(client, message)
+	})
+
+	t.Run("invalid payload", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte("invalid"))
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, gomock.Any()).DoAndReturn(func(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+			m := map[string]interface{}{}
+			assert.Nil(t, json.Unmarshal([]byte(payload.(string)), &m))
+			assert.NotContains(t, m, "cmdId")
+			assert.Equal(t, []interface{}{map[string]interface{}{"outcome": "error", "message": "invalid payload"}}, m["results"])
+			return token
+		})
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+	})
+}
+
+func TestResultQoS(t *testing.T) {
+	messageHandler, deployment, _, _, _, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	assert.NotNil(t, messageHandler.SetResultQoS(-1))
+	assert.NotNil(t, messageHandler.SetResultQoS(3))
+	assert.Nil(t, messageHandler.SetResultQoS(1))
+
+	payload, rawData := getPayloadFromFixture(t, "../testdata/deployment.yaml")
+
+	message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s", url.QueryEscape(string(payload)))))
+	deployment.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(newResult("Deployment", "default", "my-deployment", OutcomeCreated, "create deployment -- my-deployment"))
+	client.EXPECT().Publish("/dType/dID/cmdexe", byte(1), false, "a@apply|create deployment -- my-deployment").Return(token)
+	token.EXPECT().Wait().Return(false)
+
+	messageHandler.Command()(client, message)
+}
+
+func TestParseGroupVersionKind(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		kind     string
+		expected schema.GroupVersionKind
+		hasErr   bool
+	}{
+		{kind: "apps/v1/StatefulSet", expected: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"}},
+		{kind: "v1/PersistentVolumeClaim", expected: schema.GroupVersionKind{Version: "v1", Kind: "PersistentVolumeClaim"}},
+		{kind: "example.com/v1alpha1/Sensor", expected: schema.GroupVersionKind{Group: "example.com", Version: "v1alpha1", Kind: "Sensor"}},
+		{kind: "StatefulSet", hasErr: true},
+		{kind: "apps/v1/", hasErr: true},
+		{kind: "a/b/c/Kind", hasErr: true},
+	}
+
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("kind=%v", c.kind), func(t *testing.T) {
+			gvk, err := parseGroupVersionKind(c.kind)
+			if c.hasErr {
+				assert.NotNil(err)
+			} else {
+				assert.Nil(err)
+				assert.Equal(c.expected, gvk)
+			}
+		})
+	}
+}
+
+func TestBundle(t *testing.T) {
+	messageHandler, deployment, service, configmap, secret, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	payload, err := ioutil.ReadFile("../testdata/bundle.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, deploymentData := getPayloadFromFixture(t, "../testdata/deployment.yaml")
+	_, serviceData := getPayloadFromFixture(t, "../testdata/service.yaml")
+	_, configmapData := getPayloadFromFixture(t, "../testdata/configmap.yaml")
+
+	t.Run("apply", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s", url.QueryEscape(string(payload)))))
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@apply|apply configmap success; apply service success; apply deployment success").Return(token)
+		token.EXPECT().Wait().Return(false)
+		gomock.InOrder(
+			configmap.EXPECT().Apply(NewRawDataMatcher(configmapData)).Return(&Result{Message: "apply configmap success"}),
+			service.EXPECT().Apply(NewRawDataMatcher(serviceData)).Return(&Result{Message: "apply service success"}),
+			deployment.EXPECT().Apply(NewRawDataMatcher(deploymentData)).Return(&Result{Message: "apply deployment success"}),
+		)
+		secret.EXPECT().Apply(gomock.Any()).Times(0)
+
+		messageHandler.Command()(client, message)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@delete|%s", url.QueryEscape(string(payload)))))
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@delete|delete deployment success; delete service success; delete configmap success").Return(token)
+		token.EXPECT().Wait().Return(false)
+		gomock.InOrder(
+			deployment.EXPECT().Delete(NewRawDataMatcher(deploymentData)).Return(&Result{Message: "delete deployment success"}),
+			service.EXPECT().Delete(NewRawDataMatcher(serviceData)).Return(&Result{Message: "delete service success"}),
+			configmap.EXPECT().Delete(NewRawDataMatcher(configmapData)).Return(&Result{Message: "delete configmap success"}),
+		)
+		secret.EXPECT().Delete(gomock.Any()).Times(0)
+
+		messageHandler.Command()(client, message)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		payload, err := ioutil.ReadFile("../testdata/list.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, secretData := getPayloadFromFixture(t, "../testdata/secret.yaml")
+
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s", url.QueryEscape(string(payload)))))
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@apply|unknown type, skip this message; apply secret success; unknown type, skip this message").Return(token)
+		token.EXPECT().Wait().Return(false)
+		secret.EXPECT().Apply(NewRawDataMatcher(secretData)).Return(&Result{Message: "apply secret success"})
+
+		messageHandler.Command()(client, message)
+	})
+}
+
+func TestNamespace(t *testing.T) {
+	messageHandler, deployment, service, configmap, secret, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	namespaceCases := []struct {
+		namespace string
+		applied   string
+		result    string
+	}{
+		{namespace: "", applied: "default", result: "a@apply|apply deployment success"},
+		{namespace: "default", applied: "default", result: "a@apply|apply deployment success"},
+		{namespace: "tenant-a", applied: "tenant-a", result: "a@apply|apply deployment success"},
+		{namespace: "kube-system", applied: "", result: "a@apply|namespace is not allowed -- kube-system"},
+	}
+
+	for _, c := range namespaceCases {
+		t.Run(fmt.Sprintf("namespace=%v", c.namespace), func(t *testing.T) {
+			payload := getPayloadWithNamespace(t, "../testdata/deployment.yaml", c.namespace)
+
+			message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s", url.QueryEscape(string(payload)))))
+			client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, c.result).Return(token)
+			token.EXPECT().Wait().Return(false)
+			if c.applied != "" {
+				deployment.EXPECT().Apply(gomock.Any()).DoAndReturn(func(rawData runtime.Object) *Result {
+					assert.Equal(t, c.applied, rawData.(*appsv1.Deployment).ObjectMeta.Namespace)
+					return &Result{Message: "apply deployment success"}
+				}).Times(1)
+			} else {
+				deployment.EXPECT().Apply(gomock.Any()).Times(0)
+			}
+			deployment.EXPECT().Delete(gomock.Any()).Times(0)
+			service.EXPECT().Apply(gomock.Any()).Times(0)
+			service.EXPECT().Delete(gomock.Any()).Times(0)
+			configmap.EXPECT().Apply(gomock.Any()).Times(0)
+			configmap.EXPECT().Delete(gomock.Any()).Times(0)
+			secret.EXPECT().Apply(gomock.Any()).Times(0)
+			secret.EXPECT().Delete(gomock.Any()).Times(0)
+
+			messageHandler.Command()(client, message)
+		})
+	}
+}
+
+func getPayloadWithNamespace(t *testing.T, filepath string, namespace string) []byte {
+	yamlbytes, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := make(map[string]interface{})
+	err = yaml.Unmarshal(yamlbytes, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if namespace != "" {
+		m["metadata"].(map[string]interface{})["namespace"] = namespace
+	}
+	jstr, err := json.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jstr
+}
+
 func getPayloadFromFixture(t *testing.T, filepath string) ([]byte, runtime.Object) {
 	yamlbytes, err := ioutil.ReadFile(filepath)
 	if err != nil {
@@ -392,6 +1314,15 @@ func (m *rawDataMatcher) Matches(x interface{}) bool {
 			return false
 		}
 		return true
+	case *unstructured.Unstructured:
+		d2, ok := x.(*unstructured.Unstructured)
+		if !ok {
+			return false
+		}
+		if d1.GetKind() != d2.GetKind() || d1.GetName() != d2.GetName() || d1.GetNamespace() != d2.GetNamespace() {
+			return false
+		}
+		return true
 	default:
 		return false
 	}
@@ -0,0 +1,51 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"sort"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+type namespacePolicy struct {
+	defaultNamespace string
+	allowed          map[string]bool
+}
+
+func newNamespacePolicy(defaultNamespace string, allowedNamespaces []string) *namespacePolicy {
+	if defaultNamespace == "" {
+		defaultNamespace = apiv1.NamespaceDefault
+	}
+	allowed := map[string]bool{defaultNamespace: true}
+	for _, namespace := range allowedNamespaces {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			allowed[namespace] = true
+		}
+	}
+	return &namespacePolicy{
+		defaultNamespace: defaultNamespace,
+		allowed:          allowed,
+	}
+}
+
+func (p *namespacePolicy) resolve(namespace string) (string, bool) {
+	if namespace == "" {
+		namespace = p.defaultNamespace
+	}
+	return namespace, p.allowed[namespace]
+}
+
+// list returns the allowed namespaces in alphabetical order.
+func (p *namespacePolicy) list() []string {
+	namespaces := []string{}
+	for namespace := range p.allowed {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
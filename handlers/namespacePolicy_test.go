@@ -0,0 +1,50 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespacePolicyResolve(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		defaultNamespace string
+		allowed          []string
+		namespace        string
+		resolved         string
+		ok               bool
+	}{
+		{defaultNamespace: "", allowed: nil, namespace: "", resolved: "default", ok: true},
+		{defaultNamespace: "", allowed: nil, namespace: "default", resolved: "default", ok: true},
+		{defaultNamespace: "", allowed: nil, namespace: "kube-system", resolved: "kube-system", ok: false},
+		{defaultNamespace: "tenant-a", allowed: nil, namespace: "", resolved: "tenant-a", ok: true},
+		{defaultNamespace: "tenant-a", allowed: nil, namespace: "default", resolved: "default", ok: false},
+		{defaultNamespace: "default", allowed: []string{" tenant-a", "tenant-b ", ""}, namespace: "tenant-a", resolved: "tenant-a", ok: true},
+		{defaultNamespace: "default", allowed: []string{" tenant-a", "tenant-b ", ""}, namespace: "tenant-b", resolved: "tenant-b", ok: true},
+		{defaultNamespace: "default", allowed: []string{" tenant-a", "tenant-b ", ""}, namespace: "kube-system", resolved: "kube-system", ok: false},
+	}
+
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("default=%v, allowed=%v, namespace=%v", c.defaultNamespace, c.allowed, c.namespace), func(t *testing.T) {
+			policy := newNamespacePolicy(c.defaultNamespace, c.allowed)
+			resolved, ok := policy.resolve(c.namespace)
+			assert.Equal(c.resolved, resolved)
+			assert.Equal(c.ok, ok)
+		})
+	}
+}
+
+func TestNamespacePolicyList(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]string{"default"}, newNamespacePolicy("", nil).list())
+	assert.Equal([]string{"default", "tenant-a", "tenant-b"}, newNamespacePolicy("default", []string{"tenant-b", " tenant-a", "default"}).list())
+}
@@ -0,0 +1,199 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	managedByLabel         = "app.kubernetes.io/managed-by"
+	managedByValue         = "mqtt-kube-operator"
+	deviceIDLabel          = "mqtt-kube-operator/device-id"
+	setLabel               = "mqtt-kube-operator/set"
+	manifestHashAnnotation = "mqtt-kube-operator/manifest-hash"
+	generationAnnotation   = "mqtt-kube-operator/set-generation"
+)
+
+// prunableKinds are the kinds searched by the prune command in addition to the kinds allowed for the dynamic handler.
+var prunableKinds = []schema.GroupVersionKind{
+	{Group: "", Version: "v1", Kind: "Secret"},
+	{Group: "", Version: "v1", Kind: "ConfigMap"},
+	{Group: "", Version: "v1", Kind: "Service"},
+	{Group: "apps", Version: "v1", Kind: "Deployment"},
+}
+
+// stampOwnership labels rawData as managed by the device (and as a member of set if it is not empty),
+// and annotates it with the hash of its manifest, and with generation of the bundle applied to set if both are not empty.
+func stampOwnership(rawData runtime.Object, deviceID string, set string, generation string) error {
+	accessor, err := meta.Accessor(rawData)
+	if err != nil {
+		return err
+	}
+	annotations := accessor.GetAnnotations()
+	_, hashed := annotations[manifestHashAnnotation]
+	_, generated := annotations[generationAnnotation]
+	if hashed || generated {
+		// the previous stamp is not a part of the manifest
+		delete(annotations, manifestHashAnnotation)
+		delete(annotations, generationAnnotation)
+		if len(annotations) == 0 {
+			annotations = nil
+		}
+		accessor.SetAnnotations(annotations)
+	}
+	hash, err := manifestHash(rawData)
+	if err != nil {
+		return err
+	}
+
+	objectLabels := accessor.GetLabels()
+	if objectLabels == nil {
+		objectLabels = map[string]string{}
+	}
+	objectLabels[managedByLabel] = managedByValue
+	objectLabels[deviceIDLabel] = deviceID
+	if set != "" {
+		objectLabels[setLabel] = set
+	}
+	accessor.SetLabels(objectLabels)
+
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[manifestHashAnnotation] = hash
+	if set != "" && generation != "" {
+		annotations[generationAnnotation] = generation
+	}
+	accessor.SetAnnotations(annotations)
+	return nil
+}
+
+// newGeneration returns the generation of the bundle applied at appliedAt, which is greater than the ones applied before.
+func newGeneration(appliedAt time.Time) string {
+	return strconv.FormatInt(appliedAt.UnixNano(), 10)
+}
+
+// generationOf returns the generation of the bundle in which rawData was applied last, or 0 if it is unknown.
+func generationOf(rawData runtime.Object) int64 {
+	accessor, err := meta.Accessor(rawData)
+	if err != nil {
+		return 0
+	}
+	generation, err := strconv.ParseInt(accessor.GetAnnotations()[generationAnnotation], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return generation
+}
+
+// manifestHash returns the sha256 hash of the JSON representation of rawData.
+func manifestHash(rawData runtime.Object) (string, error) {
+	data, err := json.Marshal(rawData)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// ownershipSelector returns the label selector of the objects in set managed by the device.
+func ownershipSelector(deviceID string, set string) string {
+	return labels.SelectorFromSet(labels.Set{
+		managedByLabel: managedByValue,
+		deviceIDLabel:  deviceID,
+		setLabel:       set,
+	}).String()
+}
+
+// ownedOperations wraps operations to stamp the ownership on each object before operating it.
+func (h *MessageHandler) ownedOperations(operations map[handlerType]func(runtime.Object) *Result, set string, generation string) map[handlerType]func(runtime.Object) *Result {
+	owned := map[handlerType]func(runtime.Object) *Result{}
+	for t, operation := range operations {
+		operation := operation
+		owned[t] = func(rawData runtime.Object) *Result {
+			if err := stampOwnership(rawData, h.deviceID, set, generation); err != nil {
+				msg := "invalid format, skip this message"
+				h.logger.Infof("%s: %s", msg, err.Error())
+				return newErrorResult(msg)
+			}
+			return operation(rawData)
+		}
+	}
+	return owned
+}
+
+// pruneSet deletes the objects in set managed by the device which were not in the bundle applied last to set.
+// The objects in the bundle applied last are the ones annotated with the latest generation, so that they are found even after restarting.
+func (h *MessageHandler) pruneSet(set string) []*Result {
+	kinds := append([]schema.GroupVersionKind{}, prunableKinds...)
+	dynamicKinds := []schema.GroupVersionKind{}
+	for gvk := range h.allowedKinds {
+		dynamicKinds = append(dynamicKinds, gvk)
+	}
+	sort.Slice(dynamicKinds, func(i, j int) bool {
+		return dynamicKinds[i].String() < dynamicKinds[j].String()
+	})
+	kinds = append(kinds, dynamicKinds...)
+
+	results := []*Result{}
+	managed := []runtime.Object{}
+	selector := ownershipSelector(h.deviceID, set)
+	for _, gvk := range kinds {
+		objects, err := h.prune.List(gvk, h.namespaces.list(), selector)
+		if err != nil {
+			msg := fmt.Sprintf("list %s err -- %s", gvk.Kind, set)
+			h.logger.Errorf("%s: %s", msg, err.Error())
+			results = append(results, newResult(gvk.Kind, "", "", OutcomeError, msg).setError(err))
+			continue
+		}
+		managed = append(managed, objects...)
+	}
+
+	var latest int64
+	for _, rawData := range managed {
+		if generation := generationOf(rawData); generation > latest {
+			latest = generation
+		}
+	}
+	if latest == 0 {
+		msg := fmt.Sprintf("no bundle is applied to the set -- %s", set)
+		h.logger.Infof(msg)
+		return append(results, newErrorResult(msg))
+	}
+	stale := []runtime.Object{}
+	for _, rawData := range managed {
+		if generationOf(rawData) < latest {
+			stale = append(stale, rawData)
+		}
+	}
+	sortManifests(stale, true)
+
+	for _, rawData := range stale {
+		result := h.prune.Delete(rawData)
+		results = append(results, result)
+		if stateResult := h.removeState(rawData, result); stateResult != nil {
+			results = append(results, stateResult)
+		}
+	}
+	if len(results) == 0 {
+		msg := fmt.Sprintf("nothing to prune -- %s", set)
+		h.logger.Infof(msg)
+		results = append(results, newResult("", "", set, OutcomeUnchanged, msg))
+	}
+	return results
+}
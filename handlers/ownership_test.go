@@ -0,0 +1,179 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStampOwnership(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("typed", func(t *testing.T) {
+		_, rawData := getPayloadFromFixture(t, "../testdata/deployment.yaml")
+		deployment := rawData.(*appsv1.Deployment)
+
+		assert.Nil(stampOwnership(deployment, "dID", "my-set", "2"))
+		assert.Equal(map[string]string{
+			"app":                          "MyDeployment",
+			"app.kubernetes.io/managed-by": "mqtt-kube-operator",
+			"mqtt-kube-operator/device-id": "dID",
+			"mqtt-kube-operator/set":       "my-set",
+		}, deployment.ObjectMeta.Labels)
+		hash := deployment.ObjectMeta.Annotations[manifestHashAnnotation]
+		assert.True(strings.HasPrefix(hash, "sha256:"))
+		assert.Equal("2", deployment.ObjectMeta.Annotations[generationAnnotation])
+		assert.Equal(int64(2), generationOf(deployment))
+
+		_, rawData = getPayloadFromFixture(t, "../testdata/deployment.yaml")
+		other := rawData.(*appsv1.Deployment)
+		other.ObjectMeta.Annotations = map[string]string{manifestHashAnnotation: "sha256:previous", generationAnnotation: "1"}
+		assert.Nil(stampOwnership(other, "dID", "", "3"))
+		assert.Equal(hash, other.ObjectMeta.Annotations[manifestHashAnnotation])
+		assert.NotContains(other.ObjectMeta.Labels, setLabel)
+		assert.NotContains(other.ObjectMeta.Annotations, generationAnnotation)
+		assert.Equal(int64(0), generationOf(other))
+
+		other.Spec.Template.Spec.Containers[0].Image = "nginx:1.7.8"
+		assert.Nil(stampOwnership(other, "dID", "", ""))
+		assert.NotEqual(hash, other.ObjectMeta.Annotations[manifestHashAnnotation])
+	})
+	t.Run("unstructured", func(t *testing.T) {
+		obj := getUnstructuredFromFixture(t, "../testdata/customresource.yaml")
+		obj.SetAnnotations(map[string]string{manifestHashAnnotation: "sha256:previous"})
+
+		assert.Nil(stampOwnership(obj, "dID", "", ""))
+		assert.Equal("mqtt-kube-operator", obj.GetLabels()[managedByLabel])
+		assert.Equal("dID", obj.GetLabels()[deviceIDLabel])
+
+		expected := getUnstructuredFromFixture(t, "../testdata/customresource.yaml")
+		hash, err := manifestHash(expected)
+		assert.Nil(err)
+		assert.Equal(hash, obj.GetAnnotations()[manifestHashAnnotation])
+	})
+}
+
+func TestOwnershipSelector(t *testing.T) {
+	assert.Equal(t, "app.kubernetes.io/managed-by=mqtt-kube-operator,mqtt-kube-operator/device-id=dID,mqtt-kube-operator/set=my-set", ownershipSelector("dID", "my-set"))
+}
+
+func TestPrune(t *testing.T) {
+	messageHandler, deployment, service, configmap, _, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	prune := NewMockPruneHandlerInf(ctrl)
+
+	payload, err := ioutil.ReadFile("../testdata/bundle.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selector := ownershipSelector("dID", "my-set")
+	namespaces := []string{"default", "tenant-a"}
+	managed := func(kind string, name string, generation string) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(schema.GroupVersionKind{Version: "v1", Kind: kind})
+		if kind == "Deployment" {
+			obj.SetAPIVersion("apps/v1")
+		}
+		obj.SetNamespace("default")
+		obj.SetName(name)
+		if generation != "" {
+			obj.SetAnnotations(map[string]string{generationAnnotation: generation})
+		}
+		return obj
+	}
+
+	t.Run("not enabled", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte("a@prune|my-set"))
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@prune|prune is not enabled").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+	})
+
+	messageHandler.prune = prune
+
+	t.Run("not applied", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte("a@prune|my-set"))
+		prune.EXPECT().List(gomock.Any(), namespaces, selector).Return([]runtime.Object{managed("ConfigMap", "my-configmap", "")}, nil).Times(len(prunableKinds))
+		prune.EXPECT().Delete(gomock.Any()).Times(0)
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@prune|no bundle is applied to the set -- my-set").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+	})
+	t.Run("invalid set", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s|set=my set", url.QueryEscape(string(payload)))))
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@apply|invalid parameter -- set").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+	})
+	t.Run("apply", func(t *testing.T) {
+		stamped := func(rawData runtime.Object) *Result {
+			accessor, err := meta.Accessor(rawData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "my-set", accessor.GetLabels()[setLabel])
+			assert.Equal(t, "dID", accessor.GetLabels()[deviceIDLabel])
+			assert.NotEmpty(t, accessor.GetAnnotations()[manifestHashAnnotation])
+			assert.NotZero(t, generationOf(rawData))
+			return &Result{Message: fmt.Sprintf("apply %s", accessor.GetName())}
+		}
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s|set=my-set", url.QueryEscape(string(payload)))))
+		configmap.EXPECT().Apply(gomock.Any()).DoAndReturn(stamped)
+		service.EXPECT().Apply(gomock.Any()).DoAndReturn(stamped)
+		deployment.EXPECT().Apply(gomock.Any()).DoAndReturn(stamped)
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@apply|apply my-configmap; apply my-service; apply my-deployment").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+	})
+	t.Run("prune", func(t *testing.T) {
+		// the objects applied before restarting are found by their generations
+		oldConfigmap := managed("ConfigMap", "old-configmap", "1")
+		oldDeployment := managed("Deployment", "old-deployment", "")
+
+		message.EXPECT().Payload().Return([]byte("a@prune|my-set"))
+		prune.EXPECT().List(schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, namespaces, selector).Return([]runtime.Object{}, nil)
+		prune.EXPECT().List(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, namespaces, selector).Return([]runtime.Object{managed("ConfigMap", "my-configmap", "2"), oldConfigmap}, nil)
+		prune.EXPECT().List(schema.GroupVersionKind{Version: "v1", Kind: "Service"}, namespaces, selector).Return(nil, fmt.Errorf("listErr"))
+		prune.EXPECT().List(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, namespaces, selector).Return([]runtime.Object{oldDeployment, managed("Deployment", "my-deployment", "2")}, nil)
+		gomock.InOrder(
+			prune.EXPECT().Delete(oldDeployment).Return(newResult("Deployment", "default", "old-deployment", OutcomeDeleted, "delete deployment -- old-deployment")),
+			prune.EXPECT().Delete(oldConfigmap).Return(newResult("ConfigMap", "default", "old-configmap", OutcomeDeleted, "delete configmap -- old-configmap")),
+		)
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@prune|list Service err -- my-set; delete deployment -- old-deployment; delete configmap -- old-configmap").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+	})
+	t.Run("nothing to prune", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte("a@prune|my-set"))
+		prune.EXPECT().List(gomock.Any(), namespaces, selector).Return([]runtime.Object{managed("ConfigMap", "my-configmap", "2")}, nil).Times(len(prunableKinds))
+		prune.EXPECT().Delete(gomock.Any()).Times(0)
+		client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, "a@prune|nothing to prune -- my-set").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, message)
+	})
+}
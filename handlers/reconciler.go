@@ -0,0 +1,277 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/tech-sketch/mqtt-kube-operator/metrics"
+)
+
+type reconciler struct {
+	store    StateStoreInf
+	drift    DriftHandlerInf
+	interval time.Duration
+	mutex    sync.Mutex
+	stopCh   chan bool
+	finishCh chan bool
+}
+
+/*
+EnableReconciler : persist the objects applied by the commands to the secret storeName in storeNamespace as their desired states,
+and check every intervalSec seconds whether they are deleted or modified to re-apply them.
+*/
+func (h *MessageHandler) EnableReconciler(clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, discoveryClient discovery.DiscoveryInterface, storeNamespace string, storeName string, intervalSec int) error {
+	if intervalSec <= 0 {
+		return fmt.Errorf("invalid reconcile interval %d", intervalSec)
+	}
+	h.reconciler = &reconciler{
+		store:    newStateStore(clientset, h.logger, storeNamespace, storeName),
+		drift:    newDynamicHandler(dynamicClient, discoveryClient, h.logger),
+		interval: time.Duration(intervalSec) * time.Second,
+	}
+	return nil
+}
+
+/*
+GetDriftTopic : get the topic name to publish the drifts detected by the reconciler
+*/
+func (h *MessageHandler) GetDriftTopic() string {
+	return "/" + h.deviceType + "/" + h.deviceID + "/drift"
+}
+
+/*
+StartReconciling : start the loop to reconcile the objects with their desired states. It does nothing if the reconciler is not enabled or already started.
+*/
+func (h *MessageHandler) StartReconciling(client mqtt.Client) {
+	if h.reconciler == nil {
+		return
+	}
+	r := h.reconciler
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stopCh != nil {
+		return
+	}
+	r.stopCh = make(chan bool, 1)
+	r.finishCh = make(chan bool, 1)
+
+	go func(stopCh chan bool, finishCh chan bool) {
+		h.logger.Infof("start reconciling every %s", r.interval)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				h.logger.Infof("stop reconciling")
+				finishCh <- true
+				return
+			case <-ticker.C:
+				h.reconcile(client)
+			}
+		}
+	}(r.stopCh, r.finishCh)
+}
+
+/*
+StopReconciling : stop the reconcile loop and wait until it finishes.
+*/
+func (h *MessageHandler) StopReconciling() {
+	if h.reconciler == nil {
+		return
+	}
+	r := h.reconciler
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stopCh == nil {
+		return
+	}
+	r.stopCh <- true
+	<-r.finishCh
+	r.stopCh = nil
+	r.finishCh = nil
+}
+
+// reconcile re-applies the objects which are deleted or modified, and publishes the drifts and the results of re-applying them to the drift topic.
+func (h *MessageHandler) reconcile(client mqtt.Client) {
+	startedAt := time.Now()
+	objects, err := h.reconciler.store.Load()
+	if err != nil {
+		h.logger.Errorf("load desired states err: %s", err.Error())
+		return
+	}
+	results := []*Result{}
+	for _, rawData := range objects {
+		results = append(results, h.reconcileObject(rawData)...)
+	}
+	if len(results) == 0 {
+		return
+	}
+
+	payload := newCommandResult("", "reconcile", startedAt, results...).Format(h.resultFormat)
+	if token := client.Publish(h.GetDriftTopic(), h.resultQoS, false, payload); token.Wait() && token.Error() != nil {
+		h.logger.Errorf("mqtt publish error, topic=%s, %s", h.GetDriftTopic(), token.Error())
+		metrics.PublishFailed(h.GetDriftTopic())
+		return
+	}
+	h.logger.Infof("send message: %s", payload)
+}
+
+// reconcileObject re-applies the object if it is drifted from its desired state, and returns the drift and the result of re-applying it.
+// Only this object is locked while reconciling it, and its desired state is found again in case a command changed it after loaded.
+func (h *MessageHandler) reconcileObject(rawData runtime.Object) []*Result {
+	accessor, err := meta.Accessor(rawData)
+	if err != nil {
+		return nil
+	}
+	key, err := h.objectKey(rawData)
+	if err != nil {
+		return nil
+	}
+	unlock := h.locks.lock([]string{key})
+	defer unlock()
+
+	desired, err := h.reconciler.store.Find(rawData.GetObjectKind().GroupVersionKind().GroupKind(), accessor.GetNamespace(), accessor.GetName())
+	if err != nil {
+		h.logger.Errorf("find desired state err: %s", err.Error())
+		return nil
+	}
+	if desired == nil {
+		// deleted by a command after loaded
+		return nil
+	}
+	drift := h.reconciler.drift.Drift(desired)
+	if drift.Outcome != OutcomeDrifted {
+		return nil
+	}
+	typed, err := toTyped(desired)
+	if err != nil {
+		h.logger.Errorf("decode desired state err: %s", err.Error())
+		return nil
+	}
+	return []*Result{drift, h.operateObject(h.applyOperations(false), typed)}
+}
+
+// saveState persists the applied object as its desired state, and returns the result only if it fails.
+func (h *MessageHandler) saveState(rawData runtime.Object, result *Result) *Result {
+	if h.reconciler == nil {
+		return nil
+	}
+	switch result.Outcome {
+	case OutcomeCreated, OutcomeUpdated, OutcomeUnchanged:
+	default:
+		return nil
+	}
+	if err := h.reconciler.store.Save(rawData); err != nil {
+		return h.stateErrorResult("save", result, err)
+	}
+	return nil
+}
+
+// removeState removes the desired state of the deleted object, and returns the result only if it fails.
+func (h *MessageHandler) removeState(rawData runtime.Object, result *Result) *Result {
+	if h.reconciler == nil {
+		return nil
+	}
+	switch result.Outcome {
+	case OutcomeDeleted, OutcomeNotFound:
+	default:
+		return nil
+	}
+	if err := h.reconciler.store.Remove(rawData); err != nil {
+		return h.stateErrorResult("remove", result, err)
+	}
+	return nil
+}
+
+// adoptState updates the desired state of the deployment operated by a rollout command, so that the reconciler does not revert the operation.
+// It returns the result only if it fails.
+func (h *MessageHandler) adoptState(result *Result, update func(deployment *unstructured.Unstructured) error) *Result {
+	if h.reconciler == nil || result.Outcome != OutcomeUpdated {
+		return nil
+	}
+	rawData, err := h.reconciler.store.Find(deploymentGroupKind, result.Namespace, result.Name)
+	if err != nil {
+		return h.stateErrorResult("save", result, err)
+	}
+	deployment, ok := rawData.(*unstructured.Unstructured)
+	if !ok {
+		// the deployment is not managed by the reconciler
+		return nil
+	}
+	if err := update(deployment); err != nil {
+		return h.stateErrorResult("save", result, err)
+	}
+	if err := h.reconciler.store.Save(deployment); err != nil {
+		return h.stateErrorResult("save", result, err)
+	}
+	return nil
+}
+
+func (h *MessageHandler) stateErrorResult(action string, result *Result, err error) *Result {
+	msg := fmt.Sprintf("%s desired state err -- %s", action, result.Name)
+	h.logger.Errorf("%s: %s", msg, err.Error())
+	return newResult(result.Kind, result.Namespace, result.Name, OutcomeError, msg).setError(err)
+}
+
+// saveDesiredDeployment persists the deployment restored by the auto rollback as its desired state, and returns the result only if it fails.
+func (h *MessageHandler) saveDesiredDeployment(deployment *appsv1.Deployment, result *Result) *Result {
+	if h.reconciler == nil {
+		return nil
+	}
+	desired, err := toUnstructured(desiredDeployment(deployment))
+	if err != nil {
+		return h.stateErrorResult("save", result, err)
+	}
+	return h.saveState(desired, result)
+}
+
+// desiredState returns the original object written in the manifest with the namespace, labels and annotations of rawData,
+// which are resolved and stamped when operating it. It returns rawData if the original is unknown.
+func desiredState(original *unstructured.Unstructured, rawData runtime.Object) runtime.Object {
+	accessor, err := meta.Accessor(rawData)
+	if original == nil || err != nil {
+		return rawData
+	}
+	desired := original.DeepCopy()
+	desired.SetNamespace(accessor.GetNamespace())
+	desired.SetLabels(accessor.GetLabels())
+	desired.SetAnnotations(accessor.GetAnnotations())
+	return desired
+}
+
+// desiredDeployment returns the deployment which has only the labels, annotations and spec of deployment to be saved as its desired state.
+func desiredDeployment(deployment *appsv1.Deployment) *appsv1.Deployment {
+	annotations := map[string]string{}
+	for key, value := range deployment.ObjectMeta.Annotations {
+		if key != revisionAnnotation {
+			annotations[key] = value
+		}
+	}
+	return &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        deployment.ObjectMeta.Name,
+			Namespace:   deployment.ObjectMeta.Namespace,
+			Labels:      deployment.ObjectMeta.Labels,
+			Annotations: annotations,
+		},
+		Spec: *deployment.Spec.DeepCopy(),
+	}
+}
@@ -0,0 +1,228 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func setUpReconciler(t *testing.T, messageHandler *MessageHandler) (*MockStateStoreInf, *MockDriftHandlerInf, func()) {
+	ctrl := gomock.NewController(t)
+	store := NewMockStateStoreInf(ctrl)
+	drift := NewMockDriftHandlerInf(ctrl)
+	messageHandler.reconciler = &reconciler{
+		store:    store,
+		drift:    drift,
+		interval: time.Hour,
+	}
+	return store, drift, ctrl.Finish
+}
+
+func TestEnableReconciler(t *testing.T) {
+	assert := assert.New(t)
+	messageHandler, _, _, _, _, _, _, _, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	assert.NotNil(messageHandler.EnableReconciler(nil, nil, nil, "default", "state", 0))
+	assert.Nil(messageHandler.reconciler)
+	assert.Nil(messageHandler.EnableReconciler(nil, nil, nil, "default", "state", 60))
+	assert.Equal(60*time.Second, messageHandler.reconciler.interval)
+	assert.Equal("/dType/dID/drift", messageHandler.GetDriftTopic())
+
+	messageHandler.StartReconciling(nil)
+	messageHandler.StartReconciling(nil)
+	messageHandler.StopReconciling()
+	messageHandler.StopReconciling()
+	assert.Nil(messageHandler.reconciler.stopCh)
+}
+
+func TestReconcile(t *testing.T) {
+	messageHandler, deployment, _, configmap, _, client, _, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+	store, drift, tearDownReconciler := setUpReconciler(t, messageHandler)
+	defer tearDownReconciler()
+
+	payload, deploymentData := getPayloadFromFixture(t, "../testdata/deployment.yaml")
+	_, configmapData := getPayloadFromFixture(t, "../testdata/configmap.yaml")
+	configmapData.(*apiv1.ConfigMap).ObjectMeta.Namespace = "default"
+	desired, err := decodeOriginal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired.SetNamespace("default")
+	configmapGroupKind := schema.GroupKind{Kind: "ConfigMap"}
+
+	t.Run("drifted", func(t *testing.T) {
+		store.EXPECT().Load().Return([]runtime.Object{configmapData, desired}, nil)
+		store.EXPECT().Find(configmapGroupKind, "default", "my-configmap").Return(configmapData, nil)
+		store.EXPECT().Find(deploymentGroupKind, "default", "my-deployment").Return(desired, nil)
+		drift.EXPECT().Drift(configmapData).Return(newResult("ConfigMap", "default", "my-configmap", OutcomeUnchanged, "configmap is not modified -- my-configmap"))
+		drift.EXPECT().Drift(desired).Return(newResult("Deployment", "default", "my-deployment", OutcomeDrifted, "deployment is modified at .spec.replicas -- my-deployment"))
+		configmap.EXPECT().Apply(gomock.Any()).Times(0)
+		deployment.EXPECT().Apply(NewRawDataMatcher(deploymentData)).Return(newResult("Deployment", "default", "my-deployment", OutcomeUpdated, "update deployment -- my-deployment"))
+		client.EXPECT().Publish("/dType/dID/drift", byte(0), false, "deployment is modified at .spec.replicas -- my-deployment; update deployment -- my-deployment").Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.reconcile(client)
+	})
+	t.Run("not drifted", func(t *testing.T) {
+		store.EXPECT().Load().Return([]runtime.Object{desired}, nil)
+		store.EXPECT().Find(deploymentGroupKind, "default", "my-deployment").Return(desired, nil)
+		drift.EXPECT().Drift(desired).Return(newResult("Deployment", "default", "my-deployment", OutcomeUnchanged, "deployment is not modified -- my-deployment"))
+		client.EXPECT().Publish(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+		messageHandler.reconcile(client)
+	})
+	t.Run("changed after loaded", func(t *testing.T) {
+		changed := desired.DeepCopy()
+		if err := unstructured.SetNestedField(changed.Object, int64(5), "spec", "replicas"); err != nil {
+			t.Fatal(err)
+		}
+		store.EXPECT().Load().Return([]runtime.Object{configmapData, desired}, nil)
+		store.EXPECT().Find(configmapGroupKind, "default", "my-configmap").Return(nil, nil)
+		store.EXPECT().Find(deploymentGroupKind, "default", "my-deployment").Return(changed, nil)
+		drift.EXPECT().Drift(changed).Return(newResult("Deployment", "default", "my-deployment", OutcomeUnchanged, "deployment is not modified -- my-deployment"))
+		client.EXPECT().Publish(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+		messageHandler.reconcile(client)
+	})
+	t.Run("locked by a command", func(t *testing.T) {
+		unlock := messageHandler.locks.lock([]string{"default_Deployment.apps_my-deployment"})
+		store.EXPECT().Load().Return([]runtime.Object{desired}, nil)
+		store.EXPECT().Find(deploymentGroupKind, "default", "my-deployment").Return(desired, nil)
+		drift.EXPECT().Drift(desired).Return(newResult("Deployment", "default", "my-deployment", OutcomeUnchanged, "deployment is not modified -- my-deployment"))
+		client.EXPECT().Publish(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+		done := make(chan bool)
+		go func() {
+			messageHandler.reconcile(client)
+			done <- true
+		}()
+		select {
+		case <-done:
+			t.Fatal("the object locked by a command is reconciled")
+		case <-time.After(100 * time.Millisecond):
+		}
+		unlock()
+		<-done
+	})
+	t.Run("load failure", func(t *testing.T) {
+		store.EXPECT().Load().Return(nil, fmt.Errorf("failure"))
+		drift.EXPECT().Drift(gomock.Any()).Times(0)
+		client.EXPECT().Publish(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+		messageHandler.reconcile(client)
+	})
+}
+
+func TestDesiredState(t *testing.T) {
+	messageHandler, deployment, _, _, _, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+	store, _, tearDownReconciler := setUpReconciler(t, messageHandler)
+	defer tearDownReconciler()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	rollout := NewMockRolloutHandlerInf(ctrl)
+	messageHandler.rollout = rollout
+
+	payload, rawData := getPayloadFromFixture(t, "../testdata/deployment.yaml")
+	body := url.QueryEscape(string(payload))
+	desired, err := decodeOriginal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired.SetNamespace("default")
+	stored := func() runtime.Object {
+		return desired.DeepCopy()
+	}
+
+	testCases := []struct {
+		name    string
+		payload string
+		setUp   func()
+		result  string
+	}{
+		{name: "apply", payload: "a@apply|" + body, setUp: func() {
+			deployment.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(newResult("Deployment", "default", "my-deployment", OutcomeCreated, "create deployment -- my-deployment"))
+			store.EXPECT().Save(gomock.Any()).DoAndReturn(func(rawData runtime.Object) error {
+				// only the fields written in the manifest are persisted with the ownership
+				obj := rawData.(*unstructured.Unstructured)
+				assert.Equal(t, desired.Object["spec"], obj.Object["spec"])
+				assert.Equal(t, "default", obj.GetNamespace())
+				assert.Equal(t, "dID", obj.GetLabels()[deviceIDLabel])
+				return nil
+			})
+		}, result: "a@apply|create deployment -- my-deployment"},
+		{name: "apply failure", payload: "a@apply|" + body, setUp: func() {
+			deployment.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(newResult("Deployment", "default", "my-deployment", OutcomeError, "update deployment err -- my-deployment"))
+			store.EXPECT().Save(gomock.Any()).Times(0)
+		}, result: "a@apply|update deployment err -- my-deployment"},
+		{name: "save failure", payload: "a@apply|" + body, setUp: func() {
+			deployment.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(newResult("Deployment", "default", "my-deployment", OutcomeUnchanged, "deployment is not changed -- my-deployment"))
+			store.EXPECT().Save(NewRawDataMatcher(desired)).Return(fmt.Errorf("failure"))
+		}, result: "a@apply|deployment is not changed -- my-deployment; save desired state err -- my-deployment"},
+		{name: "delete", payload: "a@delete|" + body, setUp: func() {
+			deployment.EXPECT().Delete(NewRawDataMatcher(rawData)).Return(newResult("Deployment", "default", "my-deployment", OutcomeDeleted, "delete deployment -- my-deployment"))
+			store.EXPECT().Remove(NewRawDataMatcher(desired)).Return(nil)
+		}, result: "a@delete|delete deployment -- my-deployment"},
+		{name: "scale", payload: "a@scale|my-deployment|replicas=5", setUp: func() {
+			rollout.EXPECT().Scale("default", "my-deployment", int32(5)).Return(newResult("Deployment", "default", "my-deployment", OutcomeUpdated, "scale deployment to 5 -- my-deployment"))
+			store.EXPECT().Find(deploymentGroupKind, "default", "my-deployment").Return(stored(), nil)
+			store.EXPECT().Save(gomock.Any()).DoAndReturn(func(rawData runtime.Object) error {
+				replicas, _, _ := unstructured.NestedInt64(rawData.(*unstructured.Unstructured).Object, "spec", "replicas")
+				assert.Equal(t, int64(5), replicas)
+				return nil
+			})
+		}, result: "a@scale|scale deployment to 5 -- my-deployment"},
+		{name: "scale unmanaged", payload: "a@scale|my-deployment|replicas=5", setUp: func() {
+			rollout.EXPECT().Scale("default", "my-deployment", int32(5)).Return(newResult("Deployment", "default", "my-deployment", OutcomeUpdated, "scale deployment to 5 -- my-deployment"))
+			store.EXPECT().Find(deploymentGroupKind, "default", "my-deployment").Return(nil, nil)
+			store.EXPECT().Save(gomock.Any()).Times(0)
+		}, result: "a@scale|scale deployment to 5 -- my-deployment"},
+		{name: "rollback", payload: "a@rollback|my-deployment", setUp: func() {
+			updated := rawData.(*appsv1.Deployment).DeepCopy()
+			updated.Spec.Template.Spec.Containers[0].Image = "nginx:1.7.8"
+			updated.Spec.Template.ObjectMeta.Annotations = map[string]string{restartedAtAnnotation: "2018-01-02T03:04:05Z"}
+			result := newResult("Deployment", "default", "my-deployment", OutcomeUpdated, "rollback deployment to revision 1 -- my-deployment")
+			result.updated = updated
+			rollout.EXPECT().Rollback("default", "my-deployment", int64(0)).Return(result)
+			store.EXPECT().Find(deploymentGroupKind, "default", "my-deployment").Return(stored(), nil)
+			store.EXPECT().Save(gomock.Any()).DoAndReturn(func(rawData runtime.Object) error {
+				deployment := &appsv1.Deployment{}
+				if err := runtime.DefaultUnstructuredConverter.FromUnstructured(rawData.(*unstructured.Unstructured).Object, deployment); err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, "nginx:1.7.8", deployment.Spec.Template.Spec.Containers[0].Image)
+				assert.Empty(t, deployment.Spec.Template.ObjectMeta.Annotations)
+				return nil
+			})
+		}, result: "a@rollback|rollback deployment to revision 1 -- my-deployment"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			message.EXPECT().Payload().Return([]byte(c.payload))
+			c.setUp()
+			client.EXPECT().Publish("/dType/dID/cmdexe", byte(0), false, c.result).Return(token)
+			token.EXPECT().Wait().Return(false)
+
+			messageHandler.Command()(client, message)
+		})
+	}
+}
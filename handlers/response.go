@@ -0,0 +1,171 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// the reason codes of MQTT v5 returned with the results of a command
+const (
+	reasonSuccess                     byte = 0x00
+	reasonImplementationSpecificError byte = 0x83
+	reasonNotAuthorized               byte = 0x87
+	reasonQuotaExceeded               byte = 0x97
+	reasonPayloadFormatInvalid        byte = 0x99
+)
+
+const (
+	reasonCodeProperty  = "reason-code"
+	encodingProperty    = "encoding"
+	compressionProperty = "compression"
+	contentTypeText     = "text/plain"
+	contentTypeJSON     = "application/json"
+	// maxDecodedPayloadSize limits the size of a compressed command after it is decompressed
+	maxDecodedPayloadSize = 16 * 1024 * 1024
+	// responseMetricTopic is counted by the metrics instead of the response topics, which are given by the senders of the commands
+	responseMetricTopic = "response"
+)
+
+// traceProperties are the user properties of the W3C trace context, which are returned with the results of the command.
+var traceProperties = []string{"traceparent", "tracestate"}
+
+/*
+Response : a payload published with the MQTT v5 properties, which is passed to the Publish of a MQTT v5 client only.
+*/
+type Response struct {
+	Payload         []byte
+	ContentType     string
+	CorrelationData []byte
+	UserProperties  map[string]string
+}
+
+// reply is where and how the results of a command are published.
+// The results are published to the cmdexe topic, or to the response topic with the correlation data of the command if it is received by a MQTT v5 client.
+type reply struct {
+	topic           string
+	v5              bool
+	correlationData []byte
+	userProperties  map[string]string
+}
+
+// newReply returns the reply to the message, and the payload of the message decoded with its encoding and compression properties.
+func (h *MessageHandler) newReply(msg mqtt.Message) (*reply, []byte, error) {
+	r := &reply{topic: h.GetCmdExeTopic()}
+	properties, ok := msg.(MessagePropertiesInf)
+	if !ok {
+		return r, msg.Payload(), nil
+	}
+	r.v5 = true
+	if responseTopic := properties.ResponseTopic(); responseTopic != "" {
+		r.topic = responseTopic
+	}
+	r.correlationData = properties.CorrelationData()
+	r.userProperties = map[string]string{}
+	for _, key := range traceProperties {
+		if value := properties.UserProperty(key); value != "" {
+			r.userProperties[key] = value
+		}
+	}
+	if contentType := properties.ContentType(); contentType != "" && contentType != contentTypeText {
+		return r, nil, fmt.Errorf("unsupported content type -- %s", contentType)
+	}
+	payload, err := decodePayload(msg.Payload(), properties.UserProperty(encodingProperty), properties.UserProperty(compressionProperty))
+	return r, payload, err
+}
+
+// metricTopicOf returns the topic of the reply counted by the metrics, so that the labels are bounded whatever the response topic is.
+func (h *MessageHandler) metricTopicOf(r *reply) string {
+	if r.topic == h.GetCmdExeTopic() {
+		return r.topic
+	}
+	return responseMetricTopic
+}
+
+// message returns the payload to publish with the client, which is a Response with the reason code if the reply is to a MQTT v5 command.
+func (r *reply) message(payload string, format ResultFormat, reasonCode byte) interface{} {
+	if !r.v5 {
+		return payload
+	}
+	userProperties := map[string]string{reasonCodeProperty: strconv.Itoa(int(reasonCode))}
+	for key, value := range r.userProperties {
+		userProperties[key] = value
+	}
+	contentType := contentTypeText
+	if format == ResultFormatJSON {
+		contentType = contentTypeJSON
+	}
+	return &Response{
+		Payload:         []byte(payload),
+		ContentType:     contentType,
+		CorrelationData: r.correlationData,
+		UserProperties:  userProperties,
+	}
+}
+
+// decodePayload decodes the payload encoded with base64 and then compressed with gzip, if they are specified.
+func decodePayload(payload []byte, encoding string, compression string) ([]byte, error) {
+	switch encoding {
+	case "", "identity":
+	case "base64":
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(payload)))
+		n, err := base64.StdEncoding.Decode(decoded, payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 payload")
+		}
+		payload = decoded[:n]
+	default:
+		return nil, fmt.Errorf("unsupported encoding -- %s", encoding)
+	}
+	switch compression {
+	case "", "identity":
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip payload")
+		}
+		defer reader.Close()
+		decompressed, err := ioutil.ReadAll(io.LimitReader(reader, maxDecodedPayloadSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip payload")
+		}
+		if len(decompressed) > maxDecodedPayloadSize {
+			return nil, fmt.Errorf("decompressed payload is too large, exceeds %d bytes", maxDecodedPayloadSize)
+		}
+		payload = decompressed
+	default:
+		return nil, fmt.Errorf("unsupported compression -- %s", compression)
+	}
+	return payload, nil
+}
+
+// reasonCodeOf returns the reason code of the results, which is the one of the first rejected result, or of the failure if any result is failed.
+func reasonCodeOf(results []*Result) byte {
+	reasonCode := reasonSuccess
+	for _, result := range results {
+		if result.Outcome != OutcomeError {
+			continue
+		}
+		switch metav1.StatusReason(result.Reason) {
+		case metav1.StatusReasonForbidden:
+			return reasonNotAuthorized
+		case metav1.StatusReasonTooManyRequests:
+			return reasonQuotaExceeded
+		}
+		reasonCode = reasonImplementationSpecificError
+	}
+	return reasonCode
+}
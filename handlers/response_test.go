@@ -0,0 +1,263 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/mqtt-kube-operator/metrics"
+)
+
+// v5Message is a message received with the MQTT v5 properties.
+type v5Message struct {
+	mqtt.Message
+	responseTopic   string
+	correlationData []byte
+	contentType     string
+	userProperties  map[string]string
+}
+
+func (m *v5Message) ResponseTopic() string {
+	return m.responseTopic
+}
+
+func (m *v5Message) CorrelationData() []byte {
+	return m.correlationData
+}
+
+func (m *v5Message) ContentType() string {
+	return m.contentType
+}
+
+func (m *v5Message) UserProperty(key string) string {
+	return m.userProperties[key]
+}
+
+func gzipPayload(t *testing.T, payload []byte) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNewReply(t *testing.T) {
+	assert := assert.New(t)
+	messageHandler, _, _, _, _, _, message, _, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	t.Run("v3.1.1", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte("a@b|c"))
+
+		r, payload, err := messageHandler.newReply(message)
+		assert.Nil(err)
+		assert.Equal(&reply{topic: "/dType/dID/cmdexe"}, r)
+		assert.Equal([]byte("a@b|c"), payload)
+	})
+	t.Run("v5", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte(base64.StdEncoding.EncodeToString(gzipPayload(t, []byte("a@b|c")))))
+
+		r, payload, err := messageHandler.newReply(&v5Message{
+			Message:         message,
+			responseTopic:   "/requester/response",
+			correlationData: []byte("request-1"),
+			contentType:     "text/plain",
+			userProperties: map[string]string{
+				"encoding":    "base64",
+				"compression": "gzip",
+				"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+				"other":       "ignored",
+			},
+		})
+		assert.Nil(err)
+		assert.Equal(&reply{
+			topic:           "/requester/response",
+			v5:              true,
+			correlationData: []byte("request-1"),
+			userProperties:  map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		}, r)
+		assert.Equal([]byte("a@b|c"), payload)
+	})
+	t.Run("v5 without response topic", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte("a@b|c"))
+
+		r, payload, err := messageHandler.newReply(&v5Message{Message: message})
+		assert.Nil(err)
+		assert.Equal(&reply{topic: "/dType/dID/cmdexe", v5: true, userProperties: map[string]string{}}, r)
+		assert.Equal([]byte("a@b|c"), payload)
+	})
+	t.Run("unsupported content type", func(t *testing.T) {
+		r, _, err := messageHandler.newReply(&v5Message{Message: message, responseTopic: "/requester/response", contentType: "application/json"})
+		assert.NotNil(err)
+		assert.Equal("unsupported content type -- application/json", err.Error())
+		assert.Equal("/requester/response", r.topic)
+	})
+}
+
+func TestDecodePayload(t *testing.T) {
+	assert := assert.New(t)
+
+	compressed := gzipPayload(t, []byte("a@b|c"))
+	decodeCases := []struct {
+		name        string
+		payload     []byte
+		encoding    string
+		compression string
+		expected    []byte
+		expectedErr string
+	}{
+		{name: "plain", payload: []byte("a@b|c"), expected: []byte("a@b|c")},
+		{name: "identity", payload: []byte("a@b|c"), encoding: "identity", compression: "identity", expected: []byte("a@b|c")},
+		{name: "base64", payload: []byte(base64.StdEncoding.EncodeToString([]byte("a@b|c"))), encoding: "base64", expected: []byte("a@b|c")},
+		{name: "gzip", payload: compressed, compression: "gzip", expected: []byte("a@b|c")},
+		{name: "base64 gzip", payload: []byte(base64.StdEncoding.EncodeToString(compressed)), encoding: "base64", compression: "gzip", expected: []byte("a@b|c")},
+		{name: "invalid base64", payload: []byte("!"), encoding: "base64", expectedErr: "invalid base64 payload"},
+		{name: "invalid gzip", payload: []byte("a@b|c"), compression: "gzip", expectedErr: "invalid gzip payload"},
+		{name: "truncated gzip", payload: compressed[:len(compressed)-4], compression: "gzip", expectedErr: "invalid gzip payload"},
+		{name: "unsupported encoding", payload: []byte("a@b|c"), encoding: "hex", expectedErr: "unsupported encoding -- hex"},
+		{name: "unsupported compression", payload: []byte("a@b|c"), compression: "zstd", expectedErr: "unsupported compression -- zstd"},
+		{name: "too large", payload: gzipPayload(t, make([]byte, maxDecodedPayloadSize+1)), compression: "gzip", expectedErr: fmt.Sprintf("decompressed payload is too large, exceeds %d bytes", maxDecodedPayloadSize)},
+	}
+
+	for _, c := range decodeCases {
+		t.Run(c.name, func(t *testing.T) {
+			payload, err := decodePayload(c.payload, c.encoding, c.compression)
+			if c.expectedErr != "" {
+				assert.NotNil(err)
+				assert.Equal(c.expectedErr, err.Error())
+				return
+			}
+			assert.Nil(err)
+			assert.Equal(c.expected, payload)
+		})
+	}
+}
+
+func TestReplyMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("a@b|c", (&reply{topic: "/dType/dID/cmdexe"}).message("a@b|c", ResultFormatUltralight, reasonSuccess))
+
+	r := &reply{
+		topic:           "/requester/response",
+		v5:              true,
+		correlationData: []byte("request-1"),
+		userProperties:  map[string]string{"tracestate": "vendor=value"},
+	}
+	assert.Equal(&Response{
+		Payload:         []byte("a@b|c"),
+		ContentType:     "text/plain",
+		CorrelationData: []byte("request-1"),
+		UserProperties:  map[string]string{"reason-code": "0", "tracestate": "vendor=value"},
+	}, r.message("a@b|c", ResultFormatUltralight, reasonSuccess))
+	assert.Equal(&Response{
+		Payload:         []byte(`{"results":[]}`),
+		ContentType:     "application/json",
+		CorrelationData: []byte("request-1"),
+		UserProperties:  map[string]string{"reason-code": "135", "tracestate": "vendor=value"},
+	}, r.message(`{"results":[]}`, ResultFormatJSON, reasonNotAuthorized))
+	assert.Equal(map[string]string{"tracestate": "vendor=value"}, r.userProperties)
+}
+
+func TestReasonCodeOf(t *testing.T) {
+	assert := assert.New(t)
+
+	forbidden := newResult("Deployment", "tenant-b", "my-deployment", OutcomeError, "namespace is not allowed -- tenant-b")
+	forbidden.Reason = string(metav1.StatusReasonForbidden)
+	tooMany := newErrorResult("command queue is full, retry later")
+	tooMany.Reason = string(metav1.StatusReasonTooManyRequests)
+	conflict := newResult("Deployment", "default", "my-deployment", OutcomeError, "update deployment err -- my-deployment")
+	conflict.Reason = string(metav1.StatusReasonConflict)
+	created := newResult("Deployment", "default", "my-deployment", OutcomeCreated, "create deployment -- my-deployment")
+
+	reasonCases := []struct {
+		name     string
+		results  []*Result
+		expected byte
+	}{
+		{name: "no result", results: []*Result{}, expected: reasonSuccess},
+		{name: "success", results: []*Result{created}, expected: reasonSuccess},
+		{name: "failure", results: []*Result{created, conflict}, expected: reasonImplementationSpecificError},
+		{name: "forbidden", results: []*Result{conflict, forbidden}, expected: reasonNotAuthorized},
+		{name: "too many requests", results: []*Result{tooMany}, expected: reasonQuotaExceeded},
+	}
+
+	for _, c := range reasonCases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(c.expected, reasonCodeOf(c.results))
+		})
+	}
+}
+
+func TestCommandResponse(t *testing.T) {
+	messageHandler, deployment, _, _, _, client, message, token, tearDown := setUpMocks(t, "dType", "dID")
+	defer tearDown()
+
+	payload, rawData := getPayloadFromFixture(t, "../testdata/deployment.yaml")
+	body := url.QueryEscape(string(payload))
+
+	t.Run("apply", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s", body)))
+		deployment.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(newResult("Deployment", "default", "my-deployment", OutcomeCreated, "create deployment -- my-deployment"))
+		client.EXPECT().Publish("/requester/response", byte(0), false, &Response{
+			Payload:         []byte("a@apply|create deployment -- my-deployment"),
+			ContentType:     "text/plain",
+			CorrelationData: []byte("request-1"),
+			UserProperties:  map[string]string{"reason-code": "0"},
+		}).Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, &v5Message{Message: message, responseTopic: "/requester/response", correlationData: []byte("request-1")})
+	})
+	t.Run("publish error", func(t *testing.T) {
+		failures := testutil.ToFloat64(metrics.PublishFailures.WithLabelValues("response"))
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s", body)))
+		deployment.EXPECT().Apply(NewRawDataMatcher(rawData)).Return(newResult("Deployment", "default", "my-deployment", OutcomeUpdated, "update deployment -- my-deployment"))
+		client.EXPECT().Publish("/requester/my-response", byte(0), false, gomock.Any()).Return(token)
+		token.EXPECT().Wait().Return(true)
+		token.EXPECT().Error().Return(fmt.Errorf("publishErr")).Times(2)
+
+		messageHandler.Command()(client, &v5Message{Message: message, responseTopic: "/requester/my-response"})
+		// the response topic given by the sender is not used as the label
+		assert.Equal(t, failures+1, testutil.ToFloat64(metrics.PublishFailures.WithLabelValues("response")))
+		assert.Equal(t, float64(0), testutil.ToFloat64(metrics.PublishFailures.WithLabelValues("my-response")))
+	})
+	t.Run("unsupported compression", func(t *testing.T) {
+		message.EXPECT().Payload().Return([]byte(fmt.Sprintf("a@apply|%s", body)))
+		deployment.EXPECT().Apply(gomock.Any()).Times(0)
+		client.EXPECT().Publish("/requester/response", byte(0), false, &Response{
+			Payload:         []byte("unsupported compression -- zstd"),
+			ContentType:     "text/plain",
+			CorrelationData: []byte("request-2"),
+			UserProperties:  map[string]string{"reason-code": "153"},
+		}).Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		messageHandler.Command()(client, &v5Message{
+			Message:         message,
+			responseTopic:   "/requester/response",
+			correlationData: []byte("request-2"),
+			userProperties:  map[string]string{"compression": "zstd"},
+		})
+	})
+}
@@ -0,0 +1,155 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+/*
+Outcome : a machine-readable outcome of an operation.
+*/
+type Outcome string
+
+/*
+Outcomes of an operation.
+*/
+const (
+	OutcomeCreated     Outcome = "created"
+	OutcomeUpdated     Outcome = "updated"
+	OutcomeUnchanged   Outcome = "unchanged"
+	OutcomeDeleted     Outcome = "deleted"
+	OutcomeNotFound    Outcome = "not-found"
+	OutcomeRetrieved   Outcome = "retrieved"
+	OutcomeProgressing Outcome = "progressing"
+	OutcomeReady       Outcome = "ready"
+	OutcomeDrifted     Outcome = "drifted"
+	OutcomeError       Outcome = "error"
+)
+
+/*
+ResultFormat : a format of the command result published to the cmdexe topic.
+*/
+type ResultFormat string
+
+/*
+Formats of the command result.
+*/
+const (
+	ResultFormatUltralight ResultFormat = "ultralight"
+	ResultFormatJSON       ResultFormat = "json"
+)
+
+/*
+Result : a struct to hold the result of an operation to an object.
+*/
+type Result struct {
+	Kind            string  `json:"kind,omitempty"`
+	Namespace       string  `json:"namespace,omitempty"`
+	Name            string  `json:"name,omitempty"`
+	Outcome         Outcome `json:"outcome"`
+	Reason          string  `json:"reason,omitempty"`
+	ResourceVersion string  `json:"resourceVersion,omitempty"`
+	Message         string  `json:"message"`
+	Diff            string  `json:"diff,omitempty"`
+	// the object before the update, to which it is rolled back when its rollout is failed
+	previous runtime.Object
+	// the object after the update, which is adopted as the desired state of the object
+	updated runtime.Object
+}
+
+func newResult(kind string, namespace string, name string, outcome Outcome, message string) *Result {
+	return &Result{
+		Kind:      kind,
+		Namespace: namespace,
+		Name:      name,
+		Outcome:   outcome,
+		Message:   message,
+	}
+}
+
+func newErrorResult(message string) *Result {
+	return &Result{
+		Outcome: OutcomeError,
+		Message: message,
+	}
+}
+
+func (r *Result) setError(err error) *Result {
+	r.Outcome = OutcomeError
+	r.Reason = string(errors.ReasonForError(err))
+	return r
+}
+
+func (r *Result) setResourceVersion(resourceVersion string) *Result {
+	r.ResourceVersion = resourceVersion
+	return r
+}
+
+func (r *Result) setUpdatedResourceVersion(prevResourceVersion string, resourceVersion string) *Result {
+	if prevResourceVersion == resourceVersion {
+		r.Outcome = OutcomeUnchanged
+	}
+	return r.setResourceVersion(resourceVersion)
+}
+
+/*
+CommandResult : a struct to hold the results of a command.
+*/
+type CommandResult struct {
+	CommandID        string    `json:"cmdId,omitempty"`
+	Action           string    `json:"action,omitempty"`
+	Results          []*Result `json:"results"`
+	StartedAt        time.Time `json:"startedAt"`
+	DurationMillisec int64     `json:"durationMs"`
+}
+
+func newCommandResult(commandID string, action string, startedAt time.Time, results ...*Result) *CommandResult {
+	return &CommandResult{
+		CommandID:        commandID,
+		Action:           action,
+		Results:          results,
+		StartedAt:        startedAt,
+		DurationMillisec: int64(time.Since(startedAt) / time.Millisecond),
+	}
+}
+
+/*
+Text : get the results as a text joined by "; ", each of which is followed by its diff if any.
+*/
+func (r *CommandResult) Text() string {
+	messages := []string{}
+	for _, result := range r.Results {
+		if result.Diff != "" {
+			messages = append(messages, result.Message+"\n"+result.Diff)
+			continue
+		}
+		messages = append(messages, result.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+/*
+Format : get the payload of this result in the specified format.
+*/
+func (r *CommandResult) Format(format ResultFormat) string {
+	if format == ResultFormatJSON {
+		b, err := json.Marshal(r)
+		if err == nil {
+			return string(b)
+		}
+	}
+	if r.CommandID == "" {
+		return r.Text()
+	}
+	return fmt.Sprintf("%s@%s|%s", r.CommandID, r.Action, r.Text())
+}
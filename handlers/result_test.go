@@ -0,0 +1,94 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResult(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("error", func(t *testing.T) {
+		result := newResult("Deployment", "default", "my-deployment", OutcomeCreated, "msg").setError(errors.NewForbidden(appsv1.Resource("deployments"), "my-deployment", fmt.Errorf("forbidden")))
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal("Forbidden", result.Reason)
+
+		result = newErrorResult("msg").setError(fmt.Errorf("failure"))
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal("", result.Reason)
+	})
+
+	resourceVersionCases := []struct {
+		prev    string
+		current string
+		outcome Outcome
+	}{
+		{prev: "1", current: "2", outcome: OutcomeUpdated},
+		{prev: "1", current: "1", outcome: OutcomeUnchanged},
+	}
+
+	for _, c := range resourceVersionCases {
+		t.Run(fmt.Sprintf("prev=%v, current=%v", c.prev, c.current), func(t *testing.T) {
+			result := newResult("Deployment", "default", "my-deployment", OutcomeUpdated, "msg").setUpdatedResourceVersion(c.prev, c.current)
+			assert.Equal(c.outcome, result.Outcome)
+			assert.Equal(c.current, result.ResourceVersion)
+		})
+	}
+}
+
+func TestCommandResultFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	startedAt := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	results := []*Result{
+		newResult("ConfigMap", "default", "my-configmap", OutcomeCreated, "create configmap -- my-configmap").setResourceVersion("1"),
+		newResult("Deployment", "default", "my-deployment", OutcomeError, "update deployment err -- my-deployment"),
+	}
+
+	formatCases := []struct {
+		cmdID  string
+		format ResultFormat
+		result string
+	}{
+		{cmdID: "a", format: ResultFormatUltralight, result: "a@apply|create configmap -- my-configmap; update deployment err -- my-deployment"},
+		{cmdID: "", format: ResultFormatUltralight, result: "create configmap -- my-configmap; update deployment err -- my-deployment"},
+		{cmdID: "a", format: "", result: "a@apply|create configmap -- my-configmap; update deployment err -- my-deployment"},
+	}
+
+	for _, c := range formatCases {
+		t.Run(fmt.Sprintf("cmdID=%v, format=%v", c.cmdID, c.format), func(t *testing.T) {
+			assert.Equal(c.result, newCommandResult(c.cmdID, "apply", startedAt, results...).Format(c.format))
+		})
+	}
+
+	t.Run("diff", func(t *testing.T) {
+		diffResult := newResult("ConfigMap", "default", "my-configmap", OutcomeUpdated, "update configmap (dry run) -- my-configmap")
+		diffResult.Diff = "--- live\n+++ merged\n"
+		assert.Equal("a@diff|update configmap (dry run) -- my-configmap\n--- live\n+++ merged\n", newCommandResult("a", "diff", startedAt, diffResult).Format(ResultFormatUltralight))
+	})
+
+	t.Run("json", func(t *testing.T) {
+		m := map[string]interface{}{}
+		assert.Nil(json.Unmarshal([]byte(newCommandResult("a", "apply", startedAt, results...).Format(ResultFormatJSON)), &m))
+		assert.Equal("a", m["cmdId"])
+		assert.Equal("apply", m["action"])
+		assert.Equal("2019-10-01T00:00:00Z", m["startedAt"])
+		assert.Contains(m, "durationMs")
+		assert.Equal([]interface{}{
+			map[string]interface{}{"kind": "ConfigMap", "namespace": "default", "name": "my-configmap", "outcome": "created", "resourceVersion": "1", "message": "create configmap -- my-configmap"},
+			map[string]interface{}{"kind": "Deployment", "namespace": "default", "name": "my-deployment", "outcome": "error", "message": "update deployment err -- my-deployment"},
+		}, m["results"])
+	})
+}
@@ -0,0 +1,370 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+	revisionAnnotation    = "deployment.kubernetes.io/revision"
+	// the reason of the Progressing condition set by the deployment controller when the rollout is failed
+	progressDeadlineExceededReason = "ProgressDeadlineExceeded"
+)
+
+type rolloutHandler struct {
+	kubeClient     kubernetes.Interface
+	logger         *zap.SugaredLogger
+	getCurrentTime func() time.Time
+}
+
+func newRolloutHandler(clientset *kubernetes.Clientset, logger *zap.SugaredLogger) *rolloutHandler {
+	return &rolloutHandler{
+		kubeClient:     clientset,
+		logger:         logger,
+		getCurrentTime: time.Now,
+	}
+}
+
+/*
+Scale : change the replicas of the deployment through the scale subresource.
+*/
+func (h *rolloutHandler) Scale(namespace string, name string, replicas int32) *Result {
+	deploymentsClient := h.kubeClient.AppsV1().Deployments(namespace)
+	scale, err := deploymentsClient.GetScale(name, metav1.GetOptions{})
+	if err != nil {
+		msg := fmt.Sprintf("get deployment scale err -- %s", name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult("Deployment", namespace, name, OutcomeError, msg).setError(err)
+	}
+	if scale.Spec.Replicas == replicas {
+		msg := fmt.Sprintf("deployment is already scaled to %d -- %s", replicas, name)
+		h.logger.Infof(msg)
+		return newResult("Deployment", namespace, name, OutcomeUnchanged, msg).setResourceVersion(scale.ObjectMeta.ResourceVersion)
+	}
+	scale.Spec.Replicas = replicas
+	updated, err := deploymentsClient.UpdateScale(name, scale)
+	if err != nil {
+		msg := fmt.Sprintf("scale deployment err -- %s", name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult("Deployment", namespace, name, OutcomeError, msg).setError(err)
+	}
+	msg := fmt.Sprintf("scale deployment to %d -- %s", replicas, name)
+	h.logger.Infof(msg)
+	return newResult("Deployment", namespace, name, OutcomeUpdated, msg).setResourceVersion(updated.ObjectMeta.ResourceVersion)
+}
+
+/*
+Restart : restart the pods of the deployment by updating an annotation of its pod template like "kubectl rollout restart".
+*/
+func (h *rolloutHandler) Restart(namespace string, name string) *Result {
+	deployment, result := h.get(namespace, name)
+	if result != nil {
+		return result
+	}
+	if deployment.Spec.Paused {
+		msg := fmt.Sprintf("can not restart paused deployment, resume it first -- %s", name)
+		h.logger.Infof(msg)
+		return newResult("Deployment", namespace, name, OutcomeError, msg)
+	}
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`, restartedAtAnnotation, h.getCurrentTime().Format(time.RFC3339))
+	return h.patch(namespace, name, patch, "restart")
+}
+
+/*
+Pause : pause the rollout of the deployment.
+*/
+func (h *rolloutHandler) Pause(namespace string, name string) *Result {
+	return h.setPaused(namespace, name, true)
+}
+
+/*
+Resume : resume the paused rollout of the deployment.
+*/
+func (h *rolloutHandler) Resume(namespace string, name string) *Result {
+	return h.setPaused(namespace, name, false)
+}
+
+func (h *rolloutHandler) setPaused(namespace string, name string, paused bool) *Result {
+	action := "pause"
+	if !paused {
+		action = "resume"
+	}
+	deployment, result := h.get(namespace, name)
+	if result != nil {
+		return result
+	}
+	if deployment.Spec.Paused == paused {
+		msg := fmt.Sprintf("deployment is already %sd -- %s", action, name)
+		h.logger.Infof(msg)
+		return newResult("Deployment", namespace, name, OutcomeUnchanged, msg).setResourceVersion(deployment.ObjectMeta.ResourceVersion)
+	}
+	return h.patch(namespace, name, fmt.Sprintf(`{"spec":{"paused":%t}}`, paused), action)
+}
+
+/*
+Rollback : roll the deployment back to the pod template of the specified revision, or of the previous revision if revision is 0.
+*/
+func (h *rolloutHandler) Rollback(namespace string, name string, revision int64) *Result {
+	deployment, result := h.get(namespace, name)
+	if result != nil {
+		return result
+	}
+	if deployment.Spec.Paused {
+		msg := fmt.Sprintf("can not rollback paused deployment, resume it first -- %s", name)
+		h.logger.Infof(msg)
+		return newResult("Deployment", namespace, name, OutcomeError, msg)
+	}
+	replicaSet, result := h.findRevision(namespace, deployment, revision)
+	if result != nil {
+		return result
+	}
+	toRevision, _ := strconv.ParseInt(replicaSet.ObjectMeta.Annotations[revisionAnnotation], 10, 64)
+	currentRevision, _ := strconv.ParseInt(deployment.ObjectMeta.Annotations[revisionAnnotation], 10, 64)
+	if toRevision == currentRevision {
+		msg := fmt.Sprintf("deployment is already at revision %d -- %s", toRevision, name)
+		h.logger.Infof(msg)
+		return newResult("Deployment", namespace, name, OutcomeUnchanged, msg).setResourceVersion(deployment.ObjectMeta.ResourceVersion)
+	}
+
+	template := replicaSet.Spec.Template.DeepCopy()
+	// the hash label is added to the template of a replicaset by the deployment controller
+	delete(template.ObjectMeta.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+	deploymentsClient := h.kubeClient.AppsV1().Deployments(namespace)
+	var updated *appsv1.Deployment
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := deploymentsClient.Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		current.Spec.Template = *template
+		updated, err = deploymentsClient.Update(current)
+		return err
+	})
+	if err != nil {
+		msg := fmt.Sprintf("rollback deployment err -- %s", name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult("Deployment", namespace, name, OutcomeError, msg).setError(err)
+	}
+	msg := fmt.Sprintf("rollback deployment to revision %d -- %s", toRevision, name)
+	h.logger.Infof(msg)
+	result = newResult("Deployment", namespace, name, OutcomeUpdated, msg).setResourceVersion(updated.ObjectMeta.ResourceVersion)
+	result.updated = updated
+	return result
+}
+
+// findRevision finds the replicaset of the deployment at the revision, or at the latest revision before the current one if revision is 0.
+func (h *rolloutHandler) findRevision(namespace string, deployment *appsv1.Deployment, revision int64) (*appsv1.ReplicaSet, *Result) {
+	name := deployment.ObjectMeta.Name
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		msg := fmt.Sprintf("invalid selector of deployment -- %s", name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return nil, newResult("Deployment", namespace, name, OutcomeError, msg)
+	}
+	replicaSets, err := h.kubeClient.AppsV1().ReplicaSets(namespace).List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		msg := fmt.Sprintf("list replicasets err -- %s", name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return nil, newResult("Deployment", namespace, name, OutcomeError, msg).setError(err)
+	}
+
+	currentRevision, _ := strconv.ParseInt(deployment.ObjectMeta.Annotations[revisionAnnotation], 10, 64)
+	var found *appsv1.ReplicaSet
+	var foundRevision int64
+	for i := range replicaSets.Items {
+		replicaSet := &replicaSets.Items[i]
+		if !metav1.IsControlledBy(replicaSet, deployment) {
+			continue
+		}
+		r, err := strconv.ParseInt(replicaSet.ObjectMeta.Annotations[revisionAnnotation], 10, 64)
+		if err != nil {
+			continue
+		}
+		if revision > 0 {
+			if r == revision {
+				return replicaSet, nil
+			}
+		} else if r < currentRevision && r > foundRevision {
+			found, foundRevision = replicaSet, r
+		}
+	}
+	if found == nil {
+		msg := fmt.Sprintf("no previous revision of deployment -- %s", name)
+		if revision > 0 {
+			msg = fmt.Sprintf("revision %d of deployment is not found -- %s", revision, name)
+		}
+		h.logger.Infof(msg)
+		return nil, newResult("Deployment", namespace, name, OutcomeNotFound, msg)
+	}
+	return found, nil
+}
+
+/*
+Restore : restore the labels, annotations and spec of the deployment to those of previous, which is the deployment before the last apply.
+*/
+func (h *rolloutHandler) Restore(previous *appsv1.Deployment) *Result {
+	namespace, name := previous.ObjectMeta.Namespace, previous.ObjectMeta.Name
+	deploymentsClient := h.kubeClient.AppsV1().Deployments(namespace)
+	var updated *appsv1.Deployment
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := deploymentsClient.Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		current.ObjectMeta.Labels = previous.ObjectMeta.Labels
+		current.ObjectMeta.Annotations = previous.ObjectMeta.Annotations
+		current.Spec = previous.Spec
+		updated, err = deploymentsClient.Update(current)
+		return err
+	})
+	if err != nil {
+		msg := fmt.Sprintf("restore deployment err -- %s", name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult("Deployment", namespace, name, OutcomeError, msg).setError(err)
+	}
+	msg := fmt.Sprintf("rollback deployment to the previously applied spec -- %s", name)
+	h.logger.Infof(msg)
+	return newResult("Deployment", namespace, name, OutcomeUpdated, msg).setResourceVersion(updated.ObjectMeta.ResourceVersion)
+}
+
+/*
+Wait : wait until the rollout of the deployment is completed, failed or timed out, and call progress with the status message whenever it changes.
+*/
+func (h *rolloutHandler) Wait(namespace string, name string, timeout time.Duration, progress func(msg string)) *Result {
+	deployment, result := h.get(namespace, name)
+	if result != nil {
+		return result
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var watcher watch.Interface
+	defer func() {
+		if watcher != nil {
+			watcher.Stop()
+		}
+	}()
+	lastStatus := ""
+	for {
+		status, done, failed := rolloutStatus(deployment)
+		if failed {
+			msg := fmt.Sprintf("deployment exceeded its progress deadline -- %s", name)
+			h.logger.Infof(msg)
+			result := newResult("Deployment", namespace, name, OutcomeError, msg).setResourceVersion(deployment.ObjectMeta.ResourceVersion)
+			result.Reason = progressDeadlineExceededReason
+			return result
+		}
+		if done {
+			msg := fmt.Sprintf("deployment successfully rolled out -- %s", name)
+			h.logger.Infof(msg)
+			return newResult("Deployment", namespace, name, OutcomeReady, msg).setResourceVersion(deployment.ObjectMeta.ResourceVersion)
+		}
+		if status != lastStatus {
+			lastStatus = status
+			msg := fmt.Sprintf("%s -- %s", status, name)
+			h.logger.Infof(msg)
+			progress(msg)
+		}
+
+		if watcher == nil {
+			w, err := h.kubeClient.AppsV1().Deployments(namespace).Watch(metav1.ListOptions{
+				FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+				ResourceVersion: deployment.ObjectMeta.ResourceVersion,
+			})
+			if err != nil {
+				msg := fmt.Sprintf("watch deployment err -- %s", name)
+				h.logger.Errorf("%s: %s", msg, err.Error())
+				return newResult("Deployment", namespace, name, OutcomeError, msg).setError(err)
+			}
+			watcher = w
+		}
+		select {
+		case event, ok := <-watcher.ResultChan():
+			switch {
+			case !ok || event.Type == watch.Error:
+				// the watch is closed or expired, so get the latest deployment and watch it again
+				watcher.Stop()
+				watcher = nil
+				if deployment, result = h.get(namespace, name); result != nil {
+					return result
+				}
+			case event.Type == watch.Deleted:
+				msg := fmt.Sprintf("deployment is deleted while waiting for the rollout -- %s", name)
+				h.logger.Infof(msg)
+				return newResult("Deployment", namespace, name, OutcomeNotFound, msg)
+			default:
+				if d, ok := event.Object.(*appsv1.Deployment); ok {
+					deployment = d
+				}
+			}
+		case <-timer.C:
+			msg := fmt.Sprintf("timed out waiting for the rollout of deployment -- %s", name)
+			h.logger.Infof(msg)
+			result := newResult("Deployment", namespace, name, OutcomeError, msg).setResourceVersion(deployment.ObjectMeta.ResourceVersion)
+			result.Reason = string(metav1.StatusReasonTimeout)
+			return result
+		}
+	}
+}
+
+// rolloutStatus returns the status message of the rollout like "kubectl rollout status", whether it is done and whether it is failed.
+func rolloutStatus(deployment *appsv1.Deployment) (string, bool, bool) {
+	if deployment.ObjectMeta.Generation > deployment.Status.ObservedGeneration {
+		return "waiting for deployment spec update to be observed", false, false
+	}
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Reason == progressDeadlineExceededReason {
+			return condition.Message, false, true
+		}
+	}
+	status := deployment.Status
+	if deployment.Spec.Replicas != nil && status.UpdatedReplicas < *deployment.Spec.Replicas {
+		return fmt.Sprintf("%d out of %d new replicas have been updated", status.UpdatedReplicas, *deployment.Spec.Replicas), false, false
+	}
+	if status.Replicas > status.UpdatedReplicas {
+		return fmt.Sprintf("%d old replicas are pending termination", status.Replicas-status.UpdatedReplicas), false, false
+	}
+	if status.AvailableReplicas < status.UpdatedReplicas {
+		return fmt.Sprintf("%d of %d updated replicas are available", status.AvailableReplicas, status.UpdatedReplicas), false, false
+	}
+	return "", true, false
+}
+
+func (h *rolloutHandler) get(namespace string, name string) (*appsv1.Deployment, *Result) {
+	deployment, err := h.kubeClient.AppsV1().Deployments(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		msg := fmt.Sprintf("get deployment err -- %s", name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return nil, newResult("Deployment", namespace, name, OutcomeError, msg).setError(err)
+	}
+	return deployment, nil
+}
+
+func (h *rolloutHandler) patch(namespace string, name string, patch string, action string) *Result {
+	patched, err := h.kubeClient.AppsV1().Deployments(namespace).Patch(name, types.StrategicMergePatchType, []byte(patch))
+	if err != nil {
+		msg := fmt.Sprintf("%s deployment err -- %s", action, name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult("Deployment", namespace, name, OutcomeError, msg).setError(err)
+	}
+	msg := fmt.Sprintf("%s deployment -- %s", action, name)
+	h.logger.Infof(msg)
+	return newResult("Deployment", namespace, name, OutcomeUpdated, msg).setResourceVersion(patched.ObjectMeta.ResourceVersion)
+}
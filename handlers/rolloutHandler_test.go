@@ -0,0 +1,496 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/mqtt-kube-operator/mock"
+)
+
+func setUpRolloutHandler(t *testing.T) (*rolloutHandler, *mock.MockDeploymentInterface, *mock.MockReplicaSetInterface, func()) {
+	ctrl := gomock.NewController(t)
+
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = zap.NewAtomicLevelAt(zap.FatalLevel)
+	logger, _ := loggerConfig.Build()
+
+	clientset := mock.NewMockInterface(ctrl)
+	mappsv1 := mock.NewMockAppsV1Interface(ctrl)
+	deployment := mock.NewMockDeploymentInterface(ctrl)
+	replicaSet := mock.NewMockReplicaSetInterface(ctrl)
+	clientset.EXPECT().AppsV1().Return(mappsv1).AnyTimes()
+	mappsv1.EXPECT().Deployments("default").Return(deployment).AnyTimes()
+	mappsv1.EXPECT().ReplicaSets("default").Return(replicaSet).AnyTimes()
+
+	handler := &rolloutHandler{
+		kubeClient: clientset,
+		logger:     logger.Sugar(),
+		getCurrentTime: func() time.Time {
+			return time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+		},
+	}
+
+	return handler, deployment, replicaSet, func() {
+		logger.Sync()
+		ctrl.Finish()
+	}
+}
+
+func newRolloutTestDeployment(revision string, paused bool) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "my-deployment",
+			Namespace:       "default",
+			UID:             types.UID("deployment-uid"),
+			ResourceVersion: "10",
+			Annotations:     map[string]string{revisionAnnotation: revision},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nginx"}},
+			Template: newRolloutTestTemplate("nginx:1.3", ""),
+			Paused:   paused,
+		},
+	}
+}
+
+func newRolloutTestTemplate(image string, hash string) apiv1.PodTemplateSpec {
+	template := apiv1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "nginx"}},
+		Spec:       apiv1.PodSpec{Containers: []apiv1.Container{{Name: "nginx", Image: image}}},
+	}
+	if hash != "" {
+		template.ObjectMeta.Labels[appsv1.DefaultDeploymentUniqueLabelKey] = hash
+	}
+	return template
+}
+
+func newRolloutTestReplicaSet(revision string, image string, ownerUID types.UID) appsv1.ReplicaSet {
+	controller := true
+	hash := "hash" + revision
+	return appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "my-deployment-" + hash,
+			Annotations:     map[string]string{revisionAnnotation: revision},
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "my-deployment", UID: ownerUID, Controller: &controller}},
+		},
+		Spec: appsv1.ReplicaSetSpec{Template: newRolloutTestTemplate(image, hash)},
+	}
+}
+
+func TestRolloutScale(t *testing.T) {
+	assert := assert.New(t)
+	handler, deployment, _, tearDown := setUpRolloutHandler(t)
+	defer tearDown()
+
+	newScale := func(replicas int32, resourceVersion string) *autoscalingv1.Scale {
+		return &autoscalingv1.Scale{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-deployment", ResourceVersion: resourceVersion},
+			Spec:       autoscalingv1.ScaleSpec{Replicas: replicas},
+		}
+	}
+
+	t.Run("scale", func(t *testing.T) {
+		deployment.EXPECT().GetScale("my-deployment", metav1.GetOptions{}).Return(newScale(1, "10"), nil)
+		deployment.EXPECT().UpdateScale("my-deployment", newScale(3, "10")).Return(newScale(3, "11"), nil)
+
+		result := handler.Scale("default", "my-deployment", 3)
+		assert.Equal(OutcomeUpdated, result.Outcome)
+		assert.Equal("11", result.ResourceVersion)
+		assert.Equal("scale deployment to 3 -- my-deployment", result.Message)
+	})
+	t.Run("unchanged", func(t *testing.T) {
+		deployment.EXPECT().GetScale("my-deployment", metav1.GetOptions{}).Return(newScale(3, "11"), nil)
+		deployment.EXPECT().UpdateScale(gomock.Any(), gomock.Any()).Times(0)
+
+		result := handler.Scale("default", "my-deployment", 3)
+		assert.Equal(OutcomeUnchanged, result.Outcome)
+		assert.Equal("deployment is already scaled to 3 -- my-deployment", result.Message)
+	})
+	t.Run("not found", func(t *testing.T) {
+		deployment.EXPECT().GetScale("my-deployment", metav1.GetOptions{}).Return(nil, errors.NewNotFound(appsv1.Resource("deployment"), "my-deployment"))
+
+		result := handler.Scale("default", "my-deployment", 3)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(string(metav1.StatusReasonNotFound), result.Reason)
+		assert.Equal("get deployment scale err -- my-deployment", result.Message)
+	})
+	t.Run("failure", func(t *testing.T) {
+		deployment.EXPECT().GetScale("my-deployment", metav1.GetOptions{}).Return(newScale(1, "10"), nil)
+		deployment.EXPECT().UpdateScale("my-deployment", gomock.Any()).Return(nil, fmt.Errorf("failure"))
+
+		result := handler.Scale("default", "my-deployment", 3)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal("scale deployment err -- my-deployment", result.Message)
+	})
+}
+
+func TestRolloutRestart(t *testing.T) {
+	assert := assert.New(t)
+	handler, deployment, _, tearDown := setUpRolloutHandler(t)
+	defer tearDown()
+
+	t.Run("restart", func(t *testing.T) {
+		deployment.EXPECT().Get("my-deployment", metav1.GetOptions{}).Return(newRolloutTestDeployment("2", false), nil)
+		deployment.EXPECT().Patch("my-deployment", types.StrategicMergePatchType,
+			[]byte(`{"spec":{"template":{"metadata":{"annotations":{"kubectl.kubernetes.io/restartedAt":"2018-01-02T03:04:05Z"}}}}}`),
+		).Return(&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "11"}}, nil)
+
+		result := handler.Restart("default", "my-deployment")
+		assert.Equal(OutcomeUpdated, result.Outcome)
+		assert.Equal("11", result.ResourceVersion)
+		assert.Equal("restart deployment -- my-deployment", result.Message)
+	})
+	t.Run("paused", func(t *testing.T) {
+		deployment.EXPECT().Get("my-deployment", metav1.GetOptions{}).Return(newRolloutTestDeployment("2", true), nil)
+		deployment.EXPECT().Patch(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+		result := handler.Restart("default", "my-deployment")
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal("can not restart paused deployment, resume it first -- my-deployment", result.Message)
+	})
+	t.Run("failure", func(t *testing.T) {
+		deployment.EXPECT().Get("my-deployment", metav1.GetOptions{}).Return(newRolloutTestDeployment("2", false), nil)
+		deployment.EXPECT().Patch("my-deployment", types.StrategicMergePatchType, gomock.Any()).Return(nil, fmt.Errorf("failure"))
+
+		result := handler.Restart("default", "my-deployment")
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal("restart deployment err -- my-deployment", result.Message)
+	})
+}
+
+func TestRolloutPauseResume(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		action  string
+		paused  bool
+		patch   string
+		outcome Outcome
+		msg     string
+	}{
+		{action: "pause", paused: false, patch: `{"spec":{"paused":true}}`, outcome: OutcomeUpdated, msg: "pause deployment -- my-deployment"},
+		{action: "pause", paused: true, outcome: OutcomeUnchanged, msg: "deployment is already paused -- my-deployment"},
+		{action: "resume", paused: true, patch: `{"spec":{"paused":false}}`, outcome: OutcomeUpdated, msg: "resume deployment -- my-deployment"},
+		{action: "resume", paused: false, outcome: OutcomeUnchanged, msg: "deployment is already resumed -- my-deployment"},
+	}
+
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("action=%s, paused=%t", c.action, c.paused), func(t *testing.T) {
+			handler, deployment, _, tearDown := setUpRolloutHandler(t)
+			defer tearDown()
+
+			deployment.EXPECT().Get("my-deployment", metav1.GetOptions{}).Return(newRolloutTestDeployment("2", c.paused), nil)
+			if c.patch != "" {
+				deployment.EXPECT().Patch("my-deployment", types.StrategicMergePatchType, []byte(c.patch)).Return(&appsv1.Deployment{}, nil)
+			} else {
+				deployment.EXPECT().Patch(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+			}
+
+			var result *Result
+			if c.action == "pause" {
+				result = handler.Pause("default", "my-deployment")
+			} else {
+				result = handler.Resume("default", "my-deployment")
+			}
+			assert.Equal(c.outcome, result.Outcome)
+			assert.Equal(c.msg, result.Message)
+		})
+	}
+}
+
+func TestRolloutRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	replicaSets := &appsv1.ReplicaSetList{
+		Items: []appsv1.ReplicaSet{
+			newRolloutTestReplicaSet("1", "nginx:1.1", types.UID("deployment-uid")),
+			newRolloutTestReplicaSet("3", "nginx:1.3", types.UID("deployment-uid")),
+			newRolloutTestReplicaSet("2", "nginx:1.2", types.UID("deployment-uid")),
+			newRolloutTestReplicaSet("4", "nginx:1.4", types.UID("other-uid")),
+		},
+	}
+
+	testCases := []struct {
+		name     string
+		current  string
+		revision int64
+		image    string
+		outcome  Outcome
+		msg      string
+	}{
+		{name: "previous", current: "3", revision: 0, image: "nginx:1.2", outcome: OutcomeUpdated, msg: "rollback deployment to revision 2 -- my-deployment"},
+		{name: "revision", current: "3", revision: 1, image: "nginx:1.1", outcome: OutcomeUpdated, msg: "rollback deployment to revision 1 -- my-deployment"},
+		{name: "current revision", current: "3", revision: 3, outcome: OutcomeUnchanged, msg: "deployment is already at revision 3 -- my-deployment"},
+		{name: "not owned revision", current: "3", revision: 4, outcome: OutcomeNotFound, msg: "revision 4 of deployment is not found -- my-deployment"},
+		{name: "no previous", current: "1", revision: 0, outcome: OutcomeNotFound, msg: "no previous revision of deployment -- my-deployment"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			handler, deployment, replicaSet, tearDown := setUpRolloutHandler(t)
+			defer tearDown()
+
+			current := newRolloutTestDeployment(c.current, false)
+			deployment.EXPECT().Get("my-deployment", metav1.GetOptions{}).Return(current, nil)
+			replicaSet.EXPECT().List(metav1.ListOptions{LabelSelector: "app=nginx"}).Return(replicaSets, nil)
+			if c.image != "" {
+				expected := newRolloutTestDeployment(c.current, false)
+				expected.Spec.Template = newRolloutTestTemplate(c.image, "")
+				deployment.EXPECT().Get("my-deployment", metav1.GetOptions{}).Return(newRolloutTestDeployment(c.current, false), nil)
+				deployment.EXPECT().Update(expected).Return(&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "11"}}, nil)
+			} else {
+				deployment.EXPECT().Update(gomock.Any()).Times(0)
+			}
+
+			result := handler.Rollback("default", "my-deployment", c.revision)
+			assert.Equal(c.outcome, result.Outcome)
+			assert.Equal(c.msg, result.Message)
+		})
+	}
+
+	t.Run("paused", func(t *testing.T) {
+		handler, deployment, replicaSet, tearDown := setUpRolloutHandler(t)
+		defer tearDown()
+
+		deployment.EXPECT().Get("my-deployment", metav1.GetOptions{}).Return(newRolloutTestDeployment("3", true), nil)
+		replicaSet.EXPECT().List(gomock.Any()).Times(0)
+
+		result := handler.Rollback("default", "my-deployment", 0)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal("can not rollback paused deployment, resume it first -- my-deployment", result.Message)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		handler, deployment, replicaSet, tearDown := setUpRolloutHandler(t)
+		defer tearDown()
+
+		deployment.EXPECT().Get("my-deployment", metav1.GetOptions{}).Return(newRolloutTestDeployment("3", false), nil).Times(2)
+		replicaSet.EXPECT().List(gomock.Any()).Return(replicaSets, nil)
+		deployment.EXPECT().Update(gomock.Any()).Return(nil, fmt.Errorf("failure"))
+
+		result := handler.Rollback("default", "my-deployment", 0)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal("rollback deployment err -- my-deployment", result.Message)
+	})
+}
+
+func newWaitTestDeployment(observedGeneration int64, replicas int32, updatedReplicas int32, availableReplicas int32, conditions ...appsv1.DeploymentCondition) *appsv1.Deployment {
+	var desiredReplicas int32 = 3
+	deployment := newRolloutTestDeployment("2", false)
+	deployment.ObjectMeta.Generation = 2
+	deployment.Spec.Replicas = &desiredReplicas
+	deployment.Status = appsv1.DeploymentStatus{
+		ObservedGeneration: observedGeneration,
+		Replicas:           replicas,
+		UpdatedReplicas:    updatedReplicas,
+		AvailableReplicas:  availableReplicas,
+		Conditions:         conditions,
+	}
+	return deployment
+}
+
+func TestRolloutWait(t *testing.T) {
+	assert := assert.New(t)
+
+	progressDeadlineExceeded := appsv1.DeploymentCondition{
+		Type:    appsv1.DeploymentProgressing,
+		Status:  apiv1.ConditionFalse,
+		Reason:  "ProgressDeadlineExceeded",
+		Message: `ReplicaSet "my-deployment-hash2" has timed out progressing.`,
+	}
+
+	testCases := []struct {
+		name     string
+		current  *appsv1.Deployment
+		events   []watch.Event
+		close    bool
+		rewatch  []watch.Event
+		outcome  Outcome
+		reason   string
+		msg      string
+		progress []string
+	}{
+		{
+			name:    "already rolled out",
+			current: newWaitTestDeployment(2, 3, 3, 3),
+			outcome: OutcomeReady,
+			msg:     "deployment successfully rolled out -- my-deployment",
+		},
+		{
+			name:    "rolled out",
+			current: newWaitTestDeployment(1, 3, 0, 3),
+			events: []watch.Event{
+				{Type: watch.Modified, Object: newWaitTestDeployment(2, 4, 1, 3)},
+				{Type: watch.Modified, Object: newWaitTestDeployment(2, 4, 1, 3)},
+				{Type: watch.Modified, Object: newWaitTestDeployment(2, 4, 3, 3)},
+				{Type: watch.Modified, Object: newWaitTestDeployment(2, 3, 3, 2)},
+				{Type: watch.Modified, Object: newWaitTestDeployment(2, 3, 3, 3)},
+			},
+			outcome: OutcomeReady,
+			msg:     "deployment successfully rolled out -- my-deployment",
+			progress: []string{
+				"waiting for deployment spec update to be observed -- my-deployment",
+				"1 out of 3 new replicas have been updated -- my-deployment",
+				"1 old replicas are pending termination -- my-deployment",
+				"2 of 3 updated replicas are available -- my-deployment",
+			},
+		},
+		{
+			name:    "progress deadline exceeded",
+			current: newWaitTestDeployment(2, 3, 1, 3),
+			events: []watch.Event{
+				{Type: watch.Modified, Object: newWaitTestDeployment(2, 3, 1, 3, progressDeadlineExceeded)},
+			},
+			outcome:  OutcomeError,
+			reason:   "ProgressDeadlineExceeded",
+			msg:      "deployment exceeded its progress deadline -- my-deployment",
+			progress: []string{"1 out of 3 new replicas have been updated -- my-deployment"},
+		},
+		{
+			name:     "timeout",
+			current:  newWaitTestDeployment(2, 3, 1, 3),
+			outcome:  OutcomeError,
+			reason:   string(metav1.StatusReasonTimeout),
+			msg:      "timed out waiting for the rollout of deployment -- my-deployment",
+			progress: []string{"1 out of 3 new replicas have been updated -- my-deployment"},
+		},
+		{
+			name:    "deleted",
+			current: newWaitTestDeployment(2, 3, 1, 3),
+			events: []watch.Event{
+				{Type: watch.Deleted, Object: newWaitTestDeployment(2, 3, 1, 3)},
+			},
+			outcome:  OutcomeNotFound,
+			msg:      "deployment is deleted while waiting for the rollout -- my-deployment",
+			progress: []string{"1 out of 3 new replicas have been updated -- my-deployment"},
+		},
+		{
+			name:    "watch closed",
+			current: newWaitTestDeployment(2, 3, 1, 3),
+			close:   true,
+			rewatch: []watch.Event{
+				{Type: watch.Modified, Object: newWaitTestDeployment(2, 3, 3, 3)},
+			},
+			outcome: OutcomeReady,
+			msg:     "deployment successfully rolled out -- my-deployment",
+			progress: []string{
+				"1 out of 3 new replicas have been updated -- my-deployment",
+				"2 out of 3 new replicas have been updated -- my-deployment",
+			},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			handler, deployment, _, tearDown := setUpRolloutHandler(t)
+			defer tearDown()
+
+			deployment.EXPECT().Get("my-deployment", metav1.GetOptions{}).Return(c.current, nil)
+			if c.outcome != OutcomeReady || c.events != nil || c.close {
+				watcher := watch.NewFakeWithChanSize(len(c.events), false)
+				for _, event := range c.events {
+					watcher.Action(event.Type, event.Object)
+				}
+				if c.close {
+					watcher.Stop()
+					refreshed := newWaitTestDeployment(2, 3, 2, 3)
+					refreshed.ObjectMeta.ResourceVersion = "20"
+					rewatcher := watch.NewFakeWithChanSize(len(c.rewatch), false)
+					for _, event := range c.rewatch {
+						rewatcher.Action(event.Type, event.Object)
+					}
+					deployment.EXPECT().Get("my-deployment", metav1.GetOptions{}).Return(refreshed, nil)
+					deployment.EXPECT().Watch(metav1.ListOptions{FieldSelector: "metadata.name=my-deployment", ResourceVersion: "20"}).Return(rewatcher, nil)
+				}
+				deployment.EXPECT().Watch(metav1.ListOptions{FieldSelector: "metadata.name=my-deployment", ResourceVersion: "10"}).Return(watcher, nil)
+			}
+
+			var progress []string
+			result := handler.Wait("default", "my-deployment", 100*time.Millisecond, func(msg string) {
+				progress = append(progress, msg)
+			})
+			assert.Equal(c.outcome, result.Outcome)
+			assert.Equal(c.reason, result.Reason)
+			assert.Equal(c.msg, result.Message)
+			assert.Equal(c.progress, progress)
+		})
+	}
+
+	t.Run("watch failure", func(t *testing.T) {
+		handler, deployment, _, tearDown := setUpRolloutHandler(t)
+		defer tearDown()
+
+		deployment.EXPECT().Get("my-deployment", metav1.GetOptions{}).Return(newWaitTestDeployment(2, 3, 1, 3), nil)
+		deployment.EXPECT().Watch(gomock.Any()).Return(nil, errors.NewForbidden(appsv1.Resource("deployment"), "my-deployment", fmt.Errorf("forbidden")))
+
+		result := handler.Wait("default", "my-deployment", time.Second, func(msg string) {})
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(string(metav1.StatusReasonForbidden), result.Reason)
+		assert.Equal("watch deployment err -- my-deployment", result.Message)
+	})
+}
+
+func TestRolloutRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	previous := newRolloutTestDeployment("2", false)
+	previous.ObjectMeta.Labels = map[string]string{"version": "1.2"}
+	previous.Spec.Template = newRolloutTestTemplate("nginx:1.2", "")
+
+	t.Run("restore", func(t *testing.T) {
+		handler, deployment, _, tearDown := setUpRolloutHandler(t)
+		defer tearDown()
+
+		current := newRolloutTestDeployment("3", false)
+		current.ObjectMeta.ResourceVersion = "11"
+		current.ObjectMeta.Labels = map[string]string{"version": "1.3"}
+		expected := current.DeepCopy()
+		expected.ObjectMeta.Labels = previous.ObjectMeta.Labels
+		expected.ObjectMeta.Annotations = previous.ObjectMeta.Annotations
+		expected.Spec = previous.Spec
+
+		gomock.InOrder(
+			deployment.EXPECT().Get("my-deployment", metav1.GetOptions{}).Return(current.DeepCopy(), nil),
+			deployment.EXPECT().Update(gomock.Any()).Return(nil, errors.NewConflict(appsv1.Resource("deployment"), "my-deployment", fmt.Errorf("conflict"))),
+			deployment.EXPECT().Get("my-deployment", metav1.GetOptions{}).Return(current.DeepCopy(), nil),
+			deployment.EXPECT().Update(expected).Return(&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "12"}}, nil),
+		)
+
+		result := handler.Restore(previous)
+		assert.Equal(OutcomeUpdated, result.Outcome)
+		assert.Equal("12", result.ResourceVersion)
+		assert.Equal("rollback deployment to the previously applied spec -- my-deployment", result.Message)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		handler, deployment, _, tearDown := setUpRolloutHandler(t)
+		defer tearDown()
+
+		deployment.EXPECT().Get("my-deployment", metav1.GetOptions{}).Return(nil, errors.NewNotFound(appsv1.Resource("deployment"), "my-deployment"))
+		deployment.EXPECT().Update(gomock.Any()).Times(0)
+
+		result := handler.Restore(previous)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(string(metav1.StatusReasonNotFound), result.Reason)
+		assert.Equal("restore deployment err -- my-deployment", result.Message)
+	})
+}
@@ -30,49 +30,58 @@ func newSecretHandler(clientset *kubernetes.Clientset, logger *zap.SugaredLogger
 	}
 }
 
-func (h *secretHandler) Apply(rawData runtime.Object) string {
+func (h *secretHandler) Apply(rawData runtime.Object) *Result {
 	secret := rawData.(*apiv1.Secret)
-	secretsClient := h.kubeClient.CoreV1().Secrets(apiv1.NamespaceDefault)
+	namespace := secret.ObjectMeta.Namespace
+	secretsClient := h.kubeClient.CoreV1().Secrets(namespace)
 	name := secret.ObjectMeta.Name
 	current, getErr := secretsClient.Get(name, metav1.GetOptions{})
 
 	if current != nil && getErr == nil {
+		resourceVersion := current.ObjectMeta.ResourceVersion
+		var updated *apiv1.Secret
 		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
 			current.ObjectMeta.Labels = secret.ObjectMeta.Labels
 			current.ObjectMeta.Annotations = secret.ObjectMeta.Annotations
 			current.Type = secret.Type
 			current.Data = secret.Data
-			_, err := secretsClient.Update(current)
+			var err error
+			updated, err = secretsClient.Update(current)
 			return err
 		})
 		if err != nil {
 			msg := fmt.Sprintf("update secret err -- %s", name)
 			h.logger.Errorf("%s: %s", msg, err.Error())
-			return msg
+			return newResult("Secret", namespace, name, OutcomeError, msg).setError(err)
 		}
 		msg := fmt.Sprintf("update secret -- %s", name)
 		h.logger.Infof(msg)
-		return msg
+		result := newResult("Secret", namespace, name, OutcomeUpdated, msg)
+		if updated != nil {
+			result.setUpdatedResourceVersion(resourceVersion, updated.ObjectMeta.ResourceVersion)
+		}
+		return result
 	} else if errors.IsNotFound(getErr) {
-		result, err := secretsClient.Create(secret)
+		created, err := secretsClient.Create(secret)
 		if err != nil {
 			msg := fmt.Sprintf("create secret err -- %s", name)
 			h.logger.Errorf("%s: %s", msg, err.Error())
-			return msg
+			return newResult("Secret", namespace, name, OutcomeError, msg).setError(err)
 		}
-		msg := fmt.Sprintf("create secret -- %s", result.GetObjectMeta().GetName())
+		msg := fmt.Sprintf("create secret -- %s", created.GetObjectMeta().GetName())
 		h.logger.Infof(msg)
-		return msg
+		return newResult("Secret", namespace, name, OutcomeCreated, msg).setResourceVersion(created.ObjectMeta.ResourceVersion)
 	} else {
 		msg := fmt.Sprintf("get secret err -- %s", name)
 		h.logger.Errorf("%s: %s", msg, getErr.Error())
-		return msg
+		return newResult("Secret", namespace, name, OutcomeError, msg).setError(getErr)
 	}
 }
 
-func (h *secretHandler) Delete(rawData runtime.Object) string {
+func (h *secretHandler) Delete(rawData runtime.Object) *Result {
 	secret := rawData.(*apiv1.Secret)
-	secretsClient := h.kubeClient.CoreV1().Secrets(apiv1.NamespaceDefault)
+	namespace := secret.ObjectMeta.Namespace
+	secretsClient := h.kubeClient.CoreV1().Secrets(namespace)
 	name := secret.ObjectMeta.Name
 	current, getErr := secretsClient.Get(name, metav1.GetOptions{})
 
@@ -83,18 +92,18 @@ func (h *secretHandler) Delete(rawData runtime.Object) string {
 		}); err != nil {
 			msg := fmt.Sprintf("delete secret err -- %s", name)
 			h.logger.Errorf("%s: %s", msg, err.Error())
-			return msg
+			return newResult("Secret", namespace, name, OutcomeError, msg).setError(err)
 		}
 		msg := fmt.Sprintf("delete secret -- %s", name)
 		h.logger.Infof(msg)
-		return msg
+		return newResult("Secret", namespace, name, OutcomeDeleted, msg).setResourceVersion(current.ObjectMeta.ResourceVersion)
 	} else if errors.IsNotFound(getErr) {
 		msg := fmt.Sprintf("secret does not exist -- %s", name)
 		h.logger.Infof(msg)
-		return msg
+		return newResult("Secret", namespace, name, OutcomeNotFound, msg)
 	} else {
 		msg := fmt.Sprintf("get secret err -- %s", name)
 		h.logger.Errorf("%s: %s", msg, getErr.Error())
-		return msg
+		return newResult("Secret", namespace, name, OutcomeError, msg).setError(getErr)
 	}
 }
@@ -68,7 +68,8 @@ func TestSecretCreate(t *testing.T) {
 		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 		result := handler.Apply(rawData)
-		assert.Equal(fmt.Sprintf("create secret -- %s", name), result)
+		assert.Equal(OutcomeCreated, result.Outcome)
+		assert.Equal(fmt.Sprintf("create secret -- %s", name), result.Message)
 	})
 	t.Run("failure", func(t *testing.T) {
 		client.EXPECT().Get(name, metav1.GetOptions{}).Return(nil, getErr)
@@ -77,7 +78,8 @@ func TestSecretCreate(t *testing.T) {
 		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 		result := handler.Apply(rawData)
-		assert.Equal(fmt.Sprintf("create secret err -- %s", name), result)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(fmt.Sprintf("create secret err -- %s", name), result.Message)
 	})
 }
 
@@ -96,7 +98,8 @@ func TestSecretUpdate(t *testing.T) {
 		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 		result := handler.Apply(rawData)
-		assert.Equal(fmt.Sprintf("update secret -- %s", name), result)
+		assert.Equal(OutcomeUpdated, result.Outcome)
+		assert.Equal(fmt.Sprintf("update secret -- %s", name), result.Message)
 	})
 	t.Run("failure", func(t *testing.T) {
 		client.EXPECT().Get(name, metav1.GetOptions{}).Return(prev, nil)
@@ -105,7 +108,8 @@ func TestSecretUpdate(t *testing.T) {
 		client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 		result := handler.Apply(rawData)
-		assert.Equal(fmt.Sprintf("update secret err -- %s", name), result)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(fmt.Sprintf("update secret err -- %s", name), result.Message)
 	})
 }
 
@@ -120,7 +124,8 @@ func TestSecretApplyGetErr(t *testing.T) {
 	client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 	result := handler.Apply(rawData)
-	assert.Equal(fmt.Sprintf("get secret err -- %s", name), result)
+	assert.Equal(OutcomeError, result.Outcome)
+	assert.Equal(fmt.Sprintf("get secret err -- %s", name), result.Message)
 }
 
 func TestSecretDelete(t *testing.T) {
@@ -137,7 +142,8 @@ func TestSecretDelete(t *testing.T) {
 		client.EXPECT().Delete(name, &metav1.DeleteOptions{PropagationPolicy: &deletePolicy}).Return(nil)
 
 		result := handler.Delete(rawData)
-		assert.Equal(fmt.Sprintf("delete secret -- %s", name), result)
+		assert.Equal(OutcomeDeleted, result.Outcome)
+		assert.Equal(fmt.Sprintf("delete secret -- %s", name), result.Message)
 	})
 	t.Run("failure", func(t *testing.T) {
 		client.EXPECT().Get(name, metav1.GetOptions{}).Return(obj, nil)
@@ -146,7 +152,8 @@ func TestSecretDelete(t *testing.T) {
 		client.EXPECT().Delete(name, &metav1.DeleteOptions{PropagationPolicy: &deletePolicy}).Return(fmt.Errorf("failure"))
 
 		result := handler.Delete(rawData)
-		assert.Equal(fmt.Sprintf("delete secret err -- %s", name), result)
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(fmt.Sprintf("delete secret err -- %s", name), result.Message)
 	})
 }
 
@@ -156,12 +163,13 @@ func TestSecretDeleteError(t *testing.T) {
 	defer tearDown()
 
 	errCases := []struct {
-		name string
-		err  error
-		msg  string
+		name    string
+		err     error
+		msg     string
+		outcome Outcome
 	}{
-		{name: "notfound", err: errors.NewNotFound(apiv1.Resource("secret"), name), msg: "secret does not exist"},
-		{name: "othererr", err: fmt.Errorf("failure"), msg: "get secret err"},
+		{name: "notfound", err: errors.NewNotFound(apiv1.Resource("secret"), name), msg: "secret does not exist", outcome: OutcomeNotFound},
+		{name: "othererr", err: fmt.Errorf("failure"), msg: "get secret err", outcome: OutcomeError},
 	}
 
 	for _, c := range errCases {
@@ -172,7 +180,8 @@ func TestSecretDeleteError(t *testing.T) {
 			client.EXPECT().Delete(gomock.Any(), gomock.Any()).Times(0)
 
 			result := handler.Delete(rawData)
-			assert.Equal(fmt.Sprintf("%s -- %s", c.msg, name), result)
+			assert.Equal(c.outcome, result.Outcome)
+			assert.Equal(fmt.Sprintf("%s -- %s", c.msg, name), result.Message)
 		})
 	}
 }
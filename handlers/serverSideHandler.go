@@ -0,0 +1,205 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+)
+
+/*
+DefaultFieldManager : the field manager name used by server-side apply when no name is configured.
+*/
+const DefaultFieldManager = "mqtt-kube-operator"
+
+var deploymentGroupKind = appsv1.SchemeGroupVersion.WithKind("Deployment").GroupKind()
+
+type serverSideHandler struct {
+	*dynamicHandler
+	fieldManager string
+}
+
+func newServerSideHandler(dynamicClient dynamic.Interface, discoveryClient discovery.DiscoveryInterface, fieldManager string, logger *zap.SugaredLogger) *serverSideHandler {
+	if fieldManager == "" {
+		fieldManager = DefaultFieldManager
+	}
+	return &serverSideHandler{
+		dynamicHandler: newDynamicHandler(dynamicClient, discoveryClient, logger),
+		fieldManager:   fieldManager,
+	}
+}
+
+func (h *serverSideHandler) Apply(rawData runtime.Object) *Result {
+	return h.apply(rawData, false)
+}
+
+func (h *serverSideHandler) ForceApply(rawData runtime.Object) *Result {
+	return h.apply(rawData, true)
+}
+
+func (h *serverSideHandler) apply(rawData runtime.Object, force bool) *Result {
+	obj, err := toUnstructured(rawData)
+	if err != nil {
+		msg := "invalid format, skip this message"
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newErrorResult(msg)
+	}
+	kind := strings.ToLower(obj.GetKind())
+	name := obj.GetName()
+	resourceClient, err := h.getResourceClient(obj)
+	if err != nil {
+		msg := fmt.Sprintf("get %s mapping err -- %s", kind, name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult(obj.GetKind(), obj.GetNamespace(), name, OutcomeError, msg).setError(err)
+	}
+	namespace := obj.GetNamespace()
+
+	// the current object is fetched only to tell whether the apply created, updated or did not change it
+	current, getErr := resourceClient.Get(name, metav1.GetOptions{})
+	if getErr != nil && !errors.IsNotFound(getErr) {
+		msg := fmt.Sprintf("get %s err -- %s", kind, name)
+		h.logger.Errorf("%s: %s", msg, getErr.Error())
+		return newResult(obj.GetKind(), namespace, name, OutcomeError, msg).setError(getErr)
+	}
+
+	data, err := toApplyConfiguration(obj)
+	if err != nil {
+		msg := "invalid format, skip this message"
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult(obj.GetKind(), namespace, name, OutcomeError, msg)
+	}
+
+	options := metav1.PatchOptions{FieldManager: h.fieldManager}
+	if force {
+		options.Force = &force
+	}
+	applied, err := resourceClient.Patch(name, types.ApplyPatchType, data, options)
+	if err != nil {
+		if errors.IsConflict(err) {
+			msg := fmt.Sprintf("apply %s conflict -- %s: %s", kind, name, getConflicts(err))
+			h.logger.Warnf("%s: %s", msg, err.Error())
+			return newResult(obj.GetKind(), namespace, name, OutcomeError, msg).setError(err)
+		}
+		msg := fmt.Sprintf("apply %s err -- %s", kind, name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult(obj.GetKind(), namespace, name, OutcomeError, msg).setError(err)
+	}
+	msg := fmt.Sprintf("apply %s -- %s", kind, name)
+	h.logger.Infof(msg)
+	if current == nil || getErr != nil {
+		result := newResult(obj.GetKind(), namespace, name, OutcomeCreated, msg)
+		if applied != nil {
+			result.setResourceVersion(applied.GetResourceVersion())
+		}
+		return result
+	}
+	result := newResult(obj.GetKind(), namespace, name, OutcomeUpdated, msg)
+	if applied != nil {
+		result.setUpdatedResourceVersion(current.GetResourceVersion(), applied.GetResourceVersion())
+	}
+	if result.Outcome == OutcomeUpdated && obj.GroupVersionKind().GroupKind() == deploymentGroupKind {
+		result.previous = toPreviousDeployment(current, h.logger)
+	}
+	return result
+}
+
+// toPreviousDeployment converts the deployment before the apply, to which it is rolled back when its rollout is failed.
+// It returns nil if the deployment can not be converted, and then the deployment is not rolled back.
+func toPreviousDeployment(current *unstructured.Unstructured, logger *zap.SugaredLogger) runtime.Object {
+	previous := &appsv1.Deployment{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(current.UnstructuredContent(), previous); err != nil {
+		logger.Errorf("convert deployment err, it is not rolled back -- %s: %s", current.GetName(), err.Error())
+		return nil
+	}
+	return previous
+}
+
+func (h *serverSideHandler) DryRun(rawData runtime.Object) *Result {
+	return h.dryRun(rawData, false)
+}
+
+func (h *serverSideHandler) Diff(rawData runtime.Object) *Result {
+	return h.dryRun(rawData, true)
+}
+
+func (h *serverSideHandler) dryRun(rawData runtime.Object, withDiff bool) *Result {
+	obj, err := toUnstructured(rawData)
+	if err != nil {
+		msg := "invalid format, skip this message"
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newErrorResult(msg)
+	}
+	kind := strings.ToLower(obj.GetKind())
+	name := obj.GetName()
+	resourceClient, err := h.getResourceClient(obj)
+	if err != nil {
+		msg := fmt.Sprintf("get %s mapping err -- %s", kind, name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult(obj.GetKind(), obj.GetNamespace(), name, OutcomeError, msg).setError(err)
+	}
+	namespace := obj.GetNamespace()
+
+	live, getErr := resourceClient.Get(name, metav1.GetOptions{})
+	if getErr != nil && !errors.IsNotFound(getErr) {
+		msg := fmt.Sprintf("get %s err -- %s", kind, name)
+		h.logger.Errorf("%s: %s", msg, getErr.Error())
+		return newResult(obj.GetKind(), namespace, name, OutcomeError, msg).setError(getErr)
+	}
+	if getErr != nil {
+		live = nil
+	}
+
+	data, err := toApplyConfiguration(obj)
+	if err != nil {
+		msg := "invalid format, skip this message"
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult(obj.GetKind(), namespace, name, OutcomeError, msg)
+	}
+	options := metav1.PatchOptions{FieldManager: h.fieldManager, DryRun: []string{metav1.DryRunAll}}
+	merged, err := resourceClient.Patch(name, types.ApplyPatchType, data, options)
+	if err != nil {
+		if errors.IsConflict(err) {
+			msg := fmt.Sprintf("dry run %s conflict -- %s: %s", kind, name, getConflicts(err))
+			h.logger.Warnf("%s: %s", msg, err.Error())
+			return newResult(obj.GetKind(), namespace, name, OutcomeError, msg).setError(err)
+		}
+		msg := fmt.Sprintf("dry run %s err -- %s", kind, name)
+		h.logger.Errorf("%s: %s", msg, err.Error())
+		return newResult(obj.GetKind(), namespace, name, OutcomeError, msg).setError(err)
+	}
+	return h.dryRunResult(obj, live, merged, withDiff)
+}
+
+// toApplyConfiguration removes the fields which are owned by the api server and must not be sent in an apply configuration.
+func toApplyConfiguration(obj *unstructured.Unstructured) ([]byte, error) {
+	unstructured.RemoveNestedField(obj.Object, "status")
+	unstructured.RemoveNestedField(obj.Object, "metadata", "creationTimestamp")
+	unstructured.RemoveNestedField(obj.Object, "metadata", "resourceVersion")
+	return obj.MarshalJSON()
+}
+
+func getConflicts(err error) string {
+	status, ok := err.(errors.APIStatus)
+	if !ok || status.Status().Details == nil || len(status.Status().Details.Causes) == 0 {
+		return err.Error()
+	}
+	conflicts := []string{}
+	for _, cause := range status.Status().Details.Causes {
+		conflicts = append(conflicts, fmt.Sprintf("%s %s", cause.Field, cause.Message))
+	}
+	return strings.Join(conflicts, ", ")
+}
@@ -0,0 +1,247 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"go.uber.org/zap"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/mqtt-kube-operator/mock"
+)
+
+var deploymentResource = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+
+func setUpServerSideHandler(t *testing.T) (*serverSideHandler, *mock.MockResourceInterface, runtime.Object, string, func()) {
+	ctrl := gomock.NewController(t)
+
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = zap.NewAtomicLevelAt(zap.FatalLevel)
+	logger, _ := loggerConfig.Build()
+
+	mapper := mock.NewMockRESTMapper(ctrl)
+	dynamicClient := mock.NewMockDynamicInterface(ctrl)
+	namespaceable := mock.NewMockNamespaceableResourceInterface(ctrl)
+	resource := mock.NewMockResourceInterface(ctrl)
+	mapper.EXPECT().RESTMapping(schema.GroupKind{Group: "apps", Kind: "Deployment"}, "v1").Return(&meta.RESTMapping{
+		Resource:         deploymentResource,
+		GroupVersionKind: appsv1.SchemeGroupVersion.WithKind("Deployment"),
+		Scope:            meta.RESTScopeNamespace,
+	}, nil).AnyTimes()
+	dynamicClient.EXPECT().Resource(deploymentResource).Return(namespaceable).AnyTimes()
+	namespaceable.EXPECT().Namespace("default").Return(resource).AnyTimes()
+
+	handler := &serverSideHandler{
+		dynamicHandler: &dynamicHandler{
+			dynamicClient: dynamicClient,
+			mapper:        mapper,
+			logger:        logger.Sugar(),
+		},
+		fieldManager: DefaultFieldManager,
+	}
+
+	_, rawData := getPayloadFromFixture(t, "../testdata/deployment.yaml")
+	rawData.(*appsv1.Deployment).ObjectMeta.Namespace = "default"
+	rawData.GetObjectKind().SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind("Deployment"))
+
+	name := "my-deployment"
+
+	return handler, resource, rawData, name, func() {
+		logger.Sync()
+		ctrl.Finish()
+	}
+}
+
+func TestServerSideApply(t *testing.T) {
+	assert := assert.New(t)
+	handler, client, rawData, name, tearDown := setUpServerSideHandler(t)
+	defer tearDown()
+
+	force := true
+	forceCases := []struct {
+		force   bool
+		options metav1.PatchOptions
+	}{
+		{force: false, options: metav1.PatchOptions{FieldManager: "mqtt-kube-operator"}},
+		{force: true, options: metav1.PatchOptions{FieldManager: "mqtt-kube-operator", Force: &force}},
+	}
+
+	for _, c := range forceCases {
+		t.Run(fmt.Sprintf("force=%v", c.force), func(t *testing.T) {
+			client.EXPECT().Get(name, metav1.GetOptions{}).Return(nil, errors.NewNotFound(deploymentResource.GroupResource(), name))
+			client.EXPECT().Patch(name, types.ApplyPatchType, gomock.Any(), c.options).DoAndReturn(func(name string, pt types.PatchType, data []byte, options metav1.PatchOptions) (*unstructured.Unstructured, error) {
+				m := map[string]interface{}{}
+				assert.Nil(json.Unmarshal(data, &m))
+				assert.Equal("apps/v1", m["apiVersion"])
+				assert.Equal("Deployment", m["kind"])
+				assert.NotContains(m, "status")
+				assert.NotContains(m["metadata"], "creationTimestamp")
+				applied := &unstructured.Unstructured{Object: m}
+				applied.SetResourceVersion("1")
+				return applied, nil
+			})
+			client.EXPECT().Update(gomock.Any(), gomock.Any()).Times(0)
+
+			var result *Result
+			if c.force {
+				result = handler.ForceApply(rawData.DeepCopyObject())
+			} else {
+				result = handler.Apply(rawData.DeepCopyObject())
+			}
+			assert.Equal(OutcomeCreated, result.Outcome)
+			assert.Equal("1", result.ResourceVersion)
+			assert.Equal(fmt.Sprintf("apply deployment -- %s", name), result.Message)
+		})
+	}
+}
+
+func TestServerSideApplyOutcome(t *testing.T) {
+	assert := assert.New(t)
+	handler, client, rawData, name, tearDown := setUpServerSideHandler(t)
+	defer tearDown()
+
+	outcomeCases := []struct {
+		name            string
+		resourceVersion string
+		outcome         Outcome
+	}{
+		{name: "updated", resourceVersion: "2", outcome: OutcomeUpdated},
+		{name: "unchanged", resourceVersion: "1", outcome: OutcomeUnchanged},
+	}
+
+	for _, c := range outcomeCases {
+		t.Run(c.name, func(t *testing.T) {
+			current, err := toUnstructured(rawData.DeepCopyObject())
+			assert.Nil(err)
+			current.SetResourceVersion("1")
+			applied := &unstructured.Unstructured{}
+			applied.SetResourceVersion(c.resourceVersion)
+			client.EXPECT().Get(name, metav1.GetOptions{}).Return(current, nil)
+			client.EXPECT().Patch(name, types.ApplyPatchType, gomock.Any(), gomock.Any()).Return(applied, nil)
+
+			result := handler.Apply(rawData.DeepCopyObject())
+			assert.Equal(c.outcome, result.Outcome)
+			assert.Equal(c.resourceVersion, result.ResourceVersion)
+			assert.Equal(fmt.Sprintf("apply deployment -- %s", name), result.Message)
+			if c.outcome == OutcomeUpdated {
+				previous, ok := result.previous.(*appsv1.Deployment)
+				assert.True(ok)
+				assert.Equal(name, previous.ObjectMeta.Name)
+				assert.Equal("1", previous.ObjectMeta.ResourceVersion)
+				assert.Equal(rawData.(*appsv1.Deployment).Spec.Replicas, previous.Spec.Replicas)
+			} else {
+				assert.Nil(result.previous)
+			}
+		})
+	}
+}
+
+func TestServerSideApplyConflict(t *testing.T) {
+	assert := assert.New(t)
+	handler, client, rawData, name, tearDown := setUpServerSideHandler(t)
+	defer tearDown()
+
+	conflictErr := errors.NewApplyConflict([]metav1.StatusCause{
+		{Type: metav1.CauseTypeFieldManagerConflict, Field: ".spec.replicas", Message: `conflict with "horizontal-pod-autoscaler"`},
+		{Type: metav1.CauseTypeFieldManagerConflict, Field: ".metadata.labels.app", Message: `conflict with "kubectl"`},
+	}, "Apply failed with 2 conflicts")
+	client.EXPECT().Get(name, metav1.GetOptions{}).Return(&unstructured.Unstructured{}, nil)
+	client.EXPECT().Patch(name, types.ApplyPatchType, gomock.Any(), gomock.Any()).Return(nil, conflictErr)
+
+	result := handler.Apply(rawData)
+	assert.Equal(OutcomeError, result.Outcome)
+	assert.Equal(string(metav1.StatusReasonConflict), result.Reason)
+	assert.Equal(fmt.Sprintf(`apply deployment conflict -- %s: .spec.replicas conflict with "horizontal-pod-autoscaler", .metadata.labels.app conflict with "kubectl"`, name), result.Message)
+}
+
+func TestServerSideApplyErr(t *testing.T) {
+	assert := assert.New(t)
+	handler, client, rawData, name, tearDown := setUpServerSideHandler(t)
+	defer tearDown()
+
+	t.Run("get", func(t *testing.T) {
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(nil, fmt.Errorf("failure"))
+		client.EXPECT().Patch(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+		result := handler.Apply(rawData.DeepCopyObject())
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(fmt.Sprintf("get deployment err -- %s", name), result.Message)
+	})
+	t.Run("patch", func(t *testing.T) {
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(&unstructured.Unstructured{}, nil)
+		client.EXPECT().Patch(name, types.ApplyPatchType, gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("failure"))
+
+		result := handler.Apply(rawData.DeepCopyObject())
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(fmt.Sprintf("apply deployment err -- %s", name), result.Message)
+	})
+}
+
+func TestServerSideDryRun(t *testing.T) {
+	assert := assert.New(t)
+	handler, client, rawData, name, tearDown := setUpServerSideHandler(t)
+	defer tearDown()
+
+	options := metav1.PatchOptions{FieldManager: "mqtt-kube-operator", DryRun: []string{metav1.DryRunAll}}
+
+	t.Run("create", func(t *testing.T) {
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(nil, errors.NewNotFound(deploymentResource.GroupResource(), name))
+		client.EXPECT().Patch(name, types.ApplyPatchType, gomock.Any(), options).DoAndReturn(func(name string, pt types.PatchType, data []byte, options metav1.PatchOptions) (*unstructured.Unstructured, error) {
+			applied := &unstructured.Unstructured{}
+			assert.Nil(applied.UnmarshalJSON(data))
+			return applied, nil
+		})
+
+		result := handler.Diff(rawData.DeepCopyObject())
+		assert.Equal(OutcomeCreated, result.Outcome)
+		assert.Equal(fmt.Sprintf("create deployment (dry run) -- %s", name), result.Message)
+		assert.Contains(result.Diff, "+kind: Deployment\n")
+	})
+	t.Run("update", func(t *testing.T) {
+		live, err := toUnstructured(rawData.DeepCopyObject())
+		assert.Nil(err)
+		live.SetResourceVersion("1")
+		assert.Nil(unstructured.SetNestedField(live.Object, int64(1), "spec", "replicas"))
+
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(live, nil)
+		client.EXPECT().Patch(name, types.ApplyPatchType, gomock.Any(), options).DoAndReturn(func(name string, pt types.PatchType, data []byte, options metav1.PatchOptions) (*unstructured.Unstructured, error) {
+			applied := live.DeepCopy()
+			assert.Nil(unstructured.SetNestedField(applied.Object, int64(3), "spec", "replicas"))
+			return applied, nil
+		})
+
+		result := handler.Diff(rawData.DeepCopyObject())
+		assert.Equal(OutcomeUpdated, result.Outcome)
+		assert.Equal(fmt.Sprintf("update deployment (dry run) -- %s", name), result.Message)
+		assert.Equal("1", result.ResourceVersion)
+		assert.Contains(result.Diff, "-  replicas: 1\n+  replicas: 3\n")
+	})
+	t.Run("conflict", func(t *testing.T) {
+		conflictErr := errors.NewApplyConflict([]metav1.StatusCause{
+			{Type: metav1.CauseTypeFieldManagerConflict, Field: ".spec.replicas", Message: `conflict with "kubectl"`},
+		}, "Apply failed with 1 conflict")
+		client.EXPECT().Get(name, metav1.GetOptions{}).Return(&unstructured.Unstructured{}, nil)
+		client.EXPECT().Patch(name, types.ApplyPatchType, gomock.Any(), options).Return(nil, conflictErr)
+
+		result := handler.DryRun(rawData.DeepCopyObject())
+		assert.Equal(OutcomeError, result.Outcome)
+		assert.Equal(fmt.Sprintf(`dry run deployment conflict -- %s: .spec.replicas conflict with "kubectl"`, name), result.Message)
+	})
+}
@@ -30,48 +30,57 @@ func newServiceHandler(clientset *kubernetes.Clientset, logger *zap.SugaredLogge
 	}
 }
 
-func (h *serviceHandler) Apply(rawData runtime.Object) string {
+func (h *serviceHandler) Apply(rawData runtime.Object) *Result {
 	service := rawData.(*apiv1.Service)
-	servicesClient := h.kubeClient.CoreV1().Services(apiv1.NamespaceDefault)
+	namespace := service.ObjectMeta.Namespace
+	servicesClient := h.kubeClient.CoreV1().Services(namespace)
 	name := service.ObjectMeta.Name
 	current, getErr := servicesClient.Get(name, metav1.GetOptions{})
 
 	if current != nil && getErr == nil {
+		resourceVersion := current.ObjectMeta.ResourceVersion
+		var updated *apiv1.Service
 		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
 			current.ObjectMeta.Labels = service.ObjectMeta.Labels
 			current.ObjectMeta.Annotations = service.ObjectMeta.Annotations
 			current.Spec = service.Spec
-			_, err := servicesClient.Update(current)
+			var err error
+			updated, err = servicesClient.Update(current)
 			return err
 		})
 		if err != nil {
 			msg := fmt.Sprintf("update service err -- %s", name)
 			h.logger.Errorf("%s: %s", msg, err.Error())
-			return msg
+			return newResult("Service", namespace, name, OutcomeError, msg).setError(err)
 		}
 		msg := fmt.Sprintf("update service -- %s", name)
 		h.logger.Infof(msg)
-		return msg
+		result := newResult("Service", namespace, name, OutcomeUpdated, msg)
+		if updated != nil {
+			result.setUpdatedResourceVersion(resourceVersion, updated.ObjectMeta.ResourceVersion)
+		}
+		return result
 	} else if errors.IsNotFound(getErr) {
-		result, err := servicesClient.Create(service)
+		created, err := servicesClient.Create(service)
 		if err != nil {
 			msg := fmt.Sprintf("create service err -- %s", name)
 			h.logger.Errorf("%s: %s", msg, err.Error())
-			return msg
+			return newResult("Service", namespace, name, OutcomeError, msg).setError(err)
 		}
-		msg := fmt.Sprintf("create service -- %s", result.GetObjectMeta().GetName())
+		msg := fmt.Sprintf("create service -- %s", created.GetObjectMeta().GetName())
 		h.logger.Infof(msg)
-		return msg
+		return newResult("Service", namespace, name, OutcomeCreated, msg).setResourceVersion(created.ObjectMeta.ResourceVersion)
 	} else {
 		msg := fmt.Sprintf("get service err -- %s", name)
 		h.logger.Errorf("%s: %s", msg, getErr.Error())
-		return msg
+		return newResult("Service", namespace, name, OutcomeError, msg).setError(getErr)
 	}
 }
 
-func (h *serviceHandler) Delete(rawData runtime.Object) string {
+func (h *serviceHandler) Delete(rawData runtime.Object) *Result {
 	service := rawData.(*apiv1.Service)
-	servicesClient := h.kubeClient.CoreV1().Services(apiv1.NamespaceDefault)
+	namespace := service.ObjectMeta.Namespace
+	servicesClient := h.kubeClient.CoreV1().Services(namespace)
 	name := service.ObjectMeta.Name
 	current, getErr := servicesClient.Get(name, metav1.GetOptions{})
 
@@ -82,18 +91,18 @@ func (h *serviceHandler) Delete(rawData runtime.Object) string {
 		}); err != nil {
 			msg := fmt.Sprintf("delete service err -- %s", name)
 			h.logger.Errorf("%s: %s", msg, err.Error())
-			return msg
+			return newResult("Service", namespace, name, OutcomeError, msg).setError(err)
 		}
 		msg := fmt.Sprintf("delete service -- %s", name)
 		h.logger.Infof(msg)
-		return msg
+		return newResult("Service", namespace, name, OutcomeDeleted, msg).setResourceVersion(current.ObjectMeta.ResourceVersion)
 	} else if errors.IsNotFound(getErr) {
 		msg := fmt.Sprintf("service does not exist -- %s", name)
 		h.logger.Infof(msg)
-		return msg
+		return newResult("Service", namespace, name, OutcomeNotFound, msg)
 	} else {
 		msg := fmt.Sprintf("get service err -- %s", name)
 		h.logger.Errorf("%s: %s", msg, getErr.Error())
-		return msg
+		return newResult("Service", namespace, name, OutcomeError, msg).setError(getErr)
 	}
 }
@@ -0,0 +1,186 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"go.uber.org/zap"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+type stateStore struct {
+	kubeClient kubernetes.Interface
+	logger     *zap.SugaredLogger
+	namespace  string
+	name       string
+}
+
+func newStateStore(clientset kubernetes.Interface, logger *zap.SugaredLogger, namespace string, name string) *stateStore {
+	return &stateStore{
+		kubeClient: clientset,
+		logger:     logger,
+		namespace:  namespace,
+		name:       name,
+	}
+}
+
+/*
+Save : persist the object as the desired state, overwriting the previous one.
+The object should be unstructured as written in the manifest, because the zero values of the fields of a typed object
+which are not written in the manifest are also persisted and regarded as drifts from the live object.
+*/
+func (s *stateStore) Save(rawData runtime.Object) error {
+	key, err := stateKey(rawData)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(rawData)
+	if err != nil {
+		return err
+	}
+	return s.update(func(secret *apiv1.Secret) bool {
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		secret.Data[key] = data
+		return true
+	})
+}
+
+/*
+Remove : remove the desired state of the object.
+*/
+func (s *stateStore) Remove(rawData runtime.Object) error {
+	key, err := stateKey(rawData)
+	if err != nil {
+		return err
+	}
+	return s.update(func(secret *apiv1.Secret) bool {
+		if _, ok := secret.Data[key]; !ok {
+			return false
+		}
+		delete(secret.Data, key)
+		return true
+	})
+}
+
+/*
+Find : get the desired state of the object identified by group kind, namespace and name, or nil if it is not stored.
+*/
+func (s *stateStore) Find(groupKind schema.GroupKind, namespace string, name string) (runtime.Object, error) {
+	secret, err := s.get()
+	if err != nil || secret == nil {
+		return nil, err
+	}
+	data, ok := secret.Data[stateKeyOf(groupKind, namespace, name)]
+	if !ok {
+		return nil, nil
+	}
+	return decodeState(data)
+}
+
+/*
+Load : get the desired states of all objects in dependency order.
+*/
+func (s *stateStore) Load() ([]runtime.Object, error) {
+	secret, err := s.get()
+	if err != nil || secret == nil {
+		return nil, err
+	}
+	keys := []string{}
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	objects := []runtime.Object{}
+	for _, key := range keys {
+		rawData, err := decodeState(secret.Data[key])
+		if err != nil {
+			s.logger.Errorf("invalid desired state, skip it -- %s: %s", key, err.Error())
+			continue
+		}
+		objects = append(objects, rawData)
+	}
+	sortManifests(objects, false)
+	return objects, nil
+}
+
+// get returns nil if the secret does not exist yet.
+func (s *stateStore) get() (*apiv1.Secret, error) {
+	secret, err := s.kubeClient.CoreV1().Secrets(s.namespace).Get(s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	return secret, err
+}
+
+// update modifies the secret by modify, which returns false if nothing is modified, and creates the secret if it does not exist.
+func (s *stateStore) update(modify func(secret *apiv1.Secret) bool) error {
+	secretsClient := s.kubeClient.CoreV1().Secrets(s.namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := s.get()
+		if err != nil {
+			return err
+		}
+		if secret == nil {
+			secret = &apiv1.Secret{ObjectMeta: metav1.ObjectMeta{Name: s.name, Namespace: s.namespace}}
+			if !modify(secret) {
+				return nil
+			}
+			_, err = secretsClient.Create(secret)
+			if errors.IsAlreadyExists(err) {
+				// created by another writer in the meantime, so retry to update it
+				return errors.NewConflict(apiv1.Resource("secret"), s.name, err)
+			}
+			return err
+		}
+		if !modify(secret) {
+			return nil
+		}
+		_, err = secretsClient.Update(secret)
+		return err
+	})
+}
+
+// stateKey returns the key of the object like "<namespace>_<kind>.<group>_<name>", which is a valid key of the data of a secret.
+// "_" can not appear in a namespace, a kind, a group nor a name, so the keys of the objects never collide.
+func stateKey(rawData runtime.Object) (string, error) {
+	accessor, err := meta.Accessor(rawData)
+	if err != nil {
+		return "", err
+	}
+	return stateKeyOf(rawData.GetObjectKind().GroupVersionKind().GroupKind(), accessor.GetNamespace(), accessor.GetName()), nil
+}
+
+func stateKeyOf(groupKind schema.GroupKind, namespace string, name string) string {
+	kind := groupKind.Kind
+	if groupKind.Group != "" {
+		kind += "." + groupKind.Group
+	}
+	return fmt.Sprintf("%s_%s_%s", namespace, kind, name)
+}
+
+// decodeState decodes the desired state as an unstructured object, so that it has only the fields written in the manifest.
+func decodeState(data []byte) (runtime.Object, error) {
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
@@ -0,0 +1,236 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"go.uber.org/zap"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/mqtt-kube-operator/mock"
+)
+
+func setUpStateStore(t *testing.T) (*stateStore, *mock.MockSecretInterface, func()) {
+	ctrl := gomock.NewController(t)
+
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = zap.NewAtomicLevelAt(zap.FatalLevel)
+	logger, _ := loggerConfig.Build()
+
+	clientset := mock.NewMockInterface(ctrl)
+	mcorev1 := mock.NewMockCoreV1Interface(ctrl)
+	secret := mock.NewMockSecretInterface(ctrl)
+	clientset.EXPECT().CoreV1().Return(mcorev1).AnyTimes()
+	mcorev1.EXPECT().Secrets("operator").Return(secret).AnyTimes()
+
+	store := newStateStore(clientset, logger.Sugar(), "operator", "state")
+
+	return store, secret, func() {
+		logger.Sync()
+		ctrl.Finish()
+	}
+}
+
+func newStateTestObjects(t *testing.T) (*unstructured.Unstructured, []byte, *unstructured.Unstructured, []byte) {
+	deployment := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "my-deployment", "namespace": "default"},
+		"spec":       map[string]interface{}{"replicas": int64(3)},
+	}}
+	configmap := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "my-configmap", "namespace": "default"},
+		"data":       map[string]interface{}{"key": "value"},
+	}}
+	deploymentData, err := json.Marshal(deployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configmapData, err := json.Marshal(configmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deployment, deploymentData, configmap, configmapData
+}
+
+func TestStateStoreSave(t *testing.T) {
+	assert := assert.New(t)
+	deployment, deploymentData, _, configmapData := newStateTestObjects(t)
+	notFound := errors.NewNotFound(apiv1.Resource("secret"), "state")
+
+	t.Run("create", func(t *testing.T) {
+		store, secret, tearDown := setUpStateStore(t)
+		defer tearDown()
+
+		secret.EXPECT().Get("state", metav1.GetOptions{}).Return(nil, notFound)
+		secret.EXPECT().Create(&apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "state", Namespace: "operator"},
+			Data:       map[string][]byte{"default_Deployment.apps_my-deployment": deploymentData},
+		}).Return(&apiv1.Secret{}, nil)
+
+		assert.Nil(store.Save(deployment))
+	})
+	t.Run("update", func(t *testing.T) {
+		store, secret, tearDown := setUpStateStore(t)
+		defer tearDown()
+
+		secret.EXPECT().Get("state", metav1.GetOptions{}).Return(&apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "state", Namespace: "operator"},
+			Data:       map[string][]byte{"default_ConfigMap_my-configmap": configmapData},
+		}, nil)
+		secret.EXPECT().Update(&apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "state", Namespace: "operator"},
+			Data: map[string][]byte{
+				"default_ConfigMap_my-configmap":        configmapData,
+				"default_Deployment.apps_my-deployment": deploymentData,
+			},
+		}).Return(&apiv1.Secret{}, nil)
+
+		assert.Nil(store.Save(deployment))
+	})
+	t.Run("created by another", func(t *testing.T) {
+		store, secret, tearDown := setUpStateStore(t)
+		defer tearDown()
+
+		gomock.InOrder(
+			secret.EXPECT().Get("state", metav1.GetOptions{}).Return(nil, notFound),
+			secret.EXPECT().Create(gomock.Any()).Return(nil, errors.NewAlreadyExists(apiv1.Resource("secret"), "state")),
+			secret.EXPECT().Get("state", metav1.GetOptions{}).Return(&apiv1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "state", Namespace: "operator"}}, nil),
+			secret.EXPECT().Update(gomock.Any()).Return(&apiv1.Secret{}, nil),
+		)
+
+		assert.Nil(store.Save(deployment))
+	})
+	t.Run("failure", func(t *testing.T) {
+		store, secret, tearDown := setUpStateStore(t)
+		defer tearDown()
+
+		secret.EXPECT().Get("state", metav1.GetOptions{}).Return(nil, fmt.Errorf("failure"))
+		secret.EXPECT().Update(gomock.Any()).Times(0)
+
+		assert.NotNil(store.Save(deployment))
+	})
+}
+
+func TestStateStoreRemove(t *testing.T) {
+	assert := assert.New(t)
+	deployment, _, configmap, configmapData := newStateTestObjects(t)
+
+	store, secret, tearDown := setUpStateStore(t)
+	defer tearDown()
+
+	stored := func() *apiv1.Secret {
+		return &apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "state", Namespace: "operator"},
+			Data:       map[string][]byte{"default_ConfigMap_my-configmap": configmapData},
+		}
+	}
+
+	t.Run("remove", func(t *testing.T) {
+		secret.EXPECT().Get("state", metav1.GetOptions{}).Return(stored(), nil)
+		secret.EXPECT().Update(&apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "state", Namespace: "operator"},
+			Data:       map[string][]byte{},
+		}).Return(&apiv1.Secret{}, nil)
+
+		assert.Nil(store.Remove(configmap))
+	})
+	t.Run("not stored", func(t *testing.T) {
+		secret.EXPECT().Get("state", metav1.GetOptions{}).Return(stored(), nil)
+		secret.EXPECT().Update(gomock.Any()).Times(0)
+
+		assert.Nil(store.Remove(deployment))
+	})
+	t.Run("no secret", func(t *testing.T) {
+		secret.EXPECT().Get("state", metav1.GetOptions{}).Return(nil, errors.NewNotFound(apiv1.Resource("secret"), "state"))
+		secret.EXPECT().Create(gomock.Any()).Times(0)
+
+		assert.Nil(store.Remove(deployment))
+	})
+}
+
+func TestStateStoreLoad(t *testing.T) {
+	assert := assert.New(t)
+	deployment, deploymentData, configmap, configmapData := newStateTestObjects(t)
+
+	store, secret, tearDown := setUpStateStore(t)
+	defer tearDown()
+
+	t.Run("load", func(t *testing.T) {
+		secret.EXPECT().Get("state", metav1.GetOptions{}).Return(&apiv1.Secret{
+			Data: map[string][]byte{
+				"default_Deployment.apps_my-deployment": deploymentData,
+				"default_ConfigMap_my-configmap":        configmapData,
+				"default_Broken_my-broken":              []byte("broken"),
+			},
+		}, nil)
+
+		objects, err := store.Load()
+		assert.Nil(err)
+		assert.Equal([]runtime.Object{configmap, deployment}, objects)
+	})
+	t.Run("no secret", func(t *testing.T) {
+		secret.EXPECT().Get("state", metav1.GetOptions{}).Return(nil, errors.NewNotFound(apiv1.Resource("secret"), "state"))
+
+		objects, err := store.Load()
+		assert.Nil(err)
+		assert.Empty(objects)
+	})
+	t.Run("find", func(t *testing.T) {
+		secret.EXPECT().Get("state", metav1.GetOptions{}).Return(&apiv1.Secret{
+			Data: map[string][]byte{"default_Deployment.apps_my-deployment": deploymentData},
+		}, nil).Times(2)
+
+		found, err := store.Find(schema.GroupKind{Group: "apps", Kind: "Deployment"}, "default", "my-deployment")
+		assert.Nil(err)
+		assert.Equal(deployment, found)
+
+		found, err = store.Find(schema.GroupKind{Group: "apps", Kind: "Deployment"}, "default", "other")
+		assert.Nil(err)
+		assert.Nil(found)
+	})
+}
+
+func TestStateKey(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := stateKey(&appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Name: "my-deployment", Namespace: "default"},
+	})
+	assert.Nil(err)
+	assert.Equal("default_Deployment.apps_my-deployment", key)
+
+	key, err = stateKey(&unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "my-deployment", "namespace": "default"},
+	}})
+	assert.Nil(err)
+	assert.Equal("default_Deployment.example.com_my-deployment", key)
+
+	key, err = stateKey(&apiv1.Namespace{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+		ObjectMeta: metav1.ObjectMeta{Name: "tenant-a"},
+	})
+	assert.Nil(err)
+	assert.Equal("_Namespace_tenant-a", key)
+}
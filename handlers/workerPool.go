@@ -0,0 +1,121 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"sync"
+)
+
+type job struct {
+	keys []string
+	run  func()
+}
+
+// workerPool runs the submitted jobs concurrently, but runs the jobs sharing a key one by one in the submitted order.
+// At most queueSize jobs can wait to be run.
+type workerPool struct {
+	queueSize int
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	pending   []*job
+	running   map[string]bool
+	stopped   bool
+	wg        sync.WaitGroup
+}
+
+func newWorkerPool(workers int, queueSize int) *workerPool {
+	p := &workerPool{
+		queueSize: queueSize,
+		pending:   []*job{},
+		running:   map[string]bool{},
+	}
+	p.cond = sync.NewCond(&p.mutex)
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// submit queues run, and returns false if the queue is full or the pool is stopped.
+func (p *workerPool) submit(keys []string, run func()) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stopped || len(p.pending) >= p.queueSize {
+		return false
+	}
+	p.pending = append(p.pending, &job{keys: keys, run: run})
+	p.cond.Broadcast()
+	return true
+}
+
+// queued returns the number of the jobs waiting to be run.
+func (p *workerPool) queued() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.pending)
+}
+
+// stop rejects new jobs, and waits until the queued jobs finish.
+func (p *workerPool) stop() {
+	p.mutex.Lock()
+	p.stopped = true
+	p.cond.Broadcast()
+	p.mutex.Unlock()
+	p.wg.Wait()
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+	for {
+		p.mutex.Lock()
+		j := p.next()
+		for j == nil {
+			if p.stopped && len(p.pending) == 0 {
+				p.mutex.Unlock()
+				return
+			}
+			p.cond.Wait()
+			j = p.next()
+		}
+		p.mutex.Unlock()
+
+		j.run()
+
+		p.mutex.Lock()
+		for _, key := range j.keys {
+			delete(p.running, key)
+		}
+		p.cond.Broadcast()
+		p.mutex.Unlock()
+	}
+}
+
+// next takes the first pending job which neither shares a key with the running jobs nor with the pending jobs before it.
+// It must be called with the mutex locked.
+func (p *workerPool) next() *job {
+	blocked := map[string]bool{}
+	for i, j := range p.pending {
+		runnable := true
+		for _, key := range j.keys {
+			if p.running[key] || blocked[key] {
+				runnable = false
+			}
+		}
+		if !runnable {
+			for _, key := range j.keys {
+				blocked[key] = true
+			}
+			continue
+		}
+		p.pending = append(p.pending[:i], p.pending[i+1:]...)
+		for _, key := range j.keys {
+			p.running[key] = true
+		}
+		return j
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+/*
+Package handlers : handle MQTT message and deploy object to kubernetes.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package handlers
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolOrder(t *testing.T) {
+	assert := assert.New(t)
+	p := newWorkerPool(2, 10)
+	defer p.stop()
+
+	var mutex sync.Mutex
+	order := []string{}
+	record := func(name string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		order = append(order, name)
+	}
+	started := make(chan bool)
+	release := make(chan bool)
+	done := make(chan bool, 3)
+
+	assert.True(p.submit([]string{"k"}, func() {
+		started <- true
+		<-release
+		record("k1")
+		done <- true
+	}))
+	<-started
+	assert.True(p.submit([]string{"k", "j"}, func() {
+		record("k2")
+		done <- true
+	}))
+	assert.True(p.submit([]string{"i"}, func() {
+		record("i")
+		done <- true
+	}))
+	// the job of the other key runs while the first job of k is running
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the job of the other key is not run")
+	}
+	release <- true
+	<-done
+	<-done
+
+	assert.Equal([]string{"i", "k1", "k2"}, order)
+}
+
+func TestWorkerPoolBlockedByPending(t *testing.T) {
+	assert := assert.New(t)
+	p := newWorkerPool(2, 10)
+	defer p.stop()
+
+	started := make(chan bool)
+	release := make(chan bool)
+	done := make(chan string, 2)
+
+	assert.True(p.submit([]string{"k"}, func() {
+		started <- true
+		<-release
+	}))
+	<-started
+	// the second job shares j with the first pending job, so it waits for it even though j is not running
+	assert.True(p.submit([]string{"k", "j"}, func() {
+		done <- "k-j"
+	}))
+	assert.True(p.submit([]string{"j"}, func() {
+		done <- "j"
+	}))
+	select {
+	case name := <-done:
+		t.Fatalf("%s is run before the former job", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+	release <- true
+	assert.Equal("k-j", <-done)
+	assert.Equal("j", <-done)
+}
+
+func TestWorkerPoolQueueSize(t *testing.T) {
+	assert := assert.New(t)
+	p := newWorkerPool(1, 1)
+
+	started := make(chan bool)
+	release := make(chan bool)
+	ran := make(chan bool, 1)
+
+	assert.True(p.submit([]string{"k"}, func() {
+		started <- true
+		<-release
+	}))
+	<-started
+	assert.True(p.submit([]string{"j"}, func() {
+		ran <- true
+	}))
+	assert.Equal(1, p.queued())
+	assert.False(p.submit([]string{"i"}, func() {}))
+
+	release <- true
+	p.stop()
+	// the queued job is run before stopping
+	assert.Len(ran, 1)
+	assert.False(p.submit([]string{"i"}, func() {}))
+}
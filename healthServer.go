@@ -0,0 +1,94 @@
+/*
+Package main : entry point of mqtt-kube-operator.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"k8s.io/client-go/discovery"
+
+	"github.com/tech-sketch/mqtt-kube-operator/metrics"
+)
+
+// probeTimeout is the timeout of the request to the kubernetes API checked by /readyz.
+const probeTimeout = 5 * time.Second
+
+// healthServer serves /healthz, /readyz and /metrics.
+// /healthz succeeds while the process is alive, and /readyz succeeds while the connection to the MQTT broker is open
+// and the kubernetes API is reachable.
+type healthServer struct {
+	logger     *zap.SugaredLogger
+	mqttClient mqtt.Client
+	kubeClient discovery.ServerVersionInterface
+	server     *http.Server
+}
+
+func newHealthServer(logger *zap.SugaredLogger, address string, mqttClient mqtt.Client, kubeClient discovery.ServerVersionInterface) *healthServer {
+	s := &healthServer{
+		logger:     logger,
+		mqttClient: mqttClient,
+		kubeClient: kubeClient,
+	}
+	s.server = &http.Server{Addr: address, Handler: s.handler()}
+	return s
+}
+
+func (s *healthServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+func (s *healthServer) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *healthServer) readyz(w http.ResponseWriter, r *http.Request) {
+	failures := []string{}
+	// IsConnected is also true while reconnecting
+	if !s.mqttClient.IsConnectionOpen() {
+		failures = append(failures, "mqtt: not connected")
+	}
+	if _, err := s.kubeClient.ServerVersion(); err != nil {
+		failures = append(failures, fmt.Sprintf("kubernetes: %s", err.Error()))
+	}
+	if len(failures) > 0 {
+		s.logger.Debugf("not ready -- %s", strings.Join(failures, ", "))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(failures, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *healthServer) start() {
+	go func() {
+		s.logger.Infof("start http server, address=%s", s.server.Addr)
+		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			s.logger.Errorf("http server error, address=%s: %s", s.server.Addr, err.Error())
+		}
+	}()
+}
+
+func (s *healthServer) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		s.logger.Errorf("http server shutdown error: %s", err.Error())
+	}
+}
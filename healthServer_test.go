@@ -0,0 +1,78 @@
+/*
+Package main : entry point of mqtt-kube-operator.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	k8sversion "k8s.io/apimachinery/pkg/version"
+)
+
+type fakeServerVersion struct {
+	err error
+}
+
+func (f *fakeServerVersion) ServerVersion() (*k8sversion.Info, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &k8sversion.Info{GitVersion: "v1.14.0"}, nil
+}
+
+func TestHealthServer(t *testing.T) {
+	assert := assert.New(t)
+	exec, mqttClient, _, tearDown := setUpMocks(t)
+	defer tearDown()
+
+	get := func(s *healthServer, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		s.handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+
+	t.Run("healthz", func(t *testing.T) {
+		s := newHealthServer(exec.logger, ":0", mqttClient, &fakeServerVersion{err: fmt.Errorf("unreachable")})
+		recorder := get(s, "/healthz")
+		assert.Equal(http.StatusOK, recorder.Code)
+		assert.Equal("ok\n", recorder.Body.String())
+	})
+
+	readyzCases := []struct {
+		name      string
+		connected bool
+		kubeErr   error
+		code      int
+		body      string
+	}{
+		{name: "ready", connected: true, kubeErr: nil, code: http.StatusOK, body: "ok\n"},
+		{name: "mqtt disconnected", connected: false, kubeErr: nil, code: http.StatusServiceUnavailable, body: "mqtt: not connected\n"},
+		{name: "kubernetes unreachable", connected: true, kubeErr: fmt.Errorf("timeout"), code: http.StatusServiceUnavailable, body: "kubernetes: timeout\n"},
+		{name: "both", connected: false, kubeErr: fmt.Errorf("timeout"), code: http.StatusServiceUnavailable, body: "mqtt: not connected\nkubernetes: timeout\n"},
+	}
+
+	for _, c := range readyzCases {
+		t.Run("readyz "+c.name, func(t *testing.T) {
+			mqttClient.EXPECT().IsConnectionOpen().Return(c.connected)
+
+			s := newHealthServer(exec.logger, ":0", mqttClient, &fakeServerVersion{err: c.kubeErr})
+			recorder := get(s, "/readyz")
+			assert.Equal(c.code, recorder.Code)
+			assert.Equal(c.body, recorder.Body.String())
+		})
+	}
+
+	t.Run("metrics", func(t *testing.T) {
+		s := newHealthServer(exec.logger, ":0", mqttClient, &fakeServerVersion{})
+		recorder := get(s, "/metrics")
+		assert.Equal(http.StatusOK, recorder.Code)
+		assert.Contains(recorder.Body.String(), "mqtt_kube_operator_mqtt_connected")
+	})
+}
@@ -6,40 +6,64 @@ Package main : entry point of mqtt-kube-operator.
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
 	"github.com/tech-sketch/mqtt-kube-operator/handlers"
+	"github.com/tech-sketch/mqtt-kube-operator/metrics"
 	"github.com/tech-sketch/mqtt-kube-operator/reporters"
 )
 
+// version is overwritten by the build flags
+var version = "0.2.0"
+
+const (
+	presenceQoS            = 1
+	willPresencePayload    = "status|offline|reason|connection lost"
+	offlinePresencePayload = "status|offline|reason|shutdown"
+)
+
 type executer struct {
 	logger                     *zap.SugaredLogger
 	opts                       *mqtt.ClientOptions
+	useMQTT5                   bool
 	deviceType                 string
 	deviceID                   string
+	startedAt                  time.Time
 	messageHandler             *handlers.MessageHandler
 	mqttClient                 mqtt.Client
+	outbound                   *bufferedClient
+	healthServer               *healthServer
+	cmdQoS                     byte
+	maxRetryInterval           time.Duration
+	sleep                      func(time.Duration)
+	connectionMutex            sync.Mutex
 	usePodStateReporter        bool
 	podStateReporter           reporters.ReporterInf
 	useDeploymentStateReporter bool
 	deploymentStateReporter    reporters.ReporterInf
+	useNodeStateReporter       bool
+	nodeStateReporter          reporters.ReporterInf
+	useEventReporter           bool
+	eventReporter              reporters.ReporterInf
 }
 
 func newExecuter(logger *zap.SugaredLogger) (*executer, error) {
@@ -47,8 +71,14 @@ func newExecuter(logger *zap.SugaredLogger) (*executer, error) {
 		logger:     logger,
 		opts:       mqtt.NewClientOptions(),
 		deviceType: os.Getenv("DEVICE_TYPE"),
-		deviceID:   os.Getenv("DEVICE_ID"),
+		startedAt:  time.Now(),
+		sleep:      time.Sleep,
+	}
+	deviceID, err := getDeviceID()
+	if err != nil {
+		return nil, err
 	}
+	e.deviceID = deviceID
 
 	config, err := e.getKubeConfig()
 	if err != nil {
@@ -58,13 +88,164 @@ func newExecuter(logger *zap.SugaredLogger) (*executer, error) {
 	if err != nil {
 		return nil, err
 	}
+	defaultNamespace, namespaces := e.getNamespaces()
 	e.messageHandler = handlers.NewMessageHandler(clientset, logger, e.deviceType, e.deviceID)
+	e.messageHandler.SetNamespaces(defaultNamespace, namespaces)
+	if resultFormat := os.Getenv("RESULT_FORMAT"); resultFormat != "" {
+		if err := e.messageHandler.SetResultFormat(resultFormat); err != nil {
+			return nil, err
+		}
+	}
+	maxLogPayloadSize, err := getIntEnv("LOGS_MAX_PAYLOAD_BYTES", 64*1024)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.messageHandler.SetMaxLogPayloadSize(maxLogPayloadSize); err != nil {
+		return nil, err
+	}
+	logTailLines, err := getIntEnv("LOGS_DEFAULT_TAIL_LINES", 1000)
+	if err != nil {
+		return nil, err
+	}
+	maxLogBytes, err := getIntEnv("LOGS_MAX_BYTES", 1024*1024)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.messageHandler.SetLogLimits(logTailLines, maxLogBytes); err != nil {
+		return nil, err
+	}
+	waitTimeout, err := getIntEnv("WAIT_TIMEOUT_SEC", 300)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.messageHandler.SetWaitTimeout(waitTimeout); err != nil {
+		return nil, err
+	}
+	autoRollbackDeadline, err := getIntEnv("AUTO_ROLLBACK_DEADLINE_SEC", 0)
+	if err != nil {
+		return nil, err
+	}
+	if autoRollbackDeadline > 0 {
+		if err := e.messageHandler.EnableAutoRollback(autoRollbackDeadline); err != nil {
+			return nil, err
+		}
+	}
+	resultQoS, err := getQoSEnv("MQTT_RESULT_QOS")
+	if err != nil {
+		return nil, err
+	}
+	if err := e.messageHandler.SetResultQoS(int(resultQoS)); err != nil {
+		return nil, err
+	}
+	publishDelay, err := getIntEnv("CMD_PUBLISH_DELAY_MSEC", 500)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.messageHandler.SetPublishDelay(publishDelay); err != nil {
+		return nil, err
+	}
+	workers, err := getIntEnv("CMD_WORKERS", 4)
+	if err != nil {
+		return nil, err
+	}
+	queueSize, err := getIntEnv("CMD_QUEUE_SIZE", 100)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.messageHandler.EnableWorkerPool(workers, queueSize); err != nil {
+		return nil, err
+	}
+	dedupTTL, err := getIntEnv("CMD_DEDUP_TTL_SEC", 0)
+	if err != nil {
+		return nil, err
+	}
+	dedupMaxEntries, err := getIntEnv("CMD_DEDUP_MAX_ENTRIES", 1000)
+	if err != nil {
+		return nil, err
+	}
+	if dedupTTL > 0 {
+		if err := e.messageHandler.EnableCommandDedup(dedupTTL, dedupMaxEntries, os.Getenv("CMD_DEDUP_CACHE_PATH")); err != nil {
+			return nil, err
+		}
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	e.messageHandler.EnableDryRun(dynamicClient, clientset.Discovery())
+	e.messageHandler.EnablePrune(dynamicClient, clientset.Discovery())
+	if allowedKinds := e.getAllowedKinds(); len(allowedKinds) > 0 {
+		if err := e.messageHandler.EnableDynamicHandler(dynamicClient, clientset.Discovery(), allowedKinds); err != nil {
+			return nil, err
+		}
+	}
+	useServerSideApply, err := strconv.ParseBool(os.Getenv("USE_SERVER_SIDE_APPLY"))
+	if err != nil {
+		useServerSideApply = false
+	}
+	if useServerSideApply {
+		e.messageHandler.EnableServerSideApply(dynamicClient, clientset.Discovery(), os.Getenv("FIELD_MANAGER"))
+	}
+	useReconciler, err := strconv.ParseBool(os.Getenv("USE_RECONCILER"))
+	if err != nil {
+		useReconciler = false
+	}
+	if useReconciler {
+		storeNamespace := os.Getenv("STATE_STORE_NAMESPACE")
+		if storeNamespace == "" {
+			storeNamespace = defaultNamespace
+		}
+		storeName := os.Getenv("STATE_STORE_NAME")
+		if storeName == "" {
+			storeName = "mqtt-kube-operator-state"
+		}
+		reconcileInterval, err := getIntEnv("RECONCILE_INTERVAL_SEC", 60)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.messageHandler.EnableReconciler(clientset, dynamicClient, clientset.Discovery(), storeNamespace, storeName, reconcileInterval); err != nil {
+			return nil, err
+		}
+	}
 
 	if err := e.setMQTTOptions(); err != nil {
 		return nil, err
 	}
 	e.opts.OnConnect = e.onConnect
-	e.mqttClient = mqtt.NewClient(e.opts)
+	e.opts.OnConnectionLost = e.onConnectionLost
+	if e.useMQTT5 {
+		if e.mqttClient, err = newMQTT5Client(e.opts, logger); err != nil {
+			return nil, err
+		}
+	} else {
+		e.mqttClient = mqtt.NewClient(e.opts)
+	}
+	outboundQueueSize, err := getIntEnv("OUTBOUND_QUEUE_SIZE", 0)
+	if err != nil {
+		return nil, err
+	}
+	if outboundQueueSize > 0 {
+		policy := os.Getenv("OUTBOUND_QUEUE_DROP_POLICY")
+		if policy == "" {
+			policy = string(dropOldest)
+		}
+		queue, err := newOutboundQueue(logger, outboundQueueSize, policy, os.Getenv("OUTBOUND_QUEUE_PATH"))
+		if err != nil {
+			return nil, err
+		}
+		e.outbound = newBufferedClient(e.mqttClient, logger, queue)
+	}
+	if address := os.Getenv("HTTP_LISTEN_ADDRESS"); address != "" {
+		// the probe must not hang on the kubernetes API, so it uses its own client with a timeout
+		probeConfig := rest.CopyConfig(config)
+		probeConfig.Timeout = probeTimeout
+		probeClientset, err := kubernetes.NewForConfig(probeConfig)
+		if err != nil {
+			return nil, err
+		}
+		e.healthServer = newHealthServer(logger, address, e.mqttClient, probeClientset.Discovery())
+	}
+	publisher := e.getPublisher(e.mqttClient)
 
 	usePodStateReporter, err := strconv.ParseBool(os.Getenv("USE_POD_STATE_REPORTER"))
 	if err != nil {
@@ -78,24 +259,105 @@ func newExecuter(logger *zap.SugaredLogger) (*executer, error) {
 	}
 	e.useDeploymentStateReporter = useDeploymentStateReporter
 
-	getIntervalSec := func() int {
-		intervalSec, err := strconv.Atoi(os.Getenv("REPORT_INTERVAL_SEC"))
-		if err != nil {
-			intervalSec = 1
-		}
-		return intervalSec
+	useNodeStateReporter, err := strconv.ParseBool(os.Getenv("USE_NODE_STATE_REPORTER"))
+	if err != nil {
+		useNodeStateReporter = false
+	}
+	e.useNodeStateReporter = useNodeStateReporter
+
+	useEventReporter, err := strconv.ParseBool(os.Getenv("USE_EVENT_REPORTER"))
+	if err != nil {
+		useEventReporter = false
+	}
+	e.useEventReporter = useEventReporter
+
+	resyncSec, err := e.getResyncSec()
+	if err != nil {
+		return nil, err
+	}
+	eventDedupSec, err := getIntEnv("REPORT_EVENT_DEDUP_SEC", 300)
+	if err != nil {
+		return nil, err
+	}
+	eventRatePerMin, err := getIntEnv("REPORT_EVENT_RATE_PER_MIN", 60)
+	if err != nil {
+		return nil, err
 	}
 	targetLabelKey := os.Getenv("REPORT_TARGET_LABEL_KEY")
+	formatter, err := reporters.NewFormatter(os.Getenv("REPORT_FORMAT"))
+	if err != nil {
+		return nil, err
+	}
+	reportQoS, err := getQoSEnv("MQTT_REPORT_QOS")
+	if err != nil {
+		return nil, err
+	}
+	reportRetain, err := strconv.ParseBool(os.Getenv("MQTT_REPORT_RETAIN"))
+	if err != nil {
+		reportRetain = false
+	}
+	publishOptions := reporters.PublishOptions{QoS: reportQoS, Retained: reportRetain}
 	if e.usePodStateReporter {
-		e.podStateReporter = reporters.NewPodStateReporter(e.mqttClient, clientset, logger, e.deviceType, e.deviceID, getIntervalSec(), targetLabelKey)
+		e.podStateReporter = reporters.NewPodStateReporter(publisher, clientset, logger, e.deviceType, e.deviceID, resyncSec, targetLabelKey, namespaces, formatter, publishOptions)
 	}
 	if e.useDeploymentStateReporter {
-		e.deploymentStateReporter = reporters.NewDeploymentStateReporter(e.mqttClient, clientset, logger, e.deviceType, e.deviceID, getIntervalSec(), targetLabelKey)
+		e.deploymentStateReporter = reporters.NewDeploymentStateReporter(publisher, clientset, logger, e.deviceType, e.deviceID, resyncSec, targetLabelKey, namespaces, formatter, publishOptions)
+	}
+	if e.useNodeStateReporter {
+		e.nodeStateReporter = reporters.NewNodeStateReporter(publisher, clientset, logger, e.deviceType, e.deviceID, resyncSec, targetLabelKey, formatter, publishOptions)
+	}
+	if e.useEventReporter {
+		e.eventReporter = reporters.NewEventReporter(publisher, clientset, logger, e.deviceType, e.deviceID, targetLabelKey, namespaces, formatter,
+			eventDedupSec, eventRatePerMin, publishOptions)
 	}
 
 	return e, nil
 }
 
+// getResyncSec returns REPORT_RESYNC_SEC, or REPORT_INTERVAL_SEC replaced by it if only the latter is set.
+func (e *executer) getResyncSec() (int, error) {
+	if os.Getenv("REPORT_RESYNC_SEC") == "" && os.Getenv("REPORT_INTERVAL_SEC") != "" {
+		e.logger.Warnf("REPORT_INTERVAL_SEC is deprecated, use REPORT_RESYNC_SEC instead")
+		return getIntEnv("REPORT_INTERVAL_SEC", 0)
+	}
+	return getIntEnv("REPORT_RESYNC_SEC", 0)
+}
+
+// getIntEnv returns the value of the environment variable as a non-negative int, or defaultValue if it is not set.
+func getIntEnv(key string, defaultValue int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid %s '%s', expected a non-negative integer", key, value)
+	}
+	return i, nil
+}
+
+// getDeviceID returns DEVICE_ID, which must be a valid label value since the applied objects are labelled with it.
+func getDeviceID() (string, error) {
+	deviceID := os.Getenv("DEVICE_ID")
+	if errs := validation.IsValidLabelValue(deviceID); len(errs) > 0 {
+		return "", fmt.Errorf("invalid DEVICE_ID '%s', %s", deviceID, strings.Join(errs, ", "))
+	}
+	return deviceID, nil
+}
+
+// getQoSEnv returns the value of the environment variable as a MQTT QoS, or 0 if it is not set.
+func getQoSEnv(key string) (byte, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0, nil
+	}
+	qos, err := strconv.Atoi(value)
+	if err != nil || qos < 0 || qos > 2 {
+		return 0, fmt.Errorf("invalid %s '%s', expected 0, 1 or 2", key, value)
+	}
+	return byte(qos), nil
+}
+
 func (e *executer) getKubeConfig() (*rest.Config, error) {
 	kubeConfigPath := os.Getenv("KUBE_CONF_PATH")
 	if kubeConfigPath != "" {
@@ -104,61 +366,231 @@ func (e *executer) getKubeConfig() (*rest.Config, error) {
 	return rest.InClusterConfig()
 }
 
+func (e *executer) getNamespaces() (string, []string) {
+	defaultNamespace := os.Getenv("DEFAULT_NAMESPACE")
+	if defaultNamespace == "" {
+		defaultNamespace = apiv1.NamespaceDefault
+	}
+	namespaces := []string{defaultNamespace}
+	seen := map[string]bool{defaultNamespace: true}
+	for _, namespace := range strings.Split(os.Getenv("ALLOWED_NAMESPACES"), ",") {
+		namespace = strings.TrimSpace(namespace)
+		if namespace == "" || seen[namespace] {
+			continue
+		}
+		seen[namespace] = true
+		namespaces = append(namespaces, namespace)
+	}
+	return defaultNamespace, namespaces
+}
+
+func (e *executer) getAllowedKinds() []string {
+	allowedKinds := []string{}
+	for _, kind := range strings.Split(os.Getenv("ALLOWED_KINDS"), ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			allowedKinds = append(allowedKinds, kind)
+		}
+	}
+	return allowedKinds
+}
+
 func (e *executer) setMQTTOptions() error {
 	useTLS, err := strconv.ParseBool(os.Getenv("MQTT_USE_TLS"))
 	if err != nil {
 		useTLS = true
 	}
-	caPath := os.Getenv("MQTT_TLS_CA_PATH")
 	username := os.Getenv("MQTT_USERNAME")
 	password := os.Getenv("MQTT_PASSWORD")
 	host := os.Getenv("MQTT_HOST")
 	port := os.Getenv("MQTT_PORT")
 
 	if useTLS {
-		ca, err := ioutil.ReadFile(caPath)
+		tlsConfig, err := e.getTLSConfig()
 		if err != nil {
-			return fmt.Errorf("can not read '%s': %s", caPath, err.Error())
+			return err
 		}
-
-		rootCA := x509.NewCertPool()
-		if !rootCA.AppendCertsFromPEM(ca) {
-			return fmt.Errorf("failed to parse root certificate: %s", caPath)
-		}
-		tlsConfig := &tls.Config{RootCAs: rootCA}
 		e.opts.AddBroker(fmt.Sprintf("tls://%s:%s", host, port))
 		e.opts.SetTLSConfig(tlsConfig)
 	} else {
 		e.opts.AddBroker(fmt.Sprintf("tcp://%s:%s", host, port))
 	}
 
-	e.opts.SetClientID("kube-go")
-	e.opts.SetCleanSession(true)
+	clientID := os.Getenv("MQTT_CLIENT_ID")
+	if clientID == "" {
+		clientID = fmt.Sprintf("mqtt-kube-operator-%s-%s", e.deviceType, e.deviceID)
+	}
+	cleanSession, err := strconv.ParseBool(os.Getenv("MQTT_CLEAN_SESSION"))
+	if err != nil {
+		cleanSession = true
+	}
+	cmdQoS, err := getQoSEnv("MQTT_CMD_QOS")
+	if err != nil {
+		return err
+	}
+	e.cmdQoS = cmdQoS
+	maxRetrySec, err := getIntEnv("MQTT_MAX_RECONNECT_INTERVAL_SEC", 60)
+	if err != nil {
+		return err
+	}
+	if maxRetrySec == 0 {
+		return fmt.Errorf("invalid MQTT_MAX_RECONNECT_INTERVAL_SEC 0")
+	}
+	e.maxRetryInterval = time.Duration(maxRetrySec) * time.Second
+	switch protocolVersion := os.Getenv("MQTT_PROTOCOL_VERSION"); protocolVersion {
+	case "", "3.1.1":
+		e.useMQTT5 = false
+	case "5":
+		e.useMQTT5 = true
+	default:
+		return fmt.Errorf("invalid MQTT_PROTOCOL_VERSION '%s', expected 3.1.1 or 5", protocolVersion)
+	}
+
+	e.opts.SetClientID(clientID)
+	e.opts.SetCleanSession(cleanSession)
 	e.opts.SetUsername(username)
 	e.opts.SetPassword(password)
+	e.opts.SetWill(e.getPresenceTopic(), willPresencePayload, presenceQoS, true)
+	e.opts.SetAutoReconnect(true)
+	e.opts.SetMaxReconnectInterval(e.maxRetryInterval)
 
 	return nil
 }
 
 func (e *executer) onConnect(c mqtt.Client) {
-	if cmdToken := c.Subscribe(e.messageHandler.GetCmdTopic(), 0, e.messageHandler.Command()); cmdToken.Wait() && cmdToken.Error() != nil {
-		e.logger.Errorf("mqtt subscribe error, deviceType=%s, deviceID=%s, %s", e.deviceType, e.deviceID, cmdToken.Error())
-		panic(cmdToken.Error())
+	e.connectionMutex.Lock()
+	defer e.connectionMutex.Unlock()
+
+	e.logger.Infof("connected to MQTT Broker, deviceType=%s, deviceID=%s", e.deviceType, e.deviceID)
+	metrics.Connected.Set(1)
+	if !e.subscribe(c) {
+		return
+	}
+	e.publishPresence(c, e.getOnlinePresencePayload())
+	if e.outbound != nil {
+		e.outbound.flush()
 	}
+	e.messageHandler.StartReconciling(e.getPublisher(c))
 	if e.usePodStateReporter {
 		e.podStateReporter.StartReporting()
 	}
 	if e.useDeploymentStateReporter {
 		e.deploymentStateReporter.StartReporting()
 	}
+	if e.useNodeStateReporter {
+		e.nodeStateReporter.StartReporting()
+	}
+	if e.useEventReporter {
+		e.eventReporter.StartReporting()
+	}
+}
+
+// getPresenceTopic returns the topic to publish whether this program is online or offline as a retained message.
+func (e *executer) getPresenceTopic() string {
+	return "/" + e.deviceType + "/" + e.deviceID + "/presence"
+}
+
+func (e *executer) getOnlinePresencePayload() string {
+	reporters := []string{}
+	if e.usePodStateReporter {
+		reporters = append(reporters, "pod")
+	}
+	if e.useDeploymentStateReporter {
+		reporters = append(reporters, "deployment")
+	}
+	if e.useNodeStateReporter {
+		reporters = append(reporters, "node")
+	}
+	if e.useEventReporter {
+		reporters = append(reporters, "event")
+	}
+	return fmt.Sprintf("status|online|version|%s|startedAt|%s|reporters|%s", version, e.startedAt.Format(time.RFC3339), strings.Join(reporters, ","))
+}
+
+// publishPresence publishes the presence directly, because a queued presence is outdated when it is published.
+func (e *executer) publishPresence(c mqtt.Client, payload string) {
+	if token := c.Publish(e.getPresenceTopic(), presenceQoS, true, payload); token.WaitTimeout(5*time.Second) && token.Error() != nil {
+		e.logger.Errorf("mqtt publish error, topic=%s, %s", e.getPresenceTopic(), token.Error())
+		metrics.PublishFailed(e.getPresenceTopic())
+		return
+	}
+	e.logger.Infof("send presence: %s", payload)
+}
+
+// subscribe subscribes the cmd topic, retrying until it succeeds or the connection is lost.
+func (e *executer) subscribe(c mqtt.Client) bool {
+	for interval := time.Second; ; interval = nextRetryInterval(interval, e.maxRetryInterval) {
+		if cmdToken := c.Subscribe(e.messageHandler.GetCmdTopic(), e.cmdQoS, e.onCommand); cmdToken.Wait() && cmdToken.Error() != nil {
+			e.logger.Errorf("mqtt subscribe error, deviceType=%s, deviceID=%s, retry after %s: %s", e.deviceType, e.deviceID, interval, cmdToken.Error())
+			e.sleep(interval)
+			// IsConnected is also true while reconnecting
+			if !c.IsConnectionOpen() {
+				return false
+			}
+			continue
+		}
+		return true
+	}
+}
+
+func (e *executer) onCommand(c mqtt.Client, message mqtt.Message) {
+	e.messageHandler.Command()(e.getPublisher(c), message)
+}
+
+// getPublisher returns the client to publish the messages, which queues them while disconnected if the outbound queue is enabled.
+func (e *executer) getPublisher(c mqtt.Client) mqtt.Client {
+	if e.outbound != nil {
+		return e.outbound
+	}
+	return c
+}
+
+func (e *executer) onConnectionLost(c mqtt.Client, err error) {
+	e.connectionMutex.Lock()
+	defer e.connectionMutex.Unlock()
+
+	metrics.ConnectionLost.Inc()
+	// the client reconnects in parallel, and onConnect may have already run.
+	// IsConnected is also true while reconnecting, which is always the case with AutoReconnect
+	if c.IsConnectionOpen() {
+		return
+	}
+	metrics.Connected.Set(0)
+	e.logger.Errorf("mqtt connection lost, stop reporting until reconnected: %s", err.Error())
+	e.stop()
+}
+
+// stop stops the reconciler and the reporters. They are started again by onConnect.
+func (e *executer) stop() {
+	e.messageHandler.StopReconciling()
+	if e.usePodStateReporter {
+		e.podStateReporter.StopReporting()
+	}
+	if e.useDeploymentStateReporter {
+		e.deploymentStateReporter.StopReporting()
+	}
+	if e.useNodeStateReporter {
+		e.nodeStateReporter.StopReporting()
+	}
+	if e.useEventReporter {
+		e.eventReporter.StopReporting()
+	}
+}
+
+// nextRetryInterval doubles interval up to maxInterval.
+func nextRetryInterval(interval time.Duration, maxInterval time.Duration) time.Duration {
+	if interval *= 2; interval > maxInterval {
+		return maxInterval
+	}
+	return interval
 }
 
 func handle(e *executer) string {
-	if token := e.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		msg := fmt.Sprintf("mqtt connect error: %s", token.Error())
-		e.logger.Errorf(msg)
-		panic(token.Error())
-	} else {
+	for interval := time.Second; ; interval = nextRetryInterval(interval, e.maxRetryInterval) {
+		if token := e.mqttClient.Connect(); token.Wait() && token.Error() != nil {
+			e.logger.Errorf("mqtt connect error, retry after %s: %s", interval, token.Error())
+			e.sleep(interval)
+			continue
+		}
 		msg := fmt.Sprintf("Connected to MQTT Broker(%s), start loop", e.opts.Servers[0].String())
 		e.logger.Infof(msg)
 		return msg
@@ -192,21 +624,26 @@ func main() {
 		logger.Errorf("executer error: %s", err.Error())
 		panic(err)
 	}
-	handle(exec)
-
+	if exec.healthServer != nil {
+		exec.healthServer.start()
+	}
 	go func() {
 		s := <-sigCh
 		logger.Debugf("caught signal :%v", s)
-		if exec.usePodStateReporter {
-			exec.podStateReporter.GetStopCh() <- true
-			<-exec.podStateReporter.GetFinishCh()
+		exec.messageHandler.StopWorkers()
+		exec.stop()
+		if exec.mqttClient.IsConnectionOpen() {
+			// the will is not published on a clean disconnection
+			exec.publishPresence(exec.mqttClient, offlinePresencePayload)
 		}
-		if exec.useDeploymentStateReporter {
-			exec.deploymentStateReporter.GetStopCh() <- true
-			<-exec.deploymentStateReporter.GetFinishCh()
+		exec.mqttClient.Disconnect(250)
+		metrics.Connected.Set(0)
+		if exec.healthServer != nil {
+			exec.healthServer.stop()
 		}
 		exitCh <- true
 	}()
+	go handle(exec)
 
 	<-exitCh
 	logger.Infof("finish main")
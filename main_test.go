@@ -9,16 +9,20 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"go.uber.org/zap"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 
 	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/tech-sketch/mqtt-kube-operator/handlers"
+	"github.com/tech-sketch/mqtt-kube-operator/metrics"
 	"github.com/tech-sketch/mqtt-kube-operator/mock"
 )
 
@@ -31,14 +35,19 @@ func setUpMocks(t *testing.T) (*executer, *mock.MockClient, *mock.MockToken, fun
 
 	mqttClient := mock.NewMockClient(ctrl)
 	token := mock.NewMockToken(ctrl)
-	podStateReporter := mock.NewMockReporterInf(ctrl)
-	deploymentStateReporter := mock.NewMockReporterInf(ctrl)
+	podStateReporter := NewMockReporterInf(ctrl)
+	deploymentStateReporter := NewMockReporterInf(ctrl)
 
 	exec := &executer{
 		logger:                  logger.Sugar(),
+		deviceType:              "testDeviceType",
+		deviceID:                "testDeviceID",
 		mqttClient:              mqttClient,
 		podStateReporter:        podStateReporter,
 		deploymentStateReporter: deploymentStateReporter,
+		startedAt:               time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+		maxRetryInterval:        5 * time.Second,
+		sleep:                   func(time.Duration) {},
 	}
 	return exec, mqttClient, token, func() {
 		logger.Sync()
@@ -192,6 +201,311 @@ func TestGetMQTTOptionsError(t *testing.T) {
 	}
 }
 
+func TestSetMQTTSessionOptions(t *testing.T) {
+	assert := assert.New(t)
+	exec, _, _, tearDown := setUpMocks(t)
+	defer tearDown()
+
+	os.Setenv("MQTT_USE_TLS", "false")
+	defer os.Unsetenv("MQTT_USE_TLS")
+
+	sessionCases := []struct {
+		clientID             string
+		cleanSession         string
+		cmdQoS               string
+		expectedClientID     string
+		expectedCleanSession bool
+		expectedCmdQoS       byte
+		expectedErr          string
+	}{
+		{clientID: "nil", cleanSession: "nil", cmdQoS: "nil", expectedClientID: "mqtt-kube-operator-testDeviceType-testDeviceID", expectedCleanSession: true, expectedCmdQoS: 0},
+		{clientID: "my-client", cleanSession: "false", cmdQoS: "1", expectedClientID: "my-client", expectedCleanSession: false, expectedCmdQoS: 1},
+		{clientID: "", cleanSession: "invalid", cmdQoS: "2", expectedClientID: "mqtt-kube-operator-testDeviceType-testDeviceID", expectedCleanSession: true, expectedCmdQoS: 2},
+		{clientID: "nil", cleanSession: "nil", cmdQoS: "3", expectedErr: "invalid MQTT_CMD_QOS '3', expected 0, 1 or 2"},
+	}
+
+	for _, c := range sessionCases {
+		t.Run(fmt.Sprintf("MQTT_CLIENT_ID=%v, MQTT_CLEAN_SESSION=%v, MQTT_CMD_QOS=%v", c.clientID, c.cleanSession, c.cmdQoS), func(t *testing.T) {
+			if c.clientID != "nil" {
+				os.Setenv("MQTT_CLIENT_ID", c.clientID)
+				defer os.Unsetenv("MQTT_CLIENT_ID")
+			}
+			if c.cleanSession != "nil" {
+				os.Setenv("MQTT_CLEAN_SESSION", c.cleanSession)
+				defer os.Unsetenv("MQTT_CLEAN_SESSION")
+			}
+			if c.cmdQoS != "nil" {
+				os.Setenv("MQTT_CMD_QOS", c.cmdQoS)
+				defer os.Unsetenv("MQTT_CMD_QOS")
+			}
+
+			exec.opts = mqtt.NewClientOptions()
+			err := exec.setMQTTOptions()
+			if c.expectedErr != "" {
+				assert.NotNil(err)
+				assert.Equal(c.expectedErr, err.Error())
+				return
+			}
+			assert.Nil(err)
+			assert.Equal(c.expectedClientID, exec.opts.ClientID)
+			assert.Equal(c.expectedCleanSession, exec.opts.CleanSession)
+			assert.Equal(c.expectedCmdQoS, exec.cmdQoS)
+			assert.True(exec.opts.WillEnabled)
+			assert.Equal("/testDeviceType/testDeviceID/presence", exec.opts.WillTopic)
+			assert.Equal([]byte("status|offline|reason|connection lost"), exec.opts.WillPayload)
+			assert.Equal(byte(1), exec.opts.WillQos)
+			assert.True(exec.opts.WillRetained)
+		})
+	}
+}
+
+func TestSetMQTTProtocolVersion(t *testing.T) {
+	assert := assert.New(t)
+	exec, _, _, tearDown := setUpMocks(t)
+	defer tearDown()
+
+	os.Setenv("MQTT_USE_TLS", "false")
+	defer os.Unsetenv("MQTT_USE_TLS")
+
+	versionCases := []struct {
+		protocolVersion  string
+		expectedUseMQTT5 bool
+		expectedErr      string
+	}{
+		{protocolVersion: "nil", expectedUseMQTT5: false},
+		{protocolVersion: "", expectedUseMQTT5: false},
+		{protocolVersion: "3.1.1", expectedUseMQTT5: false},
+		{protocolVersion: "5", expectedUseMQTT5: true},
+		{protocolVersion: "4", expectedErr: "invalid MQTT_PROTOCOL_VERSION '4', expected 3.1.1 or 5"},
+	}
+
+	for _, c := range versionCases {
+		t.Run(fmt.Sprintf("MQTT_PROTOCOL_VERSION=%v", c.protocolVersion), func(t *testing.T) {
+			if c.protocolVersion != "nil" {
+				os.Setenv("MQTT_PROTOCOL_VERSION", c.protocolVersion)
+				defer os.Unsetenv("MQTT_PROTOCOL_VERSION")
+			}
+
+			exec.opts = mqtt.NewClientOptions()
+			exec.useMQTT5 = !c.expectedUseMQTT5
+			err := exec.setMQTTOptions()
+			if c.expectedErr != "" {
+				assert.NotNil(err)
+				assert.Equal(c.expectedErr, err.Error())
+				return
+			}
+			assert.Nil(err)
+			assert.Equal(c.expectedUseMQTT5, exec.useMQTT5)
+		})
+	}
+}
+
+func TestGetQoSEnv(t *testing.T) {
+	assert := assert.New(t)
+
+	qosCases := []struct {
+		value    string
+		expected byte
+		isErr    bool
+	}{
+		{value: "nil", expected: 0},
+		{value: "", expected: 0},
+		{value: "0", expected: 0},
+		{value: "1", expected: 1},
+		{value: "2", expected: 2},
+		{value: "-1", isErr: true},
+		{value: "3", isErr: true},
+		{value: "invalid", isErr: true},
+	}
+
+	for _, c := range qosCases {
+		t.Run(fmt.Sprintf("MQTT_REPORT_QOS=%v", c.value), func(t *testing.T) {
+			if c.value != "nil" {
+				os.Setenv("MQTT_REPORT_QOS", c.value)
+				defer os.Unsetenv("MQTT_REPORT_QOS")
+			}
+
+			qos, err := getQoSEnv("MQTT_REPORT_QOS")
+			if c.isErr {
+				assert.NotNil(err)
+			} else {
+				assert.Nil(err)
+				assert.Equal(c.expected, qos)
+			}
+		})
+	}
+}
+
+func TestGetIntEnv(t *testing.T) {
+	assert := assert.New(t)
+
+	intCases := []struct {
+		value    string
+		expected int
+		isErr    bool
+	}{
+		{value: "nil", expected: 60},
+		{value: "", expected: 60},
+		{value: "0", expected: 0},
+		{value: "30", expected: 30},
+		{value: "-1", isErr: true},
+		{value: "1.5", isErr: true},
+		{value: "invalid", isErr: true},
+	}
+
+	for _, c := range intCases {
+		t.Run(fmt.Sprintf("RECONCILE_INTERVAL_SEC=%v", c.value), func(t *testing.T) {
+			if c.value != "nil" {
+				os.Setenv("RECONCILE_INTERVAL_SEC", c.value)
+				defer os.Unsetenv("RECONCILE_INTERVAL_SEC")
+			}
+
+			value, err := getIntEnv("RECONCILE_INTERVAL_SEC", 60)
+			if c.isErr {
+				assert.NotNil(err)
+				assert.Equal(fmt.Sprintf("invalid RECONCILE_INTERVAL_SEC '%s', expected a non-negative integer", c.value), err.Error())
+			} else {
+				assert.Nil(err)
+				assert.Equal(c.expected, value)
+			}
+		})
+	}
+}
+
+func TestGetDeviceID(t *testing.T) {
+	assert := assert.New(t)
+
+	deviceIDCases := []struct {
+		value string
+		isErr bool
+	}{
+		{value: ""},
+		{value: "deployer_01"},
+		{value: "deployer.01-a"},
+		{value: "deployer/01", isErr: true},
+		{value: "deployer 01", isErr: true},
+		{value: strings.Repeat("a", 64), isErr: true},
+	}
+
+	for _, c := range deviceIDCases {
+		t.Run(fmt.Sprintf("DEVICE_ID=%v", c.value), func(t *testing.T) {
+			os.Setenv("DEVICE_ID", c.value)
+			defer os.Unsetenv("DEVICE_ID")
+
+			deviceID, err := getDeviceID()
+			if c.isErr {
+				assert.NotNil(err)
+				assert.True(strings.HasPrefix(err.Error(), fmt.Sprintf("invalid DEVICE_ID '%s', ", c.value)))
+			} else {
+				assert.Nil(err)
+				assert.Equal(c.value, deviceID)
+			}
+		})
+	}
+}
+
+func TestGetResyncSec(t *testing.T) {
+	assert := assert.New(t)
+	exec, _, _, tearDown := setUpMocks(t)
+	defer tearDown()
+
+	resyncCases := []struct {
+		resync   string
+		interval string
+		expected int
+		isErr    bool
+	}{
+		{resync: "nil", interval: "nil", expected: 0},
+		{resync: "300", interval: "nil", expected: 300},
+		{resync: "nil", interval: "60", expected: 60},
+		{resync: "300", interval: "60", expected: 300},
+		{resync: "nil", interval: "invalid", isErr: true},
+	}
+
+	for _, c := range resyncCases {
+		t.Run(fmt.Sprintf("REPORT_RESYNC_SEC=%v, REPORT_INTERVAL_SEC=%v", c.resync, c.interval), func(t *testing.T) {
+			if c.resync != "nil" {
+				os.Setenv("REPORT_RESYNC_SEC", c.resync)
+				defer os.Unsetenv("REPORT_RESYNC_SEC")
+			}
+			if c.interval != "nil" {
+				os.Setenv("REPORT_INTERVAL_SEC", c.interval)
+				defer os.Unsetenv("REPORT_INTERVAL_SEC")
+			}
+
+			resyncSec, err := exec.getResyncSec()
+			if c.isErr {
+				assert.NotNil(err)
+			} else {
+				assert.Nil(err)
+				assert.Equal(c.expected, resyncSec)
+			}
+		})
+	}
+}
+
+func TestGetNamespaces(t *testing.T) {
+	assert := assert.New(t)
+	exec, _, _, tearDown := setUpMocks(t)
+	defer tearDown()
+
+	namespaceCases := []struct {
+		defaultNamespace  string
+		allowedNamespaces string
+		expectedDefault   string
+		expected          []string
+	}{
+		{defaultNamespace: "nil", allowedNamespaces: "nil", expectedDefault: "default", expected: []string{"default"}},
+		{defaultNamespace: "", allowedNamespaces: "", expectedDefault: "default", expected: []string{"default"}},
+		{defaultNamespace: "tenant-a", allowedNamespaces: "nil", expectedDefault: "tenant-a", expected: []string{"tenant-a"}},
+		{defaultNamespace: "nil", allowedNamespaces: "tenant-a, tenant-b,,default,tenant-a", expectedDefault: "default", expected: []string{"default", "tenant-a", "tenant-b"}},
+	}
+
+	for _, c := range namespaceCases {
+		t.Run(fmt.Sprintf("DEFAULT_NAMESPACE=%v, ALLOWED_NAMESPACES=%v", c.defaultNamespace, c.allowedNamespaces), func(t *testing.T) {
+			if c.defaultNamespace != "nil" {
+				os.Setenv("DEFAULT_NAMESPACE", c.defaultNamespace)
+				defer os.Unsetenv("DEFAULT_NAMESPACE")
+			}
+			if c.allowedNamespaces != "nil" {
+				os.Setenv("ALLOWED_NAMESPACES", c.allowedNamespaces)
+				defer os.Unsetenv("ALLOWED_NAMESPACES")
+			}
+
+			defaultNamespace, namespaces := exec.getNamespaces()
+			assert.Equal(c.expectedDefault, defaultNamespace)
+			assert.Equal(c.expected, namespaces)
+		})
+	}
+}
+
+func TestGetAllowedKinds(t *testing.T) {
+	assert := assert.New(t)
+	exec, _, _, tearDown := setUpMocks(t)
+	defer tearDown()
+
+	kindCases := []struct {
+		allowedKinds string
+		expected     []string
+	}{
+		{allowedKinds: "nil", expected: []string{}},
+		{allowedKinds: "", expected: []string{}},
+		{allowedKinds: "apps/v1/StatefulSet", expected: []string{"apps/v1/StatefulSet"}},
+		{allowedKinds: " apps/v1/StatefulSet,,batch/v1/Job ", expected: []string{"apps/v1/StatefulSet", "batch/v1/Job"}},
+	}
+
+	for _, c := range kindCases {
+		t.Run(fmt.Sprintf("ALLOWED_KINDS=%v", c.allowedKinds), func(t *testing.T) {
+			if c.allowedKinds != "nil" {
+				os.Setenv("ALLOWED_KINDS", c.allowedKinds)
+				defer os.Unsetenv("ALLOWED_KINDS")
+			}
+
+			assert.Equal(c.expected, exec.getAllowedKinds())
+		})
+	}
+}
+
 func TestHandle(t *testing.T) {
 	assert := assert.New(t)
 	exec, mqttClient, token, tearDown := setUpMocks(t)
@@ -200,11 +514,39 @@ func TestHandle(t *testing.T) {
 	exec.opts = mqtt.NewClientOptions()
 	exec.opts.AddBroker("tcp://mqtt.example.com:1883")
 
-	mqttClient.EXPECT().Connect().Return(token)
-	token.EXPECT().Wait().Return(false)
+	t.Run("connected", func(t *testing.T) {
+		mqttClient.EXPECT().Connect().Return(token)
+		token.EXPECT().Wait().Return(false)
+
+		msg := handle(exec)
+		assert.Equal("Connected to MQTT Broker(tcp://mqtt.example.com:1883), start loop", msg)
+	})
+	t.Run("retry", func(t *testing.T) {
+		intervals := []time.Duration{}
+		exec.sleep = func(interval time.Duration) {
+			intervals = append(intervals, interval)
+		}
+		defer func() {
+			exec.sleep = func(time.Duration) {}
+		}()
+
+		mqttClient.EXPECT().Connect().Return(token).Times(5)
+		token.EXPECT().Wait().Return(true).Times(5)
+		gomock.InOrder(
+			token.EXPECT().Error().Return(fmt.Errorf("connErr")).Times(8),
+			token.EXPECT().Error().Return(nil),
+		)
+
+		msg := handle(exec)
+		assert.Equal("Connected to MQTT Broker(tcp://mqtt.example.com:1883), start loop", msg)
+		assert.Equal([]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}, intervals)
+	})
+}
 
-	msg := handle(exec)
-	assert.Equal("Connected to MQTT Broker(tcp://mqtt.example.com:1883), start loop", msg)
+func TestNextRetryInterval(t *testing.T) {
+	assert.Equal(t, 2*time.Second, nextRetryInterval(time.Second, time.Minute))
+	assert.Equal(t, time.Minute, nextRetryInterval(40*time.Second, time.Minute))
+	assert.Equal(t, time.Minute, nextRetryInterval(time.Minute, time.Minute))
 }
 
 func TestOnConnect(t *testing.T) {
@@ -232,14 +574,26 @@ func TestOnConnect(t *testing.T) {
 				exec.usePodStateReporter = pCase.use
 				exec.useDeploymentStateReporter = dCase.use
 
+				reporters := []string{}
+				if exec.usePodStateReporter {
+					reporters = append(reporters, "pod")
+				}
+				if exec.useDeploymentStateReporter {
+					reporters = append(reporters, "deployment")
+				}
+				presence := fmt.Sprintf("status|online|version|%s|startedAt|2018-01-02T03:04:05Z|reporters|%s", version, strings.Join(reporters, ","))
+
 				mqttClient.EXPECT().Subscribe("/testDeviceType/testDeviceID/cmd", byte(0), gomock.Any()).Return(token)
 				token.EXPECT().Wait().Return(true)
 				token.EXPECT().Error().Return(nil)
+				mqttClient.EXPECT().Publish("/testDeviceType/testDeviceID/presence", byte(1), true, presence).Return(token)
+				token.EXPECT().WaitTimeout(gomock.Any()).Return(true)
+				token.EXPECT().Error().Return(nil)
 				if exec.usePodStateReporter {
-					exec.podStateReporter.(*mock.MockReporterInf).EXPECT().StartReporting()
+					exec.podStateReporter.(*MockReporterInf).EXPECT().StartReporting()
 				}
 				if exec.useDeploymentStateReporter {
-					exec.deploymentStateReporter.(*mock.MockReporterInf).EXPECT().StartReporting()
+					exec.deploymentStateReporter.(*MockReporterInf).EXPECT().StartReporting()
 				}
 
 				exec.onConnect(mqttClient)
@@ -247,3 +601,91 @@ func TestOnConnect(t *testing.T) {
 		}
 	}
 }
+
+func TestOnConnectSubscribeError(t *testing.T) {
+	exec, mqttClient, token, tearDown := setUpMocks(t)
+	defer tearDown()
+
+	exec.messageHandler = handlers.NewMessageHandler(nil, exec.logger, "testDeviceType", "testDeviceID")
+	exec.usePodStateReporter = true
+
+	t.Run("retry", func(t *testing.T) {
+		gomock.InOrder(
+			mqttClient.EXPECT().Subscribe("/testDeviceType/testDeviceID/cmd", byte(0), gomock.Any()).Return(token),
+			mqttClient.EXPECT().IsConnectionOpen().Return(true),
+			mqttClient.EXPECT().Subscribe("/testDeviceType/testDeviceID/cmd", byte(0), gomock.Any()).Return(token),
+			mqttClient.EXPECT().Publish("/testDeviceType/testDeviceID/presence", byte(1), true, gomock.Any()).Return(token),
+			exec.podStateReporter.(*MockReporterInf).EXPECT().StartReporting(),
+		)
+		gomock.InOrder(
+			token.EXPECT().Wait().Return(true),
+			token.EXPECT().Error().Return(fmt.Errorf("subscribeErr")).Times(2),
+			token.EXPECT().Wait().Return(true),
+			token.EXPECT().Error().Return(nil),
+			token.EXPECT().WaitTimeout(gomock.Any()).Return(true),
+			token.EXPECT().Error().Return(nil),
+		)
+
+		exec.onConnect(mqttClient)
+	})
+	t.Run("connection lost", func(t *testing.T) {
+		mqttClient.EXPECT().Subscribe("/testDeviceType/testDeviceID/cmd", byte(0), gomock.Any()).Return(token)
+		token.EXPECT().Wait().Return(true)
+		token.EXPECT().Error().Return(fmt.Errorf("subscribeErr")).Times(2)
+		// paho keeps IsConnected true while reconnecting
+		mqttClient.EXPECT().IsConnected().Return(true).AnyTimes()
+		mqttClient.EXPECT().IsConnectionOpen().Return(false)
+		exec.podStateReporter.(*MockReporterInf).EXPECT().StartReporting().Times(0)
+
+		exec.onConnect(mqttClient)
+	})
+}
+
+func TestOnConnectionLost(t *testing.T) {
+	exec, mqttClient, _, tearDown := setUpMocks(t)
+	defer tearDown()
+
+	exec.messageHandler = handlers.NewMessageHandler(nil, exec.logger, "testDeviceType", "testDeviceID")
+	exec.usePodStateReporter = true
+	exec.useDeploymentStateReporter = false
+
+	t.Run("reconnected", func(t *testing.T) {
+		metrics.Connected.Set(1)
+		mqttClient.EXPECT().IsConnected().Return(true).AnyTimes()
+		mqttClient.EXPECT().IsConnectionOpen().Return(true)
+		exec.podStateReporter.(*MockReporterInf).EXPECT().StopReporting().Times(0)
+
+		exec.onConnectionLost(mqttClient, fmt.Errorf("connLost"))
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.Connected))
+	})
+	t.Run("reconnecting", func(t *testing.T) {
+		// paho sets the status to reconnecting before calling OnConnectionLost, and IsConnected is true in this status
+		mqttClient.EXPECT().IsConnected().Return(true).AnyTimes()
+		mqttClient.EXPECT().IsConnectionOpen().Return(false)
+		exec.podStateReporter.(*MockReporterInf).EXPECT().StopReporting()
+		exec.deploymentStateReporter.(*MockReporterInf).EXPECT().StopReporting().Times(0)
+
+		exec.onConnectionLost(mqttClient, fmt.Errorf("connLost"))
+		assert.Equal(t, float64(0), testutil.ToFloat64(metrics.Connected))
+	})
+}
+
+func TestPublishPresence(t *testing.T) {
+	exec, mqttClient, token, tearDown := setUpMocks(t)
+	defer tearDown()
+
+	t.Run("published", func(t *testing.T) {
+		mqttClient.EXPECT().Publish("/testDeviceType/testDeviceID/presence", byte(1), true, "status|offline|reason|shutdown").Return(token)
+		token.EXPECT().WaitTimeout(5 * time.Second).Return(true)
+		token.EXPECT().Error().Return(nil)
+
+		exec.publishPresence(mqttClient, offlinePresencePayload)
+	})
+	t.Run("publish error", func(t *testing.T) {
+		mqttClient.EXPECT().Publish("/testDeviceType/testDeviceID/presence", byte(1), true, "status|offline|reason|shutdown").Return(token)
+		token.EXPECT().WaitTimeout(5 * time.Second).Return(true)
+		token.EXPECT().Error().Return(fmt.Errorf("publishErr")).Times(2)
+
+		exec.publishPresence(mqttClient, offlinePresencePayload)
+	})
+}
@@ -0,0 +1,137 @@
+/*
+Package metrics : expose the metrics of mqtt-kube-operator to Prometheus.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package metrics
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "mqtt_kube_operator"
+
+/*
+Registry : the registry of the metrics exposed by mqtt-kube-operator.
+*/
+var Registry = prometheus.NewRegistry()
+
+/*
+Commands : the number of the results of the commands by action, kind and outcome.
+*/
+var Commands = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "commands_total",
+	Help:      "The number of the results of the commands by action, kind and outcome.",
+}, []string{"action", "kind", "outcome"})
+
+/*
+CommandDuration : the time to process a command by action.
+*/
+var CommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "command_duration_seconds",
+	Help:      "The time to process a command by action.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"action"})
+
+/*
+ApplyDuration : the time to apply an object to kubernetes by kind.
+*/
+var ApplyDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "apply_duration_seconds",
+	Help:      "The time to apply an object to kubernetes by kind.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"kind"})
+
+/*
+ReportDuration : the time of a resync cycle of a reporter, or to report an event of its informer.
+*/
+var ReportDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "reporter_cycle_duration_seconds",
+	Help:      "The time of a resync cycle of a reporter, or to report an event of its informer.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"reporter"})
+
+/*
+PublishFailures : the number of the messages which could not be published by the kind of topic.
+*/
+var PublishFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "publish_failures_total",
+	Help:      "The number of the messages which could not be published by the kind of topic.",
+}, []string{"topic"})
+
+/*
+Connected : 1 if the connection to the MQTT broker is open, otherwise 0.
+*/
+var Connected = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "mqtt_connected",
+	Help:      "1 if the connection to the MQTT broker is open, otherwise 0.",
+})
+
+/*
+ConnectionLost : the number of the times the connection to the MQTT broker was lost.
+*/
+var ConnectionLost = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "mqtt_connection_lost_total",
+	Help:      "The number of the times the connection to the MQTT broker was lost.",
+})
+
+/*
+OutboundQueued : the number of the messages waiting in the outbound queue.
+*/
+var OutboundQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "outbound_queued_messages",
+	Help:      "The number of the messages waiting in the outbound queue.",
+})
+
+/*
+OutboundDropped : the number of the messages dropped because the outbound queue was full.
+*/
+var OutboundDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "outbound_dropped_messages_total",
+	Help:      "The number of the messages dropped because the outbound queue was full.",
+})
+
+/*
+OutboundFlushed : the number of the queued messages published after all.
+*/
+var OutboundFlushed = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "outbound_flushed_messages_total",
+	Help:      "The number of the queued messages published after all.",
+})
+
+func init() {
+	Registry.MustRegister(
+		Commands,
+		CommandDuration,
+		ApplyDuration,
+		ReportDuration,
+		PublishFailures,
+		Connected,
+		ConnectionLost,
+		OutboundQueued,
+		OutboundDropped,
+		OutboundFlushed,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+/*
+PublishFailed : count a message which could not be published to topic.
+The last element of topic like "attrs" or "cmdexe" is used as the label so that the device type and id do not appear in it.
+*/
+func PublishFailed(topic string) {
+	PublishFailures.WithLabelValues(topic[strings.LastIndex(topic, "/")+1:]).Inc()
+}
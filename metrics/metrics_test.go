@@ -0,0 +1,50 @@
+/*
+Package metrics : expose the metrics of mqtt-kube-operator to Prometheus.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPublishFailed(t *testing.T) {
+	assert := assert.New(t)
+
+	topicCases := []struct {
+		topic string
+		label string
+	}{
+		{topic: "/dType/dID/attrs", label: "attrs"},
+		{topic: "/dType/dID/cmdexe", label: "cmdexe"},
+		{topic: "presence", label: "presence"},
+	}
+
+	for _, c := range topicCases {
+		t.Run(c.topic, func(t *testing.T) {
+			before := testutil.ToFloat64(PublishFailures.WithLabelValues(c.label))
+			PublishFailed(c.topic)
+			assert.Equal(before+1, testutil.ToFloat64(PublishFailures.WithLabelValues(c.label)))
+		})
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	families, err := Registry.Gather()
+	assert.Nil(err)
+	names := map[string]bool{}
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	assert.True(names["mqtt_kube_operator_mqtt_connected"])
+	assert.True(names["mqtt_kube_operator_outbound_queued_messages"])
+	assert.True(names["mqtt_kube_operator_outbound_flushed_messages_total"])
+	assert.True(names["go_goroutines"])
+}
@@ -0,0 +1,562 @@
+/*
+Package main : entry point of mqtt-kube-operator.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/tech-sketch/mqtt-kube-operator/handlers"
+)
+
+type connectionStatus int
+
+const (
+	disconnected connectionStatus = iota
+	connecting
+	reconnecting
+	connected
+)
+
+// sessionExpiryNever keeps the session after the connection is closed as MQTT v3.1.1 does when the clean session is false.
+const sessionExpiryNever uint32 = 0xFFFFFFFF
+
+// errConnectionLost is passed to OnConnectionLost, because autopaho does not tell why the connection is lost.
+// The reason is logged when the client or the broker reports it.
+var errConnectionLost = fmt.Errorf("connection to MQTT broker is lost")
+
+// mqtt5Client is a mqtt.Client which connects the broker with MQTT v5, configured with the same options as the MQTT v3.1.1 client.
+// The messages are received as mqtt5Message with their properties, and a handlers.Response is published with its properties.
+// The connection and the session are maintained by autopaho, which reconnects when the connection is lost if AutoReconnect is true,
+// and mqtt5Client calls OnConnect and OnConnectionLost like the MQTT v3.1.1 client does.
+// Unlike autopaho, Connect fails if the first attempt fails, so that the caller retries it in the same way for both versions.
+type mqtt5Client struct {
+	logger  *zap.SugaredLogger
+	opts    *mqtt.ClientOptions
+	mutex   sync.Mutex
+	status  connectionStatus
+	manager *autopaho.ConnectionManager
+	// ctx is canceled with the manager and the operations when Disconnect is called
+	ctx    context.Context
+	cancel context.CancelFunc
+	routes map[string]mqtt.MessageHandler
+}
+
+func newMQTT5Client(opts *mqtt.ClientOptions, logger *zap.SugaredLogger) (mqtt.Client, error) {
+	if len(opts.Servers) == 0 {
+		return nil, fmt.Errorf("no MQTT broker is specified")
+	}
+	return &mqtt5Client{
+		logger: logger,
+		opts:   opts,
+		routes: map[string]mqtt.MessageHandler{},
+	}, nil
+}
+
+// IsConnected returns true while connected or reconnecting.
+func (c *mqtt5Client) IsConnected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.status == connected || c.status == reconnecting
+}
+
+// IsConnectionOpen returns true only while connected.
+func (c *mqtt5Client) IsConnectionOpen() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.status == connected
+}
+
+// Connect starts the connection manager, and completes the token when the first attempt to connect succeeds or fails.
+func (c *mqtt5Client) Connect() mqtt.Token {
+	token := newMQTT5Token()
+	c.mutex.Lock()
+	if c.status != disconnected {
+		c.mutex.Unlock()
+		token.complete(nil)
+		return token
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	messages := make(chan *paho.Publish, 100)
+	attempted := make(chan error, 1)
+	manager, err := autopaho.NewConnection(ctx, c.clientConfig(ctx, messages, attempted))
+	if err != nil {
+		c.mutex.Unlock()
+		cancel()
+		token.complete(err)
+		return token
+	}
+	c.status = connecting
+	c.manager = manager
+	c.ctx = ctx
+	c.cancel = cancel
+	c.mutex.Unlock()
+
+	go c.dispatch(ctx, messages)
+	go func() {
+		err := <-attempted
+		if err != nil {
+			c.stop(manager)
+		}
+		token.complete(err)
+	}()
+	return token
+}
+
+// clientConfig returns the configuration of autopaho, which sends the received messages to messages,
+// and the result of the first attempt to connect to attempted.
+func (c *mqtt5Client) clientConfig(ctx context.Context, messages chan<- *paho.Publish, attempted chan<- error) autopaho.ClientConfig {
+	config := autopaho.ClientConfig{
+		ServerUrls:                    c.opts.Servers,
+		TlsCfg:                        c.opts.TLSConfig,
+		KeepAlive:                     uint16(c.opts.KeepAlive),
+		CleanStartOnInitialConnection: c.opts.CleanSession,
+		ReconnectBackoff:              c.reconnectBackoff,
+		ConnectTimeout:                c.opts.ConnectTimeout,
+		ConnectUsername:               c.opts.Username,
+		ConnectPassword:               []byte(c.opts.Password),
+		OnConnectionUp: func(*autopaho.ConnectionManager, *paho.Connack) {
+			if c.up() {
+				notify(attempted, nil)
+			}
+		},
+		OnConnectionDown: c.down,
+		OnConnectError: func(err error) {
+			if c.getStatus() == connecting {
+				notify(attempted, err)
+				return
+			}
+			c.logger.Errorf("mqtt reconnect error: %s", err.Error())
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: c.opts.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(received paho.PublishReceived) (bool, error) {
+					// the handlers may publish and wait for the acknowledgements, which are received after this function returns
+					select {
+					case messages <- received.Packet:
+					case <-ctx.Done():
+					}
+					return true, nil
+				},
+			},
+			OnClientError: func(err error) {
+				c.logger.Errorf("mqtt client error: %s", err.Error())
+			},
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				c.logger.Errorf("disconnected by the broker with reason code 0x%02x", disconnect.ReasonCode)
+			},
+		},
+	}
+	if !c.opts.CleanSession {
+		config.SessionExpiryInterval = sessionExpiryNever
+	}
+	if c.opts.WillEnabled {
+		config.WillMessage = &paho.WillMessage{
+			Retain:  c.opts.WillRetained,
+			QoS:     c.opts.WillQos,
+			Topic:   c.opts.WillTopic,
+			Payload: c.opts.WillPayload,
+		}
+	}
+	return config
+}
+
+// reconnectBackoff returns the interval before the attempt to connect, which is 0 for the first connection,
+// and otherwise starts from a second and doubles up to MaxReconnectInterval as the attempts fail.
+func (c *mqtt5Client) reconnectBackoff(attempt int) time.Duration {
+	if c.getStatus() == connecting {
+		return 0
+	}
+	interval := time.Second
+	for i := 0; i < attempt; i++ {
+		interval = nextRetryInterval(interval, c.opts.MaxReconnectInterval)
+	}
+	return interval
+}
+
+// notify sends the result of the first attempt to connect unless another one has been sent.
+func notify(attempted chan<- error, err error) {
+	select {
+	case attempted <- err:
+	default:
+	}
+}
+
+// up is called when connected, and calls OnConnect. It returns true if it is the first connection.
+func (c *mqtt5Client) up() bool {
+	c.mutex.Lock()
+	if c.status == disconnected {
+		// Disconnect is called while connecting
+		c.mutex.Unlock()
+		return false
+	}
+	first := c.status == connecting
+	c.status = connected
+	c.mutex.Unlock()
+
+	if c.opts.OnConnect != nil {
+		go c.opts.OnConnect(c)
+	}
+	return first
+}
+
+// down is called when the connection is lost, and calls OnConnectionLost. It returns true to reconnect if AutoReconnect is true.
+func (c *mqtt5Client) down() bool {
+	c.mutex.Lock()
+	if c.status != connected {
+		c.mutex.Unlock()
+		return false
+	}
+	// the status is changed before calling OnConnectionLost as the MQTT v3.1.1 client does
+	if c.opts.AutoReconnect {
+		c.status = reconnecting
+	} else {
+		// the manager stops by returning false
+		c.status = disconnected
+		c.cancel()
+		c.manager = nil
+		c.ctx = nil
+		c.cancel = nil
+	}
+	c.mutex.Unlock()
+
+	if c.opts.OnConnectionLost != nil {
+		go c.opts.OnConnectionLost(c, errConnectionLost)
+	}
+	return c.opts.AutoReconnect
+}
+
+// dispatch calls the handlers of the received messages one by one in order.
+func (c *mqtt5Client) dispatch(ctx context.Context, messages chan *paho.Publish) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case publish := <-messages:
+			if handler := c.route(publish.Topic); handler != nil {
+				handler(c, &mqtt5Message{publish: publish})
+			}
+		}
+	}
+}
+
+func (c *mqtt5Client) route(topic string) mqtt.MessageHandler {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if handler, ok := c.routes[topic]; ok {
+		return handler
+	}
+	for filter, handler := range c.routes {
+		if topicMatches(filter, topic) {
+			return handler
+		}
+	}
+	if c.opts.DefaultPublishHandler != nil {
+		return c.opts.DefaultPublishHandler
+	}
+	return nil
+}
+
+// Disconnect closes the connection without publishing the will, and stops reconnecting.
+func (c *mqtt5Client) Disconnect(quiesce uint) {
+	c.mutex.Lock()
+	manager := c.manager
+	c.mutex.Unlock()
+	if manager == nil {
+		return
+	}
+	time.Sleep(time.Duration(quiesce) * time.Millisecond)
+	c.stop(manager)
+}
+
+// stop stops manager, which sends DISCONNECT if connected, unless another connection manager has been started.
+func (c *mqtt5Client) stop(manager *autopaho.ConnectionManager) {
+	c.mutex.Lock()
+	if c.manager != manager {
+		c.mutex.Unlock()
+		return
+	}
+	cancel := c.cancel
+	c.status = disconnected
+	c.manager = nil
+	c.ctx = nil
+	c.cancel = nil
+	c.mutex.Unlock()
+
+	cancel()
+	<-manager.Done()
+}
+
+// Publish publishes the payload, which is a string, []byte, bytes.Buffer or *handlers.Response.
+func (c *mqtt5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	token := newMQTT5Token()
+	publish, err := newPublishPacket(topic, qos, retained, payload)
+	if err != nil {
+		token.complete(err)
+		return token
+	}
+	manager, ctx, err := c.current()
+	if err != nil {
+		token.complete(err)
+		return token
+	}
+	go func() {
+		response, err := manager.Publish(ctx, publish)
+		if err == nil && response != nil && response.ReasonCode >= 0x80 {
+			err = fmt.Errorf("publish rejected with reason code 0x%02x", response.ReasonCode)
+		}
+		token.complete(err)
+	}()
+	return token
+}
+
+// Subscribe subscribes the topic, and routes the messages of the topic to callback.
+func (c *mqtt5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+// SubscribeMultiple subscribes the topics, and routes the messages of the topics to callback.
+func (c *mqtt5Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	token := newMQTT5Token()
+	manager, ctx, err := c.current()
+	if err != nil {
+		token.complete(err)
+		return token
+	}
+	subscribe := &paho.Subscribe{}
+	for _, topic := range sortedTopics(filters) {
+		subscribe.Subscriptions = append(subscribe.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: filters[topic]})
+		if callback != nil {
+			c.AddRoute(topic, callback)
+		}
+	}
+	go func() {
+		suback, err := manager.Subscribe(ctx, subscribe)
+		if err == nil {
+			for i, reason := range suback.Reasons {
+				if reason >= 0x80 {
+					err = fmt.Errorf("subscribe %s rejected with reason code 0x%02x", subscribe.Subscriptions[i].Topic, reason)
+					break
+				}
+			}
+		}
+		token.complete(err)
+	}()
+	return token
+}
+
+// Unsubscribe unsubscribes the topics, and removes their routes.
+func (c *mqtt5Client) Unsubscribe(topics ...string) mqtt.Token {
+	token := newMQTT5Token()
+	c.mutex.Lock()
+	for _, topic := range topics {
+		delete(c.routes, topic)
+	}
+	c.mutex.Unlock()
+	manager, ctx, err := c.current()
+	if err != nil {
+		token.complete(err)
+		return token
+	}
+	go func() {
+		_, err := manager.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+		token.complete(err)
+	}()
+	return token
+}
+
+// AddRoute routes the messages of the topic to callback.
+func (c *mqtt5Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.routes[topic] = callback
+}
+
+// OptionsReader is not supported, and returns an empty reader.
+func (c *mqtt5Client) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+// current returns the connection manager and the context canceled when Disconnect is called.
+func (c *mqtt5Client) current() (*autopaho.ConnectionManager, context.Context, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.status != connected || c.manager == nil {
+		return nil, nil, fmt.Errorf("not connected")
+	}
+	return c.manager, c.ctx, nil
+}
+
+func (c *mqtt5Client) getStatus() connectionStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.status
+}
+
+// newPublishPacket returns the packet to publish the payload, with the properties of the payload if it is a *handlers.Response.
+func newPublishPacket(topic string, qos byte, retained bool, payload interface{}) (*paho.Publish, error) {
+	publish := &paho.Publish{Topic: topic, QoS: qos, Retain: retained}
+	switch p := payload.(type) {
+	case string:
+		publish.Payload = []byte(p)
+	case []byte:
+		publish.Payload = p
+	case bytes.Buffer:
+		publish.Payload = p.Bytes()
+	case *handlers.Response:
+		publish.Payload = p.Payload
+		publish.Properties = &paho.PublishProperties{
+			ContentType:     p.ContentType,
+			CorrelationData: p.CorrelationData,
+		}
+		keys := []string{}
+		for key := range p.UserProperties {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			publish.Properties.User = append(publish.Properties.User, paho.UserProperty{Key: key, Value: p.UserProperties[key]})
+		}
+	default:
+		return nil, fmt.Errorf("unknown payload type %T", payload)
+	}
+	return publish, nil
+}
+
+func sortedTopics(filters map[string]byte) []string {
+	topics := []string{}
+	for topic := range filters {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// topicMatches returns true if the topic matches the filter, which may have the wildcards "+" and "#".
+func topicMatches(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// mqtt5Message is a mqtt.Message received with MQTT v5, which also implements handlers.MessagePropertiesInf.
+type mqtt5Message struct {
+	publish *paho.Publish
+}
+
+func (m *mqtt5Message) Duplicate() bool {
+	return m.publish.Duplicate()
+}
+
+func (m *mqtt5Message) Qos() byte {
+	return m.publish.QoS
+}
+
+func (m *mqtt5Message) Retained() bool {
+	return m.publish.Retain
+}
+
+func (m *mqtt5Message) Topic() string {
+	return m.publish.Topic
+}
+
+func (m *mqtt5Message) MessageID() uint16 {
+	return m.publish.PacketID
+}
+
+func (m *mqtt5Message) Payload() []byte {
+	return m.publish.Payload
+}
+
+// Ack does nothing, because the message is acknowledged after its handler is called.
+func (m *mqtt5Message) Ack() {
+}
+
+func (m *mqtt5Message) ResponseTopic() string {
+	if m.publish.Properties == nil {
+		return ""
+	}
+	return m.publish.Properties.ResponseTopic
+}
+
+func (m *mqtt5Message) CorrelationData() []byte {
+	if m.publish.Properties == nil {
+		return nil
+	}
+	return m.publish.Properties.CorrelationData
+}
+
+func (m *mqtt5Message) ContentType() string {
+	if m.publish.Properties == nil {
+		return ""
+	}
+	return m.publish.Properties.ContentType
+}
+
+func (m *mqtt5Message) UserProperty(key string) string {
+	if m.publish.Properties == nil {
+		return ""
+	}
+	return m.publish.Properties.User.Get(key)
+}
+
+// mqtt5Token is completed when the operation of mqtt5Client is done.
+type mqtt5Token struct {
+	done chan struct{}
+	err  error
+}
+
+func newMQTT5Token() *mqtt5Token {
+	return &mqtt5Token{done: make(chan struct{})}
+}
+
+func (t *mqtt5Token) complete(err error) {
+	t.err = err
+	close(t.done)
+}
+
+func (t *mqtt5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *mqtt5Token) WaitTimeout(timeout time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (t *mqtt5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
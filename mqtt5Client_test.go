@@ -0,0 +1,278 @@
+/*
+Package main : entry point of mqtt-kube-operator.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/mqtt-kube-operator/handlers"
+)
+
+func TestNewMQTT5Client(t *testing.T) {
+	assert := assert.New(t)
+	logger := zap.NewNop().Sugar()
+
+	_, err := newMQTT5Client(mqtt.NewClientOptions(), logger)
+	assert.NotNil(err)
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker("tcp://127.0.0.1:1883")
+	client, err := newMQTT5Client(opts, logger)
+	assert.Nil(err)
+	assert.False(client.IsConnected())
+	assert.False(client.IsConnectionOpen())
+
+	token := client.Publish("/dType/dID/cmdexe", 1, false, "a@b|c")
+	assert.True(token.WaitTimeout(time.Second))
+	assert.Equal("not connected", token.Error().Error())
+	token = client.Subscribe("/dType/dID/cmd", 1, nil)
+	assert.True(token.WaitTimeout(time.Second))
+	assert.Equal("not connected", token.Error().Error())
+
+	// Connect fails without retrying, so that the caller retries it
+	opts = mqtt.NewClientOptions()
+	opts.AddBroker("tcp://127.0.0.1:0")
+	opts.SetConnectTimeout(time.Second)
+	client, err = newMQTT5Client(opts, logger)
+	assert.Nil(err)
+	token = client.Connect()
+	assert.True(token.WaitTimeout(5 * time.Second))
+	assert.NotNil(token.Error())
+	assert.False(client.IsConnected())
+	client.Disconnect(0)
+}
+
+func TestClientConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker("tcp://127.0.0.1:1883")
+	opts.SetClientID("my-client")
+	opts.SetUsername("user")
+	opts.SetPassword("pass")
+	opts.SetWill("/dType/dID/presence", "status|offline", 1, true)
+
+	client := &mqtt5Client{opts: opts}
+	config := client.clientConfig(context.Background(), nil, nil)
+	assert.Equal("tcp://127.0.0.1:1883", config.ServerUrls[0].String())
+	assert.Equal("my-client", config.ClientID)
+	assert.Equal(uint16(30), config.KeepAlive)
+	assert.True(config.CleanStartOnInitialConnection)
+	assert.Equal(uint32(0), config.SessionExpiryInterval)
+	assert.Equal("user", config.ConnectUsername)
+	assert.Equal([]byte("pass"), config.ConnectPassword)
+	assert.Equal(&paho.WillMessage{Retain: true, QoS: 1, Topic: "/dType/dID/presence", Payload: []byte("status|offline")}, config.WillMessage)
+
+	opts.SetCleanSession(false)
+	config = client.clientConfig(context.Background(), nil, nil)
+	assert.False(config.CleanStartOnInitialConnection)
+	assert.Equal(sessionExpiryNever, config.SessionExpiryInterval)
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := mqtt.NewClientOptions()
+	opts.SetMaxReconnectInterval(5 * time.Second)
+	client := &mqtt5Client{opts: opts, status: connecting}
+	assert.Equal(time.Duration(0), client.reconnectBackoff(0))
+
+	client.status = reconnecting
+	intervals := []time.Duration{}
+	for attempt := 0; attempt < 5; attempt++ {
+		intervals = append(intervals, client.reconnectBackoff(attempt))
+	}
+	assert.Equal([]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, intervals)
+}
+
+func TestConnectionUpAndDown(t *testing.T) {
+	assert := assert.New(t)
+
+	events := make(chan string, 10)
+	opts := mqtt.NewClientOptions()
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		events <- "connect"
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		// the status is changed before calling OnConnectionLost
+		events <- fmt.Sprintf("lost %t %t: %s", c.IsConnected(), c.IsConnectionOpen(), err.Error())
+	})
+	opts.SetAutoReconnect(true)
+	_, cancel := context.WithCancel(context.Background())
+	client := &mqtt5Client{opts: opts, status: connecting, cancel: cancel}
+
+	assert.True(client.up())
+	assert.Equal("connect", <-events)
+	assert.True(client.IsConnectionOpen())
+
+	assert.True(client.down())
+	assert.Equal("lost true false: connection to MQTT broker is lost", <-events)
+	assert.False(client.down())
+
+	assert.False(client.up())
+	assert.Equal("connect", <-events)
+
+	opts.SetAutoReconnect(false)
+	assert.False(client.down())
+	assert.Equal("lost false false: connection to MQTT broker is lost", <-events)
+	assert.Nil(client.cancel)
+
+	client.status = disconnected
+	assert.False(client.up())
+	assert.Empty(events)
+}
+
+func TestNewPublishPacket(t *testing.T) {
+	assert := assert.New(t)
+
+	publish, err := newPublishPacket("/dType/dID/cmdexe", 1, false, "a@b|c")
+	assert.Nil(err)
+	assert.Equal(&paho.Publish{Topic: "/dType/dID/cmdexe", QoS: 1, Payload: []byte("a@b|c")}, publish)
+
+	publish, err = newPublishPacket("/dType/dID/presence", 1, true, []byte("status|online"))
+	assert.Nil(err)
+	assert.Equal(&paho.Publish{Topic: "/dType/dID/presence", QoS: 1, Retain: true, Payload: []byte("status|online")}, publish)
+
+	publish, err = newPublishPacket("/dType/dID/logs", 0, false, *bytes.NewBufferString("logs"))
+	assert.Nil(err)
+	assert.Equal([]byte("logs"), publish.Payload)
+
+	publish, err = newPublishPacket("/requester/response", 1, false, &handlers.Response{
+		Payload:         []byte("a@b|c"),
+		ContentType:     "text/plain",
+		CorrelationData: []byte("request-1"),
+		UserProperties:  map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "reason-code": "0"},
+	})
+	assert.Nil(err)
+	assert.Equal(&paho.Publish{
+		Topic:   "/requester/response",
+		QoS:     1,
+		Payload: []byte("a@b|c"),
+		Properties: &paho.PublishProperties{
+			ContentType:     "text/plain",
+			CorrelationData: []byte("request-1"),
+			User: paho.UserProperties{
+				{Key: "reason-code", Value: "0"},
+				{Key: "traceparent", Value: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+			},
+		},
+	}, publish)
+
+	_, err = newPublishPacket("/dType/dID/cmdexe", 1, false, 1)
+	assert.NotNil(err)
+	assert.Equal("unknown payload type int", err.Error())
+}
+
+func TestTopicMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	topicCases := []struct {
+		filter   string
+		topic    string
+		expected bool
+	}{
+		{filter: "/dType/dID/cmd", topic: "/dType/dID/cmd", expected: true},
+		{filter: "/dType/dID/cmd", topic: "/dType/dID/cmdexe", expected: false},
+		{filter: "/dType/+/cmd", topic: "/dType/dID/cmd", expected: true},
+		{filter: "/dType/+/cmd", topic: "/dType/dID/cmd/sub", expected: false},
+		{filter: "/dType/#", topic: "/dType/dID/cmd", expected: true},
+		{filter: "/dType/dID/cmd/#", topic: "/dType/dID/cmd", expected: true},
+		{filter: "/other/#", topic: "/dType/dID/cmd", expected: false},
+	}
+
+	for _, c := range topicCases {
+		t.Run(fmt.Sprintf("filter=%s, topic=%s", c.filter, c.topic), func(t *testing.T) {
+			assert.Equal(c.expected, topicMatches(c.filter, c.topic))
+		})
+	}
+}
+
+func TestRoute(t *testing.T) {
+	assert := assert.New(t)
+
+	received := []string{}
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker("tcp://127.0.0.1:1883")
+	opts.SetDefaultPublishHandler(func(c mqtt.Client, m mqtt.Message) {
+		received = append(received, "default "+m.Topic())
+	})
+	client := &mqtt5Client{opts: opts, routes: map[string]mqtt.MessageHandler{}}
+	client.AddRoute("/dType/dID/cmd", func(c mqtt.Client, m mqtt.Message) {
+		received = append(received, "cmd "+m.Topic())
+	})
+	client.AddRoute("/dType/+/attrs", func(c mqtt.Client, m mqtt.Message) {
+		received = append(received, "attrs "+m.Topic())
+	})
+
+	for _, topic := range []string{"/dType/dID/cmd", "/dType/dID/attrs", "/dType/dID/other"} {
+		client.route(topic)(client, &mqtt5Message{publish: &paho.Publish{Topic: topic}})
+	}
+	assert.Equal([]string{"cmd /dType/dID/cmd", "attrs /dType/dID/attrs", "default /dType/dID/other"}, received)
+}
+
+func TestMQTT5Message(t *testing.T) {
+	assert := assert.New(t)
+
+	var message mqtt.Message = &mqtt5Message{publish: &paho.Publish{
+		PacketID: 3,
+		QoS:      1,
+		Topic:    "/dType/dID/cmd",
+		Payload:  []byte("a@b|c"),
+		Properties: &paho.PublishProperties{
+			ResponseTopic:   "/requester/response",
+			CorrelationData: []byte("request-1"),
+			ContentType:     "text/plain",
+			User:            paho.UserProperties{{Key: "compression", Value: "gzip"}},
+		},
+	}}
+	assert.False(message.Duplicate())
+	assert.Equal(uint16(3), message.MessageID())
+	assert.Equal(byte(1), message.Qos())
+	assert.Equal("/dType/dID/cmd", message.Topic())
+	assert.Equal([]byte("a@b|c"), message.Payload())
+
+	properties, ok := message.(handlers.MessagePropertiesInf)
+	assert.True(ok)
+	assert.Equal("/requester/response", properties.ResponseTopic())
+	assert.Equal([]byte("request-1"), properties.CorrelationData())
+	assert.Equal("text/plain", properties.ContentType())
+	assert.Equal("gzip", properties.UserProperty("compression"))
+	assert.Equal("", properties.UserProperty("encoding"))
+
+	message = &mqtt5Message{publish: paho.PublishFromPacketPublish(&packets.Publish{Topic: "/dType/dID/cmd", QoS: 1, Duplicate: true, Properties: &packets.Properties{}})}
+	assert.True(message.Duplicate())
+
+	properties = &mqtt5Message{publish: &paho.Publish{Topic: "/dType/dID/cmd"}}
+	assert.Equal("", properties.ResponseTopic())
+	assert.Nil(properties.CorrelationData())
+	assert.Equal("", properties.ContentType())
+	assert.Equal("", properties.UserProperty("compression"))
+}
+
+func TestMQTT5Token(t *testing.T) {
+	assert := assert.New(t)
+
+	token := newMQTT5Token()
+	assert.False(token.WaitTimeout(time.Millisecond))
+	assert.Nil(token.Error())
+
+	token.complete(fmt.Errorf("failure"))
+	assert.True(token.Wait())
+	assert.True(token.WaitTimeout(time.Millisecond))
+	assert.Equal("failure", token.Error().Error())
+}
@@ -0,0 +1,399 @@
+/*
+Package main : entry point of mqtt-kube-operator.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/tech-sketch/mqtt-kube-operator/metrics"
+)
+
+type dropPolicy string
+
+const (
+	dropOldest dropPolicy = "drop-oldest"
+	dropNewest dropPolicy = "drop-newest"
+)
+
+type outboundMessage struct {
+	Topic    string    `json:"topic"`
+	QoS      byte      `json:"qos"`
+	Retained bool      `json:"retained"`
+	Payload  []byte    `json:"payload"`
+	QueuedAt time.Time `json:"queuedAt"`
+}
+
+type outboundStats struct {
+	Queued  int
+	Dropped uint64
+	Flushed uint64
+}
+
+type recordOperation string
+
+const (
+	recordPush recordOperation = "push"
+	recordPop  recordOperation = "pop"
+)
+
+// outboundRecord is a line of the file of the queue, which pushes a message to the queue or pops the oldest one from it.
+type outboundRecord struct {
+	Operation recordOperation  `json:"op"`
+	Message   *outboundMessage `json:"message,omitempty"`
+}
+
+// outboundQueue keeps at most maxMessages messages which could not be published, dropping the oldest or the newest one when it is full.
+// If path is not empty, the queue is persisted to the file so that it survives restarts.
+// Each push and pop is appended to the file, which is rewritten only when it has grown too long or the queue gets empty.
+type outboundQueue struct {
+	logger         *zap.SugaredLogger
+	maxMessages    int
+	policy         dropPolicy
+	path           string
+	getCurrentTime func() time.Time
+	mutex          sync.Mutex
+	messages       []*outboundMessage
+	records        int
+	dropped        uint64
+	flushed        uint64
+}
+
+func newOutboundQueue(logger *zap.SugaredLogger, maxMessages int, policy string, path string) (*outboundQueue, error) {
+	if maxMessages <= 0 {
+		return nil, fmt.Errorf("invalid outbound queue size %d", maxMessages)
+	}
+	switch dropPolicy(policy) {
+	case dropOldest, dropNewest:
+	default:
+		return nil, fmt.Errorf("unknown drop policy '%s', expected %s or %s", policy, dropOldest, dropNewest)
+	}
+	q := &outboundQueue{
+		logger:         logger,
+		maxMessages:    maxMessages,
+		policy:         dropPolicy(policy),
+		path:           path,
+		getCurrentTime: time.Now,
+		messages:       []*outboundMessage{},
+	}
+	if path != "" {
+		q.load()
+		q.save()
+	}
+	return q, nil
+}
+
+// push appends message, and drops a message according to the policy if the queue is full.
+func (q *outboundQueue) push(message *outboundMessage) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	message.QueuedAt = q.getCurrentTime()
+	records := []*outboundRecord{}
+	if len(q.messages) >= q.maxMessages {
+		q.dropped++
+		metrics.OutboundDropped.Inc()
+		if q.policy == dropNewest {
+			q.logger.Warnf("outbound queue is full, drop the newest message, topic=%s, dropped=%d", message.Topic, q.dropped)
+			return
+		}
+		q.logger.Warnf("outbound queue is full, drop the oldest message, topic=%s, dropped=%d", q.messages[0].Topic, q.dropped)
+		q.messages = q.messages[1:]
+		records = append(records, &outboundRecord{Operation: recordPop})
+	}
+	q.messages = append(q.messages, message)
+	metrics.OutboundQueued.Set(float64(len(q.messages)))
+	q.append(append(records, &outboundRecord{Operation: recordPush, Message: message})...)
+}
+
+// peek returns the oldest message, or nil if the queue is empty.
+func (q *outboundQueue) peek() *outboundMessage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.messages) == 0 {
+		return nil
+	}
+	return q.messages[0]
+}
+
+// pop removes message after it is published, unless it has been dropped from the queue in the meantime.
+func (q *outboundQueue) pop(message *outboundMessage) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.messages) == 0 || q.messages[0] != message {
+		return
+	}
+	q.messages = q.messages[1:]
+	q.flushed++
+	metrics.OutboundQueued.Set(float64(len(q.messages)))
+	metrics.OutboundFlushed.Inc()
+	q.append(&outboundRecord{Operation: recordPop})
+}
+
+// stats returns the number of the queued messages, and the numbers of the messages dropped and flushed so far.
+func (q *outboundQueue) stats() outboundStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return outboundStats{Queued: len(q.messages), Dropped: q.dropped, Flushed: q.flushed}
+}
+
+// load restores the queue by replaying the records in the file, and starts with an empty queue if the file does not exist.
+// The broken records, such as the last one written partially when this program stopped, are ignored.
+func (q *outboundQueue) load() {
+	data, err := ioutil.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		q.logger.Errorf("read outbound queue err -- %s: %s", q.path, err.Error())
+		return
+	}
+	messages := q.replay(data)
+	if len(messages) > q.maxMessages {
+		q.dropped += uint64(len(messages) - q.maxMessages)
+		metrics.OutboundDropped.Add(float64(len(messages) - q.maxMessages))
+		if q.policy == dropNewest {
+			messages = messages[:q.maxMessages]
+		} else {
+			messages = messages[len(messages)-q.maxMessages:]
+		}
+	}
+	q.messages = messages
+	metrics.OutboundQueued.Set(float64(len(q.messages)))
+	q.logger.Infof("load %d outbound messages -- %s", len(q.messages), q.path)
+}
+
+// replay returns the messages left after the records in data.
+func (q *outboundQueue) replay(data []byte) []*outboundMessage {
+	messages := []*outboundMessage{}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		record := &outboundRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			q.logger.Errorf("invalid outbound queue record, ignore it -- %s: %s", q.path, err.Error())
+			continue
+		}
+		switch {
+		case record.Operation == recordPush && record.Message != nil:
+			messages = append(messages, record.Message)
+		case record.Operation == recordPop && len(messages) > 0:
+			messages = messages[1:]
+		}
+	}
+	return messages
+}
+
+// append appends the records to the file. It truncates the file instead when the queue gets empty,
+// and rewrites the whole file when it has more than twice as many records as maxMessages.
+// It must be called with the mutex locked.
+func (q *outboundQueue) append(records ...*outboundRecord) {
+	if q.path == "" {
+		return
+	}
+	if len(q.messages) == 0 {
+		if err := os.Truncate(q.path, 0); err != nil {
+			q.logger.Errorf("write outbound queue err -- %s: %s", q.path, err.Error())
+			return
+		}
+		q.records = 0
+		return
+	}
+	if q.records+len(records) > 2*q.maxMessages {
+		q.save()
+		return
+	}
+	data, err := marshalRecords(records)
+	if err != nil {
+		q.logger.Errorf("marshal outbound queue err: %s", err.Error())
+		return
+	}
+	file, err := os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		q.logger.Errorf("write outbound queue err -- %s: %s", q.path, err.Error())
+		return
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		q.logger.Errorf("write outbound queue err -- %s: %s", q.path, err.Error())
+		return
+	}
+	q.records += len(records)
+}
+
+// save writes the records pushing the queued messages to a temporary file and renames it, so that the file is never left half-written.
+// It must be called with the mutex locked.
+func (q *outboundQueue) save() {
+	if q.path == "" {
+		return
+	}
+	records := make([]*outboundRecord, len(q.messages))
+	for i, message := range q.messages {
+		records[i] = &outboundRecord{Operation: recordPush, Message: message}
+	}
+	data, err := marshalRecords(records)
+	if err != nil {
+		q.logger.Errorf("marshal outbound queue err: %s", err.Error())
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(q.path), filepath.Base(q.path)+".tmp")
+	if err != nil {
+		q.logger.Errorf("write outbound queue err -- %s: %s", q.path, err.Error())
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), q.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		q.logger.Errorf("write outbound queue err -- %s: %s", q.path, err.Error())
+		return
+	}
+	q.records = len(records)
+}
+
+// marshalRecords returns the records as JSON lines.
+func marshalRecords(records []*outboundRecord) ([]byte, error) {
+	data := []byte{}
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	return data, nil
+}
+
+// bufferedClient is a mqtt.Client which queues the messages published while the connection is not open,
+// and publishes them in order before the next message after the connection is opened again.
+// The messages are published by one caller at a time, and the others return as soon as their messages are queued.
+type bufferedClient struct {
+	mqtt.Client
+	logger     *zap.SugaredLogger
+	queue      *outboundQueue
+	mutex      sync.Mutex
+	publishing bool
+}
+
+func newBufferedClient(client mqtt.Client, logger *zap.SugaredLogger, queue *outboundQueue) *bufferedClient {
+	return &bufferedClient{
+		Client: client,
+		logger: logger,
+		queue:  queue,
+	}
+}
+
+// Publish publishes the message after the queued ones, or queues it if they can not be published.
+// The returned token is already completed, and has no error if the message is published or queued.
+func (c *bufferedClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var data []byte
+	switch p := payload.(type) {
+	case string:
+		data = []byte(p)
+	case []byte:
+		data = p
+	default:
+		return c.Client.Publish(topic, qos, retained, payload)
+	}
+
+	c.queue.push(&outboundMessage{Topic: topic, QoS: qos, Retained: retained, Payload: data})
+	// IsConnected is also true while reconnecting, when the messages of QoS 0 are silently discarded
+	if !c.Client.IsConnectionOpen() {
+		return &completedToken{}
+	}
+	if published := c.publishQueued(); published > 1 {
+		// the messages queued before this one are also published
+		c.logStats(published)
+	}
+	return &completedToken{}
+}
+
+// flush publishes the queued messages in order.
+func (c *bufferedClient) flush() {
+	c.logStats(c.publishQueued())
+}
+
+// publishQueued publishes the queued messages in order until one of them can not be published, and returns the number of the published ones.
+// If another caller is publishing them, it returns 0 immediately, and the caller publishes the messages queued in the meantime.
+func (c *bufferedClient) publishQueued() int {
+	c.mutex.Lock()
+	if c.publishing {
+		c.mutex.Unlock()
+		return 0
+	}
+	c.publishing = true
+	c.mutex.Unlock()
+
+	published := 0
+	for {
+		message := c.queue.peek()
+		if message == nil {
+			c.mutex.Lock()
+			// the message queued before this check is published by this caller, and the one queued after it by the next one
+			if message = c.queue.peek(); message == nil {
+				c.publishing = false
+				c.mutex.Unlock()
+				return published
+			}
+			c.mutex.Unlock()
+		}
+		if err := c.publish(message); err != nil {
+			c.logger.Errorf("mqtt publish error, keep the queued messages, topic=%s, %s", message.Topic, err.Error())
+			metrics.PublishFailed(message.Topic)
+			c.mutex.Lock()
+			c.publishing = false
+			c.mutex.Unlock()
+			return published
+		}
+		c.queue.pop(message)
+		published++
+	}
+}
+
+func (c *bufferedClient) logStats(published int) {
+	stats := c.queue.stats()
+	c.logger.Infof("publish %d queued messages, queued=%d, dropped=%d, flushed=%d", published, stats.Queued, stats.Dropped, stats.Flushed)
+}
+
+func (c *bufferedClient) publish(message *outboundMessage) error {
+	if token := c.Client.Publish(message.Topic, message.QoS, message.Retained, message.Payload); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// completedToken is returned for the messages published or queued by bufferedClient.
+type completedToken struct{}
+
+func (t *completedToken) Wait() bool {
+	return true
+}
+
+func (t *completedToken) WaitTimeout(time.Duration) bool {
+	return true
+}
+
+func (t *completedToken) Error() error {
+	return nil
+}
@@ -0,0 +1,289 @@
+/*
+Package main : entry point of mqtt-kube-operator.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/mqtt-kube-operator/mock"
+)
+
+func setUpOutboundQueue(t *testing.T, maxMessages int, policy string, path string) (*outboundQueue, func()) {
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = zap.NewAtomicLevelAt(zap.FatalLevel)
+	logger, _ := loggerConfig.Build()
+
+	q, err := newOutboundQueue(logger.Sugar(), maxMessages, policy, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q, func() {
+		logger.Sync()
+	}
+}
+
+func getQueuedPayloads(q *outboundQueue) []string {
+	payloads := []string{}
+	for _, message := range q.messages {
+		payloads = append(payloads, string(message.Payload))
+	}
+	return payloads
+}
+
+func TestNewOutboundQueue(t *testing.T) {
+	assert := assert.New(t)
+	logger := zap.NewNop().Sugar()
+
+	_, err := newOutboundQueue(logger, 0, "drop-oldest", "")
+	assert.Equal("invalid outbound queue size 0", err.Error())
+	_, err = newOutboundQueue(logger, 10, "drop-random", "")
+	assert.Equal("unknown drop policy 'drop-random', expected drop-oldest or drop-newest", err.Error())
+}
+
+func TestOutboundQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	policyCases := []struct {
+		policy   string
+		expected []string
+	}{
+		{policy: "drop-oldest", expected: []string{"b", "c"}},
+		{policy: "drop-newest", expected: []string{"a", "b"}},
+	}
+
+	for _, c := range policyCases {
+		t.Run(c.policy, func(t *testing.T) {
+			q, tearDown := setUpOutboundQueue(t, 2, c.policy, "")
+			defer tearDown()
+
+			for _, payload := range []string{"a", "b", "c"} {
+				q.push(&outboundMessage{Topic: "/test", Payload: []byte(payload)})
+			}
+			assert.Equal(c.expected, getQueuedPayloads(q))
+			assert.Equal(outboundStats{Queued: 2, Dropped: 1}, q.stats())
+
+			assert.Equal(c.expected[0], string(q.peek().Payload))
+			q.pop(q.peek())
+			q.pop(q.peek())
+			assert.Nil(q.peek())
+			q.pop(q.peek())
+			assert.Equal(outboundStats{Queued: 0, Dropped: 1, Flushed: 2}, q.stats())
+		})
+	}
+	t.Run("dropped while publishing", func(t *testing.T) {
+		q, tearDown := setUpOutboundQueue(t, 1, "drop-oldest", "")
+		defer tearDown()
+
+		q.push(&outboundMessage{Topic: "/test", Payload: []byte("a")})
+		publishing := q.peek()
+		q.push(&outboundMessage{Topic: "/test", Payload: []byte("b")})
+		q.pop(publishing)
+		assert.Equal([]string{"b"}, getQueuedPayloads(q))
+		assert.Equal(outboundStats{Queued: 1, Dropped: 1}, q.stats())
+	})
+
+	t.Run("persistence", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "outboundQueue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "outbound.json")
+
+		q, tearDown := setUpOutboundQueue(t, 3, "drop-oldest", path)
+		defer tearDown()
+		for _, payload := range []string{"a", "b", "c"} {
+			q.push(&outboundMessage{Topic: "/test", QoS: 1, Retained: true, Payload: []byte(payload)})
+		}
+		q.pop(q.peek())
+
+		restarted, tearDownRestarted := setUpOutboundQueue(t, 3, "drop-oldest", path)
+		defer tearDownRestarted()
+		assert.Equal([]string{"b", "c"}, getQueuedPayloads(restarted))
+		assert.Equal("/test", restarted.peek().Topic)
+		assert.Equal(byte(1), restarted.peek().QoS)
+		assert.True(restarted.peek().Retained)
+
+		smaller, tearDownSmaller := setUpOutboundQueue(t, 1, "drop-oldest", path)
+		defer tearDownSmaller()
+		assert.Equal([]string{"c"}, getQueuedPayloads(smaller))
+		assert.Equal(uint64(1), smaller.stats().Dropped)
+
+		files, err := ioutil.ReadDir(dir)
+		assert.Nil(err)
+		assert.Len(files, 1)
+	})
+	t.Run("append", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "outboundQueue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "outbound.json")
+		countLines := func() int {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return strings.Count(string(data), "\n")
+		}
+
+		q, tearDown := setUpOutboundQueue(t, 2, "drop-oldest", path)
+		defer tearDown()
+		q.push(&outboundMessage{Topic: "/test", Payload: []byte("a")})
+		q.push(&outboundMessage{Topic: "/test", Payload: []byte("b")})
+		assert.Equal(2, countLines())
+		// the oldest one is dropped by appending a pop record
+		q.push(&outboundMessage{Topic: "/test", Payload: []byte("c")})
+		assert.Equal(4, countLines())
+		// the file is rewritten instead of growing more than twice as many as the messages
+		q.push(&outboundMessage{Topic: "/test", Payload: []byte("d")})
+		assert.Equal(2, countLines())
+		q.pop(q.peek())
+		assert.Equal(3, countLines())
+
+		restarted, tearDownRestarted := setUpOutboundQueue(t, 2, "drop-oldest", path)
+		defer tearDownRestarted()
+		assert.Equal([]string{"d"}, getQueuedPayloads(restarted))
+
+		// the file is truncated when the queue gets empty
+		q.pop(q.peek())
+		assert.Equal(0, countLines())
+	})
+	t.Run("partially written", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "outboundQueue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "outbound.json")
+		data := `{"op":"push","message":{"topic":"/test","payload":"YQ=="}}` + "\n" + `{"op":"push","mess`
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		q, tearDown := setUpOutboundQueue(t, 3, "drop-oldest", path)
+		defer tearDown()
+		assert.Equal([]string{"a"}, getQueuedPayloads(q))
+	})
+	t.Run("broken file", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "outboundQueue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "outbound.json")
+		if err := ioutil.WriteFile(path, []byte("broken"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		q, tearDown := setUpOutboundQueue(t, 3, "drop-oldest", path)
+		defer tearDown()
+		assert.Empty(q.messages)
+	})
+}
+
+func TestBufferedClient(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mqttClient := mock.NewMockClient(ctrl)
+	token := mock.NewMockToken(ctrl)
+	q, tearDown := setUpOutboundQueue(t, 10, "drop-oldest", "")
+	defer tearDown()
+	client := newBufferedClient(mqttClient, q.logger, q)
+
+	t.Run("disconnected", func(t *testing.T) {
+		mqttClient.EXPECT().IsConnectionOpen().Return(false).Times(2)
+		mqttClient.EXPECT().Publish(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+		assert.Nil(client.Publish("/dType/dID/attrs", 0, false, "a").Error())
+		assert.Nil(client.Publish("/dType/dID/cmdexe", 1, false, []byte("b")).Error())
+		assert.Equal([]string{"a", "b"}, getQueuedPayloads(q))
+	})
+	t.Run("publish error", func(t *testing.T) {
+		mqttClient.EXPECT().IsConnectionOpen().Return(true)
+		mqttClient.EXPECT().Publish("/dType/dID/attrs", byte(0), false, []byte("a")).Return(token)
+		token.EXPECT().Wait().Return(true)
+		token.EXPECT().Error().Return(fmt.Errorf("publishErr")).Times(2)
+
+		assert.Nil(client.Publish("/dType/dID/attrs", 0, false, "c").Error())
+		assert.Equal([]string{"a", "b", "c"}, getQueuedPayloads(q))
+	})
+	t.Run("reconnected", func(t *testing.T) {
+		gomock.InOrder(
+			mqttClient.EXPECT().Publish("/dType/dID/attrs", byte(0), false, []byte("a")).Return(token),
+			mqttClient.EXPECT().Publish("/dType/dID/cmdexe", byte(1), false, []byte("b")).Return(token),
+			mqttClient.EXPECT().Publish("/dType/dID/attrs", byte(0), false, []byte("c")).Return(token),
+		)
+		token.EXPECT().Wait().Return(true).Times(3)
+		token.EXPECT().Error().Return(nil).Times(3)
+
+		client.flush()
+		assert.Empty(getQueuedPayloads(q))
+		assert.Equal(outboundStats{Queued: 0, Dropped: 0, Flushed: 3}, q.stats())
+	})
+	t.Run("connected", func(t *testing.T) {
+		mqttClient.EXPECT().IsConnectionOpen().Return(true)
+		mqttClient.EXPECT().Publish("/dType/dID/attrs", byte(0), false, []byte("d")).Return(token)
+		token.EXPECT().Wait().Return(true)
+		token.EXPECT().Error().Return(nil)
+
+		assert.Nil(client.Publish("/dType/dID/attrs", 0, false, "d").Error())
+		assert.Empty(getQueuedPayloads(q))
+	})
+	t.Run("publishing by another", func(t *testing.T) {
+		publishing := make(chan bool)
+		release := make(chan bool)
+		done := make(chan bool)
+		mqttClient.EXPECT().IsConnectionOpen().Return(true).Times(2)
+		gomock.InOrder(
+			mqttClient.EXPECT().Publish("/dType/dID/attrs", byte(0), false, []byte("e")).DoAndReturn(func(string, byte, bool, interface{}) mqtt.Token {
+				publishing <- true
+				<-release
+				return token
+			}),
+			mqttClient.EXPECT().Publish("/dType/dID/attrs", byte(0), false, []byte("f")).Return(token),
+		)
+		token.EXPECT().Wait().Return(true).Times(2)
+		token.EXPECT().Error().Return(nil).Times(2)
+
+		go func() {
+			client.Publish("/dType/dID/attrs", 0, false, "e")
+			done <- true
+		}()
+		<-publishing
+		// the message is queued without waiting for the other one being published
+		returned := make(chan bool)
+		go func() {
+			client.Publish("/dType/dID/attrs", 0, false, "f")
+			returned <- true
+		}()
+		select {
+		case <-returned:
+		case <-time.After(time.Second):
+			t.Fatal("publish waits for the other one being published")
+		}
+		assert.Equal([]string{"e", "f"}, getQueuedPayloads(q))
+		release <- true
+		<-done
+		assert.Empty(getQueuedPayloads(q))
+	})
+}
@@ -6,19 +6,24 @@ Package reporters : report state of kubernetes using MQTT.
 package reporters
 
 import (
-	"fmt"
+	"reflect"
+	"sort"
 	"time"
 
 	"go.uber.org/zap"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 
-	apiv1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tech-sketch/mqtt-kube-operator/metrics"
 )
 
-const deploymentAttrsFormat = "%s|deployment|%s|label|%s:%s|desired|%d|current|%d|updated|%d|ready|%d|unavailable|%d|available|%d"
+const deploymentStateReporterName = "DeploymentStateReporter"
 
 /*
 DeploymentStateReporter : a struct to report the state of Deployments.
@@ -32,51 +37,148 @@ type DeploymentStateReporter struct {
 /*
 NewDeploymentStateReporter : a factory method to create DeploymentStateReporter.
 */
-func NewDeploymentStateReporter(mqttClient mqtt.Client, kubeClient *kubernetes.Clientset, logger *zap.SugaredLogger, deviceType string, deviceID string, intervalSec int, targetLabelKey string) *DeploymentStateReporter {
+func NewDeploymentStateReporter(mqttClient mqtt.Client, kubeClient *kubernetes.Clientset, logger *zap.SugaredLogger, deviceType string, deviceID string, resyncSec int, targetLabelKey string, namespaces []string, formatter FormatterInf, publishOptions PublishOptions) *DeploymentStateReporter {
 	return &DeploymentStateReporter{
-		baseReporter: &baseReporter{deviceType, deviceID, time.Duration(intervalSec * 1000), make(chan bool, 1), make(chan bool, 1)},
-		impl:         &deploymentStateReporterImpl{logger, mqttClient, kubeClient, targetLabelKey, time.Now},
+		baseReporter: newBaseReporter(deviceType, deviceID, time.Duration(resyncSec*1000)),
+		impl:         &deploymentStateReporterImpl{logger, mqttClient, publishOptions, kubeClient, targetLabelKey, namespaces, formatter, time.Now, nil},
 		logger:       logger,
 	}
 }
 
 /*
-StartReporting : start a loop to report the state of PODs at the specified interval.
+StartReporting : start watching Deployments to report their state when it changes, and also at the specified resync interval if any.
 */
 func (r *DeploymentStateReporter) StartReporting() {
-	go func() {
-		r.logger.Debugf("start DeploymentStateReporter loop")
-		r.baseReporter.loop(r.impl)
-		r.logger.Debugf("stop DeploymentStateReporter loop")
-	}()
+	r.baseReporter.start(deploymentStateReporterName, r.GetAttrsTopic(), r.impl, r.logger)
 }
 
 type deploymentStateReporterImpl struct {
 	logger         *zap.SugaredLogger
 	mqttClient     mqtt.Client
+	publishOptions PublishOptions
 	kubeClient     kubernetes.Interface
 	targetLabelKey string
+	namespaces     []string
+	formatter      FormatterInf
 	getCurrentTime func() time.Time
+	listers        []appslisters.DeploymentLister
+}
+
+func (impl *deploymentStateReporterImpl) Start(topic string, stopCh <-chan struct{}) {
+	if impl.targetLabelKey == "" {
+		impl.logger.Warnf("target label key is empty, no deployment is reported")
+		return
+	}
+	// drop the listers of the informers stopped when the reporting was stopped last
+	impl.listers = nil
+	for _, namespace := range impl.namespaces {
+		impl.logger.Debugf("start watching deployments, namespace=%s", namespace)
+		factory := newInformerFactory(impl.kubeClient, namespace, impl.targetLabelKey)
+		informer := factory.Apps().V1().Deployments()
+		informer.Informer().AddEventHandler(timedEventHandler(deploymentStateReporterName, cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				impl.onAdd(topic, obj)
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				impl.onUpdate(topic, oldObj, newObj)
+			},
+			DeleteFunc: func(obj interface{}) {
+				impl.onDelete(topic, obj)
+			},
+		}))
+		impl.listers = append(impl.listers, informer.Lister())
+		factory.Start(stopCh)
+	}
 }
 
 func (impl *deploymentStateReporterImpl) Report(topic string) {
-	impl.logger.Debugf("check deployments state")
-	deploymentsClient := impl.kubeClient.AppsV1().Deployments(apiv1.NamespaceDefault)
+	for _, lister := range impl.listers {
+		deployments, err := lister.List(labels.Everything())
+		if err != nil {
+			impl.logger.Errorf("deploymentLister list err -- %#v", err)
+			continue
+		}
+		sort.Slice(deployments, func(i, j int) bool {
+			return deployments[i].ObjectMeta.Name < deployments[j].ObjectMeta.Name
+		})
+		for _, deployment := range deployments {
+			impl.publish(topic, deployment)
+		}
+	}
+}
+
+func (impl *deploymentStateReporterImpl) onAdd(topic string, obj interface{}) {
+	if deployment, ok := obj.(*appsv1.Deployment); ok {
+		impl.publish(topic, deployment)
+	}
+}
 
-	list, err := deploymentsClient.List(metav1.ListOptions{})
+func (impl *deploymentStateReporterImpl) onUpdate(topic string, oldObj interface{}, newObj interface{}) {
+	oldDeployment, ok := oldObj.(*appsv1.Deployment)
+	if !ok {
+		return
+	}
+	newDeployment, ok := newObj.(*appsv1.Deployment)
+	if !ok {
+		return
+	}
+	// the informer notifies every update of a deployment, but only the change of the reported state is published
+	oldState, _ := impl.state(time.Time{}, oldDeployment)
+	if newState, _ := impl.state(time.Time{}, newDeployment); !reflect.DeepEqual(oldState, newState) {
+		impl.publish(topic, newDeployment)
+	}
+}
+
+// onDelete publishes the deleted state, also when the label has been removed because the object does not match the selector of the informer any more.
+func (impl *deploymentStateReporterImpl) onDelete(topic string, obj interface{}) {
+	if deployment, ok := deletedObject(obj).(*appsv1.Deployment); ok {
+		impl.publishState(topic, deletedState(impl.getCurrentTime(), "Deployment", deployment.ObjectMeta, impl.targetLabelKey))
+	}
+}
+
+func (impl *deploymentStateReporterImpl) publish(topic string, deployment *appsv1.Deployment) {
+	state, ok := impl.state(impl.getCurrentTime(), deployment)
+	if !ok {
+		return
+	}
+	impl.publishState(topic, state)
+}
+
+func (impl *deploymentStateReporterImpl) publishState(topic string, state *ObjectState) {
+	msg, err := impl.formatter.Format(state)
 	if err != nil {
-		impl.logger.Errorf("deploymentsClient list err -- %#v", err)
+		impl.logger.Errorf("format deployment err -- %s: %s", state.Name, err.Error())
 		return
 	}
+	if token := impl.mqttClient.Publish(topic, impl.publishOptions.QoS, impl.publishOptions.Retained, msg); token.Wait() && token.Error() != nil {
+		impl.logger.Errorf("mqtt publish error, topic=%s, msg=%s, %s", topic, msg, token.Error())
+		metrics.PublishFailed(topic)
+	}
+}
 
-	for _, deployment := range list.Items {
-		if val, ok := deployment.ObjectMeta.Labels[impl.targetLabelKey]; ok {
-			msg := fmt.Sprintf(deploymentAttrsFormat, impl.getCurrentTime().Format(time.RFC3339), deployment.ObjectMeta.Name,
-				impl.targetLabelKey, val, *deployment.Spec.Replicas, deployment.Status.Replicas, deployment.Status.UpdatedReplicas,
-				deployment.Status.ReadyReplicas, deployment.Status.UnavailableReplicas, deployment.Status.AvailableReplicas)
-			if token := impl.mqttClient.Publish(topic, 0, false, msg); token.Wait() && token.Error() != nil {
-				impl.logger.Errorf("mqtt publish error, topic=%s, msg=%s, %s", topic, msg, token.Error())
-			}
-		}
+func (impl *deploymentStateReporterImpl) state(timestamp time.Time, deployment *appsv1.Deployment) (*ObjectState, bool) {
+	val, ok := deployment.ObjectMeta.Labels[impl.targetLabelKey]
+	if !ok {
+		return nil, false
+	}
+	var desired int32 = 1
+	if deployment.Spec.Replicas != nil {
+		desired = *deployment.Spec.Replicas
 	}
+	return &ObjectState{
+		Timestamp:  timestamp,
+		Kind:       "Deployment",
+		Namespace:  deployment.ObjectMeta.Namespace,
+		Name:       deployment.ObjectMeta.Name,
+		LabelKey:   impl.targetLabelKey,
+		LabelValue: val,
+		Attrs: []Attr{
+			{"desired", desired},
+			{"current", deployment.Status.Replicas},
+			{"updated", deployment.Status.UpdatedReplicas},
+			{"ready", deployment.Status.ReadyReplicas},
+			{"unavailable", deployment.Status.UnavailableReplicas},
+			{"available", deployment.Status.AvailableReplicas},
+		},
+	}, true
 }
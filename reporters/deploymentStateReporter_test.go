@@ -10,10 +10,14 @@ import (
 	"testing"
 	"time"
 
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"go.uber.org/zap"
 
 	appsv1 "k8s.io/api/apps/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
@@ -21,7 +25,7 @@ import (
 	"github.com/tech-sketch/mqtt-kube-operator/mock"
 )
 
-func setUpDeploymentStateReporterMocks(t *testing.T, deviceType string, deviceID string, intervalSec int) (*DeploymentStateReporter, func()) {
+func setUpDeploymentStateReporterMocks(t *testing.T, deviceType string, deviceID string, resyncSec int) (*DeploymentStateReporter, func()) {
 	ctrl := gomock.NewController(t)
 
 	loggerConfig := zap.NewProductionConfig()
@@ -29,8 +33,8 @@ func setUpDeploymentStateReporterMocks(t *testing.T, deviceType string, deviceID
 	logger, _ := loggerConfig.Build()
 
 	deploymentStateReporter := &DeploymentStateReporter{
-		baseReporter: &baseReporter{deviceType, deviceID, time.Duration(intervalSec), make(chan bool, 1), make(chan bool, 1)},
-		impl:         mock.NewMockReporterImplInf(ctrl),
+		baseReporter: newBaseReporter(deviceType, deviceID, time.Duration(resyncSec)),
+		impl:         NewMockReporterImplInf(ctrl),
 		logger:       logger.Sugar(),
 	}
 	return deploymentStateReporter, func() {
@@ -70,34 +74,66 @@ func TestDeploymentGetTopic(t *testing.T) {
 	}
 }
 
-func TestDeploymentGetChannel(t *testing.T) {
+func TestDeploymentRestartReporting(t *testing.T) {
 	assert := assert.New(t)
-	deploymentStateReporter, tearDown := setUpDeploymentStateReporterMocks(t, "dType", "dID", 1)
+	deploymentStateReporter, tearDown := setUpDeploymentStateReporterMocks(t, "dType", "dID", 0)
 	defer tearDown()
 
-	assert.Equal(deploymentStateReporter.stopCh, deploymentStateReporter.GetStopCh())
-	assert.Equal(deploymentStateReporter.finishCh, deploymentStateReporter.GetFinishCh())
+	informerStopChs := []<-chan struct{}{}
+	impl := deploymentStateReporter.impl.(*MockReporterImplInf)
+	impl.EXPECT().Start("/dType/dID/attrs", gomock.Any()).Do(func(topic string, stopCh <-chan struct{}) {
+		informerStopChs = append(informerStopChs, stopCh)
+	}).Times(2)
+
+	deploymentStateReporter.StopReporting()
+	deploymentStateReporter.StartReporting()
+	deploymentStateReporter.StartReporting()
+	deploymentStateReporter.StopReporting()
+	deploymentStateReporter.StopReporting()
+	assert.Nil(deploymentStateReporter.stopCh)
+	deploymentStateReporter.StartReporting()
+	deploymentStateReporter.StopReporting()
+
+	assert.Len(informerStopChs, 2)
+	for _, stopCh := range informerStopChs {
+		_, ok := <-stopCh
+		assert.False(ok)
+	}
 }
 
 func TestDeploymentStartReporting(t *testing.T) {
 	assert := assert.New(t)
-	deploymentStateReporter, tearDown := setUpDeploymentStateReporterMocks(t, "dType", "dID", 10)
-	defer tearDown()
 
-	deploymentStateReporter.impl.(*mock.MockReporterImplInf).EXPECT().Report("/dType/dID/attrs").MinTimes(1)
-	deploymentStateReporter.StartReporting()
+	resyncCases := []struct {
+		resyncSec int
+		reported  bool
+	}{
+		{resyncSec: 10, reported: true},
+		{resyncSec: 0, reported: false},
+	}
 
-	c := make(chan bool, 1)
-	go func() {
-		time.Sleep(50 * time.Millisecond)
-		deploymentStateReporter.GetStopCh() <- true
-		assert.False(<-deploymentStateReporter.GetFinishCh())
-		c <- true
-	}()
-	assert.True(<-c)
+	for _, c := range resyncCases {
+		t.Run(fmt.Sprintf("resyncSec=%d", c.resyncSec), func(t *testing.T) {
+			deploymentStateReporter, tearDown := setUpDeploymentStateReporterMocks(t, "dType", "dID", c.resyncSec)
+			defer tearDown()
+
+			impl := deploymentStateReporter.impl.(*MockReporterImplInf)
+			impl.EXPECT().Start("/dType/dID/attrs", gomock.Any()).Times(1)
+			if c.reported {
+				impl.EXPECT().Report("/dType/dID/attrs").MinTimes(1)
+			} else {
+				impl.EXPECT().Report(gomock.Any()).Times(0)
+			}
+			deploymentStateReporter.StartReporting()
+
+			time.Sleep(50 * time.Millisecond)
+			deploymentStateReporter.StopReporting()
+			assert.Nil(deploymentStateReporter.stopCh)
+		})
+	}
 }
 
-func setUpDeploymentStateReporterImplMocks(t *testing.T) (*deploymentStateReporterImpl, *mock.MockClient, *mock.MockToken, *mock.MockDeploymentInterface, func()) {
+func setUpDeploymentStateReporterImplMocks(t *testing.T) (*deploymentStateReporterImpl, *mock.MockClient, *mock.MockToken, func()) {
 	ctrl := gomock.NewController(t)
 
 	loggerConfig := zap.NewProductionConfig()
@@ -107,27 +143,32 @@ func setUpDeploymentStateReporterImplMocks(t *testing.T) (*deploymentStateReport
 	mqttClient := mock.NewMockClient(ctrl)
 	token := mock.NewMockToken(ctrl)
 
-	kubeClient := mock.NewMockInterface(ctrl)
-	apps := mock.NewMockAppsV1Interface(ctrl)
-	deploymentsClient := mock.NewMockDeploymentInterface(ctrl)
-	kubeClient.EXPECT().AppsV1().Return(apps).Times(1)
-	apps.EXPECT().Deployments(gomock.Any()).Return(deploymentsClient).Times(1)
-
 	impl := &deploymentStateReporterImpl{
 		logger:     logger.Sugar(),
 		mqttClient: mqttClient,
-		kubeClient: kubeClient,
+		namespaces: []string{"default"},
+		formatter:  &ultralightFormatter{},
 		getCurrentTime: func() time.Time {
 			return time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local)
 		},
 	}
 
-	return impl, mqttClient, token, deploymentsClient, func() {
+	return impl, mqttClient, token, func() {
 		logger.Sync()
 		ctrl.Finish()
 	}
 }
 
+func newDeploymentLister(t *testing.T, deployments []appsv1.Deployment) appslisters.DeploymentLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for i := range deployments {
+		if err := indexer.Add(&deployments[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return appslisters.NewDeploymentLister(indexer)
+}
+
 func TestDeploymentReport(t *testing.T) {
 	var desired1 int32 = 1
 	var desired2 int32 = 11
@@ -222,14 +263,15 @@ func TestDeploymentReport(t *testing.T) {
 	for _, testCase := range testCases {
 		for _, testLabel := range testLabels {
 			t.Run(fmt.Sprintf("deployment num=%d, label=%s", len(testCase.deploymentList.Items), testLabel.key), func(t *testing.T) {
-				impl, mqttClient, token, deploymentsClient, tearDown := setUpDeploymentStateReporterImplMocks(t)
+				impl, mqttClient, token, tearDown := setUpDeploymentStateReporterImplMocks(t)
 				defer tearDown()
 
 				if testLabel.key != "nil" {
 					impl.targetLabelKey = testLabel.key
 				}
 
-				deploymentsClient.EXPECT().List(gomock.Any()).Return(&testCase.deploymentList, nil).Times(1)
+				impl.listers = []appslisters.DeploymentLister{newDeploymentLister(t, testCase.deploymentList.Items)}
+
 				if len(testCase.deploymentList.Items) == 0 {
 					mqttClient.EXPECT().Publish("/test", byte(0), false, gomock.Any()).Times(0)
 				} else if len(testCase.deploymentList.Items) == 1 {
@@ -258,12 +300,121 @@ func TestDeploymentReport(t *testing.T) {
 	}
 }
 
-func TestDeploymentReportError(t *testing.T) {
-	impl, mqttClient, _, deploymentsClient, tearDown := setUpDeploymentStateReporterImplMocks(t)
+func TestDeploymentOnUpdate(t *testing.T) {
+	var desired int32 = 1
+	oldDeployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "testdeployment1", ResourceVersion: "1", Labels: map[string]string{"testkey": "value1"}},
+		Spec:       appsv1.DeploymentSpec{Replicas: &desired},
+		Status:     appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, UnavailableReplicas: 1},
+	}
+
+	testCases := []struct {
+		name   string
+		update func(deployment *appsv1.Deployment)
+		msg    string
+	}{
+		{name: "ready", update: func(deployment *appsv1.Deployment) {
+			deployment.Status.ReadyReplicas = 1
+			deployment.Status.AvailableReplicas = 1
+			deployment.Status.UnavailableReplicas = 0
+		}, msg: "|deployment|testdeployment1|label|testkey:value1|desired|1|current|1|updated|1|ready|1|unavailable|0|available|1"},
+		{name: "scaled", update: func(deployment *appsv1.Deployment) {
+			var scaled int32 = 3
+			deployment.Spec.Replicas = &scaled
+		}, msg: "|deployment|testdeployment1|label|testkey:value1|desired|3|current|1|updated|1|ready|0|unavailable|1|available|0"},
+		{name: "other", update: func(deployment *appsv1.Deployment) { deployment.Status.ObservedGeneration = 2 }},
+		{name: "label removed", update: func(deployment *appsv1.Deployment) { delete(deployment.ObjectMeta.Labels, "testkey") }},
+	}
+
+	dt := time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local).Format(time.RFC3339)
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			impl, mqttClient, token, tearDown := setUpDeploymentStateReporterImplMocks(t)
+			defer tearDown()
+			impl.targetLabelKey = "testkey"
+
+			newDeployment := oldDeployment.DeepCopy()
+			newDeployment.ObjectMeta.ResourceVersion = "2"
+			c.update(newDeployment)
+
+			if c.msg != "" {
+				mqttClient.EXPECT().Publish("/test", byte(0), false, dt+c.msg).Return(token).Times(1)
+				token.EXPECT().Wait().Return(false).Times(1)
+			} else {
+				mqttClient.EXPECT().Publish("/test", byte(0), false, gomock.Any()).Times(0)
+			}
+
+			impl.onUpdate("/test", oldDeployment, newDeployment)
+		})
+	}
+}
+
+func TestDeploymentOnDelete(t *testing.T) {
+	deleted := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "testdeployment1", Labels: map[string]string{"testkey": "value1"}}}
+	unlabeled := deleted.DeepCopy()
+	delete(unlabeled.ObjectMeta.Labels, "testkey")
+
+	testCases := []struct {
+		name string
+		obj  interface{}
+		msg  string
+	}{
+		{name: "deleted", obj: deleted, msg: "|deployment|testdeployment1|label|testkey:value1|deleted|true"},
+		{name: "tombstone", obj: cache.DeletedFinalStateUnknown{Key: "testdeployment1", Obj: deleted}, msg: "|deployment|testdeployment1|label|testkey:value1|deleted|true"},
+		{name: "label removed", obj: unlabeled, msg: "|deployment|testdeployment1|label|testkey:|deleted|true"},
+		{name: "unknown object", obj: "testdeployment1"},
+	}
+
+	dt := time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local).Format(time.RFC3339)
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			impl, mqttClient, token, tearDown := setUpDeploymentStateReporterImplMocks(t)
+			defer tearDown()
+			impl.targetLabelKey = "testkey"
+
+			if c.msg != "" {
+				mqttClient.EXPECT().Publish("/test", byte(0), false, dt+c.msg).Return(token).Times(1)
+				token.EXPECT().Wait().Return(false).Times(1)
+			} else {
+				mqttClient.EXPECT().Publish("/test", byte(0), false, gomock.Any()).Times(0)
+			}
+
+			impl.onDelete("/test", c.obj)
+		})
+	}
+}
+
+func TestDeploymentStart(t *testing.T) {
+	assert := assert.New(t)
+
+	impl, mqttClient, token, tearDown := setUpDeploymentStateReporterImplMocks(t)
 	defer tearDown()
 
-	deploymentsClient.EXPECT().List(gomock.Any()).Return(nil, fmt.Errorf("test error")).Times(1)
-	mqttClient.EXPECT().Publish("/test", byte(0), false, gomock.Any()).Times(0)
+	var desired int32 = 2
+	impl.targetLabelKey = "testkey"
+	impl.kubeClient = fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "testdeployment1", Namespace: "default", Labels: map[string]string{"testkey": "value1"}}, Spec: appsv1.DeploymentSpec{Replicas: &desired}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "testdeployment2", Namespace: "default", Labels: map[string]string{"dummy": "dummy"}}, Spec: appsv1.DeploymentSpec{Replicas: &desired}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "testdeployment3", Namespace: "kube-system", Labels: map[string]string{"testkey": "value3"}}, Spec: appsv1.DeploymentSpec{Replicas: &desired}},
+	)
+
+	dt := time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local).Format(time.RFC3339)
+	published := make(chan string, 3)
+	mqttClient.EXPECT().Publish("/test", byte(0), false, gomock.Any()).DoAndReturn(func(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+		published <- payload.(string)
+		return token
+	}).Times(1)
+	token.EXPECT().Wait().Return(false).Times(1)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	impl.Start("/test", stopCh)
+	assert.Len(impl.listers, 1)
 
-	impl.Report("/test")
+	select {
+	case msg := <-published:
+		assert.Equal(dt+"|deployment|testdeployment1|label|testkey:value1|desired|2|current|0|updated|0|ready|0|unavailable|0|available|0", msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
 }
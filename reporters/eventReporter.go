@@ -0,0 +1,280 @@
+/*
+Package reporters : report state of kubernetes using MQTT.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package reporters
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
+
+	"github.com/tech-sketch/mqtt-kube-operator/metrics"
+)
+
+const eventReporterName = "EventReporter"
+
+// maxOwnerDepth is the depth of the owner references followed to find the labelled object, e.g. Pod -> ReplicaSet -> Deployment.
+const maxOwnerDepth = 2
+
+/*
+EventReporter : a struct to forward the Warning events of the labelled objects.
+*/
+type EventReporter struct {
+	*baseReporter
+	impl   ReporterImplInf
+	logger *zap.SugaredLogger
+}
+
+/*
+NewEventReporter : a factory method to create EventReporter.
+The same event (reason) of the same object is forwarded only once in dedupSec, and at most ratePerMin events are forwarded in a minute.
+*/
+func NewEventReporter(mqttClient mqtt.Client, kubeClient *kubernetes.Clientset, logger *zap.SugaredLogger, deviceType string, deviceID string, targetLabelKey string, namespaces []string, formatter FormatterInf, dedupSec int, ratePerMin int, publishOptions PublishOptions) *EventReporter {
+	return &EventReporter{
+		baseReporter: newBaseReporter(deviceType, deviceID, 0),
+		impl: &eventReporterImpl{
+			logger:         logger,
+			mqttClient:     mqttClient,
+			publishOptions: publishOptions,
+			kubeClient:     kubeClient,
+			targetLabelKey: targetLabelKey,
+			namespaces:     namespaces,
+			formatter:      formatter,
+			getCurrentTime: time.Now,
+			dedupWindow:    time.Duration(dedupSec) * time.Second,
+			rateLimiter:    newEventRateLimiter(ratePerMin),
+			forwarded:      map[string]time.Time{},
+		},
+		logger: logger,
+	}
+}
+
+/*
+GetEventsTopic : get the events topic name
+*/
+func (r *EventReporter) GetEventsTopic() string {
+	return "/" + r.deviceType + "/" + r.deviceID + "/events"
+}
+
+/*
+StartReporting : start watching Warning events to forward them to the events topic.
+*/
+func (r *EventReporter) StartReporting() {
+	r.baseReporter.start(eventReporterName, r.GetEventsTopic(), r.impl, r.logger)
+}
+
+func newEventRateLimiter(ratePerMin int) flowcontrol.RateLimiter {
+	if ratePerMin <= 0 {
+		return flowcontrol.NewFakeAlwaysRateLimiter()
+	}
+	return flowcontrol.NewTokenBucketRateLimiter(float32(ratePerMin)/60, ratePerMin)
+}
+
+type eventReporterImpl struct {
+	logger         *zap.SugaredLogger
+	mqttClient     mqtt.Client
+	publishOptions PublishOptions
+	kubeClient     kubernetes.Interface
+	targetLabelKey string
+	namespaces     []string
+	formatter      FormatterInf
+	getCurrentTime func() time.Time
+	dedupWindow    time.Duration
+	rateLimiter    flowcontrol.RateLimiter
+	mutex          sync.Mutex
+	since          time.Time
+	forwarded      map[string]time.Time
+}
+
+// ownerListers look up the involved objects of the events and their owners from the caches of the informers.
+type ownerListers struct {
+	pods        corelisters.PodLister
+	replicaSets appslisters.ReplicaSetLister
+	deployments appslisters.DeploymentLister
+}
+
+func newOwnerListers(factory informers.SharedInformerFactory) *ownerListers {
+	return &ownerListers{
+		pods:        factory.Core().V1().Pods().Lister(),
+		replicaSets: factory.Apps().V1().ReplicaSets().Lister(),
+		deployments: factory.Apps().V1().Deployments().Lister(),
+	}
+}
+
+func (impl *eventReporterImpl) Start(topic string, stopCh <-chan struct{}) {
+	if impl.targetLabelKey == "" {
+		impl.logger.Warnf("target label key is empty, no event is forwarded")
+		return
+	}
+	impl.mutex.Lock()
+	if impl.since.IsZero() {
+		// the timestamps of events are in seconds
+		impl.since = impl.getCurrentTime().Truncate(time.Second)
+	}
+	impl.mutex.Unlock()
+	go func() {
+		<-stopCh
+		// the events occurred while stopped, e.g. while disconnected from MQTT Broker, are forwarded on restarting
+		impl.mutex.Lock()
+		impl.since = impl.getCurrentTime().Truncate(time.Second)
+		impl.mutex.Unlock()
+	}()
+	for _, namespace := range impl.namespaces {
+		impl.logger.Debugf("start watching events, namespace=%s", namespace)
+		ownerFactory := informers.NewSharedInformerFactoryWithOptions(impl.kubeClient, 0, informers.WithNamespace(namespace))
+		owners := newOwnerListers(ownerFactory)
+		ownerFactory.Start(stopCh)
+		ownerFactory.WaitForCacheSync(stopCh)
+		// events do not carry the labels of the involved object, so all Warning events are watched and filtered later
+		factory := informers.NewSharedInformerFactoryWithOptions(impl.kubeClient, 0,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.FieldSelector = "type=" + apiv1.EventTypeWarning
+			}),
+		)
+		informer := factory.Core().V1().Events()
+		informer.Informer().AddEventHandler(timedEventHandler(eventReporterName, cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				impl.onEvent(topic, owners, obj)
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				impl.onEvent(topic, owners, newObj)
+			},
+		}))
+		factory.Start(stopCh)
+	}
+}
+
+func (impl *eventReporterImpl) Report(topic string) {
+	// events are forwarded only when they occur
+}
+
+func (impl *eventReporterImpl) onEvent(topic string, owners *ownerListers, obj interface{}) {
+	event, ok := obj.(*apiv1.Event)
+	if !ok || event.Type != apiv1.EventTypeWarning {
+		return
+	}
+	// the informer lists the past events at first, which were already forwarded or are no longer relevant
+	impl.mutex.Lock()
+	since := impl.since
+	impl.mutex.Unlock()
+	if eventTime(event).Before(since) {
+		return
+	}
+	involved := event.InvolvedObject
+	val, ok := impl.findLabelValue(owners, involved.Kind, involved.Namespace, involved.Name, 0)
+	if !ok {
+		return
+	}
+	key := fmt.Sprintf("%s/%s/%s/%s", involved.Namespace, involved.Kind, involved.Name, event.Reason)
+	if !impl.shouldForward(key) {
+		impl.logger.Debugf("suppress event -- %s", key)
+		return
+	}
+	impl.publish(topic, event, val)
+}
+
+// shouldForward deduplicates the events by key, and then applies the rate limit.
+func (impl *eventReporterImpl) shouldForward(key string) bool {
+	impl.mutex.Lock()
+	defer impl.mutex.Unlock()
+
+	now := impl.getCurrentTime()
+	for k, forwardedAt := range impl.forwarded {
+		if now.Sub(forwardedAt) >= impl.dedupWindow {
+			delete(impl.forwarded, k)
+		}
+	}
+	if _, ok := impl.forwarded[key]; ok {
+		return false
+	}
+	if !impl.rateLimiter.TryAccept() {
+		return false
+	}
+	if impl.dedupWindow > 0 {
+		impl.forwarded[key] = now
+	}
+	return true
+}
+
+// findLabelValue returns the value of the target label of the object, or of its controller, e.g. the Deployment of a Pod.
+func (impl *eventReporterImpl) findLabelValue(owners *ownerListers, kind string, namespace string, name string, depth int) (string, bool) {
+	var objMeta metav1.Object
+	var err error
+	switch kind {
+	case "Pod":
+		objMeta, err = owners.pods.Pods(namespace).Get(name)
+	case "ReplicaSet":
+		objMeta, err = owners.replicaSets.ReplicaSets(namespace).Get(name)
+	case "Deployment":
+		objMeta, err = owners.deployments.Deployments(namespace).Get(name)
+	default:
+		return "", false
+	}
+	if err != nil {
+		impl.logger.Debugf("get %s err -- %s: %s", kind, name, err.Error())
+		return "", false
+	}
+	if val, ok := objMeta.GetLabels()[impl.targetLabelKey]; ok {
+		return val, true
+	}
+	owner := metav1.GetControllerOf(objMeta)
+	if owner == nil || depth >= maxOwnerDepth {
+		return "", false
+	}
+	return impl.findLabelValue(owners, owner.Kind, namespace, owner.Name, depth+1)
+}
+
+func (impl *eventReporterImpl) publish(topic string, event *apiv1.Event, labelValue string) {
+	state := &ObjectState{
+		Timestamp:  eventTime(event),
+		Kind:       "Event",
+		Namespace:  event.ObjectMeta.Namespace,
+		Name:       event.ObjectMeta.Name,
+		LabelKey:   impl.targetLabelKey,
+		LabelValue: labelValue,
+		Attrs: []Attr{
+			{"objectKind", event.InvolvedObject.Kind},
+			{"objectName", event.InvolvedObject.Name},
+			{"reason", event.Reason},
+			{"message", event.Message},
+			{"count", event.Count},
+			{"source", event.Source.Component},
+		},
+	}
+	msg, err := impl.formatter.Format(state)
+	if err != nil {
+		impl.logger.Errorf("format event err -- %s: %s", event.ObjectMeta.Name, err.Error())
+		return
+	}
+	if token := impl.mqttClient.Publish(topic, impl.publishOptions.QoS, impl.publishOptions.Retained, msg); token.Wait() && token.Error() != nil {
+		impl.logger.Errorf("mqtt publish error, topic=%s, msg=%s, %s", topic, msg, token.Error())
+		metrics.PublishFailed(topic)
+	}
+}
+
+// eventTime returns when the event occurred last.
+func eventTime(event *apiv1.Event) time.Time {
+	if !event.LastTimestamp.IsZero() {
+		return event.LastTimestamp.Time
+	}
+	if !event.EventTime.IsZero() {
+		return event.EventTime.Time
+	}
+	return event.ObjectMeta.CreationTimestamp.Time
+}
@@ -0,0 +1,360 @@
+/*
+Package reporters : report state of kubernetes using MQTT.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package reporters
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/flowcontrol"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/mqtt-kube-operator/mock"
+)
+
+func setUpEventReporterMocks(t *testing.T, deviceType string, deviceID string) (*EventReporter, func()) {
+	ctrl := gomock.NewController(t)
+
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = zap.NewAtomicLevelAt(zap.FatalLevel)
+	logger, _ := loggerConfig.Build()
+
+	eventReporter := &EventReporter{
+		baseReporter: newBaseReporter(deviceType, deviceID, 0),
+		impl:         NewMockReporterImplInf(ctrl),
+		logger:       logger.Sugar(),
+	}
+	return eventReporter, func() {
+		logger.Sync()
+		ctrl.Finish()
+	}
+}
+
+func TestEventGetTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	eventReporter, tearDown := setUpEventReporterMocks(t, "dType", "dID")
+	defer tearDown()
+
+	assert.Equal("/dType/dID/events", eventReporter.GetEventsTopic())
+	assert.Equal("/dType/dID/attrs", eventReporter.GetAttrsTopic())
+}
+
+func TestEventStartReporting(t *testing.T) {
+	assert := assert.New(t)
+
+	eventReporter, tearDown := setUpEventReporterMocks(t, "dType", "dID")
+	defer tearDown()
+
+	impl := eventReporter.impl.(*MockReporterImplInf)
+	impl.EXPECT().Start("/dType/dID/events", gomock.Any()).Times(1)
+	impl.EXPECT().Report(gomock.Any()).Times(0)
+	eventReporter.StartReporting()
+
+	time.Sleep(50 * time.Millisecond)
+	eventReporter.StopReporting()
+	assert.Nil(eventReporter.stopCh)
+}
+
+var eventTestStartedAt = time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local)
+
+func setUpEventReporterImplMocks(t *testing.T, objects ...runtime.Object) (*eventReporterImpl, *ownerListers, *mock.MockClient, *mock.MockToken, func()) {
+	ctrl := gomock.NewController(t)
+
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = zap.NewAtomicLevelAt(zap.FatalLevel)
+	logger, _ := loggerConfig.Build()
+
+	mqttClient := mock.NewMockClient(ctrl)
+	token := mock.NewMockToken(ctrl)
+
+	impl := &eventReporterImpl{
+		logger:         logger.Sugar(),
+		mqttClient:     mqttClient,
+		kubeClient:     fake.NewSimpleClientset(objects...),
+		targetLabelKey: "testkey",
+		namespaces:     []string{"default"},
+		formatter:      &ultralightFormatter{},
+		getCurrentTime: func() time.Time {
+			return eventTestStartedAt
+		},
+		dedupWindow: time.Minute,
+		rateLimiter: flowcontrol.NewFakeAlwaysRateLimiter(),
+		since:       eventTestStartedAt,
+		forwarded:   map[string]time.Time{},
+	}
+
+	stopCh := make(chan struct{})
+	factory := informers.NewSharedInformerFactory(impl.kubeClient, 0)
+	owners := newOwnerListers(factory)
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+
+	return impl, owners, mqttClient, token, func() {
+		close(stopCh)
+		logger.Sync()
+		ctrl.Finish()
+	}
+}
+
+func newEventTestObjects() []runtime.Object {
+	controller := true
+	return []runtime.Object{
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "testdeployment1", Namespace: "default", Labels: map[string]string{"testkey": "value1"}}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "testdeployment1-abc", Namespace: "default", OwnerReferences: []metav1.OwnerReference{
+			{Kind: "Deployment", Name: "testdeployment1", Controller: &controller},
+		}}},
+		&apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "testdeployment1-abc-xyz", Namespace: "default", OwnerReferences: []metav1.OwnerReference{
+			{Kind: "ReplicaSet", Name: "testdeployment1-abc", Controller: &controller},
+		}}},
+		&apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Namespace: "default", Labels: map[string]string{"testkey": "value2"}}},
+		&apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "testpod2", Namespace: "default", Labels: map[string]string{"dummy": "dummy"}}},
+		&apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "testnode1", Labels: map[string]string{"testkey": "value3"}}},
+	}
+}
+
+func newTestEvent(kind string, name string, eventType string, reason string, lastTimestamp time.Time) *apiv1.Event {
+	return &apiv1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: name + ".event", Namespace: "default"},
+		InvolvedObject: apiv1.ObjectReference{Kind: kind, Namespace: "default", Name: name},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        "Back-off pulling image \"nginx:notexist\"",
+		Count:          3,
+		Source:         apiv1.EventSource{Component: "kubelet"},
+		LastTimestamp:  metav1.NewTime(lastTimestamp),
+	}
+}
+
+func TestEventOnEvent(t *testing.T) {
+	dt := eventTestStartedAt.Format(time.RFC3339)
+	testCases := []struct {
+		name  string
+		event *apiv1.Event
+		msg   string
+	}{
+		{
+			name:  "labelled pod",
+			event: newTestEvent("Pod", "testpod1", apiv1.EventTypeWarning, "BackOff", eventTestStartedAt),
+			msg:   dt + "|event|testpod1.event|label|testkey:value2|objectKind|Pod|objectName|testpod1|reason|BackOff|message|Back-off pulling image \"nginx:notexist\"|count|3|source|kubelet",
+		},
+		{
+			name:  "pod owned by labelled deployment",
+			event: newTestEvent("Pod", "testdeployment1-abc-xyz", apiv1.EventTypeWarning, "FailedScheduling", eventTestStartedAt.Add(time.Second)),
+			msg: eventTestStartedAt.Add(time.Second).Format(time.RFC3339) +
+				"|event|testdeployment1-abc-xyz.event|label|testkey:value1|objectKind|Pod|objectName|testdeployment1-abc-xyz|reason|FailedScheduling|message|Back-off pulling image \"nginx:notexist\"|count|3|source|kubelet",
+		},
+		{
+			name:  "replicaset owned by labelled deployment",
+			event: newTestEvent("ReplicaSet", "testdeployment1-abc", apiv1.EventTypeWarning, "FailedCreate", eventTestStartedAt),
+			msg:   dt + "|event|testdeployment1-abc.event|label|testkey:value1|objectKind|ReplicaSet|objectName|testdeployment1-abc|reason|FailedCreate|message|Back-off pulling image \"nginx:notexist\"|count|3|source|kubelet",
+		},
+		{
+			name:  "not labelled pod",
+			event: newTestEvent("Pod", "testpod2", apiv1.EventTypeWarning, "BackOff", eventTestStartedAt),
+		},
+		{
+			name:  "not existing pod",
+			event: newTestEvent("Pod", "notexist", apiv1.EventTypeWarning, "BackOff", eventTestStartedAt),
+		},
+		{
+			name:  "not supported kind",
+			event: newTestEvent("Node", "testnode1", apiv1.EventTypeWarning, "SystemOOM", eventTestStartedAt),
+		},
+		{
+			name:  "normal event",
+			event: newTestEvent("Pod", "testpod1", apiv1.EventTypeNormal, "Pulling", eventTestStartedAt),
+		},
+		{
+			name:  "past event",
+			event: newTestEvent("Pod", "testpod1", apiv1.EventTypeWarning, "BackOff", eventTestStartedAt.Add(-time.Second)),
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			impl, owners, mqttClient, token, tearDown := setUpEventReporterImplMocks(t, newEventTestObjects()...)
+			defer tearDown()
+
+			if c.msg != "" {
+				mqttClient.EXPECT().Publish("/test", byte(0), false, c.msg).Return(token).Times(1)
+				token.EXPECT().Wait().Return(false).Times(1)
+			} else {
+				mqttClient.EXPECT().Publish(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+			}
+
+			impl.onEvent("/test", owners, c.event)
+		})
+	}
+}
+
+func TestEventDedup(t *testing.T) {
+	assert := assert.New(t)
+
+	impl, owners, mqttClient, token, tearDown := setUpEventReporterImplMocks(t, newEventTestObjects()...)
+	defer tearDown()
+
+	now := eventTestStartedAt
+	impl.getCurrentTime = func() time.Time {
+		return now
+	}
+
+	published := []string{}
+	mqttClient.EXPECT().Publish("/test", byte(0), false, gomock.Any()).DoAndReturn(func(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+		published = append(published, payload.(string))
+		return token
+	}).Times(3)
+	token.EXPECT().Wait().Return(false).Times(3)
+
+	impl.onEvent("/test", owners, newTestEvent("Pod", "testpod1", apiv1.EventTypeWarning, "BackOff", eventTestStartedAt))
+	// the same reason of the same object is suppressed in the window
+	now = now.Add(30 * time.Second)
+	impl.onEvent("/test", owners, newTestEvent("Pod", "testpod1", apiv1.EventTypeWarning, "BackOff", now))
+	// but the other reason is not
+	impl.onEvent("/test", owners, newTestEvent("Pod", "testpod1", apiv1.EventTypeWarning, "Failed", now))
+	// and it is forwarded again after the window
+	now = now.Add(30 * time.Second)
+	impl.onEvent("/test", owners, newTestEvent("Pod", "testpod1", apiv1.EventTypeWarning, "BackOff", now))
+
+	assert.Len(published, 3)
+	assert.Len(impl.forwarded, 2)
+}
+
+func TestEventRateLimit(t *testing.T) {
+	impl, owners, mqttClient, _, tearDown := setUpEventReporterImplMocks(t, newEventTestObjects()...)
+	defer tearDown()
+
+	impl.rateLimiter = flowcontrol.NewFakeNeverRateLimiter()
+	mqttClient.EXPECT().Publish(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+	impl.onEvent("/test", owners, newTestEvent("Pod", "testpod1", apiv1.EventTypeWarning, "BackOff", eventTestStartedAt))
+	assert.Empty(t, impl.forwarded)
+}
+
+func TestNewEventRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		ratePerMin int
+		accepted   int
+	}{
+		{ratePerMin: 0, accepted: 10},
+		{ratePerMin: 3, accepted: 3},
+	}
+
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("ratePerMin=%d", c.ratePerMin), func(t *testing.T) {
+			rateLimiter := newEventRateLimiter(c.ratePerMin)
+			accepted := 0
+			for i := 0; i < 10; i++ {
+				if rateLimiter.TryAccept() {
+					accepted++
+				}
+			}
+			assert.Equal(c.accepted, accepted)
+		})
+	}
+}
+
+func TestEventStart(t *testing.T) {
+	assert := assert.New(t)
+
+	objects := append(newEventTestObjects(),
+		newTestEvent("Pod", "testpod1", apiv1.EventTypeWarning, "BackOff", eventTestStartedAt),
+		newTestEvent("Pod", "testpod2", apiv1.EventTypeWarning, "BackOff", eventTestStartedAt),
+	)
+	impl, _, mqttClient, token, tearDown := setUpEventReporterImplMocks(t, objects...)
+	defer tearDown()
+
+	published := make(chan string, 2)
+	mqttClient.EXPECT().Publish("/test", byte(0), false, gomock.Any()).DoAndReturn(func(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+		published <- payload.(string)
+		return token
+	}).Times(1)
+	token.EXPECT().Wait().Return(false).Times(1)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	impl.Start("/test", stopCh)
+
+	select {
+	case msg := <-published:
+		assert.Contains(msg, "|event|testpod1.event|label|testkey:value2|")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestEventStartWithoutLabel(t *testing.T) {
+	impl, _, mqttClient, _, tearDown := setUpEventReporterImplMocks(t)
+	defer tearDown()
+
+	impl.targetLabelKey = ""
+	mqttClient.EXPECT().Publish(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	impl.Start("/test", stopCh)
+	assert.True(t, impl.since.Equal(eventTestStartedAt))
+}
+
+func TestEventRestart(t *testing.T) {
+	assert := assert.New(t)
+
+	impl, _, _, _, tearDown := setUpEventReporterImplMocks(t)
+	defer tearDown()
+
+	impl.since = time.Time{}
+	var mutex sync.Mutex
+	now := eventTestStartedAt
+	impl.getCurrentTime = func() time.Time {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return now
+	}
+	setNow := func(t time.Time) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		now = t
+	}
+	getSince := func() time.Time {
+		impl.mutex.Lock()
+		defer impl.mutex.Unlock()
+		return impl.since
+	}
+
+	stopCh := make(chan struct{})
+	impl.Start("/test", stopCh)
+	assert.True(getSince().Equal(eventTestStartedAt))
+
+	// the events after the reporter is stopped are forwarded when it starts again
+	stoppedAt := eventTestStartedAt.Add(time.Minute)
+	setNow(stoppedAt)
+	close(stopCh)
+	for i := 0; i < 100 && !getSince().Equal(stoppedAt); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(getSince().Equal(stoppedAt))
+
+	setNow(stoppedAt.Add(time.Minute))
+	restartStopCh := make(chan struct{})
+	defer close(restartStopCh)
+	impl.Start("/test", restartStopCh)
+	assert.True(getSince().Equal(stoppedAt))
+}
@@ -0,0 +1,133 @@
+/*
+Package reporters : report state of kubernetes using MQTT.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package reporters
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+Formats of the reported payload.
+*/
+const (
+	FormatUltralight = "ultralight"
+	FormatJSON       = "json"
+	FormatNGSILD     = "ngsi-ld"
+)
+
+const ngsiLDContext = "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+
+/*
+Attr : a struct to hold a reported attribute of an object.
+*/
+type Attr struct {
+	Name  string
+	Value interface{}
+}
+
+/*
+ObjectState : a struct to hold the reported state of an object.
+*/
+type ObjectState struct {
+	Timestamp  time.Time
+	Kind       string
+	Namespace  string
+	Name       string
+	LabelKey   string
+	LabelValue string
+	Attrs      []Attr
+}
+
+/*
+NewFormatter : a factory method to create the formatter of the specified format ("ultralight", "json" or "ngsi-ld").
+*/
+func NewFormatter(format string) (FormatterInf, error) {
+	switch format {
+	case "", FormatUltralight:
+		return &ultralightFormatter{}, nil
+	case FormatJSON:
+		return &jsonFormatter{}, nil
+	case FormatNGSILD:
+		return &ngsiLDFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown report format '%s', expected %s, %s or %s", format, FormatUltralight, FormatJSON, FormatNGSILD)
+	}
+}
+
+// ultralightFormatter formats the state like "2018-01-02T03:04:05+09:00|pod|name|label|key:value|phase|Running".
+type ultralightFormatter struct{}
+
+func (f *ultralightFormatter) Format(state *ObjectState) (string, error) {
+	elements := []string{
+		state.Timestamp.Format(time.RFC3339),
+		strings.ToLower(state.Kind),
+		state.Name,
+		"label",
+		state.LabelKey + ":" + state.LabelValue,
+	}
+	for _, attr := range state.Attrs {
+		// "|" is the separator of ultralight, so it can not appear in a value like the message of an event
+		elements = append(elements, attr.Name, strings.Replace(fmt.Sprintf("%v", attr.Value), "|", " ", -1))
+	}
+	return strings.Join(elements, "|"), nil
+}
+
+// jsonFormatter formats the state as a measure of iotagent-json like {"TimeInstant": "...", "pod": "name", "label": "key:value", "phase": "Running"}.
+type jsonFormatter struct{}
+
+func (f *jsonFormatter) Format(state *ObjectState) (string, error) {
+	m := map[string]interface{}{
+		"TimeInstant":               state.Timestamp.Format(time.RFC3339),
+		strings.ToLower(state.Kind): state.Name,
+		"label":                     state.LabelKey + ":" + state.LabelValue,
+	}
+	for _, attr := range state.Attrs {
+		m[attr.Name] = attr.Value
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// ngsiLDFormatter formats the state as a NGSI-LD entity whose id is like "urn:ngsi-ld:Pod:namespace:name" or "urn:ngsi-ld:Node:name".
+type ngsiLDFormatter struct{}
+
+func (f *ngsiLDFormatter) Format(state *ObjectState) (string, error) {
+	observedAt := state.Timestamp.UTC().Format("2006-01-02T15:04:05Z")
+	property := func(value interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"type":       "Property",
+			"value":      value,
+			"observedAt": observedAt,
+		}
+	}
+	entity := map[string]interface{}{
+		"@context": ngsiLDContext,
+		"id":       fmt.Sprintf("urn:ngsi-ld:%s:%s:%s", state.Kind, state.Namespace, state.Name),
+		"type":     state.Kind,
+		"name":     property(state.Name),
+		"label":    property(map[string]string{"key": state.LabelKey, "value": state.LabelValue}),
+	}
+	// a cluster-scoped object like a Node has neither namespace attribute nor namespace part of its id
+	if state.Namespace == "" {
+		entity["id"] = fmt.Sprintf("urn:ngsi-ld:%s:%s", state.Kind, state.Name)
+	} else {
+		entity["namespace"] = property(state.Namespace)
+	}
+	for _, attr := range state.Attrs {
+		entity[attr.Name] = property(attr.Value)
+	}
+	b, err := json.Marshal(entity)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
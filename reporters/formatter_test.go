@@ -0,0 +1,129 @@
+/*
+Package reporters : report state of kubernetes using MQTT.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package reporters
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestObjectState() *ObjectState {
+	return &ObjectState{
+		Timestamp:  time.Date(2018, 1, 2, 3, 4, 5, 0, time.FixedZone("JST", 9*60*60)),
+		Kind:       "Pod",
+		Namespace:  "default",
+		Name:       "test-pod",
+		LabelKey:   "report",
+		LabelValue: "yes",
+		Attrs: []Attr{
+			{"phase", "Running"},
+			{"restarts", int32(2)},
+		},
+	}
+}
+
+func TestNewFormatter(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		format   string
+		expected FormatterInf
+	}{
+		{format: "", expected: &ultralightFormatter{}},
+		{format: FormatUltralight, expected: &ultralightFormatter{}},
+		{format: FormatJSON, expected: &jsonFormatter{}},
+		{format: FormatNGSILD, expected: &ngsiLDFormatter{}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(fmt.Sprintf("format=%s", testCase.format), func(t *testing.T) {
+			formatter, err := NewFormatter(testCase.format)
+			assert.Nil(err)
+			assert.IsType(testCase.expected, formatter)
+		})
+	}
+}
+
+func TestNewFormatterUnknown(t *testing.T) {
+	assert := assert.New(t)
+
+	formatter, err := NewFormatter("xml")
+	assert.Nil(formatter)
+	assert.NotNil(err)
+	assert.Equal("unknown report format 'xml', expected ultralight, json or ngsi-ld", err.Error())
+}
+
+func TestFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		format   string
+		expected string
+	}{
+		{
+			format:   FormatUltralight,
+			expected: "2018-01-02T03:04:05+09:00|pod|test-pod|label|report:yes|phase|Running|restarts|2",
+		},
+		{
+			format:   FormatJSON,
+			expected: `{"TimeInstant":"2018-01-02T03:04:05+09:00","label":"report:yes","phase":"Running","pod":"test-pod","restarts":2}`,
+		},
+		{
+			format: FormatNGSILD,
+			expected: `{"@context":"https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld",` +
+				`"id":"urn:ngsi-ld:Pod:default:test-pod",` +
+				`"label":{"observedAt":"2018-01-01T18:04:05Z","type":"Property","value":{"key":"report","value":"yes"}},` +
+				`"name":{"observedAt":"2018-01-01T18:04:05Z","type":"Property","value":"test-pod"},` +
+				`"namespace":{"observedAt":"2018-01-01T18:04:05Z","type":"Property","value":"default"},` +
+				`"phase":{"observedAt":"2018-01-01T18:04:05Z","type":"Property","value":"Running"},` +
+				`"restarts":{"observedAt":"2018-01-01T18:04:05Z","type":"Property","value":2},` +
+				`"type":"Pod"}`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(fmt.Sprintf("format=%s", testCase.format), func(t *testing.T) {
+			formatter, err := NewFormatter(testCase.format)
+			assert.Nil(err)
+			msg, err := formatter.Format(newTestObjectState())
+			assert.Nil(err)
+			assert.Equal(testCase.expected, msg)
+		})
+	}
+}
+
+func TestFormatNGSILDClusterScoped(t *testing.T) {
+	assert := assert.New(t)
+
+	state := newTestObjectState()
+	state.Kind = "Node"
+	state.Namespace = ""
+	state.Name = "test-node"
+	state.Attrs = []Attr{{"ready", "True"}}
+
+	msg, err := (&ngsiLDFormatter{}).Format(state)
+	assert.Nil(err)
+	assert.Equal(`{"@context":"https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld",`+
+		`"id":"urn:ngsi-ld:Node:test-node",`+
+		`"label":{"observedAt":"2018-01-01T18:04:05Z","type":"Property","value":{"key":"report","value":"yes"}},`+
+		`"name":{"observedAt":"2018-01-01T18:04:05Z","type":"Property","value":"test-node"},`+
+		`"ready":{"observedAt":"2018-01-01T18:04:05Z","type":"Property","value":"True"},`+
+		`"type":"Node"}`, msg)
+}
+
+func TestFormatUltralightSeparator(t *testing.T) {
+	assert := assert.New(t)
+
+	state := newTestObjectState()
+	state.Attrs = []Attr{{"message", "a|b"}}
+
+	msg, err := (&ultralightFormatter{}).Format(state)
+	assert.Nil(err)
+	assert.Equal("2018-01-02T03:04:05+09:00|pod|test-pod|label|report:yes|message|a b", msg)
+}
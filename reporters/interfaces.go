@@ -6,7 +6,17 @@ Package reporters : report state of kubernetes using MQTT.
 package reporters
 
 import (
+	"sync"
 	"time"
+
+	"go.uber.org/zap"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tech-sketch/mqtt-kube-operator/metrics"
 )
 
 /*
@@ -15,23 +25,47 @@ ReporterInf : a interface to specify the method signatures that Reporter should
 type ReporterInf interface {
 	GetAttrsTopic() string
 	StartReporting()
-	GetStopCh() chan bool
-	GetFinishCh() chan bool
+	StopReporting()
 }
 
 /*
 ReporterImplInf : a interface to specify the method signatures that ReporterImpl should be implemented.
 */
 type ReporterImplInf interface {
+	Start(string, <-chan struct{})
 	Report(string)
 }
 
+/*
+FormatterInf : a interface to specify the method signatures that a formatter of the reported payload should be implemented.
+*/
+type FormatterInf interface {
+	Format(*ObjectState) (string, error)
+}
+
+/*
+PublishOptions : the QoS and the retained flag of the messages published by a reporter.
+*/
+type PublishOptions struct {
+	QoS      byte
+	Retained bool
+}
+
 type baseReporter struct {
-	deviceType       string
-	deviceID         string
-	intervalMillisec time.Duration
-	stopCh           chan bool
-	finishCh         chan bool
+	deviceType     string
+	deviceID       string
+	resyncMillisec time.Duration
+	mutex          sync.Mutex
+	stopCh         chan bool
+	finishCh       chan bool
+}
+
+func newBaseReporter(deviceType string, deviceID string, resyncMillisec time.Duration) *baseReporter {
+	return &baseReporter{
+		deviceType:     deviceType,
+		deviceID:       deviceID,
+		resyncMillisec: resyncMillisec,
+	}
 }
 
 /*
@@ -42,33 +76,120 @@ func (b *baseReporter) GetAttrsTopic() string {
 }
 
 /*
-GetStopCh : get the channel to receive a loop stop message
+StopReporting : stop the loop and wait until it finishes. It does nothing if the loop is not running.
 */
-func (b *baseReporter) GetStopCh() chan bool {
-	return b.stopCh
+func (b *baseReporter) StopReporting() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.stopCh == nil {
+		return
+	}
+	b.stopCh <- true
+	<-b.finishCh
+	b.stopCh = nil
+	b.finishCh = nil
 }
 
-/*
-GetFinishCh : get the channel to send a loop stopped message
-*/
-func (b *baseReporter) GetFinishCh() chan bool {
-	return b.finishCh
+// start runs the loop in a goroutine. It does nothing if the loop is already running.
+func (b *baseReporter) start(name string, topic string, impl ReporterImplInf, logger *zap.SugaredLogger) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.stopCh != nil {
+		return
+	}
+	b.stopCh = make(chan bool, 1)
+	b.finishCh = make(chan bool, 1)
+
+	go func(stopCh chan bool, finishCh chan bool) {
+		logger.Debugf("start %s loop", name)
+		b.loop(name, topic, impl, stopCh)
+		logger.Debugf("stop %s loop", name)
+		finishCh <- true
+	}(b.stopCh, b.finishCh)
 }
 
-func (b *baseReporter) loop(impl ReporterImplInf) {
-	ticker := time.NewTicker(b.intervalMillisec * time.Millisecond)
+func (b *baseReporter) loop(name string, topic string, impl ReporterImplInf, stopCh chan bool) {
+	informerStopCh := make(chan struct{})
+	impl.Start(topic, informerStopCh)
 
+	// receiving from a nil channel blocks forever, so no heartbeat is sent when resyncMillisec is 0
+	var resyncCh <-chan time.Time
+	if b.resyncMillisec > 0 {
+		ticker := time.NewTicker(b.resyncMillisec * time.Millisecond)
+		defer ticker.Stop()
+		resyncCh = ticker.C
+	}
 LOOP:
 	for {
 		select {
-		case <-ticker.C:
-			impl.Report(b.GetAttrsTopic())
-		case <-b.stopCh:
-			ticker.Stop()
+		case <-resyncCh:
+			startedAt := time.Now()
+			impl.Report(topic)
+			metrics.ReportDuration.WithLabelValues(name).Observe(time.Since(startedAt).Seconds())
+		case <-stopCh:
 			break LOOP
 		}
 	}
+	close(informerStopCh)
+}
+
+// timedEventHandler wraps handler to observe the time to report each event of the informer as a cycle of the reporter,
+// since the states are reported only by the events when the resync interval is 0.
+func timedEventHandler(name string, handler cache.ResourceEventHandlerFuncs) cache.ResourceEventHandlerFuncs {
+	observe := func(startedAt time.Time) {
+		metrics.ReportDuration.WithLabelValues(name).Observe(time.Since(startedAt).Seconds())
+	}
+	timed := cache.ResourceEventHandlerFuncs{}
+	if handler.AddFunc != nil {
+		timed.AddFunc = func(obj interface{}) {
+			defer observe(time.Now())
+			handler.AddFunc(obj)
+		}
+	}
+	if handler.UpdateFunc != nil {
+		timed.UpdateFunc = func(oldObj, newObj interface{}) {
+			defer observe(time.Now())
+			handler.UpdateFunc(oldObj, newObj)
+		}
+	}
+	if handler.DeleteFunc != nil {
+		timed.DeleteFunc = func(obj interface{}) {
+			defer observe(time.Now())
+			handler.DeleteFunc(obj)
+		}
+	}
+	return timed
+}
+
+// newInformerFactory creates an informer factory which watches only the objects having targetLabelKey in namespace.
+func newInformerFactory(kubeClient kubernetes.Interface, namespace string, targetLabelKey string) informers.SharedInformerFactory {
+	return informers.NewSharedInformerFactoryWithOptions(kubeClient, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = targetLabelKey
+		}),
+	)
+}
 
-	close(b.stopCh)
-	close(b.finishCh)
+// deletedObject returns the deleted object, which is wrapped in DeletedFinalStateUnknown when the informer missed the deletion.
+func deletedObject(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+	return obj
+}
+
+// deletedState returns the state reported when the object is deleted, whose label value is empty if the label has been removed.
+func deletedState(timestamp time.Time, kind string, meta metav1.ObjectMeta, targetLabelKey string) *ObjectState {
+	return &ObjectState{
+		Timestamp:  timestamp,
+		Kind:       kind,
+		Namespace:  meta.Namespace,
+		Name:       meta.Name,
+		LabelKey:   targetLabelKey,
+		LabelValue: meta.Labels[targetLabelKey],
+		Attrs: []Attr{
+			{"deleted", true},
+		},
+	}
 }
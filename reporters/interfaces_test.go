@@ -0,0 +1,63 @@
+/*
+Package reporters : report state of kubernetes using MQTT.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package reporters
+
+import (
+	"testing"
+
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/mqtt-kube-operator/metrics"
+)
+
+func reportCount(t *testing.T, name string) uint64 {
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "mqtt_kube_operator_reporter_cycle_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "reporter" && label.GetValue() == name {
+					return metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestTimedEventHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	added := []interface{}{}
+	deleted := []interface{}{}
+	handler := timedEventHandler("TimedEventHandlerTest", cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			added = append(added, obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			deleted = append(deleted, obj)
+		},
+	})
+	assert.NotNil(handler.AddFunc)
+	assert.Nil(handler.UpdateFunc)
+	assert.NotNil(handler.DeleteFunc)
+
+	before := reportCount(t, "TimedEventHandlerTest")
+	handler.OnAdd("a")
+	handler.OnUpdate("a", "b")
+	handler.OnDelete("b")
+
+	assert.Equal([]interface{}{"a"}, added)
+	assert.Equal([]interface{}{"b"}, deleted)
+	assert.Equal(before+2, reportCount(t, "TimedEventHandlerTest"))
+}
@@ -0,0 +1,216 @@
+/*
+Package reporters : report state of kubernetes using MQTT.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package reporters
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tech-sketch/mqtt-kube-operator/metrics"
+)
+
+const nodeStateReporterName = "NodeStateReporter"
+
+// nodeResources are the resources whose capacity and allocatable are reported.
+var nodeResources = []apiv1.ResourceName{apiv1.ResourceCPU, apiv1.ResourceMemory, apiv1.ResourcePods}
+
+/*
+NodeStateReporter : a struct to report the state of Nodes.
+*/
+type NodeStateReporter struct {
+	*baseReporter
+	impl   ReporterImplInf
+	logger *zap.SugaredLogger
+}
+
+/*
+NewNodeStateReporter : a factory method to create NodeStateReporter.
+*/
+func NewNodeStateReporter(mqttClient mqtt.Client, kubeClient *kubernetes.Clientset, logger *zap.SugaredLogger, deviceType string, deviceID string, resyncSec int, targetLabelKey string, formatter FormatterInf, publishOptions PublishOptions) *NodeStateReporter {
+	return &NodeStateReporter{
+		baseReporter: newBaseReporter(deviceType, deviceID, time.Duration(resyncSec*1000)),
+		impl:         &nodeStateReporterImpl{logger, mqttClient, publishOptions, kubeClient, targetLabelKey, formatter, time.Now, nil},
+		logger:       logger,
+	}
+}
+
+/*
+StartReporting : start watching Nodes to report their state when it changes, and also at the specified resync interval if any.
+*/
+func (r *NodeStateReporter) StartReporting() {
+	r.baseReporter.start(nodeStateReporterName, r.GetAttrsTopic(), r.impl, r.logger)
+}
+
+type nodeStateReporterImpl struct {
+	logger         *zap.SugaredLogger
+	mqttClient     mqtt.Client
+	publishOptions PublishOptions
+	kubeClient     kubernetes.Interface
+	targetLabelKey string
+	formatter      FormatterInf
+	getCurrentTime func() time.Time
+	lister         corelisters.NodeLister
+}
+
+func (impl *nodeStateReporterImpl) Start(topic string, stopCh <-chan struct{}) {
+	if impl.targetLabelKey == "" {
+		impl.logger.Warnf("target label key is empty, no node is reported")
+		return
+	}
+	impl.logger.Debugf("start watching nodes")
+	// nodes are not namespaced, so the factory watches the whole cluster
+	factory := newInformerFactory(impl.kubeClient, "", impl.targetLabelKey)
+	informer := factory.Core().V1().Nodes()
+	informer.Informer().AddEventHandler(timedEventHandler(nodeStateReporterName, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			impl.onAdd(topic, obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			impl.onUpdate(topic, oldObj, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			impl.onDelete(topic, obj)
+		},
+	}))
+	impl.lister = informer.Lister()
+	factory.Start(stopCh)
+}
+
+func (impl *nodeStateReporterImpl) Report(topic string) {
+	if impl.lister == nil {
+		return
+	}
+	nodes, err := impl.lister.List(labels.Everything())
+	if err != nil {
+		impl.logger.Errorf("nodeLister list err -- %#v", err)
+		return
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ObjectMeta.Name < nodes[j].ObjectMeta.Name
+	})
+	for _, node := range nodes {
+		impl.publish(topic, node)
+	}
+}
+
+func (impl *nodeStateReporterImpl) onAdd(topic string, obj interface{}) {
+	if node, ok := obj.(*apiv1.Node); ok {
+		impl.publish(topic, node)
+	}
+}
+
+func (impl *nodeStateReporterImpl) onUpdate(topic string, oldObj interface{}, newObj interface{}) {
+	oldNode, ok := oldObj.(*apiv1.Node)
+	if !ok {
+		return
+	}
+	newNode, ok := newObj.(*apiv1.Node)
+	if !ok {
+		return
+	}
+	// the kubelet updates the heartbeat of the conditions periodically, but only the change of the reported state is published
+	oldState, _ := impl.state(time.Time{}, oldNode)
+	if newState, _ := impl.state(time.Time{}, newNode); !reflect.DeepEqual(oldState, newState) {
+		impl.publish(topic, newNode)
+	}
+}
+
+// onDelete publishes the deleted state, also when the label has been removed because the object does not match the selector of the informer any more.
+func (impl *nodeStateReporterImpl) onDelete(topic string, obj interface{}) {
+	if node, ok := deletedObject(obj).(*apiv1.Node); ok {
+		impl.publishState(topic, deletedState(impl.getCurrentTime(), "Node", node.ObjectMeta, impl.targetLabelKey))
+	}
+}
+
+func (impl *nodeStateReporterImpl) publish(topic string, node *apiv1.Node) {
+	state, ok := impl.state(impl.getCurrentTime(), node)
+	if !ok {
+		return
+	}
+	impl.publishState(topic, state)
+}
+
+func (impl *nodeStateReporterImpl) publishState(topic string, state *ObjectState) {
+	msg, err := impl.formatter.Format(state)
+	if err != nil {
+		impl.logger.Errorf("format node err -- %s: %s", state.Name, err.Error())
+		return
+	}
+	if token := impl.mqttClient.Publish(topic, impl.publishOptions.QoS, impl.publishOptions.Retained, msg); token.Wait() && token.Error() != nil {
+		impl.logger.Errorf("mqtt publish error, topic=%s, msg=%s, %s", topic, msg, token.Error())
+		metrics.PublishFailed(topic)
+	}
+}
+
+func (impl *nodeStateReporterImpl) state(timestamp time.Time, node *apiv1.Node) (*ObjectState, bool) {
+	val, ok := node.ObjectMeta.Labels[impl.targetLabelKey]
+	if !ok {
+		return nil, false
+	}
+	attrs := []Attr{
+		{"ready", nodeConditionStatus(node, apiv1.NodeReady)},
+		{"memoryPressure", nodeConditionStatus(node, apiv1.NodeMemoryPressure)},
+		{"diskPressure", nodeConditionStatus(node, apiv1.NodeDiskPressure)},
+		{"pidPressure", nodeConditionStatus(node, apiv1.NodePIDPressure)},
+	}
+	for _, resource := range nodeResources {
+		attrs = append(attrs,
+			Attr{string(resource) + "Capacity", quantityString(node.Status.Capacity, resource)},
+			Attr{string(resource) + "Allocatable", quantityString(node.Status.Allocatable, resource)},
+		)
+	}
+	attrs = append(attrs,
+		Attr{"kubeletVersion", node.Status.NodeInfo.KubeletVersion},
+		Attr{"taints", taintsString(node.Spec.Taints)},
+	)
+	return &ObjectState{
+		Timestamp:  timestamp,
+		Kind:       "Node",
+		Name:       node.ObjectMeta.Name,
+		LabelKey:   impl.targetLabelKey,
+		LabelValue: val,
+		Attrs:      attrs,
+	}, true
+}
+
+// nodeConditionStatus returns "True", "False" or "Unknown", which is also returned when the node does not have the condition.
+func nodeConditionStatus(node *apiv1.Node, conditionType apiv1.NodeConditionType) string {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == conditionType {
+			return string(condition.Status)
+		}
+	}
+	return string(apiv1.ConditionUnknown)
+}
+
+func quantityString(resources apiv1.ResourceList, name apiv1.ResourceName) string {
+	quantity, ok := resources[name]
+	if !ok {
+		return ""
+	}
+	return quantity.String()
+}
+
+// taintsString returns the taints joined with "," like "key1=value1:NoSchedule,key2:NoExecute".
+func taintsString(taints []apiv1.Taint) string {
+	elements := []string{}
+	for _, taint := range taints {
+		elements = append(elements, taint.ToString())
+	}
+	return strings.Join(elements, ",")
+}
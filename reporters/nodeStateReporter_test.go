@@ -0,0 +1,438 @@
+/*
+Package reporters : report state of kubernetes using MQTT.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package reporters
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/mqtt-kube-operator/mock"
+)
+
+func setUpNodeStateReporterMocks(t *testing.T, deviceType string, deviceID string, resyncSec int) (*NodeStateReporter, func()) {
+	ctrl := gomock.NewController(t)
+
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = zap.NewAtomicLevelAt(zap.FatalLevel)
+	logger, _ := loggerConfig.Build()
+
+	nodeStateReporter := &NodeStateReporter{
+		baseReporter: newBaseReporter(deviceType, deviceID, time.Duration(resyncSec)),
+		impl:         NewMockReporterImplInf(ctrl),
+		logger:       logger.Sugar(),
+	}
+	return nodeStateReporter, func() {
+		logger.Sync()
+		ctrl.Finish()
+	}
+}
+
+func TestNodeGetTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	deviceTypeCases := []struct {
+		name string
+	}{
+		{name: "dType"},
+		{name: "/"},
+		{name: ""},
+	}
+
+	deviceIDCases := []struct {
+		name string
+	}{
+		{name: "dID"},
+		{name: "/"},
+		{name: ""},
+	}
+
+	for _, deviceTypeCase := range deviceTypeCases {
+		for _, deviceIDCase := range deviceIDCases {
+			t.Run(fmt.Sprintf("deviceType=%v, deviceID=%v", deviceTypeCase.name, deviceIDCase.name), func(t *testing.T) {
+				nodeStateReporter, tearDown := setUpNodeStateReporterMocks(t, deviceTypeCase.name, deviceIDCase.name, 1)
+				defer tearDown()
+
+				assert.Equal(fmt.Sprintf("/%s/%s/attrs", deviceTypeCase.name, deviceIDCase.name), nodeStateReporter.GetAttrsTopic())
+			})
+		}
+	}
+}
+
+func TestNodeRestartReporting(t *testing.T) {
+	assert := assert.New(t)
+	nodeStateReporter, tearDown := setUpNodeStateReporterMocks(t, "dType", "dID", 0)
+	defer tearDown()
+
+	informerStopChs := []<-chan struct{}{}
+	impl := nodeStateReporter.impl.(*MockReporterImplInf)
+	impl.EXPECT().Start("/dType/dID/attrs", gomock.Any()).Do(func(topic string, stopCh <-chan struct{}) {
+		informerStopChs = append(informerStopChs, stopCh)
+	}).Times(2)
+
+	nodeStateReporter.StopReporting()
+	nodeStateReporter.StartReporting()
+	nodeStateReporter.StartReporting()
+	nodeStateReporter.StopReporting()
+	nodeStateReporter.StopReporting()
+	assert.Nil(nodeStateReporter.stopCh)
+	nodeStateReporter.StartReporting()
+	nodeStateReporter.StopReporting()
+
+	assert.Len(informerStopChs, 2)
+	for _, stopCh := range informerStopChs {
+		_, ok := <-stopCh
+		assert.False(ok)
+	}
+}
+
+func TestNodeStartReporting(t *testing.T) {
+	assert := assert.New(t)
+
+	resyncCases := []struct {
+		resyncSec int
+		reported  bool
+	}{
+		{resyncSec: 10, reported: true},
+		{resyncSec: 0, reported: false},
+	}
+
+	for _, c := range resyncCases {
+		t.Run(fmt.Sprintf("resyncSec=%d", c.resyncSec), func(t *testing.T) {
+			nodeStateReporter, tearDown := setUpNodeStateReporterMocks(t, "dType", "dID", c.resyncSec)
+			defer tearDown()
+
+			impl := nodeStateReporter.impl.(*MockReporterImplInf)
+			impl.EXPECT().Start("/dType/dID/attrs", gomock.Any()).Times(1)
+			if c.reported {
+				impl.EXPECT().Report("/dType/dID/attrs").MinTimes(1)
+			} else {
+				impl.EXPECT().Report(gomock.Any()).Times(0)
+			}
+			nodeStateReporter.StartReporting()
+
+			time.Sleep(50 * time.Millisecond)
+			nodeStateReporter.StopReporting()
+			assert.Nil(nodeStateReporter.stopCh)
+		})
+	}
+}
+
+func setUpNodeStateReporterImplMocks(t *testing.T) (*nodeStateReporterImpl, *mock.MockClient, *mock.MockToken, func()) {
+	ctrl := gomock.NewController(t)
+
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = zap.NewAtomicLevelAt(zap.FatalLevel)
+	logger, _ := loggerConfig.Build()
+
+	mqttClient := mock.NewMockClient(ctrl)
+	token := mock.NewMockToken(ctrl)
+
+	impl := &nodeStateReporterImpl{
+		logger:     logger.Sugar(),
+		mqttClient: mqttClient,
+		formatter:  &ultralightFormatter{},
+		getCurrentTime: func() time.Time {
+			return time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local)
+		},
+	}
+
+	return impl, mqttClient, token, func() {
+		logger.Sync()
+		ctrl.Finish()
+	}
+}
+
+func newNodeLister(t *testing.T, nodes []apiv1.Node) corelisters.NodeLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for i := range nodes {
+		if err := indexer.Add(&nodes[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return corelisters.NewNodeLister(indexer)
+}
+
+func newTestNode(name string, labels map[string]string) apiv1.Node {
+	return apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Spec: apiv1.NodeSpec{
+			Taints: []apiv1.Taint{
+				{Key: "node-role.kubernetes.io/master", Effect: apiv1.TaintEffectNoSchedule},
+				{Key: "dedicated", Value: "edge", Effect: apiv1.TaintEffectNoExecute},
+			},
+		},
+		Status: apiv1.NodeStatus{
+			Conditions: []apiv1.NodeCondition{
+				{Type: apiv1.NodeMemoryPressure, Status: apiv1.ConditionFalse},
+				{Type: apiv1.NodeDiskPressure, Status: apiv1.ConditionTrue},
+				{Type: apiv1.NodePIDPressure, Status: apiv1.ConditionFalse},
+				{Type: apiv1.NodeReady, Status: apiv1.ConditionTrue},
+			},
+			Capacity: apiv1.ResourceList{
+				apiv1.ResourceCPU:    resource.MustParse("4"),
+				apiv1.ResourceMemory: resource.MustParse("8Gi"),
+				apiv1.ResourcePods:   resource.MustParse("110"),
+			},
+			Allocatable: apiv1.ResourceList{
+				apiv1.ResourceCPU:    resource.MustParse("3800m"),
+				apiv1.ResourceMemory: resource.MustParse("7Gi"),
+				apiv1.ResourcePods:   resource.MustParse("110"),
+			},
+			NodeInfo: apiv1.NodeSystemInfo{KubeletVersion: "v1.16.0"},
+		},
+	}
+}
+
+const testNodeAttrs = "|ready|True|memoryPressure|False|diskPressure|True|pidPressure|False" +
+	"|cpuCapacity|4|cpuAllocatable|3800m|memoryCapacity|8Gi|memoryAllocatable|7Gi|podsCapacity|110|podsAllocatable|110" +
+	"|kubeletVersion|v1.16.0|taints|node-role.kubernetes.io/master:NoSchedule,dedicated=edge:NoExecute"
+
+func TestNodeReport(t *testing.T) {
+	testCases := []struct {
+		nodes []apiv1.Node
+	}{
+		{
+			nodes: []apiv1.Node{},
+		},
+		{
+			nodes: []apiv1.Node{
+				newTestNode("testnode1", map[string]string{"testkey": "value1", "dummy": "dummy"}),
+			},
+		},
+		{
+			nodes: []apiv1.Node{
+				newTestNode("testnode2", map[string]string{"testkey": "value2"}),
+				newTestNode("testnode1", map[string]string{"testkey": "value1", "dummy": "dummy"}),
+				newTestNode("testnode3", map[string]string{"dummy": "dummy"}),
+			},
+		},
+	}
+	testLabels := []struct {
+		key string
+	}{
+		{key: "nil"},
+		{key: ""},
+		{key: "notexit"},
+		{key: "testkey"},
+	}
+
+	dt := time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local).Format(time.RFC3339)
+	for _, testCase := range testCases {
+		for _, testLabel := range testLabels {
+			t.Run(fmt.Sprintf("node num=%d, label=%s", len(testCase.nodes), testLabel.key), func(t *testing.T) {
+				impl, mqttClient, token, tearDown := setUpNodeStateReporterImplMocks(t)
+				defer tearDown()
+
+				if testLabel.key != "nil" {
+					impl.targetLabelKey = testLabel.key
+				}
+
+				impl.lister = newNodeLister(t, testCase.nodes)
+
+				if len(testCase.nodes) == 0 || testLabel.key != "testkey" {
+					mqttClient.EXPECT().Publish("/test", byte(0), false, gomock.Any()).Times(0)
+				} else if len(testCase.nodes) == 1 {
+					mqttClient.EXPECT().Publish("/test", byte(0), false, dt+"|node|testnode1|label|testkey:value1"+testNodeAttrs).Return(token).Times(1)
+					token.EXPECT().Wait().Return(true).Times(1)
+					token.EXPECT().Error().Return(nil).Times(1)
+				} else {
+					gomock.InOrder(
+						mqttClient.EXPECT().Publish("/test", byte(0), false, dt+"|node|testnode1|label|testkey:value1"+testNodeAttrs).Return(token),
+						mqttClient.EXPECT().Publish("/test", byte(0), false, dt+"|node|testnode2|label|testkey:value2"+testNodeAttrs).Return(token),
+					)
+					token.EXPECT().Wait().Return(true).Times(2)
+					token.EXPECT().Error().Return(nil).Times(2)
+				}
+				impl.Report("/test")
+			})
+		}
+	}
+}
+
+func TestNodeReportNotStarted(t *testing.T) {
+	impl, mqttClient, _, tearDown := setUpNodeStateReporterImplMocks(t)
+	defer tearDown()
+
+	impl.targetLabelKey = "testkey"
+	mqttClient.EXPECT().Publish(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+	impl.Report("/test")
+}
+
+func TestNodeState(t *testing.T) {
+	assert := assert.New(t)
+
+	impl, _, _, tearDown := setUpNodeStateReporterImplMocks(t)
+	defer tearDown()
+	impl.targetLabelKey = "testkey"
+
+	node := &apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "testnode1", Labels: map[string]string{"testkey": "value1"}}}
+	state, ok := impl.state(time.Time{}, node)
+	assert.True(ok)
+	assert.Equal("Node", state.Kind)
+	assert.Equal("", state.Namespace)
+	assert.Equal([]Attr{
+		{"ready", "Unknown"},
+		{"memoryPressure", "Unknown"},
+		{"diskPressure", "Unknown"},
+		{"pidPressure", "Unknown"},
+		{"cpuCapacity", ""},
+		{"cpuAllocatable", ""},
+		{"memoryCapacity", ""},
+		{"memoryAllocatable", ""},
+		{"podsCapacity", ""},
+		{"podsAllocatable", ""},
+		{"kubeletVersion", ""},
+		{"taints", ""},
+	}, state.Attrs)
+}
+
+func TestNodeOnUpdate(t *testing.T) {
+	oldNode := newTestNode("testnode1", map[string]string{"testkey": "value1"})
+	oldNode.ObjectMeta.ResourceVersion = "1"
+
+	testCases := []struct {
+		name   string
+		update func(node *apiv1.Node)
+		msg    string
+	}{
+		{name: "not ready", update: func(node *apiv1.Node) {
+			node.Status.Conditions[3].Status = apiv1.ConditionFalse
+		}, msg: "|node|testnode1|label|testkey:value1" + "|ready|False|memoryPressure|False|diskPressure|True|pidPressure|False" +
+			"|cpuCapacity|4|cpuAllocatable|3800m|memoryCapacity|8Gi|memoryAllocatable|7Gi|podsCapacity|110|podsAllocatable|110" +
+			"|kubeletVersion|v1.16.0|taints|node-role.kubernetes.io/master:NoSchedule,dedicated=edge:NoExecute"},
+		{name: "untainted", update: func(node *apiv1.Node) {
+			node.Spec.Taints = nil
+		}, msg: "|node|testnode1|label|testkey:value1" + "|ready|True|memoryPressure|False|diskPressure|True|pidPressure|False" +
+			"|cpuCapacity|4|cpuAllocatable|3800m|memoryCapacity|8Gi|memoryAllocatable|7Gi|podsCapacity|110|podsAllocatable|110" +
+			"|kubeletVersion|v1.16.0|taints|"},
+		{name: "heartbeat", update: func(node *apiv1.Node) {
+			node.Status.Conditions[3].LastHeartbeatTime = metav1.NewTime(time.Date(2018, 1, 2, 3, 4, 15, 0, time.UTC))
+		}},
+		{name: "label removed", update: func(node *apiv1.Node) { delete(node.ObjectMeta.Labels, "testkey") }},
+	}
+
+	dt := time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local).Format(time.RFC3339)
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			impl, mqttClient, token, tearDown := setUpNodeStateReporterImplMocks(t)
+			defer tearDown()
+			impl.targetLabelKey = "testkey"
+
+			newNode := oldNode.DeepCopy()
+			newNode.ObjectMeta.ResourceVersion = "2"
+			c.update(newNode)
+
+			if c.msg != "" {
+				mqttClient.EXPECT().Publish("/test", byte(0), false, dt+c.msg).Return(token).Times(1)
+				token.EXPECT().Wait().Return(false).Times(1)
+			} else {
+				mqttClient.EXPECT().Publish("/test", byte(0), false, gomock.Any()).Times(0)
+			}
+
+			impl.onUpdate("/test", &oldNode, newNode)
+		})
+	}
+}
+
+func TestNodeOnDelete(t *testing.T) {
+	deleted := &apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "testnode1", Labels: map[string]string{"testkey": "value1"}}}
+	unlabeled := deleted.DeepCopy()
+	delete(unlabeled.ObjectMeta.Labels, "testkey")
+
+	testCases := []struct {
+		name string
+		obj  interface{}
+		msg  string
+	}{
+		{name: "deleted", obj: deleted, msg: "|node|testnode1|label|testkey:value1|deleted|true"},
+		{name: "tombstone", obj: cache.DeletedFinalStateUnknown{Key: "testnode1", Obj: deleted}, msg: "|node|testnode1|label|testkey:value1|deleted|true"},
+		{name: "label removed", obj: unlabeled, msg: "|node|testnode1|label|testkey:|deleted|true"},
+		{name: "unknown object", obj: "testnode1"},
+	}
+
+	dt := time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local).Format(time.RFC3339)
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			impl, mqttClient, token, tearDown := setUpNodeStateReporterImplMocks(t)
+			defer tearDown()
+			impl.targetLabelKey = "testkey"
+
+			if c.msg != "" {
+				mqttClient.EXPECT().Publish("/test", byte(0), false, dt+c.msg).Return(token).Times(1)
+				token.EXPECT().Wait().Return(false).Times(1)
+			} else {
+				mqttClient.EXPECT().Publish("/test", byte(0), false, gomock.Any()).Times(0)
+			}
+
+			impl.onDelete("/test", c.obj)
+		})
+	}
+}
+
+func TestNodeStart(t *testing.T) {
+	assert := assert.New(t)
+
+	impl, mqttClient, token, tearDown := setUpNodeStateReporterImplMocks(t)
+	defer tearDown()
+
+	impl.targetLabelKey = "testkey"
+	impl.kubeClient = fake.NewSimpleClientset(
+		&apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "testnode1", Labels: map[string]string{"testkey": "value1"}}},
+		&apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "testnode2", Labels: map[string]string{"dummy": "dummy"}}},
+	)
+
+	dt := time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local).Format(time.RFC3339)
+	published := make(chan string, 2)
+	mqttClient.EXPECT().Publish("/test", byte(0), false, gomock.Any()).DoAndReturn(func(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+		published <- payload.(string)
+		return token
+	}).Times(1)
+	token.EXPECT().Wait().Return(false).Times(1)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	impl.Start("/test", stopCh)
+	assert.NotNil(impl.lister)
+
+	select {
+	case msg := <-published:
+		assert.Equal(dt+"|node|testnode1|label|testkey:value1"+
+			"|ready|Unknown|memoryPressure|Unknown|diskPressure|Unknown|pidPressure|Unknown"+
+			"|cpuCapacity||cpuAllocatable||memoryCapacity||memoryAllocatable||podsCapacity||podsAllocatable|"+
+			"|kubeletVersion||taints|", msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestNodeStartWithoutLabel(t *testing.T) {
+	impl, mqttClient, _, tearDown := setUpNodeStateReporterImplMocks(t)
+	defer tearDown()
+
+	impl.kubeClient = fake.NewSimpleClientset(
+		&apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "testnode1", Labels: map[string]string{"testkey": "value1"}}},
+	)
+	mqttClient.EXPECT().Publish(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	impl.Start("/test", stopCh)
+	assert.Nil(t, impl.lister)
+}
@@ -6,7 +6,8 @@ Package reporters : report state of kubernetes using MQTT.
 package reporters
 
 import (
-	"fmt"
+	"reflect"
+	"sort"
 	"time"
 
 	"go.uber.org/zap"
@@ -14,11 +15,15 @@ import (
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 
 	apiv1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tech-sketch/mqtt-kube-operator/metrics"
 )
 
-const podAttrsFormat = "%s|pod|%s|label|%s:%s|phase|%s"
+const podStateReporterName = "PodStateReporter"
 
 /*
 PodStateReporter : a struct to report the state of PODs.
@@ -32,49 +37,139 @@ type PodStateReporter struct {
 /*
 NewPodStateReporter : a factory method to create PodStateReporter.
 */
-func NewPodStateReporter(mqttClient mqtt.Client, kubeClient *kubernetes.Clientset, logger *zap.SugaredLogger, deviceType string, deviceID string, intervalSec int, targetLabelKey string) *PodStateReporter {
+func NewPodStateReporter(mqttClient mqtt.Client, kubeClient *kubernetes.Clientset, logger *zap.SugaredLogger, deviceType string, deviceID string, resyncSec int, targetLabelKey string, namespaces []string, formatter FormatterInf, publishOptions PublishOptions) *PodStateReporter {
 	return &PodStateReporter{
-		baseReporter: &baseReporter{deviceType, deviceID, time.Duration(intervalSec * 1000), make(chan bool, 1), make(chan bool, 1)},
-		impl:         &podStateReporterImpl{logger, mqttClient, kubeClient, targetLabelKey, time.Now},
+		baseReporter: newBaseReporter(deviceType, deviceID, time.Duration(resyncSec*1000)),
+		impl:         &podStateReporterImpl{logger, mqttClient, publishOptions, kubeClient, targetLabelKey, namespaces, formatter, time.Now, nil},
 		logger:       logger,
 	}
 }
 
 /*
-StartReporting : start a loop to report the state of PODs at the specified interval.
+StartReporting : start watching PODs to report their state when it changes, and also at the specified resync interval if any.
 */
 func (r *PodStateReporter) StartReporting() {
-	go func() {
-		r.logger.Debugf("start PodStateReporter loop")
-		r.baseReporter.loop(r.impl)
-		r.logger.Debugf("stop PodStateReporter loop")
-	}()
+	r.baseReporter.start(podStateReporterName, r.GetAttrsTopic(), r.impl, r.logger)
 }
 
 type podStateReporterImpl struct {
 	logger         *zap.SugaredLogger
 	mqttClient     mqtt.Client
+	publishOptions PublishOptions
 	kubeClient     kubernetes.Interface
 	targetLabelKey string
+	namespaces     []string
+	formatter      FormatterInf
 	getCurrentTime func() time.Time
+	listers        []corelisters.PodLister
+}
+
+func (impl *podStateReporterImpl) Start(topic string, stopCh <-chan struct{}) {
+	if impl.targetLabelKey == "" {
+		impl.logger.Warnf("target label key is empty, no pod is reported")
+		return
+	}
+	// drop the listers of the informers stopped when the reporting was stopped last
+	impl.listers = nil
+	for _, namespace := range impl.namespaces {
+		impl.logger.Debugf("start watching pods, namespace=%s", namespace)
+		factory := newInformerFactory(impl.kubeClient, namespace, impl.targetLabelKey)
+		informer := factory.Core().V1().Pods()
+		informer.Informer().AddEventHandler(timedEventHandler(podStateReporterName, cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				impl.onAdd(topic, obj)
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				impl.onUpdate(topic, oldObj, newObj)
+			},
+			DeleteFunc: func(obj interface{}) {
+				impl.onDelete(topic, obj)
+			},
+		}))
+		impl.listers = append(impl.listers, informer.Lister())
+		factory.Start(stopCh)
+	}
 }
 
 func (impl *podStateReporterImpl) Report(topic string) {
-	impl.logger.Debugf("check pods state")
-	podsClient := impl.kubeClient.CoreV1().Pods(apiv1.NamespaceDefault)
+	for _, lister := range impl.listers {
+		pods, err := lister.List(labels.Everything())
+		if err != nil {
+			impl.logger.Errorf("podLister list err -- %#v", err)
+			continue
+		}
+		sort.Slice(pods, func(i, j int) bool {
+			return pods[i].ObjectMeta.Name < pods[j].ObjectMeta.Name
+		})
+		for _, pod := range pods {
+			impl.publish(topic, pod)
+		}
+	}
+}
+
+func (impl *podStateReporterImpl) onAdd(topic string, obj interface{}) {
+	if pod, ok := obj.(*apiv1.Pod); ok {
+		impl.publish(topic, pod)
+	}
+}
+
+func (impl *podStateReporterImpl) onUpdate(topic string, oldObj interface{}, newObj interface{}) {
+	oldPod, ok := oldObj.(*apiv1.Pod)
+	if !ok {
+		return
+	}
+	newPod, ok := newObj.(*apiv1.Pod)
+	if !ok {
+		return
+	}
+	// the informer notifies every update of a pod, but only the change of the reported state is published
+	oldState, _ := impl.state(time.Time{}, oldPod)
+	if newState, _ := impl.state(time.Time{}, newPod); !reflect.DeepEqual(oldState, newState) {
+		impl.publish(topic, newPod)
+	}
+}
+
+// onDelete publishes the deleted state, also when the label has been removed because the object does not match the selector of the informer any more.
+func (impl *podStateReporterImpl) onDelete(topic string, obj interface{}) {
+	if pod, ok := deletedObject(obj).(*apiv1.Pod); ok {
+		impl.publishState(topic, deletedState(impl.getCurrentTime(), "Pod", pod.ObjectMeta, impl.targetLabelKey))
+	}
+}
 
-	list, err := podsClient.List(metav1.ListOptions{})
+func (impl *podStateReporterImpl) publish(topic string, pod *apiv1.Pod) {
+	state, ok := impl.state(impl.getCurrentTime(), pod)
+	if !ok {
+		return
+	}
+	impl.publishState(topic, state)
+}
+
+func (impl *podStateReporterImpl) publishState(topic string, state *ObjectState) {
+	msg, err := impl.formatter.Format(state)
 	if err != nil {
-		impl.logger.Errorf("podsClient list err -- %#v", err)
+		impl.logger.Errorf("format pod err -- %s: %s", state.Name, err.Error())
 		return
 	}
+	if token := impl.mqttClient.Publish(topic, impl.publishOptions.QoS, impl.publishOptions.Retained, msg); token.Wait() && token.Error() != nil {
+		impl.logger.Errorf("mqtt publish error, topic=%s, msg=%s, %s", topic, msg, token.Error())
+		metrics.PublishFailed(topic)
+	}
+}
 
-	for _, pod := range list.Items {
-		if val, ok := pod.ObjectMeta.Labels[impl.targetLabelKey]; ok {
-			msg := fmt.Sprintf(podAttrsFormat, impl.getCurrentTime().Format(time.RFC3339), pod.ObjectMeta.Name, impl.targetLabelKey, val, pod.Status.Phase)
-			if token := impl.mqttClient.Publish(topic, 0, false, msg); token.Wait() && token.Error() != nil {
-				impl.logger.Errorf("mqtt publish error, topic=%s, msg=%s, %s", topic, msg, token.Error())
-			}
-		}
+func (impl *podStateReporterImpl) state(timestamp time.Time, pod *apiv1.Pod) (*ObjectState, bool) {
+	val, ok := pod.ObjectMeta.Labels[impl.targetLabelKey]
+	if !ok {
+		return nil, false
 	}
+	return &ObjectState{
+		Timestamp:  timestamp,
+		Kind:       "Pod",
+		Namespace:  pod.ObjectMeta.Namespace,
+		Name:       pod.ObjectMeta.Name,
+		LabelKey:   impl.targetLabelKey,
+		LabelValue: val,
+		Attrs: []Attr{
+			{"phase", string(pod.Status.Phase)},
+		},
+	}, true
 }
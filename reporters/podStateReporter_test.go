@@ -10,10 +10,14 @@ import (
 	"testing"
 	"time"
 
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"go.uber.org/zap"
 
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
@@ -21,7 +25,7 @@ import (
 	"github.com/tech-sketch/mqtt-kube-operator/mock"
 )
 
-func setUpPodStateReporterMocks(t *testing.T, deviceType string, deviceID string, intervalSec int) (*PodStateReporter, func()) {
+func setUpPodStateReporterMocks(t *testing.T, deviceType string, deviceID string, resyncSec int) (*PodStateReporter, func()) {
 	ctrl := gomock.NewController(t)
 
 	loggerConfig := zap.NewProductionConfig()
@@ -29,8 +33,8 @@ func setUpPodStateReporterMocks(t *testing.T, deviceType string, deviceID string
 	logger, _ := loggerConfig.Build()
 
 	podStateReporter := &PodStateReporter{
-		baseReporter: &baseReporter{deviceType, deviceID, time.Duration(intervalSec), make(chan bool, 1), make(chan bool, 1)},
-		impl:         mock.NewMockReporterImplInf(ctrl),
+		baseReporter: newBaseReporter(deviceType, deviceID, time.Duration(resyncSec)),
+		impl:         NewMockReporterImplInf(ctrl),
 		logger:       logger.Sugar(),
 	}
 	return podStateReporter, func() {
@@ -70,34 +74,66 @@ func TestPodGetTopic(t *testing.T) {
 	}
 }
 
-func TestPodGetChannel(t *testing.T) {
+func TestPodRestartReporting(t *testing.T) {
 	assert := assert.New(t)
-	podStateReporter, tearDown := setUpPodStateReporterMocks(t, "dType", "dID", 1)
+	podStateReporter, tearDown := setUpPodStateReporterMocks(t, "dType", "dID", 0)
 	defer tearDown()
 
-	assert.Equal(podStateReporter.stopCh, podStateReporter.GetStopCh())
-	assert.Equal(podStateReporter.finishCh, podStateReporter.GetFinishCh())
+	informerStopChs := []<-chan struct{}{}
+	impl := podStateReporter.impl.(*MockReporterImplInf)
+	impl.EXPECT().Start("/dType/dID/attrs", gomock.Any()).Do(func(topic string, stopCh <-chan struct{}) {
+		informerStopChs = append(informerStopChs, stopCh)
+	}).Times(2)
+
+	podStateReporter.StopReporting()
+	podStateReporter.StartReporting()
+	podStateReporter.StartReporting()
+	podStateReporter.StopReporting()
+	podStateReporter.StopReporting()
+	assert.Nil(podStateReporter.stopCh)
+	podStateReporter.StartReporting()
+	podStateReporter.StopReporting()
+
+	assert.Len(informerStopChs, 2)
+	for _, stopCh := range informerStopChs {
+		_, ok := <-stopCh
+		assert.False(ok)
+	}
 }
 
 func TestPodStartReporting(t *testing.T) {
 	assert := assert.New(t)
-	podStateReporter, tearDown := setUpPodStateReporterMocks(t, "dType", "dID", 10)
-	defer tearDown()
 
-	podStateReporter.impl.(*mock.MockReporterImplInf).EXPECT().Report("/dType/dID/attrs").MinTimes(1)
-	podStateReporter.StartReporting()
+	resyncCases := []struct {
+		resyncSec int
+		reported  bool
+	}{
+		{resyncSec: 10, reported: true},
+		{resyncSec: 0, reported: false},
+	}
 
-	c := make(chan bool, 1)
-	go func() {
-		time.Sleep(50 * time.Millisecond)
-		podStateReporter.GetStopCh() <- true
-		assert.False(<-podStateReporter.GetFinishCh())
-		c <- true
-	}()
-	assert.True(<-c)
+	for _, c := range resyncCases {
+		t.Run(fmt.Sprintf("resyncSec=%d", c.resyncSec), func(t *testing.T) {
+			podStateReporter, tearDown := setUpPodStateReporterMocks(t, "dType", "dID", c.resyncSec)
+			defer tearDown()
+
+			impl := podStateReporter.impl.(*MockReporterImplInf)
+			impl.EXPECT().Start("/dType/dID/attrs", gomock.Any()).Times(1)
+			if c.reported {
+				impl.EXPECT().Report("/dType/dID/attrs").MinTimes(1)
+			} else {
+				impl.EXPECT().Report(gomock.Any()).Times(0)
+			}
+			podStateReporter.StartReporting()
+
+			time.Sleep(50 * time.Millisecond)
+			podStateReporter.StopReporting()
+			assert.Nil(podStateReporter.stopCh)
+		})
+	}
 }
 
-func setUpPodStateReporterImplMocks(t *testing.T) (*podStateReporterImpl, *mock.MockClient, *mock.MockToken, *mock.MockPodInterface, func()) {
+func setUpPodStateReporterImplMocks(t *testing.T) (*podStateReporterImpl, *mock.MockClient, *mock.MockToken, func()) {
 	ctrl := gomock.NewController(t)
 
 	loggerConfig := zap.NewProductionConfig()
@@ -107,27 +143,32 @@ func setUpPodStateReporterImplMocks(t *testing.T) (*podStateReporterImpl, *mock.
 	mqttClient := mock.NewMockClient(ctrl)
 	token := mock.NewMockToken(ctrl)
 
-	kubeClient := mock.NewMockInterface(ctrl)
-	corev1 := mock.NewMockCoreV1Interface(ctrl)
-	podsClient := mock.NewMockPodInterface(ctrl)
-	kubeClient.EXPECT().CoreV1().Return(corev1).Times(1)
-	corev1.EXPECT().Pods(gomock.Any()).Return(podsClient).Times(1)
-
 	impl := &podStateReporterImpl{
 		logger:     logger.Sugar(),
 		mqttClient: mqttClient,
-		kubeClient: kubeClient,
+		namespaces: []string{"default"},
+		formatter:  &ultralightFormatter{},
 		getCurrentTime: func() time.Time {
 			return time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local)
 		},
 	}
 
-	return impl, mqttClient, token, podsClient, func() {
+	return impl, mqttClient, token, func() {
 		logger.Sync()
 		ctrl.Finish()
 	}
 }
 
+func newPodLister(t *testing.T, pods []apiv1.Pod) corelisters.PodLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for i := range pods {
+		if err := indexer.Add(&pods[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return corelisters.NewPodLister(indexer)
+}
+
 func TestPodReport(t *testing.T) {
 	testCases := []struct {
 		podList apiv1.PodList
@@ -147,8 +188,8 @@ func TestPodReport(t *testing.T) {
 		{
 			podList: apiv1.PodList{
 				Items: []apiv1.Pod{
-					{ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Labels: map[string]string{"testkey": "value1", "dummy": "dummy"}}, Status: apiv1.PodStatus{Phase: "Running"}},
 					{ObjectMeta: metav1.ObjectMeta{Name: "testpod2", Labels: map[string]string{"testkey": "value2"}}, Status: apiv1.PodStatus{Phase: "Running"}},
+					{ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Labels: map[string]string{"testkey": "value1", "dummy": "dummy"}}, Status: apiv1.PodStatus{Phase: "Running"}},
 					{ObjectMeta: metav1.ObjectMeta{Name: "testpod3", Labels: map[string]string{"dummy": "dummy"}}, Status: apiv1.PodStatus{Phase: "Running"}},
 				},
 			},
@@ -167,14 +208,14 @@ func TestPodReport(t *testing.T) {
 	for _, testCase := range testCases {
 		for _, testLabel := range testLabels {
 			t.Run(fmt.Sprintf("pod num=%d, label=%s", len(testCase.podList.Items), testLabel.key), func(t *testing.T) {
-				impl, mqttClient, token, podsClient, tearDown := setUpPodStateReporterImplMocks(t)
+				impl, mqttClient, token, tearDown := setUpPodStateReporterImplMocks(t)
 				defer tearDown()
 
 				if testLabel.key != "nil" {
 					impl.targetLabelKey = testLabel.key
 				}
+				impl.listers = []corelisters.PodLister{newPodLister(t, testCase.podList.Items)}
 
-				podsClient.EXPECT().List(gomock.Any()).Return(&testCase.podList, nil).Times(1)
 				if len(testCase.podList.Items) == 0 {
 					mqttClient.EXPECT().Publish("/test", byte(0), false, gomock.Any()).Times(0)
 				} else if len(testCase.podList.Items) == 1 {
@@ -203,12 +244,177 @@ func TestPodReport(t *testing.T) {
 	}
 }
 
-func TestPodReportError(t *testing.T) {
-	impl, mqttClient, _, podsClient, tearDown := setUpPodStateReporterImplMocks(t)
+func TestPodReportNamespaces(t *testing.T) {
+	impl, mqttClient, token, tearDown := setUpPodStateReporterImplMocks(t)
+	defer tearDown()
+
+	impl.targetLabelKey = "testkey"
+	impl.listers = []corelisters.PodLister{
+		newPodLister(t, []apiv1.Pod{
+			{ObjectMeta: metav1.ObjectMeta{Name: "testpod2", Namespace: "default", Labels: map[string]string{"testkey": "value2"}}, Status: apiv1.PodStatus{Phase: "Pending"}},
+		}),
+		newPodLister(t, []apiv1.Pod{
+			{ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Namespace: "tenant-a", Labels: map[string]string{"testkey": "value1"}}, Status: apiv1.PodStatus{Phase: "Running"}},
+		}),
+	}
+
+	dt := time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local).Format(time.RFC3339)
+	gomock.InOrder(
+		mqttClient.EXPECT().Publish("/test", byte(0), false, dt+"|pod|testpod2|label|testkey:value2|phase|Pending").Return(token),
+		mqttClient.EXPECT().Publish("/test", byte(0), false, dt+"|pod|testpod1|label|testkey:value1|phase|Running").Return(token),
+	)
+	token.EXPECT().Wait().Return(true).Times(2)
+	token.EXPECT().Error().Return(nil).Times(2)
+
+	impl.Report("/test")
+}
+
+func TestPodReportPublishOptions(t *testing.T) {
+	impl, mqttClient, token, tearDown := setUpPodStateReporterImplMocks(t)
 	defer tearDown()
 
-	podsClient.EXPECT().List(gomock.Any()).Return(nil, fmt.Errorf("test error")).Times(1)
-	mqttClient.EXPECT().Publish("/test", byte(0), false, gomock.Any()).Times(0)
+	impl.targetLabelKey = "testkey"
+	impl.publishOptions = PublishOptions{QoS: 1, Retained: true}
+	impl.listers = []corelisters.PodLister{
+		newPodLister(t, []apiv1.Pod{
+			{ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Namespace: "default", Labels: map[string]string{"testkey": "value1"}}, Status: apiv1.PodStatus{Phase: "Running"}},
+		}),
+	}
+
+	dt := time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local).Format(time.RFC3339)
+	mqttClient.EXPECT().Publish("/test", byte(1), true, dt+"|pod|testpod1|label|testkey:value1|phase|Running").Return(token)
+	token.EXPECT().Wait().Return(true)
+	token.EXPECT().Error().Return(nil)
 
 	impl.Report("/test")
 }
+
+func TestPodOnUpdate(t *testing.T) {
+	oldPod := &apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "testpod1", ResourceVersion: "1", Labels: map[string]string{"testkey": "value1"}}, Status: apiv1.PodStatus{Phase: "Pending"}}
+
+	testCases := []struct {
+		name   string
+		update func(pod *apiv1.Pod)
+		msg    string
+	}{
+		{name: "phase", update: func(pod *apiv1.Pod) { pod.Status.Phase = "Running" }, msg: "|pod|testpod1|label|testkey:value1|phase|Running"},
+		{name: "label", update: func(pod *apiv1.Pod) { pod.ObjectMeta.Labels["testkey"] = "value2" }, msg: "|pod|testpod1|label|testkey:value2|phase|Pending"},
+		{name: "other", update: func(pod *apiv1.Pod) { pod.Status.PodIP = "10.0.0.1" }},
+		{name: "label removed", update: func(pod *apiv1.Pod) { delete(pod.ObjectMeta.Labels, "testkey") }},
+	}
+
+	dt := time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local).Format(time.RFC3339)
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			impl, mqttClient, token, tearDown := setUpPodStateReporterImplMocks(t)
+			defer tearDown()
+			impl.targetLabelKey = "testkey"
+
+			newPod := oldPod.DeepCopy()
+			newPod.ObjectMeta.ResourceVersion = "2"
+			c.update(newPod)
+
+			if c.msg != "" {
+				mqttClient.EXPECT().Publish("/test", byte(0), false, dt+c.msg).Return(token).Times(1)
+				token.EXPECT().Wait().Return(false).Times(1)
+			} else {
+				mqttClient.EXPECT().Publish("/test", byte(0), false, gomock.Any()).Times(0)
+			}
+
+			impl.onUpdate("/test", oldPod, newPod)
+		})
+	}
+}
+
+func TestPodOnDelete(t *testing.T) {
+	deleted := &apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Labels: map[string]string{"testkey": "value1"}}}
+	unlabeled := deleted.DeepCopy()
+	delete(unlabeled.ObjectMeta.Labels, "testkey")
+
+	testCases := []struct {
+		name string
+		obj  interface{}
+		msg  string
+	}{
+		{name: "deleted", obj: deleted, msg: "|pod|testpod1|label|testkey:value1|deleted|true"},
+		{name: "tombstone", obj: cache.DeletedFinalStateUnknown{Key: "testpod1", Obj: deleted}, msg: "|pod|testpod1|label|testkey:value1|deleted|true"},
+		{name: "label removed", obj: unlabeled, msg: "|pod|testpod1|label|testkey:|deleted|true"},
+		{name: "unknown object", obj: "testpod1"},
+	}
+
+	dt := time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local).Format(time.RFC3339)
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			impl, mqttClient, token, tearDown := setUpPodStateReporterImplMocks(t)
+			defer tearDown()
+			impl.targetLabelKey = "testkey"
+
+			if c.msg != "" {
+				mqttClient.EXPECT().Publish("/test", byte(0), false, dt+c.msg).Return(token).Times(1)
+				token.EXPECT().Wait().Return(false).Times(1)
+			} else {
+				mqttClient.EXPECT().Publish("/test", byte(0), false, gomock.Any()).Times(0)
+			}
+
+			impl.onDelete("/test", c.obj)
+		})
+	}
+}
+
+func TestPodStart(t *testing.T) {
+	assert := assert.New(t)
+
+	impl, mqttClient, token, tearDown := setUpPodStateReporterImplMocks(t)
+	defer tearDown()
+
+	impl.targetLabelKey = "testkey"
+	impl.namespaces = []string{"default", "tenant-a"}
+	impl.kubeClient = fake.NewSimpleClientset(
+		&apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Namespace: "default", Labels: map[string]string{"testkey": "value1"}}, Status: apiv1.PodStatus{Phase: "Running"}},
+		&apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "testpod2", Namespace: "default", Labels: map[string]string{"dummy": "dummy"}}, Status: apiv1.PodStatus{Phase: "Running"}},
+		&apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "testpod3", Namespace: "tenant-a", Labels: map[string]string{"testkey": "value3"}}, Status: apiv1.PodStatus{Phase: "Pending"}},
+		&apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "testpod4", Namespace: "kube-system", Labels: map[string]string{"testkey": "value4"}}, Status: apiv1.PodStatus{Phase: "Running"}},
+	)
+
+	dt := time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local).Format(time.RFC3339)
+	published := make(chan string, 4)
+	mqttClient.EXPECT().Publish("/test", byte(0), false, gomock.Any()).DoAndReturn(func(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+		published <- payload.(string)
+		return token
+	}).Times(2)
+	token.EXPECT().Wait().Return(false).Times(2)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	impl.Start("/test", stopCh)
+	assert.Len(impl.listers, 2)
+
+	msgs := []string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-published:
+			msgs = append(msgs, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	assert.ElementsMatch([]string{
+		dt + "|pod|testpod1|label|testkey:value1|phase|Running",
+		dt + "|pod|testpod3|label|testkey:value3|phase|Pending",
+	}, msgs)
+}
+
+func TestPodStartWithoutLabel(t *testing.T) {
+	impl, mqttClient, _, tearDown := setUpPodStateReporterImplMocks(t)
+	defer tearDown()
+
+	impl.kubeClient = fake.NewSimpleClientset(
+		&apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Namespace: "default", Labels: map[string]string{"testkey": "value1"}}},
+	)
+	mqttClient.EXPECT().Publish(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	impl.Start("/test", stopCh)
+	assert.Empty(t, impl.listers)
+}
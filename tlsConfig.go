@@ -0,0 +1,216 @@
+/*
+Package main : entry point of mqtt-kube-operator.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// tlsVersions are the TLS versions allowed for MQTT_TLS_MIN_VERSION. "1.3" is added when built with Go 1.13 or later.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+// cipherSuites are the cipher suites allowed for MQTT_TLS_CIPHER_SUITES. The 3DES suites are not allowed because they are weak.
+var cipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA256":         tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+func (e *executer) getTLSConfig() (*tls.Config, error) {
+	caPath := os.Getenv("MQTT_TLS_CA_PATH")
+	ca, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("can not read '%s': %s", caPath, err.Error())
+	}
+	rootCA := x509.NewCertPool()
+	if !rootCA.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("failed to parse root certificate: %s", caPath)
+	}
+	tlsConfig := &tls.Config{
+		RootCAs:    rootCA,
+		ServerName: os.Getenv("MQTT_TLS_SERVER_NAME"),
+	}
+
+	if minVersion := os.Getenv("MQTT_TLS_MIN_VERSION"); minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version '%s', expected %s", minVersion, tlsVersionNames())
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	for _, name := range strings.Split(os.Getenv("MQTT_TLS_CIPHER_SUITES"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		suite, ok := cipherSuites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite '%s'", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, suite)
+	}
+
+	certPath := os.Getenv("MQTT_TLS_CERT_PATH")
+	keyPath := os.Getenv("MQTT_TLS_KEY_PATH")
+	pkcs12Path := os.Getenv("MQTT_TLS_PKCS12_PATH")
+	var reloader *certificateReloader
+	switch {
+	case pkcs12Path != "" && (certPath != "" || keyPath != ""):
+		return nil, fmt.Errorf("set either MQTT_TLS_PKCS12_PATH or MQTT_TLS_CERT_PATH and MQTT_TLS_KEY_PATH")
+	case pkcs12Path != "":
+		password := os.Getenv("MQTT_TLS_PKCS12_PASSWORD")
+		reloader, err = newCertificateReloader(e.logger, func() (*tls.Certificate, error) {
+			return loadPKCS12Certificate(pkcs12Path, password)
+		}, pkcs12Path)
+	case certPath != "" && keyPath != "":
+		reloader, err = newCertificateReloader(e.logger, func() (*tls.Certificate, error) {
+			return loadPEMCertificate(certPath, keyPath)
+		}, certPath, keyPath)
+	case certPath != "" || keyPath != "":
+		return nil, fmt.Errorf("set both MQTT_TLS_CERT_PATH and MQTT_TLS_KEY_PATH")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reloader != nil {
+		tlsConfig.GetClientCertificate = reloader.getClientCertificate
+	}
+	return tlsConfig, nil
+}
+
+// tlsVersionNames returns the allowed TLS versions like "1.0, 1.1 or 1.2".
+func tlsVersionNames() string {
+	names := []string{}
+	for name := range tlsVersions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+func loadPEMCertificate(certPath string, keyPath string) (*tls.Certificate, error) {
+	certificate, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %s, %s: %s", certPath, keyPath, err.Error())
+	}
+	return &certificate, nil
+}
+
+func loadPKCS12Certificate(path string, password string) (*tls.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can not read '%s': %s", path, err.Error())
+	}
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode PKCS#12: %s: %s", path, err.Error())
+	}
+	var certPEM, keyPEM []byte
+	for _, block := range blocks {
+		if block.Type == "CERTIFICATE" {
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		} else {
+			keyPEM = append(keyPEM, pem.EncodeToMemory(block)...)
+		}
+	}
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %s: %s", path, err.Error())
+	}
+	return &certificate, nil
+}
+
+// certificateReloader keeps the client certificate loaded from the files, and loads it again on the next handshake
+// after the files are modified, so that a rotated certificate is used without restarting.
+type certificateReloader struct {
+	logger      *zap.SugaredLogger
+	load        func() (*tls.Certificate, error)
+	paths       []string
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	modTimes    []time.Time
+}
+
+func newCertificateReloader(logger *zap.SugaredLogger, load func() (*tls.Certificate, error), paths ...string) (*certificateReloader, error) {
+	r := &certificateReloader{
+		logger: logger,
+		load:   load,
+		paths:  paths,
+	}
+	certificate, err := load()
+	if err != nil {
+		return nil, err
+	}
+	r.certificate = certificate
+	r.modTimes = r.stat()
+	return r, nil
+}
+
+func (r *certificateReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	modTimes := r.stat()
+	modified := false
+	for i := range modTimes {
+		if !modTimes[i].Equal(r.modTimes[i]) {
+			modified = true
+		}
+	}
+	if modified {
+		// keep using the current certificate while the files are being rotated
+		certificate, err := r.load()
+		if err != nil {
+			r.logger.Errorf("reload client certificate err, use the current one: %s", err.Error())
+		} else {
+			r.logger.Infof("reload client certificate -- %s", strings.Join(r.paths, ", "))
+			r.certificate = certificate
+			r.modTimes = modTimes
+		}
+	}
+	return r.certificate, nil
+}
+
+func (r *certificateReloader) stat() []time.Time {
+	modTimes := make([]time.Time, len(r.paths))
+	for i, path := range r.paths {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
@@ -0,0 +1,212 @@
+/*
+Package main : entry point of mqtt-kube-operator.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getCommonName(t *testing.T, certificate *tls.Certificate) string {
+	cert, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Subject.CommonName
+}
+
+func TestGetTLSConfig(t *testing.T) {
+	assert := assert.New(t)
+	exec, _, _, tearDown := setUpMocks(t)
+	defer tearDown()
+
+	tlsCases := []struct {
+		name               string
+		env                map[string]string
+		expectedServerName string
+		expectedMinVersion uint16
+		expectedCiphers    []uint16
+		expectedClientCN   string
+		expectedErr        string
+	}{
+		{
+			name: "ca only",
+			env:  map[string]string{},
+		},
+		{
+			name: "server name, min version and cipher suites",
+			env: map[string]string{
+				"MQTT_TLS_SERVER_NAME":   "mqtt.example.com",
+				"MQTT_TLS_MIN_VERSION":   "1.2",
+				"MQTT_TLS_CIPHER_SUITES": "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,",
+			},
+			expectedServerName: "mqtt.example.com",
+			expectedMinVersion: tls.VersionTLS12,
+			expectedCiphers:    []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		},
+		{
+			name: "pem client certificate",
+			env: map[string]string{
+				"MQTT_TLS_CERT_PATH": "./testdata/client1.crt",
+				"MQTT_TLS_KEY_PATH":  "./testdata/client1.key",
+			},
+			expectedClientCN: "client1",
+		},
+		{
+			name: "pkcs12 client certificate",
+			env: map[string]string{
+				"MQTT_TLS_PKCS12_PATH":     "./testdata/client1.p12",
+				"MQTT_TLS_PKCS12_PASSWORD": "password",
+			},
+			expectedClientCN: "client1",
+		},
+		{
+			name:        "unknown min version",
+			env:         map[string]string{"MQTT_TLS_MIN_VERSION": "1.4"},
+			expectedErr: "unknown TLS version '1.4', expected " + tlsVersionNames(),
+		},
+		{
+			name:        "unknown cipher suite",
+			env:         map[string]string{"MQTT_TLS_CIPHER_SUITES": "TLS_UNKNOWN"},
+			expectedErr: "unknown cipher suite 'TLS_UNKNOWN'",
+		},
+		{
+			name:        "3des cipher suite",
+			env:         map[string]string{"MQTT_TLS_CIPHER_SUITES": "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA"},
+			expectedErr: "unknown cipher suite 'TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA'",
+		},
+		{
+			name:        "cert without key",
+			env:         map[string]string{"MQTT_TLS_CERT_PATH": "./testdata/client1.crt"},
+			expectedErr: "set both MQTT_TLS_CERT_PATH and MQTT_TLS_KEY_PATH",
+		},
+		{
+			name: "pem and pkcs12",
+			env: map[string]string{
+				"MQTT_TLS_CERT_PATH":   "./testdata/client1.crt",
+				"MQTT_TLS_KEY_PATH":    "./testdata/client1.key",
+				"MQTT_TLS_PKCS12_PATH": "./testdata/client1.p12",
+			},
+			expectedErr: "set either MQTT_TLS_PKCS12_PATH or MQTT_TLS_CERT_PATH and MQTT_TLS_KEY_PATH",
+		},
+		{
+			name: "mismatched key",
+			env: map[string]string{
+				"MQTT_TLS_CERT_PATH": "./testdata/client1.crt",
+				"MQTT_TLS_KEY_PATH":  "./testdata/client2.key",
+			},
+			expectedErr: "failed to load client certificate: ./testdata/client1.crt, ./testdata/client2.key: tls: private key does not match public key",
+		},
+		{
+			name: "wrong pkcs12 password",
+			env: map[string]string{
+				"MQTT_TLS_PKCS12_PATH":     "./testdata/client1.p12",
+				"MQTT_TLS_PKCS12_PASSWORD": "wrong",
+			},
+			expectedErr: "failed to decode PKCS#12: ./testdata/client1.p12: pkcs12: decryption password incorrect",
+		},
+	}
+
+	for _, c := range tlsCases {
+		t.Run(c.name, func(t *testing.T) {
+			os.Setenv("MQTT_TLS_CA_PATH", "./certs/DST_Root_CA_X3.pem")
+			defer os.Unsetenv("MQTT_TLS_CA_PATH")
+			for key, value := range c.env {
+				os.Setenv(key, value)
+				defer os.Unsetenv(key)
+			}
+
+			tlsConfig, err := exec.getTLSConfig()
+			if c.expectedErr != "" {
+				assert.NotNil(err)
+				assert.Equal(c.expectedErr, err.Error())
+				return
+			}
+			assert.Nil(err)
+			assert.NotNil(tlsConfig.RootCAs)
+			assert.Equal(c.expectedServerName, tlsConfig.ServerName)
+			assert.Equal(c.expectedMinVersion, tlsConfig.MinVersion)
+			assert.Equal(c.expectedCiphers, tlsConfig.CipherSuites)
+			if c.expectedClientCN == "" {
+				assert.Nil(tlsConfig.GetClientCertificate)
+			} else {
+				certificate, err := tlsConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+				assert.Nil(err)
+				assert.Equal(c.expectedClientCN, getCommonName(t, certificate))
+			}
+		})
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	assert := assert.New(t)
+	exec, _, _, tearDown := setUpMocks(t)
+	defer tearDown()
+
+	dir, err := ioutil.TempDir("", "certificateReloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath := filepath.Join(dir, "tls.crt")
+	keyPath := filepath.Join(dir, "tls.key")
+	modTime := time.Now()
+	install := func(certData []byte, keyData []byte) {
+		modTime = modTime.Add(time.Minute)
+		for path, data := range map[string][]byte{certPath: certData, keyPath: keyData} {
+			if err := ioutil.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	readFixture := func(name string) []byte {
+		data, err := ioutil.ReadFile(fmt.Sprintf("./testdata/%s", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	install(readFixture("client1.crt"), readFixture("client1.key"))
+	reloader, err := newCertificateReloader(exec.logger, func() (*tls.Certificate, error) {
+		return loadPEMCertificate(certPath, keyPath)
+	}, certPath, keyPath)
+	assert.Nil(err)
+
+	certificate, err := reloader.getClientCertificate(&tls.CertificateRequestInfo{})
+	assert.Nil(err)
+	assert.Equal("client1", getCommonName(t, certificate))
+
+	install(readFixture("client2.crt"), readFixture("client2.key"))
+	certificate, err = reloader.getClientCertificate(&tls.CertificateRequestInfo{})
+	assert.Nil(err)
+	assert.Equal("client2", getCommonName(t, certificate))
+
+	install(readFixture("client1.crt"), readFixture("client2.key"))
+	certificate, err = reloader.getClientCertificate(&tls.CertificateRequestInfo{})
+	assert.Nil(err)
+	assert.Equal("client2", getCommonName(t, certificate))
+
+	install(readFixture("client1.crt"), readFixture("client1.key"))
+	certificate, err = reloader.getClientCertificate(&tls.CertificateRequestInfo{})
+	assert.Nil(err)
+	assert.Equal("client1", getCommonName(t, certificate))
+}
+
+func TestTLSVersionNames(t *testing.T) {
+	assert.Regexp(t, "^1.0, 1.1(, 1.2 or 1.3| or 1.2)$", tlsVersionNames())
+}
@@ -0,0 +1,18 @@
+//go:build go1.13
+// +build go1.13
+
+/*
+Package main : entry point of mqtt-kube-operator.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package main
+
+import (
+	"crypto/tls"
+)
+
+// TLS 1.3 is enabled by default since Go 1.13, while it has to be enabled by GODEBUG in Go 1.12.
+func init() {
+	tlsVersions["1.3"] = tls.VersionTLS13
+}
@@ -0,0 +1,22 @@
+//go:build go1.13
+// +build go1.13
+
+/*
+Package main : entry point of mqtt-kube-operator.
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSVersion13(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(uint16(tls.VersionTLS13), tlsVersions["1.3"])
+	assert.Equal("1.0, 1.1, 1.2 or 1.3", tlsVersionNames())
+}